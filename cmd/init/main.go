@@ -148,7 +148,11 @@ func (s *sshServer) attachShell(conn ssh.Conn, connection ssh.Channel, env []str
 	}
 
 	//start a shell for this channel's connection
-	shellf, err := pty.Start(shell)
+	var shellf *os.File
+	err := children.start(shell, func() (err error) {
+		shellf, err = pty.Start(shell)
+		return
+	})
 	if err != nil {
 		close()
 		return fmt.Errorf("could not start pty: %s", err)
@@ -180,6 +184,8 @@ func (s *sshServer) attachShell(conn ssh.Conn, connection ssh.Channel, env []str
 				slog.Warn("failed to exit shell", "error", err)
 			}
 
+			children.release(shell)
+
 			// It appears that closing the pty is an idempotent operation
 			// therefore making this call ensures that the other two coroutines
 			// will fall through and exit, and there is no downside.
@@ -282,9 +288,53 @@ func (s *sshServer) handleClient(nConn net.Conn, config *ssh.ServerConfig) error
 	return nil
 }
 
-func (s *sshServer) run(password string, callable starlark.Callable) error {
+// Requests to the host metadata server should be quick. A guest booted
+// without one has to fall back rather than wait forever.
+const metadataTimeout = 10 * time.Second
+
+var metadataClient = &http.Client{Timeout: metadataTimeout}
+
+func fetchHttp(method string, urlString string, data string, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest(method, urlString, strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("fetch_http: %s %s: %s", method, urlString, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *sshServer) run(password string, authorizedKeys string, callable starlark.Callable) error {
 	s.callable = callable
 
+	allowedKeys := make(map[string]bool)
+
+	rest := []byte(authorizedKeys)
+	for len(rest) > 0 {
+		var (
+			pubKey ssh.PublicKey
+			err    error
+		)
+
+		pubKey, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+
+		allowedKeys[string(pubKey.Marshal())] = true
+	}
+
 	listener, err := net.Listen("tcp", "0.0.0.0:2222")
 	if err != nil {
 		return fmt.Errorf("ssh: failed to listen for connection: %v", err)
@@ -299,6 +349,12 @@ func (s *sshServer) run(password string, callable starlark.Callable) error {
 			}
 			return nil, fmt.Errorf("password rejected for %q", c.User())
 		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if allowedKeys[string(pubKey.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", c.User())
+		},
 	}
 
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -340,6 +396,7 @@ var (
 
 type mountOptions struct {
 	Readonly bool
+	Data     string
 }
 
 func mount(kind string, mountName string, mountPoint string, opts mountOptions) error {
@@ -347,7 +404,7 @@ func mount(kind string, mountName string, mountPoint string, opts mountOptions)
 	if opts.Readonly {
 		flags |= unix.MS_RDONLY
 	}
-	err := unix.Mount(mountName, mountPoint, kind, flags, "")
+	err := unix.Mount(mountName, mountPoint, kind, flags, opts.Data)
 	if err != nil {
 		return fmt.Errorf("failed mounting %s(%s) on %s: %v", mountName, kind, mountPoint, err)
 	}
@@ -395,7 +452,7 @@ func initMain() error {
 
 		sshServer := &sshServer{command: cmd}
 
-		return sshServer.run("insecurepassword", nil)
+		return sshServer.run("insecurepassword", "", nil)
 	}
 
 	if *downloadFile != "" {
@@ -474,6 +531,12 @@ func initMain() error {
 		return fmt.Errorf("/init must be run as root")
 	}
 
+	// Commands run by the shared helpers have to be waited on by init
+	// rather than collected by the reaper.
+	common.SetCommandRunner(children.runCommand)
+
+	go children.run()
+
 	var args starlark.Value = starlark.NewDict(0)
 
 	if ok, _ := common.Exists("/init.json"); ok {
@@ -587,23 +650,32 @@ func initMain() error {
 		kwargs []starlark.Tuple,
 	) (starlark.Value, error) {
 		var (
-			urlString string
+			urlString  string
+			method     string = "GET"
+			data       string
+			timeout    int = int(metadataTimeout / time.Second)
+			defaultVal starlark.Value
 		)
 
 		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
 			"url", &urlString,
+			"method?", &method,
+			"data?", &data,
+			"timeout?", &timeout,
+			"default?", &defaultVal,
 		); err != nil {
 			return starlark.None, err
 		}
 
-		resp, err := http.Get(urlString)
+		contents, err := fetchHttp(method, urlString, data, time.Duration(timeout)*time.Second)
 		if err != nil {
-			return starlark.None, err
-		}
-		defer resp.Body.Close()
+			// Guests can boot without the host metadata server.
+			if defaultVal != nil {
+				slog.Warn("fetch_http failed, using the default", "url", urlString, "err", err)
+
+				return defaultVal, nil
+			}
 
-		contents, err := io.ReadAll(resp.Body)
-		if err != nil {
 			return starlark.None, err
 		}
 
@@ -633,13 +705,81 @@ func initMain() error {
 		cmd.Stderr = os.Stderr
 		cmd.Stdin = os.Stdin
 
-		if err := cmd.Run(); err != nil {
+		if err := children.runCommand(cmd); err != nil {
 			return starlark.None, err
 		}
 
 		return starlark.None, nil
 	})
 
+	globals["start_services"] = starlark.NewBuiltin("start_services", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			metadataUrl string
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"metadata_url", &metadataUrl,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		count, err := startServices(metadataUrl)
+		if err != nil {
+			return starlark.None, fmt.Errorf("failed to start services: %w", err)
+		}
+
+		return starlark.MakeInt(count), nil
+	})
+
+	globals["report_ready"] = starlark.NewBuiltin("report_ready", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			metadataUrl string
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"metadata_url", &metadataUrl,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		if err := reportReady(metadataUrl); err != nil {
+			return starlark.None, fmt.Errorf("failed to report ready: %w", err)
+		}
+
+		return starlark.None, nil
+	})
+
+	globals["start_control"] = starlark.NewBuiltin("start_control", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			metadataUrl string
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"metadata_url", &metadataUrl,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		go watchControl(metadataUrl)
+
+		return starlark.None, nil
+	})
+
 	globals["set_hostname"] = starlark.NewBuiltin("set_hostname", func(
 		thread *starlark.Thread,
 		fn *starlark.Builtin,
@@ -675,6 +815,8 @@ func initMain() error {
 			mountPoint  string
 			ensurePath  bool
 			ignoreError bool
+			readOnly    bool
+			options     string
 		)
 
 		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
@@ -683,6 +825,8 @@ func initMain() error {
 			"mount_point", &mountPoint,
 			"ensure_path?", &ensurePath,
 			"ignore_error?", &ignoreError,
+			"read_only?", &readOnly,
+			"options?", &options,
 		); err != nil {
 			return starlark.None, err
 		}
@@ -695,7 +839,7 @@ func initMain() error {
 			}
 		}
 
-		err := mount(fsKind, name, mountPoint, mountOptions{})
+		err := mount(fsKind, name, mountPoint, mountOptions{Readonly: readOnly, Data: options})
 		if err != nil && !ignoreError {
 			return starlark.None, fmt.Errorf("failed to mount: %v", err)
 		}
@@ -894,18 +1038,20 @@ func initMain() error {
 		kwargs []starlark.Tuple,
 	) (starlark.Value, error) {
 		var (
-			callable starlark.Callable
+			callable       starlark.Callable
+			authorizedKeys string
 		)
 
 		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
 			"callable", &callable,
+			"authorized_keys?", &authorizedKeys,
 		); err != nil {
 			return starlark.None, err
 		}
 
 		sshServer := &sshServer{}
 
-		err := sshServer.run("insecurepassword", callable)
+		err := sshServer.run("insecurepassword", authorizedKeys, callable)
 		if err != nil {
 			return starlark.None, err
 		}
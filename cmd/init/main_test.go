@@ -0,0 +1,50 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchHttp(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hostname":
+			w.Write([]byte("guest"))
+		case "/echo":
+			io.Copy(w, r.Body)
+		case "/slow":
+			<-release
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	if got, err := fetchHttp("GET", server.URL+"/hostname", "", time.Second); err != nil || string(got) != "guest" {
+		t.Fatalf("unexpected result: %q %v", got, err)
+	}
+
+	if got, err := fetchHttp("POST", server.URL+"/echo", "data", time.Second); err != nil || string(got) != "data" {
+		t.Fatalf("unexpected result: %q %v", got, err)
+	}
+
+	if _, err := fetchHttp("GET", server.URL+"/missing", "", time.Second); err == nil {
+		t.Fatal("expected an error for a 404")
+	}
+
+	start := time.Now()
+	if _, err := fetchHttp("GET", server.URL+"/slow", "", 100*time.Millisecond); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("timeout took %s", took)
+	}
+}
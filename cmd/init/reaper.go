@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// reaper collects zombie processes when init runs as PID 1. Processes that
+// exit after their parent are reparented to init and would stay around
+// forever if nothing waited on them.
+//
+// Processes started by init itself are waited on by the goroutine that
+// started them so they are registered with start and skipped by the reaper.
+type reaper struct {
+	mtx   sync.Mutex
+	owned map[int]bool
+}
+
+var children = &reaper{owned: make(map[int]bool)}
+
+// start calls startFn (usually cmd.Start) and records the process so the
+// reaper leaves it for its own Wait call. release must be called once the
+// process has been waited on.
+func (r *reaper) start(cmd *exec.Cmd, startFn func() error) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if err := startFn(); err != nil {
+		return err
+	}
+
+	r.owned[cmd.Process.Pid] = true
+
+	return nil
+}
+
+func (r *reaper) release(cmd *exec.Cmd) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if cmd.Process != nil {
+		delete(r.owned, cmd.Process.Pid)
+	}
+}
+
+// runCommand runs cmd to completion. Every command init runs and waits on
+// has to go through here or start so the reaper doesn't collect it first.
+func (r *reaper) runCommand(cmd *exec.Cmd) error {
+	if err := r.start(cmd, cmd.Start); err != nil {
+		return err
+	}
+	defer r.release(cmd)
+
+	return cmd.Wait()
+}
+
+// Returns the state and parent of a process from /proc/<pid>/stat.
+func processState(pid string) (byte, int, bool) {
+	contents, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	// The command name can contain spaces and parentheses so start after the
+	// last closing parenthesis.
+	idx := strings.LastIndex(string(contents), ") ")
+	if idx == -1 {
+		return 0, 0, false
+	}
+
+	fields := strings.Fields(string(contents)[idx+2:])
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return fields[0][0], ppid, true
+}
+
+func (r *reaper) reap() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	ents, err := os.ReadDir("/proc")
+	if err != nil {
+		// /proc isn't mounted yet.
+		return
+	}
+
+	self := os.Getpid()
+
+	for _, ent := range ents {
+		pid, err := strconv.Atoi(ent.Name())
+		if err != nil || r.owned[pid] {
+			continue
+		}
+
+		state, ppid, ok := processState(ent.Name())
+		if !ok || ppid != self || state != 'Z' {
+			continue
+		}
+
+		var status unix.WaitStatus
+		unix.Wait4(pid, &status, unix.WNOHANG, nil)
+	}
+}
+
+// run reaps zombies each time a child exits.
+func (r *reaper) run() {
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs, unix.SIGCHLD)
+
+	for range sigs {
+		r.reap()
+	}
+}
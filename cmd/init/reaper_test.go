@@ -0,0 +1,73 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Wait for pid to become a zombie.
+func waitZombie(t *testing.T, pid int) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if state, _, ok := processState(strconv.Itoa(pid)); ok && state == 'Z' {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("process %d did not exit", pid)
+}
+
+func TestReaperSkipsOwnedProcesses(t *testing.T) {
+	r := &reaper{owned: make(map[int]bool)}
+
+	owned := exec.Command("true")
+	if err := r.start(owned, owned.Start); err != nil {
+		t.Fatal(err)
+	}
+	defer r.release(owned)
+
+	other := exec.Command("true")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitZombie(t, owned.Process.Pid)
+	waitZombie(t, other.Process.Pid)
+
+	r.reap()
+
+	// The owned process is left for it's own Wait call.
+	if err := owned.Wait(); err != nil {
+		t.Fatalf("owned process was reaped: %v", err)
+	}
+
+	if err := other.Wait(); !errors.Is(err, syscall.ECHILD) {
+		t.Fatalf("expected the other process to be reaped, got %v", err)
+	}
+}
+
+func TestReaperRunCommand(t *testing.T) {
+	r := &reaper{owned: make(map[int]bool)}
+
+	if err := r.runCommand(exec.Command("true")); err != nil {
+		t.Fatal(err)
+	}
+
+	var exit *exec.ExitError
+	if err := r.runCommand(exec.Command("false")); !errors.As(err, &exit) || exit.ExitCode() != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+
+	if len(r.owned) != 0 {
+		t.Fatalf("processes were not released: %v", r.owned)
+	}
+}
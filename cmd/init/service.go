@@ -0,0 +1,581 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+type serviceState string
+
+const (
+	serviceWaiting  serviceState = "waiting"
+	serviceStarting serviceState = "starting"
+	serviceReady    serviceState = "ready"
+	serviceExited   serviceState = "exited"
+	serviceFailed   serviceState = "failed"
+	serviceStopped  serviceState = "stopped"
+)
+
+type service struct {
+	cfg config.ServiceConfig
+	sup *supervisor
+
+	// Closed once the service passes its readiness probe.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// Closed once the service is ready or will never be ready.
+	settled    chan struct{}
+	settleOnce sync.Once
+	settleErr  error
+
+	mtx      sync.Mutex
+	state    serviceState
+	cmd      *exec.Cmd
+	restarts int
+	// Set once the service is being stopped so it's not restarted.
+	stopping bool
+	// Closed when the current process exits.
+	exited   chan struct{}
+	exitCode int
+	// Lines written here are sent to the host log.
+	log io.Writer
+}
+
+func (svc *service) setState(state serviceState) {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+
+	svc.state = state
+}
+
+func (svc *service) markReady() {
+	svc.readyOnce.Do(func() {
+		slog.Info("service ready", "name", svc.cfg.Name)
+
+		svc.setState(serviceReady)
+
+		close(svc.ready)
+	})
+
+	svc.settle(nil)
+}
+
+// settle records if the service became ready. Only the first call has an
+// effect.
+func (svc *service) settle(err error) {
+	svc.settleOnce.Do(func() {
+		svc.settleErr = err
+
+		close(svc.settled)
+	})
+}
+
+// Look up the credentials of a user name or uid[:gid].
+func lookupCredential(name string) (*syscall.Credential, error) {
+	if uidStr, gidStr, ok := strings.Cut(name, ":"); ok {
+		uid, err := strconv.Atoi(uidStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid: %s", uidStr)
+		}
+
+		gid, err := strconv.Atoi(gidStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid: %s", gidStr)
+		}
+
+		return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+	}
+
+	var (
+		usr *user.User
+		err error
+	)
+
+	if _, convErr := strconv.Atoi(name); convErr == nil {
+		usr, err = user.LookupId(name)
+	} else {
+		usr, err = user.Lookup(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := strconv.Atoi(usr.Gid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// runProbeCommand runs a command probe inside the guest.
+func runProbeCommand(ctx context.Context, args []string) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	return children.runCommand(cmd)
+}
+
+// Start the service once and wait for it to exit.
+func (svc *service) runOnce() error {
+	cmd := exec.Command(svc.cfg.Command[0], svc.cfg.Command[1:]...)
+
+	cmd.Env = append(os.Environ(), svc.cfg.Environment...)
+	cmd.Dir = svc.cfg.WorkingDirectory
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	}
+
+	cmd.Stdout = svc.log
+	cmd.Stderr = svc.log
+
+	// Run each service in it's own process group so it can be stopped with
+	// everything it started.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if svc.cfg.User != "" {
+		cred, err := lookupCredential(svc.cfg.User)
+		if err != nil {
+			return fmt.Errorf("failed to look up user %s: %w", svc.cfg.User, err)
+		}
+
+		cmd.SysProcAttr.Credential = cred
+	}
+
+	// Hold the lock while starting so stop sees either no process or one
+	// that has been recorded.
+	svc.mtx.Lock()
+
+	if svc.stopping {
+		svc.mtx.Unlock()
+		return nil
+	}
+
+	svc.state = serviceStarting
+
+	if err := children.start(cmd, cmd.Start); err != nil {
+		svc.mtx.Unlock()
+		return err
+	}
+	defer children.release(cmd)
+
+	svc.cmd = cmd
+	svc.exited = make(chan struct{})
+	svc.mtx.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if probe := svc.cfg.Ready; probe != nil {
+		go func() {
+			prober := common.Prober{Run: runProbeCommand}
+
+			if err := prober.Wait(ctx, *probe); err != nil {
+				if ctx.Err() == nil {
+					slog.Error("service did not become ready", "name", svc.cfg.Name, "err", err)
+
+					svc.settle(fmt.Errorf("service %s did not become ready: %w", svc.cfg.Name, err))
+				}
+				return
+			}
+
+			svc.markReady()
+		}()
+	} else {
+		svc.markReady()
+	}
+
+	err := cmd.Wait()
+
+	svc.mtx.Lock()
+	svc.cmd = nil
+	svc.exitCode = cmd.ProcessState.ExitCode()
+	close(svc.exited)
+	svc.mtx.Unlock()
+
+	return err
+}
+
+// stop sends SIGTERM to the process group of the service and waits until
+// deadline before killing it. Returns the exit code of the service.
+func (svc *service) stop(deadline time.Time) int {
+	svc.mtx.Lock()
+	svc.stopping = true
+	cmd := svc.cmd
+	exited := svc.exited
+	svc.mtx.Unlock()
+
+	if cmd != nil {
+		pgid := -cmd.Process.Pid
+
+		slog.Info("stopping service", "name", svc.cfg.Name)
+
+		unix.Kill(pgid, unix.SIGTERM)
+
+		select {
+		case <-exited:
+		case <-time.After(time.Until(deadline)):
+			slog.Warn("service did not stop in time", "name", svc.cfg.Name)
+
+			unix.Kill(pgid, unix.SIGKILL)
+
+			<-exited
+		}
+	}
+
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+
+	svc.state = serviceStopped
+
+	return svc.exitCode
+}
+
+func (svc *service) shouldRestart(err error) bool {
+	switch svc.cfg.Restart {
+	case "always":
+		return true
+	case "no":
+		return false
+	default:
+		return err != nil
+	}
+}
+
+// run waits for the dependencies of the service then starts it and restarts
+// it according to the restart policy.
+func (svc *service) run() {
+	for _, dep := range svc.cfg.DependsOn {
+		depSvc := svc.sup.byName[dep]
+
+		<-depSvc.settled
+
+		if depSvc.settleErr != nil {
+			slog.Error("not starting service", "name", svc.cfg.Name, "dependency", dep)
+
+			svc.setState(serviceFailed)
+			svc.settle(fmt.Errorf("service %s was not started since %s failed", svc.cfg.Name, dep))
+
+			return
+		}
+	}
+
+	delay := time.Second
+
+	for {
+		start := time.Now()
+
+		err := svc.runOnce()
+
+		svc.mtx.Lock()
+		stopping := svc.stopping
+		svc.mtx.Unlock()
+
+		if stopping {
+			return
+		}
+
+		if err != nil {
+			slog.Warn("service exited", "name", svc.cfg.Name, "err", err)
+		} else {
+			slog.Info("service exited", "name", svc.cfg.Name)
+		}
+
+		if !svc.shouldRestart(err) {
+			if err != nil {
+				svc.setState(serviceFailed)
+				svc.settle(fmt.Errorf("service %s failed: %w", svc.cfg.Name, err))
+			} else {
+				svc.setState(serviceExited)
+				svc.settle(fmt.Errorf("service %s exited before it was ready", svc.cfg.Name))
+			}
+
+			return
+		}
+
+		// Back off if the service keeps crashing.
+		if time.Since(start) > 10*time.Second {
+			delay = time.Second
+		}
+
+		time.Sleep(delay)
+
+		delay = min(delay*2, 30*time.Second)
+
+		svc.mtx.Lock()
+		svc.restarts += 1
+		svc.mtx.Unlock()
+	}
+}
+
+// supervisor starts the services declared in the config and keeps them
+// running.
+type supervisor struct {
+	metadataUrl string
+	services    []*service
+	byName      map[string]*service
+	// Services ordered so dependencies come before the services using them.
+	order []*service
+}
+
+// Stream everything written to the returned writer to the host log.
+func (s *supervisor) hostLog(source string) io.Writer {
+	r, w := io.Pipe()
+
+	go func() {
+		resp, err := http.Post(s.metadataUrl+"/log?source="+url.QueryEscape(source), "text/plain", r)
+		if err != nil {
+			slog.Warn("failed to send service log to the host", "name", source, "err", err)
+
+			// Keep the service from blocking on it's output.
+			io.Copy(os.Stderr, r)
+			return
+		}
+		resp.Body.Close()
+	}()
+
+	return w
+}
+
+// Check that every dependency exists and there are no cycles.
+func (s *supervisor) validate() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	marks := make(map[string]int)
+
+	var visit func(svc *service) error
+
+	visit = func(svc *service) error {
+		switch marks[svc.cfg.Name] {
+		case visiting:
+			return fmt.Errorf("service %s is part of a dependency cycle", svc.cfg.Name)
+		case visited:
+			return nil
+		}
+
+		marks[svc.cfg.Name] = visiting
+
+		for _, dep := range svc.cfg.DependsOn {
+			depSvc, ok := s.byName[dep]
+			if !ok {
+				return fmt.Errorf("service %s depends on unknown service %s", svc.cfg.Name, dep)
+			}
+
+			if err := visit(depSvc); err != nil {
+				return err
+			}
+		}
+
+		marks[svc.cfg.Name] = visited
+
+		s.order = append(s.order, svc)
+
+		return nil
+	}
+
+	for _, svc := range s.services {
+		if err := visit(svc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *supervisor) start() {
+	for _, svc := range s.services {
+		svc.log = s.hostLog(svc.cfg.Name)
+
+		go svc.run()
+	}
+}
+
+func newSupervisor(metadataUrl string, services []config.ServiceConfig) (*supervisor, error) {
+	s := &supervisor{metadataUrl: metadataUrl, byName: make(map[string]*service)}
+
+	for _, cfg := range services {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("services must have a name")
+		}
+
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("service %s has no command", cfg.Name)
+		}
+
+		if _, ok := s.byName[cfg.Name]; ok {
+			return nil, fmt.Errorf("service %s is declared more than once", cfg.Name)
+		}
+
+		switch cfg.Restart {
+		case "", "no", "on-failure", "always":
+		default:
+			return nil, fmt.Errorf("service %s has unknown restart policy: %s", cfg.Name, cfg.Restart)
+		}
+
+		svc := &service{
+			cfg:     cfg,
+			sup:     s,
+			state:   serviceWaiting,
+			ready:   make(chan struct{}),
+			settled: make(chan struct{}),
+			// Services that never ran report -1 like ones killed by a signal.
+			exitCode: -1,
+		}
+
+		s.services = append(s.services, svc)
+		s.byName[cfg.Name] = svc
+	}
+
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Wait for every service to be ready. Returns the errors of the services
+// that won't become ready.
+func (s *supervisor) waitReady() []error {
+	var errs []error
+
+	for _, svc := range s.services {
+		<-svc.settled
+
+		if svc.settleErr != nil {
+			errs = append(errs, svc.settleErr)
+		}
+	}
+
+	return errs
+}
+
+// stopAll stops the services in the reverse order they depend on each other.
+// Services that don't stop before deadline are killed.
+func (s *supervisor) stopAll(deadline time.Time) []config.ServiceExit {
+	var ret []config.ServiceExit
+
+	for i := len(s.order) - 1; i >= 0; i-- {
+		svc := s.order[i]
+
+		ret = append(ret, config.ServiceExit{Name: svc.cfg.Name, ExitCode: svc.stop(deadline)})
+	}
+
+	return ret
+}
+
+// The supervisor started by start_services.
+var activeServices *supervisor
+
+// Wait for the services and the command readiness probes from the metadata
+// server then tell the host the guest is ready.
+func reportReady(metadataUrl string) error {
+	var errs []error
+
+	if activeServices != nil {
+		errs = append(errs, activeServices.waitReady()...)
+	}
+
+	resp, err := metadataClient.Get(metadataUrl + "/probes")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var probes []config.ProbeConfig
+
+	// Hosts without readiness probes don't have the endpoint.
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&probes); err != nil {
+			return err
+		}
+	}
+
+	prober := common.Prober{Run: runProbeCommand}
+
+	for _, probe := range probes {
+		if err := prober.Wait(context.Background(), probe); err != nil {
+			errs = append(errs, fmt.Errorf("probe %v: %w", probe.Command, err))
+		}
+	}
+
+	var report struct {
+		Error string `json:"error,omitempty"`
+	}
+
+	if len(errs) > 0 {
+		report.Error = errors.Join(errs...).Error()
+	}
+
+	body, err := json.Marshal(&report)
+	if err != nil {
+		return err
+	}
+
+	resp, err = metadataClient.Post(metadataUrl+"/ready", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Fetch the services from the metadata server and start supervising them.
+// Returns the number of services started.
+func startServices(metadataUrl string) (int, error) {
+	resp, err := metadataClient.Get(metadataUrl + "/services")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to get services: %s", resp.Status)
+	}
+
+	var services []config.ServiceConfig
+
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		return 0, err
+	}
+
+	sup, err := newSupervisor(metadataUrl, services)
+	if err != nil {
+		return 0, err
+	}
+
+	sup.start()
+
+	activeServices = sup
+
+	return len(sup.services), nil
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package main
+
+import (
+	"os/user"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+func TestNewSupervisor(t *testing.T) {
+	s, err := newSupervisor("http://127.0.0.1", []config.ServiceConfig{
+		{Name: "web", Command: []string{"httpd"}, DependsOn: []string{"db", "cache"}},
+		{Name: "cache", Command: []string{"redis"}, Restart: "always", DependsOn: []string{"db"}},
+		{Name: "db", Command: []string{"postgres"}, Restart: "on-failure"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, svc := range s.order {
+		order = append(order, svc.cfg.Name)
+	}
+
+	// Dependencies come before the services using them.
+	if got := strings.Join(order, ","); got != "db,cache,web" {
+		t.Fatalf("unexpected start order: %s", got)
+	}
+
+	for _, svc := range s.services {
+		if svc.state != serviceWaiting || svc.exitCode != -1 {
+			t.Fatalf("unexpected initial state of %s: %s %d", svc.cfg.Name, svc.state, svc.exitCode)
+		}
+	}
+}
+
+func TestStopAll(t *testing.T) {
+	s, err := newSupervisor("http://127.0.0.1", []config.ServiceConfig{
+		{Name: "web", Command: []string{"httpd"}, DependsOn: []string{"db"}},
+		{Name: "db", Command: []string{"postgres"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Services are stopped in the reverse of the start order and the ones
+	// that never started report -1.
+	got := s.stopAll(time.Now().Add(time.Second))
+	expected := []config.ServiceExit{{Name: "web", ExitCode: -1}, {Name: "db", ExitCode: -1}}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	for _, svc := range s.services {
+		if svc.state != serviceStopped {
+			t.Fatalf("expected %s to be stopped, got %s", svc.cfg.Name, svc.state)
+		}
+	}
+}
+
+func TestNewSupervisorErrors(t *testing.T) {
+	for _, tc := range []struct {
+		services []config.ServiceConfig
+		err      string
+	}{
+		{[]config.ServiceConfig{{Command: []string{"true"}}}, "must have a name"},
+		{[]config.ServiceConfig{{Name: "a"}}, "has no command"},
+		{[]config.ServiceConfig{
+			{Name: "a", Command: []string{"true"}},
+			{Name: "a", Command: []string{"true"}},
+		}, "declared more than once"},
+		{[]config.ServiceConfig{{Name: "a", Command: []string{"true"}, Restart: "sometimes"}}, "unknown restart policy"},
+		{[]config.ServiceConfig{{Name: "a", Command: []string{"true"}, DependsOn: []string{"b"}}}, "unknown service b"},
+		{[]config.ServiceConfig{
+			{Name: "a", Command: []string{"true"}, DependsOn: []string{"b"}},
+			{Name: "b", Command: []string{"true"}, DependsOn: []string{"c"}},
+			{Name: "c", Command: []string{"true"}, DependsOn: []string{"a"}},
+		}, "dependency cycle"},
+		{[]config.ServiceConfig{{Name: "a", Command: []string{"true"}, DependsOn: []string{"a"}}}, "dependency cycle"},
+	} {
+		_, err := newSupervisor("http://127.0.0.1", tc.services)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected an error containing %q for %+v, got %v", tc.err, tc.services, err)
+		}
+	}
+}
+
+func TestLookupCredential(t *testing.T) {
+	cred, err := lookupCredential("1000:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Uid != 1000 || cred.Gid != 100 {
+		t.Fatalf("unexpected credential: %+v", cred)
+	}
+
+	root, err := user.LookupId("0")
+	if err != nil {
+		t.Skipf("no passwd entry for root: %v", err)
+	}
+
+	for _, name := range []string{root.Username, "0"} {
+		cred, err := lookupCredential(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.Uid != 0 || cred.Gid != 0 {
+			t.Fatalf("unexpected credential for %s: %+v", name, cred)
+		}
+	}
+
+	for _, name := range []string{"a:0", "0:b", "no-such-user-tinyrange"} {
+		if _, err := lookupCredential(name); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
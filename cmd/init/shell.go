@@ -170,7 +170,7 @@ func (sh *shellInstance) processLine(line string) error {
 		cmd.Stderr = os.Stderr
 		cmd.Stdin = os.Stdin
 
-		if err := cmd.Run(); err != nil {
+		if err := children.runCommand(cmd); err != nil {
 			return err
 		}
 
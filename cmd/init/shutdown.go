@@ -0,0 +1,251 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+// The default number of seconds the guest has to shut down if the host
+// doesn't specify a timeout.
+const defaultShutdownTimeout = 10
+
+var shutdownOnce sync.Once
+
+// Mount points that are managed by the kernel and don't need to be
+// unmounted before powering off.
+var virtualFilesystems = []string{"/proc", "/sys", "/dev"}
+
+// Unmount every filesystem except the root in the reverse order they were
+// mounted then remount the root read-only.
+func unmountFilesystems() error {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return err
+	}
+
+	var mountPoints []string
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		mountPoints = append(mountPoints, fields[1])
+	}
+	f.Close()
+
+	var errs []string
+
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		mountPoint := mountPoints[i]
+
+		if mountPoint == "/" {
+			continue
+		}
+
+		virtual := false
+		for _, prefix := range virtualFilesystems {
+			if mountPoint == prefix || strings.HasPrefix(mountPoint, prefix+"/") {
+				virtual = true
+			}
+		}
+		if virtual {
+			continue
+		}
+
+		if err := unix.Unmount(mountPoint, 0); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to unmount %s: %s", mountPoint, err))
+		}
+	}
+
+	if err := unix.Mount("", "/", "", unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remount / read-only: %s", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// Stop the services, every other process and the filesystems then power off.
+// Only the first call has an effect.
+func shutdownGuest(metadataUrl string, reason string, timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		slog.Info("shutting down", "reason", reason)
+
+		report := config.ShutdownReport{Reason: reason, Services: []config.ServiceExit{}}
+
+		// Leave some of the time to stop the remaining processes and sync
+		// the filesystems.
+		deadline := time.Now().Add(timeout * 3 / 4)
+
+		if activeServices != nil {
+			report.Services = activeServices.stopAll(deadline)
+		}
+
+		// Stop everything else like SSH sessions.
+		unix.Kill(-1, unix.SIGTERM)
+		time.Sleep(500 * time.Millisecond)
+		unix.Kill(-1, unix.SIGKILL)
+
+		unix.Sync()
+
+		if err := unmountFilesystems(); err != nil {
+			slog.Warn("failed to unmount filesystems", "err", err)
+
+			report.Error = err.Error()
+		}
+
+		unix.Sync()
+
+		if body, err := json.Marshal(&report); err == nil {
+			resp, err := http.Post(metadataUrl+"/shutdown", "application/json", bytes.NewReader(body))
+			if err != nil {
+				slog.Warn("failed to report shutdown", "err", err)
+			} else {
+				resp.Body.Close()
+			}
+		}
+
+		if err := unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
+			slog.Error("failed to power off", "err", err)
+		}
+	})
+}
+
+// The size of struct input_event on 64-bit architectures and the codes of
+// the ACPI power button.
+const (
+	inputEventSize = 24
+	evKey          = 1
+	keyPower       = 116
+)
+
+// Find the input device of the ACPI power button.
+func findPowerButton() (string, bool) {
+	ents, err := os.ReadDir("/sys/class/input")
+	if err != nil {
+		return "", false
+	}
+
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.Name(), "event") {
+			continue
+		}
+
+		name, err := os.ReadFile(filepath.Join("/sys/class/input", ent.Name(), "device", "name"))
+		if err != nil {
+			continue
+		}
+
+		if strings.TrimSpace(string(name)) == "Power Button" {
+			return filepath.Join("/dev/input", ent.Name()), true
+		}
+	}
+
+	return "", false
+}
+
+// Shutdown when the ACPI power button is pressed.
+func watchPowerButton(metadataUrl string) {
+	filename, ok := findPowerButton()
+	if !ok {
+		return
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		slog.Debug("failed to open power button", "err", err)
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, inputEventSize)
+
+	for {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return
+		}
+
+		typ := binary.NativeEndian.Uint16(buf[16:])
+		code := binary.NativeEndian.Uint16(buf[18:])
+		value := int32(binary.NativeEndian.Uint32(buf[20:]))
+
+		if typ == evKey && code == keyPower && value == 1 {
+			shutdownGuest(metadataUrl, "power button pressed", defaultShutdownTimeout*time.Second)
+			return
+		}
+	}
+}
+
+// Wait for commands from the host, signals and the power button asking init
+// to shutdown. The host holds each request open until it has a command to
+// send.
+func watchControl(metadataUrl string) {
+	// SIGINT is left alone since init shares the console with the shell in
+	// serial mode.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGTERM, unix.SIGPWR)
+
+	go watchPowerButton(metadataUrl)
+
+	go func() {
+		sig := <-sigs
+
+		shutdownGuest(metadataUrl, fmt.Sprintf("received %s", sig), defaultShutdownTimeout*time.Second)
+	}()
+
+	for {
+		resp, err := http.Get(metadataUrl + "/control")
+		if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var cmd config.ControlCommand
+
+		err = json.NewDecoder(resp.Body).Decode(&cmd)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			// The host doesn't support the control channel.
+			return
+		} else if err != nil || resp.StatusCode != http.StatusOK {
+			// The host times out requests without a command.
+			continue
+		}
+
+		switch cmd.Command {
+		case "shutdown":
+			timeout := cmd.Timeout
+			if timeout == 0 {
+				timeout = defaultShutdownTimeout
+			}
+
+			go shutdownGuest(metadataUrl, cmd.Reason, time.Duration(timeout)*time.Second)
+		default:
+			slog.Warn("unknown control command", "command", cmd.Command)
+		}
+	}
+}
@@ -15,6 +15,10 @@ import (
 var (
 	size   = flag.Int("size", 64, "the size of the filesystem in megabytes")
 	output = flag.String("output", "", "the file to write the filesystem to")
+
+	journal         = flag.Bool("journal", false, "create a internal journal")
+	journalSize     = flag.Int("journal-size", 0, "the size of the journal in megabytes (defaults to the size picked by mke2fs)")
+	journalChecksum = flag.Bool("journal-checksum", false, "checksum the journal (journal_checksum_v3)")
 )
 
 func mkfsMain() error {
@@ -34,6 +38,17 @@ func mkfsMain() error {
 		return err
 	}
 
+	if *journal {
+		opts := ext4.JournalOptions{Blocks: int64(*journalSize) * 1024 * 1024 / 4096}
+		if *journalChecksum {
+			opts.Features |= ext4.JBD2_FEATURE_INCOMPAT_CSUM_V3
+		}
+
+		if err := fs.AddJournal(opts); err != nil {
+			return err
+		}
+	}
+
 	for _, in := range flag.Args() {
 		if err := filesystem.ExtractArchiveTo(in, fs); err != nil {
 			return err
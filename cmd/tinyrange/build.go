@@ -1,19 +1,207 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/daemon"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
 )
 
 var (
-	buildOutput string
+	buildOutput  string
+	buildProfile string
 )
 
+// Record the builds with profiler until the returned function is called
+// which writes the report to --profile.
+func startProfile() func() error {
+	profiler := common.NewBuildProfiler()
+
+	events := eventHandler
+	eventHandler = func(ev common.Event) {
+		profiler.Handle(ev)
+		events.Emit(ev)
+	}
+
+	return func() error {
+		report := profiler.Report()
+
+		out, err := os.Create(buildProfile)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+
+		report.WriteSummary(os.Stderr, 10)
+
+		return nil
+	}
+}
+
+// Copy the build result to --output.
+func copyBuildOutput(f filesystem.File) error {
+	fh, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	out, err := os.Create(buildOutput)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, fh); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Submit the build to a running daemon and print its log while waiting.
+func buildWithDaemon(ctx context.Context, client *daemon.Client, definition string) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// The daemon doesn't share our working directory so send a absolute path.
+	if filename, name, ok := strings.Cut(definition, ":"); ok && !filepath.IsAbs(filename) {
+		definition = filepath.Join(cwd, filename) + ":" + name
+	}
+
+	job, err := client.SubmitBuild(daemon.BuildRequest{
+		Definition:    definition,
+		AlwaysRebuild: true,
+		Cwd:           cwd,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Interrupting tinyrange cancels the build in the daemon.
+	stop := context.AfterFunc(ctx, func() {
+		client.CancelBuild(job.Id)
+	})
+	defer stop()
+
+	job, err = client.FollowBuild(job.Id, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	if job.State != daemon.JobSucceeded {
+		exitBuildFailed(ctx, fmt.Errorf("%s", job.Error))
+	}
+
+	if buildOutput != "" {
+		return copyBuildOutput(filesystem.NewLocalFile(job.Output, nil))
+	}
+
+	return nil
+}
+
+// Find the log of the build of a definition by its hash, declared name
+// (file.star:name) or tag. If several builds share a tag the most recent log
+// is returned.
+func findBuildLog(query string) (string, error) {
+	db, err := newDb()
+	if err != nil {
+		return "", err
+	}
+
+	var hashes []string
+
+	if len(query) == 64 && !strings.Contains(query, ":") {
+		hashes = append(hashes, query)
+	} else if strings.Contains(query, ":") {
+		macroCtx := db.NewMacroContext()
+
+		macro, err := db.GetMacroByShorthand(macroCtx, query)
+		if err != nil {
+			return "", err
+		}
+
+		ret, err := macro.Call(macroCtx)
+		if err != nil {
+			return "", err
+		}
+
+		def, ok := ret.(common.BuildDefinition)
+		if !ok {
+			return "", fmt.Errorf("could not convert %T to BuildDefinition", ret)
+		}
+
+		hash, err := db.HashDefinition(def)
+		if err != nil {
+			return "", err
+		}
+
+		hashes = append(hashes, hash)
+	} else {
+		all, err := db.GetAllHashes()
+		if err != nil {
+			return "", err
+		}
+
+		for _, hash := range all {
+			def, err := db.GetDefinitionByHash(hash)
+			if err != nil {
+				continue
+			}
+
+			if def.Tag() == query {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+
+	var (
+		latest   string
+		latestAt time.Time
+	)
+
+	for _, hash := range hashes {
+		filename, err := db.FilenameFromHash(hash, ".log")
+		if err != nil {
+			return "", err
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+
+		if latest == "" || info.ModTime().After(latestAt) {
+			latest = filename
+			latestAt = info.ModTime()
+		}
+	}
+
+	if latest == "" {
+		return "", fmt.Errorf("no build log found")
+	}
+
+	return latest, nil
+}
+
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build a single definition",
@@ -22,6 +210,20 @@ var buildCmd = &cobra.Command{
 			return fmt.Errorf("please specify a definition")
 		}
 
+		if err := setupEvents(); err != nil {
+			return err
+		}
+
+		// Profiles are recorded from the events of builds in this process.
+		writeProfile := func() error { return nil }
+		if buildProfile != "" {
+			writeProfile = startProfile()
+		}
+
+		if client := connectDaemon(); client != nil {
+			return buildWithDaemon(cmd.Context(), client, args[0])
+		}
+
 		db, err := newDb()
 		if err != nil {
 			return err
@@ -44,30 +246,19 @@ var buildCmd = &cobra.Command{
 		}
 
 		if def, ok := ret.(common.BuildDefinition); ok {
-			f, err := db.Build(db.NewBuildContext(def), def, common.BuildOptions{
+			f, err := db.Build(db.NewBuildContextWithContext(cmd.Context(), def), def, common.BuildOptions{
 				AlwaysRebuild: true,
 			})
+			if profileErr := writeProfile(); profileErr != nil {
+				return profileErr
+			}
+
 			if err != nil {
-				slog.Error("fatal", "err", err)
-				os.Exit(1)
+				exitBuildFailed(cmd.Context(), err)
 			}
 
 			if buildOutput != "" {
-				fh, err := f.Open()
-				if err != nil {
-					return err
-				}
-				defer fh.Close()
-
-				out, err := os.Create(buildOutput)
-				if err != nil {
-					return err
-				}
-				defer out.Close()
-
-				if _, err := io.Copy(out, fh); err != nil {
-					return err
-				}
+				return copyBuildOutput(f)
 			}
 
 			return nil
@@ -79,5 +270,7 @@ var buildCmd = &cobra.Command{
 
 func init() {
 	buildCmd.PersistentFlags().StringVarP(&buildOutput, "output", "o", "", "if specified then copy the build output to a local file at path")
+	buildCmd.PersistentFlags().StringVar(&buildProfile, "profile", "", "if specified then write a report of how long each definition took to build to path and print the critical path")
+	addEventsFlags(buildCmd)
 	rootCmd.AddCommand(buildCmd)
 }
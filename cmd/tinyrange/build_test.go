@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+func TestFindBuildLog(t *testing.T) {
+	previous := rootBuildDir
+	rootBuildDir = t.TempDir()
+	defer func() { rootBuildDir = previous }()
+
+	filename := filepath.Join(t.TempDir(), "failing.star")
+
+	if err := os.WriteFile(filename, []byte(`
+def build_failing(ctx):
+    print("compiling")
+    fail("compiler exploded")
+
+failing = define.build(build_failing)
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := newDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := findBuildLog(filename + ":failing"); err == nil {
+		t.Fatal("expected no log before the definition is built")
+	}
+
+	macroCtx := db.NewMacroContext()
+
+	macro, err := db.GetMacroByDeclaredName(macroCtx, filename+":failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := macro.Call(macroCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := ret.(common.BuildDefinition)
+
+	if _, err := db.Build(db.NewBuildContext(def), def, common.BuildOptions{}); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	hash, err := db.HashDefinition(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := db.FilenameFromHash(hash, ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{filename + ":failing", hash, def.Tag()} {
+		got, err := findBuildLog(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+
+		if got != expected {
+			t.Fatalf("%s: expected %s, got %s", query, expected, got)
+		}
+	}
+
+	contents, err := os.ReadFile(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != "compiling\n" {
+		t.Fatalf("unexpected log contents: %q", contents)
+	}
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/daemon"
+)
+
+var (
+	daemonSocket  string
+	daemonLoadAll bool
+)
+
+// Connect to a running daemon if it can handle requests for this invocation.
+// Returns nil if the command should run in process.
+func connectDaemon() *daemon.Client {
+	if rootNoDaemon || rootRebuild || rootDistribution != "" || len(rootMirrors) > 0 || eventHandler != nil {
+		return nil
+	}
+
+	client := daemon.NewClient(daemon.DefaultSocket(rootRuntimeDir))
+
+	status, err := client.Status()
+	if err != nil {
+		return nil
+	}
+
+	// The daemon has to be using the same build directory.
+	buildDir, err := filepath.Abs(rootBuildDir)
+	if err != nil || buildDir != status.BuildDir {
+		return nil
+	}
+
+	return client
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Keep the package database loaded and serve a HTTP/JSON API over a unix socket",
+	Long: `Keep the package database loaded and serve a HTTP/JSON API over a unix socket.
+
+While the daemon is running tinyrange build and tinyrange query send their
+requests to it instead of loading the package database themselves.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		buildDir, err := filepath.Abs(rootBuildDir)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(rootRuntimeDir, 0700); err != nil {
+			return err
+		}
+
+		server := daemon.New(db, buildDir, rootRuntimeDir)
+
+		server.StartInstance = startInstance
+
+		if daemonLoadAll {
+			if err := server.LoadAll(); err != nil {
+				return err
+			}
+		}
+
+		socket := daemonSocket
+		if socket == "" {
+			socket = daemon.DefaultSocket(rootRuntimeDir)
+		}
+
+		return server.Serve(socket)
+	},
+}
+
+func init() {
+	daemonCmd.PersistentFlags().StringVar(&daemonSocket, "socket", "", "The unix socket to listen on (default: daemon.sock in the runtime directory).")
+	daemonCmd.PersistentFlags().BoolVar(&daemonLoadAll, "load-all", false, "Load every container builder on startup.")
+	rootCmd.AddCommand(daemonCmd)
+}
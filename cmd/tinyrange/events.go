@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+var (
+	eventsFormat string
+	eventsOutput string
+
+	// The handler for --events. nil if events are disabled.
+	eventHandler common.EventHandler
+)
+
+func addEventsFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&eventsFormat, "events", "", "Write progress events as they happen (options: [json]). Each event is a JSON object on its own line.")
+	cmd.PersistentFlags().StringVar(&eventsOutput, "events-output", "", "The file to write events to (required with --events). - writes them to stdout which is only useful for commands that don't print anything else.")
+}
+
+// Open the event stream requested with --events. tinyrange processes started
+// by builds inherit the settings through the environment so their events
+// are written to the same stream.
+func setupEvents() error {
+	if eventsFormat == "" {
+		eventsFormat = os.Getenv("TINYRANGE_EVENTS")
+
+		if output := os.Getenv("TINYRANGE_EVENTS_OUTPUT"); output != "" {
+			eventsOutput = output
+		}
+	}
+
+	if eventsFormat == "" {
+		return nil
+	} else if eventsFormat != "json" {
+		return fmt.Errorf("unknown events format: %s", eventsFormat)
+	}
+
+	// Log messages are written to stderr and the console of virtual machines
+	// to stdout so events need a destination of their own to be parsed
+	// reliably.
+	if eventsOutput == "" {
+		return fmt.Errorf("--events requires --events-output")
+	}
+
+	var out io.Writer
+
+	if eventsOutput == "-" {
+		out = os.Stdout
+	} else {
+		// Child processes might run in a different directory.
+		filename, err := filepath.Abs(eventsOutput)
+		if err != nil {
+			return err
+		}
+
+		eventsOutput = filename
+
+		// Other tinyrange processes append to the same file.
+		f, err := os.OpenFile(eventsOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		out = f
+	}
+
+	if err := os.Setenv("TINYRANGE_EVENTS", eventsFormat); err != nil {
+		return err
+	}
+
+	if err := os.Setenv("TINYRANGE_EVENTS_OUTPUT", eventsOutput); err != nil {
+		return err
+	}
+
+	var mtx sync.Mutex
+
+	eventHandler = func(ev common.Event) {
+		line, err := json.Marshal(&ev)
+		if err != nil {
+			return
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		// Write each event in a single call so lines from different
+		// processes are not interleaved.
+		out.Write(append(line, '\n'))
+	}
+
+	return nil
+}
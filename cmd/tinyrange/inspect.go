@@ -6,6 +6,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/database"
 )
 
 var (
@@ -21,7 +22,7 @@ var inspectCmd = &cobra.Command{
 		}
 
 		if inspectRaw {
-			return fmt.Errorf("--raw not implemented")
+			return database.InspectFile(args[0], os.Stdout)
 		}
 
 		db, err := newDb()
@@ -53,6 +54,6 @@ var inspectCmd = &cobra.Command{
 }
 
 func init() {
-	inspectCmd.PersistentFlags().BoolVarP(&inspectRaw, "raw", "r", false, "if specified then ")
+	inspectCmd.PersistentFlags().BoolVarP(&inspectRaw, "raw", "r", false, "if specified then list the entries of a archive, ext4, squashfs or FAT image on the host")
 	rootCmd.AddCommand(inspectCmd)
 }
@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/instance"
+	"github.com/tinyrange/tinyrange/pkg/tinyrange"
+	"golang.org/x/term"
+)
+
+var (
+	logsFollow  bool
+	stopTimeout int
+)
+
+// The key that detaches from a serial console (CTRL-]).
+const detachKey = 0x1d
+
+func getInstance(name string) (*instance.Instance, error) {
+	inst, err := instance.Get(rootRuntimeDir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !inst.Alive() {
+		return nil, fmt.Errorf("instance %s is not running", name)
+	}
+
+	return inst, nil
+}
+
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "List virtual machines running in the background",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		instances, err := instance.List(rootRuntimeDir)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+		fmt.Fprintf(w, "NAME\tINTERACTION\tCPUS\tMEMORY\tPORTS\tSSH\tSTARTED\n")
+
+		for _, inst := range instances {
+			var ports []string
+			for _, port := range inst.ForwardedPorts {
+				ports = append(ports, fmt.Sprintf("%d", port))
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%d\t%dmb\t%s\t%s\t%s\n",
+				inst.Name,
+				inst.Interaction,
+				inst.CPUCores,
+				inst.MemoryMB,
+				strings.Join(ports, ","),
+				inst.SshAddress,
+				inst.Started.Format("2006-01-02 15:04:05"),
+			)
+		}
+
+		return w.Flush()
+	},
+}
+
+// Proxy the terminal to the console of a serial instance until the user
+// presses the detach key or the instance exits.
+func attachConsole(inst *instance.Instance) error {
+	conn, err := inst.DialConsole()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to make terminal raw: %v", err)
+		}
+		defer func() { _ = term.Restore(fd, state) }()
+	}
+
+	fmt.Fprintf(os.Stderr, "attached to %s (press CTRL-] to detach)\r\n", inst.Name)
+
+	done := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		done <- err
+	}()
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+
+			if i := bytes.IndexByte(buf[:n], detachKey); i != -1 {
+				conn.Write(buf[:i])
+				done <- nil
+				return
+			}
+
+			if _, err := conn.Write(buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	if err := <-done; err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+var attachCmd = &cobra.Command{
+	Use:   "attach <name>",
+	Short: "Connect to a virtual machine running in the background",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inst, err := getInstance(args[0])
+		if err != nil {
+			return err
+		}
+
+		if inst.SshAddress != "" {
+			return tinyrange.AttachOverSsh(inst.SshAddress)
+		}
+
+		return attachConsole(inst)
+	},
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <name|hash|tag>",
+	Short: "Print the console output of a virtual machine running in the background or the log of a build",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inst, err := instance.Get(rootRuntimeDir, args[0])
+		if err != nil {
+			// Fall back to the log of a build.
+			filename, logErr := findBuildLog(args[0])
+			if logErr != nil {
+				return fmt.Errorf("no instance or build log found for %s: %w", args[0], logErr)
+			}
+
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(os.Stdout, f)
+			return err
+		}
+
+		f, err := os.Open(inst.LogFilename())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		for {
+			if _, err := io.Copy(os.Stdout, f); err != nil {
+				return err
+			}
+
+			if !logsFollow || !inst.Alive() {
+				return nil
+			}
+
+			time.Sleep(200 * time.Millisecond)
+		}
+	},
+}
+
+var stopCmd = &cobra.Command{
+	Use:   "stop <name>...",
+	Short: "Stop virtual machines running in the background",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, name := range args {
+			inst, err := instance.Get(rootRuntimeDir, name)
+			if err != nil {
+				return err
+			}
+
+			if err := inst.Stop(time.Duration(stopTimeout) * time.Second); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	logsCmd.PersistentFlags().BoolVarP(&logsFollow, "follow", "f", false, "Keep printing output until the instance exits.")
+	stopCmd.PersistentFlags().IntVar(&stopTimeout, "timeout", 10, "Seconds to wait for the guest to power off before the hypervisor is stopped.")
+
+	rootCmd.AddCommand(psCmd)
+	rootCmd.AddCommand(attachCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(stopCmd)
+}
@@ -74,6 +74,11 @@ type loginConfig struct {
 	NoScripts    bool     `json:"no_scripts,omitempty" yaml:"no_scripts,omitempty"`
 	Init         string   `json:"init,omitempty" yaml:"init,omitempty"`
 	ForwardPorts []string `json:"forward_ports,omitempty" yaml:"forward_ports,omitempty"`
+	Volumes      []string `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	// Services started and supervised by init in the guest.
+	Services []cfg.ServiceConfig `json:"services,omitempty" yaml:"services,omitempty"`
+	// Commands and forwarded ports wait for these probes to pass.
+	ReadinessProbes []cfg.ProbeConfig `json:"readiness_probes,omitempty" yaml:"readiness_probes,omitempty"`
 
 	// private configs that have to be set on the command line.
 	cpuCores          int
@@ -130,6 +135,7 @@ func (config *loginConfig) parseInclusion(db *database.PackageDatabase, inclusio
 		subConfig.cpuCores, subConfig.memorySize, arch,
 		subConfig.storageSize,
 		interaction, subConfig.debug,
+		subConfig.Volumes,
 	)
 
 	return common.DirectiveAddFile{
@@ -298,6 +304,24 @@ func (config *loginConfig) getDirectives(db *database.PackageDatabase) ([]common
 		directives = append(directives, common.DirectiveExportPort{Name: "forward", Port: portNum})
 	}
 
+	for _, svc := range config.Services {
+		if svc.Ready != nil {
+			if err := common.ValidateProbe(*svc.Ready); err != nil {
+				return nil, "", fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+		}
+
+		directives = append(directives, common.NewServiceDirective(svc))
+	}
+
+	for _, probe := range config.ReadinessProbes {
+		if err := common.ValidateProbe(probe); err != nil {
+			return nil, "", err
+		}
+
+		directives = append(directives, common.NewReadinessProbeDirective(probe))
+	}
+
 	interaction := "ssh"
 
 	directives, err = common.FlattenDirectives(directives, common.SpecialDirectiveHandlers{
@@ -324,7 +348,7 @@ func (config *loginConfig) getDirectives(db *database.PackageDatabase) ([]common
 	return directives, interaction, nil
 }
 
-func (config *loginConfig) run() error {
+func (config *loginConfig) run(ctx context.Context) error {
 	if config.Version > CURRENT_CONFIG_VERSION {
 		return fmt.Errorf("attempt to run config version %d on TinyRange version %d", config.Version, CURRENT_CONFIG_VERSION)
 	}
@@ -355,14 +379,13 @@ func (config *loginConfig) run() error {
 	if config.writeRoot != "" {
 		directives = append(directives, common.DirectiveBuiltin{Name: "init", Architecture: string(arch), GuestFilename: "init"})
 
-		def := builder.NewBuildFsDefinition(directives, "tar")
+		def := builder.NewBuildFsDefinition(directives, "tar", 0, 0, false)
 
-		ctx := db.NewBuildContext(def)
+		buildCtx := db.NewBuildContextWithContext(ctx, def)
 
-		f, err := db.Build(ctx, def, common.BuildOptions{})
+		f, err := db.Build(buildCtx, def, common.BuildOptions{})
 		if err != nil {
-			slog.Error("fatal", "err", err)
-			os.Exit(1)
+			exitBuildFailed(ctx, err)
 		}
 
 		fh, err := f.Open()
@@ -383,7 +406,6 @@ func (config *loginConfig) run() error {
 
 		return nil
 	} else if config.writeDocker != "" {
-		ctx := context.Background()
 
 		apiClient, err := client.NewClientWithOpts(client.FromEnv)
 		if err != nil {
@@ -394,14 +416,13 @@ func (config *loginConfig) run() error {
 
 		directives = append(directives, common.DirectiveBuiltin{Name: "init", Architecture: string(arch), GuestFilename: "init"})
 
-		def := builder.NewBuildFsDefinition(directives, "tar")
+		def := builder.NewBuildFsDefinition(directives, "tar", 0, 0, false)
 
-		buildCtx := db.NewBuildContext(def)
+		buildCtx := db.NewBuildContextWithContext(ctx, def)
 
 		f, err := db.Build(buildCtx, def, common.BuildOptions{})
 		if err != nil {
-			slog.Error("fatal", "err", err)
-			os.Exit(1)
+			exitBuildFailed(ctx, err)
 		}
 
 		buildCtxOut, buildCtxIn := io.Pipe()
@@ -502,10 +523,11 @@ func (config *loginConfig) run() error {
 			config.cpuCores, config.memorySize, arch,
 			config.storageSize,
 			interaction, config.debug,
+			config.Volumes,
 		)
 
 		if config.Output != "" {
-			ctx := db.NewBuildContext(def)
+			buildCtx := db.NewBuildContextWithContext(ctx, def)
 
 			defHash, err := db.HashDefinition(def)
 			if err != nil {
@@ -513,10 +535,9 @@ func (config *loginConfig) run() error {
 				os.Exit(1)
 			}
 
-			f, err := db.Build(ctx, def, common.BuildOptions{})
+			f, err := db.Build(buildCtx, def, common.BuildOptions{})
 			if err != nil {
-				slog.Error("fatal", "err", err)
-				os.Exit(1)
+				exitBuildFailed(ctx, err)
 			}
 
 			fh, err := f.Open()
@@ -541,12 +562,11 @@ func (config *loginConfig) run() error {
 
 			return nil
 		} else {
-			ctx := db.NewBuildContext(def)
-			if _, err := db.Build(ctx, def, common.BuildOptions{
+			buildCtx := db.NewBuildContextWithContext(ctx, def)
+			if _, err := db.Build(buildCtx, def, common.BuildOptions{
 				AlwaysRebuild: true,
 			}); err != nil {
-				slog.Error("fatal", "err", err)
-				os.Exit(1)
+				exitBuildFailed(ctx, err)
 			}
 
 			// if common.IsVerbose() {
@@ -586,6 +606,10 @@ var loginCmd = &cobra.Command{
 
 		currentConfig.Packages = args
 
+		if err := setupEvents(); err != nil {
+			return err
+		}
+
 		if loginLoadConfig != "" {
 			f, err := os.Open(loginLoadConfig)
 			if err != nil {
@@ -608,7 +632,7 @@ var loginCmd = &cobra.Command{
 
 			return os.WriteFile(loginSaveConfig, cfg, os.FileMode(0644))
 		} else {
-			return currentConfig.run()
+			return currentConfig.run(cmd.Context())
 		}
 	},
 }
@@ -630,6 +654,7 @@ func init() {
 	loginCmd.PersistentFlags().StringArrayVarP(&currentConfig.Macros, "macro", "m", []string{}, "Add macros to the VM.")
 	loginCmd.PersistentFlags().StringVar(&currentConfig.Architecture, "arch", "", "Override the CPU architecture of the machine. This will use emulation with a performance hit.")
 	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.ForwardPorts, "forward", []string{}, "Forward a port from the guest to the host.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.Volumes, "volume", []string{}, "Attach a persistent volume (name:mount_point[:disk|overlay|ro]).")
 
 	// private flags (need to set on command line)
 	loginCmd.PersistentFlags().IntVar(&currentConfig.cpuCores, "cpu", 1, "The number of CPU cores to allocate to the virtual machine.")
@@ -640,5 +665,6 @@ func init() {
 	loginCmd.PersistentFlags().StringVar(&currentConfig.writeDocker, "write-docker", "", "Write the root filesystem to a docker tag on the local docker daemon.")
 	loginCmd.PersistentFlags().BoolVar(&currentConfig.hash, "hash", false, "print the hash of the definition generated after the machine has exited.")
 	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.experimentalFlags, "experimental", []string{}, "Add experimental flags.")
+	addEventsFlags(loginCmd)
 	rootCmd.AddCommand(loginCmd)
 }
@@ -1,14 +1,20 @@
 package cli
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/api"
 	"github.com/tinyrange/tinyrange/pkg/buildinfo"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/database"
+	"github.com/tinyrange/tinyrange/pkg/instance"
 )
 
 var (
@@ -18,6 +24,8 @@ var (
 	rootVerbose      bool
 	rootDistribution string
 	rootMirrors      []string
+	rootRuntimeDir   string
+	rootNoDaemon     bool
 )
 
 var rootCmd = &cobra.Command{
@@ -38,26 +46,7 @@ Complete documentation is available at https://github.com/tinyrange/tinyrange`,
 }
 
 func newDb() (*database.PackageDatabase, error) {
-	db := database.New(rootBuildDir)
-
-	if rootDistribution != "" {
-		if err := db.SetDistributionServer(rootDistribution); err != nil {
-			return nil, err
-		}
-	}
-
-	// Check with Exists first so it doesn't have issues if the build dir is behind a symlink.
-	if ok, _ := common.Exists(rootBuildDir); !ok {
-		if err := common.Ensure(rootBuildDir, os.ModePerm); err != nil {
-			return nil, err
-		}
-	}
-
-	db.RebuildUserDefinitions = rootRebuild
-
-	if err := db.LoadBuiltinBuilders(); err != nil {
-		return nil, err
-	}
+	mirrors := make(map[string][]string)
 
 	for _, mirror := range rootMirrors {
 		name, url, ok := strings.Cut(mirror, "=")
@@ -65,10 +54,22 @@ func newDb() (*database.PackageDatabase, error) {
 			return nil, fmt.Errorf("invalid mirror syntax (name=url)")
 		}
 
-		db.AddMirror(name, []string{url})
+		mirrors[name] = []string{url}
+	}
+
+	tr, err := api.New(api.Options{
+		BuildDir:               rootBuildDir,
+		Distribution:           rootDistribution,
+		Mirrors:                mirrors,
+		RebuildUserDefinitions: rootRebuild,
+		OnEvent:                eventHandler,
+		Verbose:                common.IsVerbose(),
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return db, nil
+	return tr.Database(), nil
 }
 
 func init() {
@@ -77,12 +78,40 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&rootCpuProfile, "cpuprofile", "", "write cpu profile to file")
 	rootCmd.PersistentFlags().BoolVar(&rootVerbose, "verbose", false, "enable debugging output")
 	rootCmd.PersistentFlags().StringVar(&rootDistribution, "distribution", "", "The HTTP/HTTPS address of a distribution server to copy build results from")
+	rootCmd.PersistentFlags().StringVar(&rootRuntimeDir, "runtimeDir", instance.DefaultRuntimeDir(), "specify the directory background instances are tracked in")
+	rootCmd.PersistentFlags().BoolVar(&rootNoDaemon, "no-daemon", false, "don't send requests to a running tinyrange daemon")
 	rootCmd.PersistentFlags().StringArrayVar(&rootMirrors, "mirror", []string{}, "Specify mirrors to override the default mirror settings")
 }
 
+// The exit status of a interrupted command (128 + SIGINT).
+const exitInterrupted = 130
+
+// Exit after a build fails. The build is cancelled and cleaned up by the time
+// this is called if tinyrange was interrupted.
+func exitBuildFailed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		slog.Error("interrupted")
+		os.Exit(exitInterrupted)
+	}
+
+	slog.Error("fatal", "err", err)
+	os.Exit(1)
+}
+
 func Run() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Restore the default behavior after the first signal so a second one
+	// exits immediately.
+	context.AfterFunc(ctx, stop)
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		// fmt.Println(err)
+		if ctx.Err() != nil {
+			os.Exit(exitInterrupted)
+		}
+
 		os.Exit(1)
 	}
 }
@@ -18,6 +18,24 @@ var queryCmd = &cobra.Command{
 			return fmt.Errorf("please specify a builder")
 		}
 
+		if client := connectDaemon(); client != nil {
+			query := "*"
+			if len(args) > 0 {
+				query = args[0]
+			}
+
+			results, err := client.QueryPackages(queryBuilder, query)
+			if err != nil {
+				return err
+			}
+
+			for _, result := range results {
+				fmt.Printf("%s\n", result)
+			}
+
+			return nil
+		}
+
 		db, err := newDb()
 		if err != nil {
 			return err
@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,7 +12,9 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/instance"
 	"github.com/tinyrange/tinyrange/pkg/tinyrange"
 	"gopkg.in/yaml.v3"
 )
@@ -21,13 +24,106 @@ var (
 	runExportFilesystem string
 	runListenNbd        string
 	runStreamingServer  string
+	runSaveSnapshot     string
+	runRestoreSnapshot  string
+	runMonitorAddress   string
+	runLayerReport      string
+	runDetach           bool
+	runName             string
+	runSupervise        string
 )
 
+// Start a background instance running cfg. The instance is supervised by a
+// new tinyrange process so it outlives the caller.
+func startInstance(cfg config.TinyRangeConfig, name string) (*instance.Instance, error) {
+	inst, err := instance.New(rootRuntimeDir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfgJson, err := json.Marshal(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(inst.ConfigFilename(), cfgJson, 0600); err != nil {
+		return nil, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"--buildDir", rootBuildDir,
+		"--runtimeDir", rootRuntimeDir,
+		"run-vm", "--supervise", inst.Name,
+	}
+
+	if rootVerbose {
+		args = append(args, "--verbose")
+	}
+
+	if err := inst.Start(exe, args); err != nil {
+		inst.Remove()
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+// Start a background instance running cfg and print its name.
+func runDetached(cfg config.TinyRangeConfig) error {
+	if runStreamingServer != "" || runExportFilesystem != "" || runListenNbd != "" {
+		return fmt.Errorf("--detach can not be combined with --stream, --export-filesystem or --listen-nbd")
+	}
+
+	inst, err := startInstance(cfg, runName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n", inst.Name)
+
+	return nil
+}
+
+// Run inside the supervisor process started by runDetached.
+func runSupervisor(ctx context.Context, name string) error {
+	inst, err := instance.Open(rootRuntimeDir, name)
+	if err != nil {
+		return err
+	}
+
+	cfgJson, err := os.ReadFile(inst.ConfigFilename())
+	if err != nil {
+		return err
+	}
+
+	var cfg config.TinyRangeConfig
+
+	if err := json.Unmarshal(cfgJson, &cfg); err != nil {
+		return err
+	}
+
+	return tinyrange.RunDetached(ctx, rootBuildDir, cfg, inst)
+}
+
 var runCmd = &cobra.Command{
-	Use:   "run-vm <config>",
-	Short: "Run a virtual machine from a configuration file",
+	Use:     "run-vm <config>",
+	Aliases: []string{"run"},
+	Short:   "Run a virtual machine from a configuration file",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) == 0 && runStreamingServer == "" {
+		if runSupervise != "" {
+			return runSupervisor(cmd.Context(), runSupervise)
+		}
+
+		if err := setupEvents(); err != nil {
+			return err
+		}
+
+		if len(args) == 0 && runStreamingServer == "" && runRestoreSnapshot == "" {
 			return fmt.Errorf("run-vm requires a configuration file")
 		}
 
@@ -63,7 +159,7 @@ var runCmd = &cobra.Command{
 			url.Path = path.Dir(url.Path)
 
 			runStreamingServer = url.String()
-		} else {
+		} else if len(args) > 0 {
 			f, err := os.Open(args[0])
 			if err != nil {
 				return err
@@ -85,7 +181,35 @@ var runCmd = &cobra.Command{
 			}
 		}
 
-		return tinyrange.RunWithConfig(rootBuildDir, cfg, runDebug, false, runExportFilesystem, runListenNbd, runStreamingServer)
+		if runSaveSnapshot != "" {
+			cfg.SaveSnapshot = runSaveSnapshot
+		}
+
+		if runRestoreSnapshot != "" {
+			cfg.RestoreSnapshot = runRestoreSnapshot
+		}
+
+		if runMonitorAddress != "" {
+			cfg.MonitorAddress = runMonitorAddress
+		}
+
+		if runLayerReport != "" {
+			cfg.LayerReportFilename = runLayerReport
+		}
+
+		if runDetach {
+			return runDetached(cfg)
+		}
+
+		return tinyrange.RunWithConfig(cmd.Context(), cfg, tinyrange.RunOptions{
+			BuildDir:         rootBuildDir,
+			Debug:            runDebug,
+			ExportFilesystem: runExportFilesystem,
+			ListenNbd:        runListenNbd,
+			StreamingServer:  runStreamingServer,
+			OnEvent:          eventHandler,
+			Verbose:          common.IsVerbose(),
+		})
 	},
 }
 
@@ -94,5 +218,14 @@ func init() {
 	runCmd.PersistentFlags().StringVar(&runExportFilesystem, "export-filesystem", "", "write the filesystem to the host filesystem")
 	runCmd.PersistentFlags().StringVar(&runListenNbd, "listen-nbd", "", "Listen with an NBD server on the given address and port")
 	runCmd.PersistentFlags().StringVar(&runStreamingServer, "stream", "", "Specify a server to download the config from.")
+	runCmd.PersistentFlags().StringVar(&runSaveSnapshot, "save-snapshot", "", "Save the state of the virtual machine under this name once the guest is ready.")
+	runCmd.PersistentFlags().StringVar(&runRestoreSnapshot, "restore-snapshot", "", "Restore a saved snapshot instead of booting. The config file is optional.")
+	runCmd.PersistentFlags().StringVar(&runLayerReport, "layer-report", "", "Write the paths in the root filesystem that later fragments replaced or removed to this file.")
+	runCmd.PersistentFlags().StringVar(&runMonitorAddress, "monitor", "", "Listen for QMP connections on the given unix socket. Used by tinyrange vm.")
+	runCmd.PersistentFlags().BoolVarP(&runDetach, "detach", "d", false, "Run the virtual machine in the background and print its name. See tinyrange ps.")
+	runCmd.PersistentFlags().StringVar(&runName, "name", "", "The name of the instance when running in the background (default: generated).")
+	runCmd.PersistentFlags().StringVar(&runSupervise, "supervise", "", "Run as the supervisor of a background instance.")
+	runCmd.PersistentFlags().MarkHidden("supervise")
+	addEventsFlags(runCmd)
 	rootCmd.AddCommand(runCmd)
 }
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/snapshot"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage saved virtual machine snapshots",
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List all snapshots",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshots, err := snapshot.List(rootBuildDir)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+		fmt.Fprintf(w, "NAME\tCREATED\tOVERLAY\n")
+
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.Created.Format("2006-01-02 15:04:05"), s.Overlay())
+		}
+
+		return w.Flush()
+	},
+}
+
+var snapshotRemoveCmd = &cobra.Command{
+	Use:   "rm <name>...",
+	Short: "Remove snapshots",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, name := range args {
+			if err := snapshot.Remove(rootBuildDir, name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotRemoveCmd)
+	rootCmd.AddCommand(snapshotCmd)
+}
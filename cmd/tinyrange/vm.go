@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/vm"
+)
+
+var (
+	vmMonitorAddress string
+	vmDiskFormat     string
+	vmDiskReadOnly   bool
+)
+
+func dialVmMonitor() (*vm.Monitor, error) {
+	if vmMonitorAddress == "" {
+		return nil, fmt.Errorf("--monitor is required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return vm.DialMonitor(ctx, vmMonitorAddress)
+}
+
+// Make a command that runs a single monitor operation.
+func vmMonitorCommand(use string, short string, args cobra.PositionalArgs, run func(monitor *vm.Monitor, args []string) error) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  args,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			monitor, err := dialVmMonitor()
+			if err != nil {
+				return err
+			}
+			defer monitor.Close()
+
+			return run(monitor, args)
+		},
+	}
+}
+
+var vmCmd = &cobra.Command{
+	Use:   "vm",
+	Short: "Control a running virtual machine using its QMP monitor",
+}
+
+var vmStatusCmd = vmMonitorCommand("status", "Print the run state of the virtual machine", cobra.NoArgs,
+	func(monitor *vm.Monitor, args []string) error {
+		status, err := monitor.Status()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\n", status.Status)
+
+		return nil
+	})
+
+var vmPauseCmd = vmMonitorCommand("pause", "Pause all guest CPUs", cobra.NoArgs,
+	func(monitor *vm.Monitor, args []string) error {
+		return monitor.Pause()
+	})
+
+var vmResumeCmd = vmMonitorCommand("resume", "Resume a paused virtual machine", cobra.NoArgs,
+	func(monitor *vm.Monitor, args []string) error {
+		return monitor.Resume()
+	})
+
+var vmPowerdownCmd = vmMonitorCommand("powerdown", "Ask the guest to shutdown by pressing the ACPI power button", cobra.NoArgs,
+	func(monitor *vm.Monitor, args []string) error {
+		return monitor.SystemPowerdown()
+	})
+
+var vmQuitCmd = vmMonitorCommand("quit", "Stop the hypervisor immediately", cobra.NoArgs,
+	func(monitor *vm.Monitor, args []string) error {
+		return monitor.Quit()
+	})
+
+var vmAddDiskCmd = vmMonitorCommand("add-disk <id> <filename>", "Hot-plug a disk image as a virtio-blk device", cobra.ExactArgs(2),
+	func(monitor *vm.Monitor, args []string) error {
+		// The hypervisor might have a different working directory.
+		filename, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+
+		return monitor.AddDisk(args[0], filename, vmDiskFormat, vmDiskReadOnly)
+	})
+
+var vmRemoveDeviceCmd = vmMonitorCommand("remove-device <id>", "Remove a hot-plugged device", cobra.ExactArgs(1),
+	func(monitor *vm.Monitor, args []string) error {
+		return monitor.DeviceDel(args[0])
+	})
+
+func init() {
+	vmCmd.PersistentFlags().StringVar(&vmMonitorAddress, "monitor", "", "The unix socket of the QMP monitor (see run-vm --monitor).")
+
+	vmAddDiskCmd.PersistentFlags().StringVar(&vmDiskFormat, "format", "raw", "The format of the disk image (raw or qcow2).")
+	vmAddDiskCmd.PersistentFlags().BoolVar(&vmDiskReadOnly, "read-only", false, "Attach the disk read-only.")
+
+	vmCmd.AddCommand(vmStatusCmd)
+	vmCmd.AddCommand(vmPauseCmd)
+	vmCmd.AddCommand(vmResumeCmd)
+	vmCmd.AddCommand(vmPowerdownCmd)
+	vmCmd.AddCommand(vmQuitCmd)
+	vmCmd.AddCommand(vmAddDiskCmd)
+	vmCmd.AddCommand(vmRemoveDeviceCmd)
+	rootCmd.AddCommand(vmCmd)
+}
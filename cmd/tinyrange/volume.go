@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/volume"
+)
+
+var (
+	volumeSize int
+	volumePath string
+)
+
+var volumeCmd = &cobra.Command{
+	Use:   "volume",
+	Short: "Manage persistent volumes that can be attached to virtual machines",
+}
+
+var volumeCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a new ext4 formatted volume",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		vol, err := volume.Create(rootBuildDir, args[0], volumeSize, volumePath)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\n", vol.Filename)
+
+		return nil
+	},
+}
+
+var volumeListCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List all volumes",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		volumes, err := volume.List(rootBuildDir)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+		fmt.Fprintf(w, "NAME\tSIZE\tCREATED\tFILENAME\n")
+
+		for _, vol := range volumes {
+			fmt.Fprintf(w, "%s\t%dmb\t%s\t%s\n", vol.Name, vol.SizeMB, vol.Created.Format("2006-01-02 15:04:05"), vol.Filename)
+		}
+
+		return w.Flush()
+	},
+}
+
+var volumeRemoveCmd = &cobra.Command{
+	Use:   "rm <name>...",
+	Short: "Remove volumes. Volumes stored at a host path are left on disk",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, name := range args {
+			if err := volume.Remove(rootBuildDir, name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	volumeCreateCmd.PersistentFlags().IntVar(&volumeSize, "size", 1024, "The size of the volume in megabytes.")
+	volumeCreateCmd.PersistentFlags().StringVar(&volumePath, "path", "", "Store the volume at a host path rather than in the build directory. Existing images are used as is.")
+
+	volumeCmd.AddCommand(volumeCreateCmd)
+	volumeCmd.AddCommand(volumeListCmd)
+	volumeCmd.AddCommand(volumeRemoveCmd)
+	rootCmd.AddCommand(volumeCmd)
+}
@@ -0,0 +1,235 @@
+// Package api is the Go API for embedding TinyRange in other programs.
+//
+// Each TinyRange has its own package database so several can be used in the
+// same process. Everything is configured with option structs rather than
+// flags or environment variables and long running operations take a
+// context.Context which stops them when it's cancelled.
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/database"
+	"github.com/tinyrange/tinyrange/pkg/tinyrange"
+)
+
+type Options struct {
+	// The directory for built definitions and temporary files (default:
+	// common.GetDefaultBuildDir()).
+	BuildDir string
+	// The HTTP/HTTPS address of a distribution server to copy build results
+	// from.
+	Distribution string
+	// Mirrors to use instead of the defaults keyed by mirror name.
+	Mirrors map[string][]string
+	// Rebuild user definitions even if they have been built before.
+	RebuildUserDefinitions bool
+	// Called as definitions are built and virtual machines run. May be called
+	// from multiple goroutines.
+	OnEvent common.EventHandler
+	// Where builds and virtual machines log messages (default:
+	// slog.Default()).
+	Logger *slog.Logger
+	// Print more details while building and ask the hypervisor to print
+	// more details about the guest.
+	Verbose bool
+}
+
+type BuildOptions struct {
+	// Build the definition even if there is a cached result.
+	AlwaysRebuild bool
+}
+
+type BuildResult struct {
+	Tag  string
+	Hash string
+	// The filename of the build result.
+	Filename string
+}
+
+type RunOptions struct {
+	// Connected to the hypervisor console. The output is discarded if nil.
+	Console io.ReadWriter
+}
+
+// InteractiveOptions configures RunInteractive. BuildDir, OnEvent and Logger
+// default to the options of the TinyRange.
+type InteractiveOptions = tinyrange.RunOptions
+
+type TinyRange struct {
+	opts Options
+	db   *database.PackageDatabase
+
+	// The database is not safe for concurrent use.
+	mtx sync.Mutex
+}
+
+// Database returns the underlying package database. Callers must not use it
+// concurrently with Build or Query.
+func (tr *TinyRange) Database() *database.PackageDatabase {
+	return tr.db
+}
+
+// Build builds a definition given in the same format as tinyrange build.
+func (tr *TinyRange) Build(ctx context.Context, definition string, opts BuildOptions) (*BuildResult, error) {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+
+	macroCtx := tr.db.NewMacroContext()
+
+	macro, err := tr.db.GetMacroByShorthand(macroCtx, definition)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := macro.Call(macroCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	def, ok := ret.(common.BuildDefinition)
+	if !ok {
+		return nil, fmt.Errorf("could not convert %T to BuildDefinition", ret)
+	}
+
+	return tr.buildDefinition(ctx, def, opts)
+}
+
+// BuildDefinition builds a definition created with the builder package.
+func (tr *TinyRange) BuildDefinition(ctx context.Context, def common.BuildDefinition, opts BuildOptions) (*BuildResult, error) {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+
+	return tr.buildDefinition(ctx, def, opts)
+}
+
+func (tr *TinyRange) buildDefinition(ctx context.Context, def common.BuildDefinition, opts BuildOptions) (*BuildResult, error) {
+	if _, err := tr.db.Build(tr.db.NewBuildContextWithContext(ctx, def), def, common.BuildOptions{
+		AlwaysRebuild: opts.AlwaysRebuild,
+	}); err != nil {
+		return nil, err
+	}
+
+	hash, err := tr.db.HashDefinition(def)
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err := tr.db.FilenameFromHash(hash, ".bin")
+	if err != nil {
+		return nil, err
+	}
+
+	return &BuildResult{Tag: def.Tag(), Hash: hash, Filename: filename}, nil
+}
+
+// Query searches a container builder (for example alpine@3.20) for packages
+// matching query. Takes the same query syntax as tinyrange query.
+func (tr *TinyRange) Query(ctx context.Context, builder string, query string) ([]string, error) {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+
+	q, err := common.ParsePackageQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	q.MatchDirect = true
+	q.MatchPartialName = true
+
+	b, err := tr.db.GetContainerBuilder(tr.db.NewBuildContextWithContext(ctx, nil), builder, config.HostArchitecture)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := b.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, result := range results {
+		ret = append(ret, result.String())
+	}
+
+	return ret, nil
+}
+
+// RunVM runs a virtual machine until the hypervisor exits. When ctx is
+// cancelled the guest is shutdown and the error of the context is returned.
+func (tr *TinyRange) RunVM(ctx context.Context, cfg config.TinyRangeConfig, opts RunOptions) error {
+	return tinyrange.RunHeadless(ctx, cfg, tinyrange.HeadlessOptions{
+		BuildDir: tr.opts.BuildDir,
+		Console:  opts.Console,
+		OnEvent:  tr.opts.OnEvent,
+		Logger:   tr.opts.Logger,
+		Verbose:  tr.opts.Verbose,
+	})
+}
+
+// RunInteractive runs a virtual machine using the interaction from cfg (ssh,
+// vnc or serial) connected to the terminal of the process. Returns when the
+// session ends or after the guest is shutdown because ctx was cancelled.
+func (tr *TinyRange) RunInteractive(ctx context.Context, cfg config.TinyRangeConfig, opts InteractiveOptions) error {
+	if opts.BuildDir == "" {
+		opts.BuildDir = tr.opts.BuildDir
+	}
+
+	if opts.OnEvent == nil {
+		opts.OnEvent = tr.opts.OnEvent
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = tr.opts.Logger
+	}
+
+	opts.Verbose = opts.Verbose || tr.opts.Verbose
+
+	return tinyrange.RunWithConfig(ctx, cfg, opts)
+}
+
+// New creates a TinyRange and loads the builtin builders.
+func New(opts Options) (*TinyRange, error) {
+	if opts.BuildDir == "" {
+		opts.BuildDir = common.GetDefaultBuildDir()
+	}
+
+	db := database.New(opts.BuildDir)
+
+	db.RebuildUserDefinitions = opts.RebuildUserDefinitions
+	db.OnEvent = opts.OnEvent
+	db.Logger = opts.Logger
+	db.Verbose = opts.Verbose
+
+	if opts.Distribution != "" {
+		if err := db.SetDistributionServer(opts.Distribution); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check with Exists first so it doesn't have issues if the build dir is behind a symlink.
+	if ok, _ := common.Exists(opts.BuildDir); !ok {
+		if err := common.Ensure(opts.BuildDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.LoadBuiltinBuilders(); err != nil {
+		return nil, err
+	}
+
+	for name, urls := range opts.Mirrors {
+		if err := db.AddMirror(name, urls); err != nil {
+			return nil, err
+		}
+	}
+
+	return &TinyRange{opts: opts, db: db}, nil
+}
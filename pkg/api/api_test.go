@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/builder"
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+// Records events passed to the handler.
+type eventLog struct {
+	mtx    sync.Mutex
+	events []common.Event
+}
+
+func (l *eventLog) handle(ev common.Event) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.events = append(l.events, ev)
+}
+
+func (l *eventLog) kinds() []common.EventKind {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	var ret []common.EventKind
+	for _, ev := range l.events {
+		ret = append(ret, ev.Kind)
+	}
+
+	return ret
+}
+
+func newTestTinyRange(t *testing.T) (*TinyRange, *eventLog, *bytes.Buffer) {
+	t.Helper()
+
+	events := &eventLog{}
+	var logs bytes.Buffer
+
+	tr, err := New(Options{
+		BuildDir: filepath.Join(t.TempDir(), "build"),
+		OnEvent:  events.handle,
+		Logger:   slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Verbose:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tr, events, &logs
+}
+
+func constantDefinition(name string, contents string) *builder.ConstantHashDefinition {
+	return builder.NewConstantHashDefinition(name, func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(contents)), nil
+	})
+}
+
+func TestNew(t *testing.T) {
+	tr, _, _ := newTestTinyRange(t)
+
+	if ok, _ := common.Exists(tr.opts.BuildDir); !ok {
+		t.Fatalf("expected the build directory %s to be created", tr.opts.BuildDir)
+	}
+
+	db := tr.Database()
+
+	if db.GetLogger() != tr.opts.Logger {
+		t.Fatal("expected the database to use the logger from the options")
+	}
+
+	if !db.IsVerbose() {
+		t.Fatal("expected the database to be verbose")
+	}
+}
+
+func TestBuildDefinition(t *testing.T) {
+	// Nothing should be logged through the default logger.
+	var defaultLogs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&defaultLogs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(previous)
+
+	tr, events, logs := newTestTinyRange(t)
+
+	def := constantDefinition("hello", "hello world")
+
+	result, err := tr.BuildDefinition(context.Background(), def, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(result.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != "hello world" {
+		t.Fatalf("unexpected build result: %q", contents)
+	}
+
+	if result.Tag != "hello" || result.Hash == "" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// The second build uses the cached result.
+	again, err := tr.BuildDefinition(context.Background(), def, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *again != *result {
+		t.Fatalf("expected the cached result %+v, got %+v", result, again)
+	}
+
+	got := events.kinds()
+	expected := []common.EventKind{common.EventBuildStarted, common.EventBuildFinished}
+	if len(got) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, got)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "building") {
+		t.Fatalf("expected the build to be logged, got %q", logs.String())
+	}
+
+	if defaultLogs.Len() != 0 {
+		t.Fatalf("expected nothing to be logged to the default logger, got %q", defaultLogs.String())
+	}
+}
+
+func TestBuildCancelled(t *testing.T) {
+	tr, events, _ := newTestTinyRange(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := tr.BuildDefinition(ctx, constantDefinition("cancelled", ""), BuildOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if got := events.kinds(); len(got) != 0 {
+		t.Fatalf("expected no events, got %v", got)
+	}
+}
+
+func TestBuildFailed(t *testing.T) {
+	tr, events, _ := newTestTinyRange(t)
+
+	def := builder.NewConstantHashDefinition("failing", func() (io.ReadCloser, error) {
+		return nil, errors.New("no contents")
+	})
+
+	if _, err := tr.BuildDefinition(context.Background(), def, BuildOptions{}); err == nil || !strings.Contains(err.Error(), "no contents") {
+		t.Fatalf("expected the build error, got %v", err)
+	}
+
+	got := events.kinds()
+	if len(got) != 2 || got[0] != common.EventBuildStarted || got[1] != common.EventBuildFailed {
+		t.Fatalf("expected a started and failed event, got %v", got)
+	}
+
+	// The failure can be matched with the build that started.
+	started, failed := events.events[0], events.events[1]
+	if failed.Hash == "" || failed.Hash != started.Hash || failed.Parent != started.Parent || failed.Error == "" {
+		t.Fatalf("expected the failed event to match %+v, got %+v", started, failed)
+	}
+}
@@ -1,9 +1,9 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log/slog"
 	"os"
 
 	"github.com/tinyrange/tinyrange/pkg/common"
@@ -13,6 +13,7 @@ import (
 )
 
 type BuildContext struct {
+	ctx      context.Context
 	source   common.BuildSource
 	database common.PackageDatabase
 	parent   *BuildContext
@@ -21,6 +22,7 @@ type BuildContext struct {
 
 	filename  string
 	output    io.WriteCloser
+	log       io.Writer
 	inMemory  bool
 	hasCached bool
 }
@@ -41,6 +43,25 @@ func (b *BuildContext) DisplayTree() {
 	dumpContext(b, "")
 }
 
+// Context implements common.BuildContext.
+func (b *BuildContext) Context() context.Context {
+	return b.ctx
+}
+
+// Log implements common.BuildContext.
+func (b *BuildContext) Log() io.Writer {
+	if b.log == nil {
+		return io.Discard
+	}
+
+	return b.log
+}
+
+// SetLog implements common.BuildContext.
+func (b *BuildContext) SetLog(w io.Writer) {
+	b.log = w
+}
+
 // SetHasCached implements common.BuildContext.
 func (b *BuildContext) SetHasCached() {
 	b.hasCached = true
@@ -96,6 +117,7 @@ func (b *BuildContext) Database() common.PackageDatabase {
 
 func (b *BuildContext) ChildContext(source common.BuildSource, status *common.BuildStatus, filename string) common.BuildContext {
 	ctx := &BuildContext{
+		ctx:      b.ctx,
 		parent:   b,
 		filename: filename,
 		output:   nil,
@@ -262,10 +284,18 @@ func (ctx *BuildContext) Call(filename string, builder string, args ...starlark.
 		return starlark.None, fmt.Errorf("failed to GetBuilder in BuildContext.Call: %s", err)
 	}
 
-	result, err := starlark.Call(ctx.database.NewThread(filename), target, append(starlark.Tuple{ctx}, args...), []starlark.Tuple{})
+	thread := ctx.database.NewThread(filename)
+
+	// Keep anything the builder prints in the build log.
+	thread.Print = func(thread *starlark.Thread, msg string) {
+		fmt.Fprintln(os.Stderr, msg)
+		fmt.Fprintln(ctx.Log(), msg)
+	}
+
+	result, err := starlark.Call(thread, target, append(starlark.Tuple{ctx}, args...), []starlark.Tuple{})
 	if err != nil {
 		if sErr, ok := err.(*starlark.EvalError); ok {
-			slog.Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
+			ctx.database.GetLogger().Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
 		}
 		return starlark.None, err
 	}
@@ -286,5 +316,11 @@ var (
 )
 
 func NewBuildContext(source common.BuildSource, db common.PackageDatabase) *BuildContext {
-	return &BuildContext{source: source, database: db}
+	return NewBuildContextWithContext(context.Background(), source, db)
+}
+
+// NewBuildContextWithContext creates a BuildContext whose builds stop when ctx
+// is cancelled.
+func NewBuildContextWithContext(ctx context.Context, source common.BuildSource, db common.PackageDatabase) *BuildContext {
+	return &BuildContext{ctx: ctx, source: source, database: db}
 }
@@ -2,7 +2,6 @@ package builder
 
 import (
 	"fmt"
-	"log/slog"
 	"strings"
 	"time"
 
@@ -111,7 +110,7 @@ func (def *BuildEmulatorDefinition) Build(ctx common.BuildContext) (common.Build
 
 	// Run each command in the emulator.
 	for _, command := range commands {
-		slog.Debug("emulator", "run", command)
+		ctx.Database().GetLogger().Debug("emulator", "run", command)
 		if err := emu.RunShell(command); err != nil {
 			return nil, fmt.Errorf("failed to run command in emulator [%+v]: %s", command, err)
 		}
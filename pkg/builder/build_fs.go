@@ -2,19 +2,30 @@ package builder
 
 import (
 	"archive/tar"
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
 	"github.com/tinyrange/tinyrange/pkg/cpio"
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/fat16"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/gpt"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/squashfs"
 	"github.com/tinyrange/tinyrange/pkg/hash"
 	initExec "github.com/tinyrange/tinyrange/pkg/init"
+	"github.com/tinyrange/vm"
 	"go.starlark.net/starlark"
 )
 
@@ -32,6 +43,12 @@ func toTarTypeFlag(flag filesystem.FileType) byte {
 		return tar.TypeSymlink
 	case filesystem.TypeLink:
 		return tar.TypeLink
+	case filesystem.TypeCharDevice:
+		return tar.TypeChar
+	case filesystem.TypeBlockDevice:
+		return tar.TypeBlock
+	case filesystem.TypeFifo:
+		return tar.TypeFifo
 	default:
 		panic(fmt.Sprintf("unimplemented type: %s", flag))
 	}
@@ -140,17 +157,29 @@ func (i *tarBuilderResult) WriteResult(w io.Writer) error {
 					continue
 				}
 
+				// Tar has no type for sockets. They are skipped like GNU tar
+				// does.
+				if ent.Typeflag() == filesystem.TypeSocket {
+					continue
+				}
+
+				xattrs, err := filesystem.GetXattrs(ent)
+				if err != nil {
+					return err
+				}
+
 				if err := writer.WriteHeader(&tar.Header{
-					Typeflag: toTarTypeFlag(ent.Typeflag()),
-					Name:     name,
-					Linkname: ent.Linkname(),
-					Size:     ent.Size(),
-					Mode:     int64(ent.Mode()),
-					Uid:      ent.Uid(),
-					Gid:      ent.Gid(),
-					ModTime:  ent.ModTime(),
-					Devmajor: ent.Devmajor(),
-					Devminor: ent.Devminor(),
+					Typeflag:   toTarTypeFlag(ent.Typeflag()),
+					Name:       name,
+					Linkname:   ent.Linkname(),
+					Size:       ent.Size(),
+					Mode:       int64(ent.Mode()),
+					Uid:        ent.Uid(),
+					Gid:        ent.Gid(),
+					ModTime:    ent.ModTime(),
+					Devmajor:   ent.Devmajor(),
+					Devminor:   ent.Devminor(),
+					PAXRecords: filesystem.XattrsToPAX(xattrs),
 				}); err != nil {
 					return err
 				}
@@ -257,6 +286,582 @@ var (
 	_ common.BuildResult = &tarBuilderResult{}
 )
 
+// squashfsImage tracks the entries written to a squashfs image so parents can
+// be created on demand and duplicate entries are skipped like the tar builder.
+type squashfsImage struct {
+	writer  *squashfs.Writer
+	written map[string]bool
+
+	// Hard links are added last since their target may come later.
+	links [][2]string
+}
+
+func (img *squashfsImage) mkdirAll(name string) error {
+	if name == "/" || img.written[name] {
+		return nil
+	}
+
+	if err := img.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+
+	if err := img.writer.Mkdir(name, squashfs.Header{
+		Mode:    fs.ModeDir | 0755,
+		ModTime: time.UnixMilli(0),
+	}); err != nil {
+		return err
+	}
+
+	img.written[name] = true
+
+	return nil
+}
+
+// reserve returns false if name has already been written. Otherwise the
+// parents of name are created.
+func (img *squashfsImage) reserve(name string) (bool, error) {
+	if img.written[name] {
+		return false, nil
+	}
+
+	if err := img.mkdirAll(path.Dir(name)); err != nil {
+		return false, err
+	}
+
+	img.written[name] = true
+
+	return true, nil
+}
+
+func (img *squashfsImage) addEntry(prefix string, ent filesystem.Entry) error {
+	name := path.Clean(path.Join("/", prefix, ent.Name()))
+
+	// Directories created as parents take the metadata of the real entry.
+	if ent.Typeflag() == filesystem.TypeDirectory {
+		if err := img.mkdirAll(path.Dir(name)); err != nil {
+			return err
+		}
+	} else if ok, err := img.reserve(name); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	xattrs, err := filesystem.GetXattrs(ent)
+	if err != nil {
+		return err
+	}
+
+	hdr := squashfs.Header{
+		Mode:    ent.Mode() &^ fs.ModeType,
+		Uid:     uint32(ent.Uid()),
+		Gid:     uint32(ent.Gid()),
+		ModTime: ent.ModTime(),
+		Xattrs:  xattrs,
+	}
+
+	switch ent.Typeflag() {
+	case filesystem.TypeDirectory:
+		hdr.Mode |= fs.ModeDir
+
+		img.written[name] = true
+
+		return img.writer.Mkdir(name, hdr)
+	case filesystem.TypeRegular:
+		fh, err := ent.Open()
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+
+		return img.writer.CreateFile(name, hdr, fh)
+	case filesystem.TypeSymlink:
+		hdr.Mode |= fs.ModeSymlink
+
+		return img.writer.Symlink(name, ent.Linkname(), hdr)
+	case filesystem.TypeLink:
+		img.links = append(img.links, [2]string{name, path.Join("/", prefix, ent.Linkname())})
+
+		return nil
+	case filesystem.TypeCharDevice:
+		hdr.Mode |= fs.ModeDevice | fs.ModeCharDevice
+	case filesystem.TypeBlockDevice:
+		hdr.Mode |= fs.ModeDevice
+	case filesystem.TypeFifo:
+		hdr.Mode |= fs.ModeNamedPipe
+	case filesystem.TypeSocket:
+		hdr.Mode |= fs.ModeSocket
+	default:
+		return fmt.Errorf("unimplemented type: %s", ent.Typeflag())
+	}
+
+	return img.writer.Mknod(name, hdr, uint32(ent.Devmajor()), uint32(ent.Devminor()))
+}
+
+func (img *squashfsImage) addFile(name string, contents []byte, executable bool) error {
+	name = path.Clean("/" + name)
+
+	if ok, err := img.reserve(name); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
+	var mode fs.FileMode = 0644
+
+	if executable {
+		mode = 0755
+	}
+
+	return img.writer.CreateFile(name, squashfs.Header{
+		Mode:    mode,
+		ModTime: time.UnixMilli(0),
+	}, bytes.NewReader(contents))
+}
+
+type squashfsBuilderResult struct {
+	frags       []config.Fragment
+	compression squashfs.Compression
+}
+
+// WriteTo implements common.BuildResult.
+func (s *squashfsBuilderResult) WriteResult(w io.Writer) error {
+	// The superblock is written last so the image has to be seekable.
+	out, ok := w.(io.WriteSeeker)
+	if !ok {
+		return fmt.Errorf("squashfs images can only be written to a seekable file")
+	}
+
+	writer, err := squashfs.NewWriter(out, squashfs.Options{
+		Compression: s.compression,
+		ModTime:     time.UnixMilli(0),
+	})
+	if err != nil {
+		return err
+	}
+
+	img := &squashfsImage{writer: writer, written: make(map[string]bool)}
+
+	for _, frag := range s.frags {
+		if frag.Archive != nil {
+			f := filesystem.NewLocalFile(frag.Archive.HostFilename, nil)
+
+			ark, err := filesystem.ReadArchiveFromFile(f)
+			if err != nil {
+				return err
+			}
+
+			ents, err := ark.Entries()
+			if err != nil {
+				return err
+			}
+
+			for _, ent := range ents {
+				if err := img.addEntry(frag.Archive.Target, ent); err != nil {
+					return fmt.Errorf("failed to add %s: %w", ent.Name(), err)
+				}
+			}
+		} else if frag.FileContents != nil {
+			c := frag.FileContents
+
+			if err := img.addFile(c.GuestFilename, c.Contents, c.Executable); err != nil {
+				return fmt.Errorf("failed to add simple file: %s: %w", c.GuestFilename, err)
+			}
+		} else if frag.Builtin != nil {
+			c := frag.Builtin
+
+			if c.Name == "init" {
+				buf, err := initExec.GetInitExecutable(c.Architecture)
+				if err != nil {
+					return err
+				}
+
+				if err := img.addFile(c.GuestFilename, buf, true); err != nil {
+					return fmt.Errorf("failed to add simple file: %s: %w", c.GuestFilename, err)
+				}
+			} else {
+				return fmt.Errorf("unhandled builtin: %s", c.Name)
+			}
+		} else {
+			return fmt.Errorf("unhandled fragment type: %+v", frag)
+		}
+	}
+
+	for _, link := range img.links {
+		if err := img.writer.Link(link[0], link[1]); err != nil {
+			return fmt.Errorf("failed to add hard link %s: %w", link[0], err)
+		}
+	}
+
+	return writer.Close()
+}
+
+var (
+	_ common.BuildResult = &squashfsBuilderResult{}
+)
+
+// parseSquashfsKind returns the compression for a squashfs kind. The kind is
+// squashfs optionally followed by the compression like squashfs.zstd.
+func parseSquashfsKind(kind string) (squashfs.Compression, bool, error) {
+	if kind == "squashfs" {
+		return squashfs.CompressionGzip, true, nil
+	}
+
+	name, ok := strings.CutPrefix(kind, "squashfs.")
+	if !ok {
+		return 0, false, nil
+	}
+
+	compression, err := squashfs.ParseCompression(name)
+	if err != nil {
+		return 0, true, err
+	}
+
+	return compression, true, nil
+}
+
+// fragmentsToDirectory extracts frags into a new in memory directory. Like the
+// root filesystem of a virtual machine later fragments replace earlier ones.
+func fragmentsToDirectory(frags []config.Fragment) (filesystem.MutableDirectory, error) {
+	root := filesystem.NewMemoryDirectory()
+
+	for _, frag := range frags {
+		if err := filesystem.ApplyFragment(root, frag, filesystem.FragmentOptions{
+			Builtin: initExec.BuiltinFile,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return root, nil
+}
+
+// Pick the size of a ext4 image holding dir. Like the root filesystem of a
+// virtual machine there is space left over for metadata and new files.
+func defaultExt4Size(dir filesystem.Directory) (int64, error) {
+	const increment = 128 * 1024 * 1024
+
+	total, err := filesystem.GetTotalSize(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	size := (int64(float64(total)*1.5)/increment + 1) * increment
+
+	return size, nil
+}
+
+func buildExt4Image(dir filesystem.Directory, size int64, id uuid.UUID, journal bool) (*vm.VirtualMemory, error) {
+	vmem := vm.NewVirtualMemory(size, 4096)
+
+	fs, err := ext4.CreateExt4Filesystem(vmem, 0, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ext4 filesystem: %w", err)
+	}
+
+	if journal {
+		if ext4.DefaultJournalBlocks(size/4096) == 0 {
+			return nil, fmt.Errorf("ext4 image of %d bytes is too small for a journal", size)
+		}
+
+		if err := fs.AddJournal(ext4.JournalOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to create journal: %w", err)
+		}
+	}
+
+	if err := fs.MakeDeterministic(id, time.UnixMilli(0)); err != nil {
+		return nil, err
+	}
+
+	if err := filesystem.CopyToExt4(dir, fs); err != nil {
+		return nil, fmt.Errorf("failed to convert filesystem to ext4: %w", err)
+	}
+
+	return vmem, nil
+}
+
+type ext4BuilderResult struct {
+	frags   []config.Fragment
+	size    int64
+	id      uuid.UUID
+	journal bool
+}
+
+// WriteTo implements common.BuildResult.
+func (e *ext4BuilderResult) WriteResult(w io.Writer) error {
+	root, err := fragmentsToDirectory(e.frags)
+	if err != nil {
+		return err
+	}
+
+	size := e.size
+	if size == 0 {
+		size, err = defaultExt4Size(root)
+		if err != nil {
+			return err
+		}
+	}
+
+	vmem, err := buildExt4Image(root, size, e.id, e.journal)
+	if err != nil {
+		return err
+	}
+
+	if f, ok := w.(*os.File); ok {
+		return common.WriteSparse(f, vmem, size)
+	}
+
+	if _, err := io.Copy(w, io.NewSectionReader(vmem, 0, size)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var (
+	_ common.BuildResult = &ext4BuilderResult{}
+)
+
+// The EFI system partition is populated from this directory.
+const espMountpoint = "boot/efi"
+
+func copyToFat(dir filesystem.Directory, w *fat16.Fat16Writer, name string) error {
+	ents, err := dir.Readdir()
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range ents {
+		info, err := ent.File.Stat()
+		if err != nil {
+			return err
+		}
+
+		name := path.Join(name, ent.Name)
+
+		switch info.Kind() {
+		case filesystem.TypeDirectory:
+			if err := w.Mkdir(name); err != nil {
+				return err
+			}
+
+			child, ok := ent.File.(filesystem.Directory)
+			if !ok {
+				return fmt.Errorf("directory does not implement Directory: %T", ent.File)
+			}
+
+			if err := copyToFat(child, w, name); err != nil {
+				return err
+			}
+		case filesystem.TypeRegular:
+			fh, err := ent.File.Open()
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+
+			contents, err := io.ReadAll(fh)
+			if err != nil {
+				return err
+			}
+
+			if err := w.AddFile(name, contents); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: %s can not be stored in a FAT filesystem", name, info.Kind())
+		}
+	}
+
+	return nil
+}
+
+type fatBuilderResult struct {
+	frags []config.Fragment
+	opts  fat16.Options
+}
+
+// WriteTo implements common.BuildResult.
+func (f *fatBuilderResult) WriteResult(w io.Writer) error {
+	root, err := fragmentsToDirectory(f.frags)
+	if err != nil {
+		return err
+	}
+
+	fs := fat16.NewWriter("", f.opts)
+
+	if err := copyToFat(root, fs, ""); err != nil {
+		return err
+	}
+
+	if _, err := fs.WriteTo(w); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var (
+	_ common.BuildResult = &fatBuilderResult{}
+)
+
+func parseFatKind(kind string) (fat16.Format, bool) {
+	switch kind {
+	case "fat":
+		return fat16.FormatAuto, true
+	case "fat16":
+		return fat16.FormatFat16, true
+	case "fat32":
+		return fat16.FormatFat32, true
+	default:
+		return 0, false
+	}
+}
+
+// FAT volume IDs are derived from the image UUID so they are reproducible.
+func fatVolumeId(id uuid.UUID) uint32 {
+	return binary.LittleEndian.Uint32(id[:4])
+}
+
+// Move the contents of /boot/efi in root into a FAT32 filesystem for the EFI
+// system partition. The directory is left empty as a mount point.
+func extractEsp(root filesystem.MutableDirectory, opts fat16.Options) (*fat16.Fat16Writer, error) {
+	w := fat16.NewWriter("ESP", opts)
+
+	ent, err := filesystem.OpenPath(root, espMountpoint)
+	if errors.Is(err, fs.ErrNotExist) {
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dir, ok := ent.File.(filesystem.Directory)
+	if !ok {
+		return nil, fmt.Errorf("/%s is not a directory", espMountpoint)
+	}
+
+	if err := copyToFat(dir, w, ""); err != nil {
+		return nil, fmt.Errorf("failed to build EFI system partition: %w", err)
+	}
+
+	parent, err := filesystem.Mkdir(root, path.Dir(espMountpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := parent.Unlink(path.Base(espMountpoint)); err != nil {
+		return nil, err
+	}
+
+	if _, err := parent.Mkdir(path.Base(espMountpoint)); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func alignUp(val int64, alignment int64) int64 {
+	return (val + alignment - 1) / alignment * alignment
+}
+
+// gptBuilderResult writes a raw disk image with a GPT partition table. The
+// first partition is a EFI system partition holding /boot/efi and the second
+// is a ext4 root filesystem.
+type gptBuilderResult struct {
+	frags       []config.Fragment
+	size        int64
+	clusterSize uint32
+	id          uuid.UUID
+	journal     bool
+}
+
+// WriteTo implements common.BuildResult.
+func (g *gptBuilderResult) WriteResult(w io.Writer) error {
+	// The partitions are written in place so the image has to be seekable.
+	out, ok := w.(io.WriterAt)
+	if !ok {
+		return fmt.Errorf("disk images can only be written to a seekable file")
+	}
+
+	root, err := fragmentsToDirectory(g.frags)
+	if err != nil {
+		return err
+	}
+
+	esp, err := extractEsp(root, fat16.Options{
+		Format:      fat16.FormatFat32,
+		ClusterSize: g.clusterSize,
+		VolumeId:    fatVolumeId(uuid.NewSHA1(g.id, []byte("esp"))),
+	})
+	if err != nil {
+		return err
+	}
+
+	var espImage bytes.Buffer
+	if _, err := esp.WriteTo(&espImage); err != nil {
+		return err
+	}
+
+	espStart := int64(gpt.ALIGNMENT)
+	espSize := alignUp(int64(espImage.Len()), gpt.ALIGNMENT)
+
+	rootStart := espStart + espSize
+
+	diskSize := g.size
+	if diskSize == 0 {
+		rootSize, err := defaultExt4Size(root)
+		if err != nil {
+			return err
+		}
+
+		// Leave a aligned gap at the end for the backup partition table.
+		diskSize = rootStart + rootSize + gpt.ALIGNMENT
+	}
+
+	rootSize := (gpt.LastUsableOffset(diskSize) - rootStart) / gpt.ALIGNMENT * gpt.ALIGNMENT
+	if rootSize <= 0 {
+		return fmt.Errorf("disk size of %d bytes is too small to hold the partitions", diskSize)
+	}
+
+	vmem, err := buildExt4Image(root, rootSize, g.id, g.journal)
+	if err != nil {
+		return err
+	}
+
+	if err := gpt.Write(out, diskSize, uuid.NewSHA1(g.id, []byte("disk")), []gpt.Partition{
+		{
+			Type:  gpt.TYPE_EFI_SYSTEM,
+			GUID:  uuid.NewSHA1(g.id, []byte("esp")),
+			Name:  "EFI System Partition",
+			Start: espStart,
+			Size:  espSize,
+		},
+		{
+			Type:  gpt.TYPE_LINUX_FILESYSTEM,
+			GUID:  uuid.NewSHA1(g.id, []byte("root")),
+			Name:  "root",
+			Start: rootStart,
+			Size:  rootSize,
+		},
+	}); err != nil {
+		return err
+	}
+
+	if _, err := out.WriteAt(espImage.Bytes(), espStart); err != nil {
+		return err
+	}
+
+	if err := common.WriteSparseAt(out, vmem, rootStart, rootSize); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var (
+	_ common.BuildResult = &gptBuilderResult{}
+)
+
 type BuildFsDefinition struct {
 	params BuildFsParameters
 
@@ -286,6 +891,11 @@ func (def *BuildFsDefinition) ToStarlark(ctx common.BuildContext, result filesys
 	return filesystem.NewStarFile(result, def.Tag()), nil
 }
 
+// Images get UUIDs derived from the definition so they are reproducible.
+func (def *BuildFsDefinition) imageId() uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(def.Tag()))
+}
+
 // Build implements common.BuildDefinition.
 func (def *BuildFsDefinition) Build(ctx common.BuildContext) (common.BuildResult, error) {
 	// Launch child builds for each directive.
@@ -302,6 +912,34 @@ func (def *BuildFsDefinition) Build(ctx common.BuildContext) (common.BuildResult
 		return &initRamFsBuilderResult{frags: def.frags}, nil
 	} else if def.params.Kind == "tar" {
 		return &tarBuilderResult{frags: def.frags}, nil
+	} else if def.params.Kind == "ext4" {
+		return &ext4BuilderResult{
+			frags:   def.frags,
+			size:    int64(def.params.Size) * 1024 * 1024,
+			id:      def.imageId(),
+			journal: def.params.Journal,
+		}, nil
+	} else if def.params.Kind == "gpt" {
+		return &gptBuilderResult{
+			frags:       def.frags,
+			size:        int64(def.params.Size) * 1024 * 1024,
+			clusterSize: uint32(def.params.ClusterSize),
+			id:          def.imageId(),
+			journal:     def.params.Journal,
+		}, nil
+	} else if format, ok := parseFatKind(def.params.Kind); ok {
+		return &fatBuilderResult{frags: def.frags, opts: fat16.Options{
+			Format:      format,
+			ClusterSize: uint32(def.params.ClusterSize),
+			Size:        int64(def.params.Size) * 1024 * 1024,
+			VolumeId:    fatVolumeId(def.imageId()),
+		}}, nil
+	} else if compression, ok, err := parseSquashfsKind(def.params.Kind); ok {
+		if err != nil {
+			return nil, err
+		}
+
+		return &squashfsBuilderResult{frags: def.frags, compression: compression}, nil
 	} else {
 		return nil, fmt.Errorf("kind not implemented: %s", def.params.Kind)
 	}
@@ -327,6 +965,18 @@ func (def *BuildFsDefinition) Tag() string {
 
 	out = append(out, def.params.Kind)
 
+	if def.params.Size != 0 {
+		out = append(out, fmt.Sprintf("%dMB", def.params.Size))
+	}
+
+	if def.params.ClusterSize != 0 {
+		out = append(out, fmt.Sprintf("%dB", def.params.ClusterSize))
+	}
+
+	if def.params.Journal {
+		out = append(out, "journal")
+	}
+
 	return strings.Join(out, "_")
 }
 
@@ -343,6 +993,18 @@ var (
 	_ common.BuildDefinition = &BuildFsDefinition{}
 )
 
-func NewBuildFsDefinition(dir []common.Directive, kind string) *BuildFsDefinition {
-	return &BuildFsDefinition{params: BuildFsParameters{Directives: dir, Kind: kind}}
+func NewBuildFsDefinition(
+	dir []common.Directive,
+	kind string,
+	size int,
+	clusterSize int,
+	journal bool,
+) *BuildFsDefinition {
+	return &BuildFsDefinition{params: BuildFsParameters{
+		Directives:  dir,
+		Kind:        kind,
+		Size:        size,
+		ClusterSize: clusterSize,
+		Journal:     journal,
+	}}
 }
@@ -0,0 +1,172 @@
+package builder
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/fat16"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/gpt"
+	"github.com/tinyrange/tinyrange/pkg/internal/fscktest"
+)
+
+const EXT4_FEATURE_COMPAT_HAS_JOURNAL = 0x4
+
+var testFragments = []config.Fragment{
+	{FileContents: &config.FileContentsFragment{GuestFilename: "/etc/motd", Contents: []byte("hello\n")}},
+	{FileContents: &config.FileContentsFragment{GuestFilename: "/boot/efi/EFI/BOOT/BOOTX64.EFI", Contents: []byte("MZ")}},
+}
+
+func writeResult(t *testing.T, result common.BuildResult) string {
+	filename := filepath.Join(t.TempDir(), "image")
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := result.WriteResult(f); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func readGuestFile(t *testing.T, dir filesystem.Directory, name string) string {
+	ent, err := filesystem.OpenPath(dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err := ent.File.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	contents, err := io.ReadAll(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(contents)
+}
+
+func TestExt4Image(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		filename := writeResult(t, &ext4BuilderResult{
+			frags:   testFragments,
+			id:      uuid.NewSHA1(uuid.Nil, []byte("test")),
+			journal: journal,
+		})
+
+		fscktest.Check(t, filename)
+
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		sb := make([]byte, 1024)
+		if _, err := f.ReadAt(sb, 1024); err != nil {
+			t.Fatal(err)
+		}
+
+		if compat := binary.LittleEndian.Uint32(sb[0x5C:]); (compat&EXT4_FEATURE_COMPAT_HAS_JOURNAL != 0) != journal {
+			t.Fatalf("journal=%v but compatible features are %x", journal, compat)
+		}
+
+		root, err := filesystem.OpenExt4Image(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readGuestFile(t, root, "etc/motd"); got != "hello\n" {
+			t.Fatalf("unexpected contents of /etc/motd: %q", got)
+		}
+	}
+}
+
+func TestExt4ImageTooSmallForJournal(t *testing.T) {
+	err := (&ext4BuilderResult{frags: testFragments, size: 4 * 1024 * 1024, journal: true}).WriteResult(io.Discard)
+	if err == nil {
+		t.Fatal("expected a error for a journal on a 4MB image")
+	}
+}
+
+func TestGptImage(t *testing.T) {
+	filename := writeResult(t, &gptBuilderResult{
+		frags: testFragments,
+		id:    uuid.NewSHA1(uuid.Nil, []byte("test")),
+	})
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries := make([]byte, 2*gpt.ENTRY_SIZE)
+	if _, err := f.ReadAt(entries, 2*gpt.SECTOR_SIZE); err != nil {
+		t.Fatal(err)
+	}
+
+	partition := func(i int) *io.SectionReader {
+		entry := entries[i*gpt.ENTRY_SIZE:]
+
+		first := int64(binary.LittleEndian.Uint64(entry[32:]))
+		last := int64(binary.LittleEndian.Uint64(entry[40:]))
+
+		return io.NewSectionReader(f, first*gpt.SECTOR_SIZE, (last-first+1)*gpt.SECTOR_SIZE)
+	}
+
+	esp, err := fat16.OpenReader(partition(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if esp.Format() != fat16.FormatFat32 {
+		t.Fatalf("expected a FAT32 ESP, got %s", esp.Format())
+	}
+
+	ent := esp.Root()
+	for _, name := range []string{"EFI", "BOOT", "BOOTX64.EFI"} {
+		children, err := esp.ReadDir(ent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, child := range children {
+			if child.Name == name {
+				ent = child
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("%s not found in the ESP", name)
+		}
+	}
+
+	if ent.Size != 2 {
+		t.Fatalf("unexpected size of BOOTX64.EFI: %d", ent.Size)
+	}
+
+	root, err := filesystem.OpenExt4Image(partition(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readGuestFile(t, root, "etc/motd"); got != "hello\n" {
+		t.Fatalf("unexpected contents of /etc/motd: %q", got)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -27,14 +26,24 @@ func init() {
 var OFFICIAL_KERNEL_URL_X86_64 = "https://github.com/tinyrange/linux_build/releases/download/linux_x86_6.6.7/vmlinux_x86_64"
 var OFFICIAL_KERNEL_URL_AARCH64 = "https://github.com/tinyrange/linux_build/releases/download/linux_arm64_6.6.7/vmlinux_arm64"
 
-func runTinyRange(exe string, configFilename string) (*exec.Cmd, error) {
-	cmd := exec.Command(exe, "run-vm", configFilename)
+func runTinyRange(ctx common.BuildContext, exe string, configFilename string) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx.Context(), exe, "run-vm", configFilename)
 
+	// When the build is cancelled give tinyrange a chance to stop the
+	// virtual machine before it's killed.
+	cmd.Cancel = func() error {
+		return common.InterruptProcess(cmd.Process)
+	}
+	cmd.WaitDelay = 15 * time.Second
+
+	common.KillWithParent(cmd)
+
+	// Copy the console output of the virtual machine to the build log.
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = io.MultiWriter(os.Stdout, ctx.Log())
+	cmd.Stderr = io.MultiWriter(os.Stderr, ctx.Log())
 
-	slog.Debug("executing tinyrange", "args", cmd.Args)
+	ctx.Database().GetLogger().Debug("executing tinyrange", "args", cmd.Args)
 
 	if err := cmd.Start(); err != nil {
 		return nil, err
@@ -103,7 +112,13 @@ func (def *BuildVmDefinition) ToStarlark(ctx common.BuildContext, result filesys
 
 // WriteTo implements common.BuildResult.
 func (def *BuildVmDefinition) WriteResult(w io.Writer) error {
-	if err := def.cmd.Wait(); err != nil {
+	err := def.cmd.Wait()
+
+	def.server.Shutdown(context.Background())
+
+	def.out.Close()
+
+	if err != nil {
 		return err
 	}
 
@@ -111,10 +126,6 @@ func (def *BuildVmDefinition) WriteResult(w io.Writer) error {
 		return fmt.Errorf("VM did not write any output")
 	}
 
-	def.server.Shutdown(context.Background())
-
-	def.out.Close()
-
 	return nil
 }
 
@@ -189,6 +200,15 @@ func (def *BuildVmDefinition) Build(ctx common.BuildContext) (common.BuildResult
 	vmCfg.Interaction = interaction
 	vmCfg.Debug = def.params.Debug
 
+	for _, spec := range def.params.Volumes {
+		vol, err := config.ParseVolumeSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		vmCfg.Volumes = append(vmCfg.Volumes, vol)
+	}
+
 	if def.params.InitRamFs != nil {
 		// bypass the default init logic.
 		// The user code is expected to call `/init -run-config /builder.json` some how.
@@ -281,7 +301,7 @@ func (def *BuildVmDefinition) Build(ctx common.BuildContext) (common.BuildResult
 
 		_, err := io.Copy(def.out, r.Body)
 		if err != nil {
-			slog.Error("error writing output from VM", "err", err)
+			ctx.Database().GetLogger().Error("error writing output from VM", "err", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
@@ -311,7 +331,7 @@ func (def *BuildVmDefinition) Build(ctx common.BuildContext) (common.BuildResult
 		return nil, err
 	}
 
-	cmd, err := runTinyRange(exe, configFilename)
+	cmd, err := runTinyRange(ctx, exe, configFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -327,6 +347,12 @@ func (def *BuildVmDefinition) NeedsBuild(ctx common.BuildContext, cacheTime time
 		return true, nil
 	}
 
+	// The contents of volumes are not part of the hash so a cached result
+	// might have been built from different contents.
+	if len(def.params.Volumes) > 0 {
+		return true, nil
+	}
+
 	// TODO(joshua): Check if any of the child directives need to be built.
 	return false, nil
 }
@@ -374,6 +400,7 @@ func NewBuildVmDefinition(
 	storageSize int,
 	interaction string,
 	debug bool,
+	volumes []string,
 ) *BuildVmDefinition {
 	if storageSize == 0 {
 		storageSize = 1024
@@ -396,6 +423,7 @@ func NewBuildVmDefinition(
 			StorageSize:  storageSize,
 			Interaction:  interaction,
 			Debug:        debug,
+			Volumes:      volumes,
 		},
 	}
 }
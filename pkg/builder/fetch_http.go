@@ -4,11 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
 	"github.com/tinyrange/tinyrange/pkg/hash"
@@ -24,7 +22,9 @@ var ErrNotFound = errors.New("HTTP 404: Not Found")
 type FetchHttpBuildDefinition struct {
 	params FetchHttpParameters
 
-	resp *http.Response
+	resp   *http.Response
+	events common.EventHandler
+	hash   string
 }
 
 // Redistributable implements common.RedistributableDefinition.
@@ -66,7 +66,7 @@ func (f *FetchHttpBuildDefinition) WriteResult(w io.Writer) error {
 	}
 	defer f.resp.Body.Close()
 
-	prog := progressbar.DefaultBytes(f.resp.ContentLength, f.params.Url)
+	prog := common.NewDownloadProgress(f.events, f.hash, f.params.Url, f.resp.ContentLength)
 	defer prog.Close()
 
 	if _, err := io.Copy(io.MultiWriter(prog, w), f.resp.Body); err != nil {
@@ -88,12 +88,18 @@ func (f *FetchHttpBuildDefinition) Build(ctx common.BuildContext) (common.BuildR
 		return nil, err
 	}
 
+	// Download events name the definition they are for.
+	hash, err := ctx.Database().HashDefinition(f)
+	if err != nil {
+		return nil, err
+	}
+
 	onlyNotFound := true
 
 	for _, url := range urls {
 		var req *http.Request
 
-		req, err = http.NewRequest("GET", url, nil)
+		req, err = http.NewRequestWithContext(ctx.Context(), "GET", url, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -106,20 +112,22 @@ func (f *FetchHttpBuildDefinition) Build(ctx common.BuildContext) (common.BuildR
 
 		resp, err := client.Do(req)
 		if err != nil {
-			slog.Warn("failed to fetch", "url", url, "err", err)
+			ctx.Database().GetLogger().Warn("failed to fetch", "url", url, "err", err)
 			onlyNotFound = false
 			continue
 		}
 
 		if resp.StatusCode == http.StatusOK {
 			f.resp = resp
+			f.events = ctx.Database().Events()
+			f.hash = hash
 
 			return f, nil
 		} else if resp.StatusCode == http.StatusNotFound {
-			slog.Warn("failed to fetch", "url", url, "err", ErrNotFound)
+			ctx.Database().GetLogger().Warn("failed to fetch", "url", url, "err", ErrNotFound)
 			continue
 		} else {
-			slog.Warn("failed to fetch", "url", url, "err", fmt.Errorf("bad status: %s", resp.Status))
+			ctx.Database().GetLogger().Warn("failed to fetch", "url", url, "err", fmt.Errorf("bad status: %s", resp.Status))
 			onlyNotFound = false
 			continue
 		}
@@ -10,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
 	"github.com/tinyrange/tinyrange/pkg/builder/oci"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
@@ -48,13 +47,15 @@ type copyResponseResult struct {
 	body          io.ReadCloser
 	contentLength int64
 	url           string
+	events        common.EventHandler
+	hash          string
 }
 
 // WriteTo implements common.BuildResult.
 func (c *copyResponseResult) WriteResult(w io.Writer) error {
 	defer c.body.Close()
 
-	prog := progressbar.DefaultBytes(c.contentLength, c.url)
+	prog := common.NewDownloadProgress(c.events, c.hash, c.url, c.contentLength)
 	defer prog.Close()
 
 	if _, err := io.Copy(io.MultiWriter(prog, w), c.body); err != nil {
@@ -164,6 +165,12 @@ func (r *registryRequestDefinition) Build(ctx common.BuildContext) (common.Build
 		return nil, err
 	}
 
+	// Download events name the definition they are for.
+	hash, err := ctx.Database().HashDefinition(r)
+	if err != nil {
+		return nil, err
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -181,6 +188,8 @@ func (r *registryRequestDefinition) Build(ctx common.BuildContext) (common.Build
 		body:          resp.Body,
 		contentLength: resp.ContentLength,
 		url:           r.ctx.registry + r.params.Url,
+		events:        ctx.Database().Events(),
+		hash:          hash,
 	}, nil
 }
 
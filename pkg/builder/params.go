@@ -9,8 +9,11 @@ import (
 // Build Filesystem exports a series of directives into a filesystem format.
 // The build result is the built filesystem.
 type BuildFsParameters struct {
-	Directives []common.Directive // A list of directives to build the filesystem from.
-	Kind       string             // The kind of filesystem to create (initramfs,tar,fragments)
+	Directives  []common.Directive // A list of directives to build the filesystem from.
+	Kind        string             // The kind of filesystem to create (initramfs,tar,fragments,squashfs[.xz,.zstd],ext4,gpt,fat[16,32])
+	Size        int                // The size of ext4, gpt and fat images in megabytes. If 0 it's picked from the contents.
+	ClusterSize int                // The FAT cluster size in bytes for fat images and the gpt ESP. If 0 it's picked from the size.
+	Journal     bool               // Add a internal journal to ext4 images and the root partition of gpt images.
 }
 
 // Build Virtual Machine uses TinyRange to run a virtual machine with a root
@@ -29,6 +32,7 @@ type BuildVmParameters struct {
 	StorageSize int                    // The amount of storage the root device will have in megabytes.
 	Interaction string                 // How will the virtual machine be interacted with (ssh, serial)
 	Debug       bool                   // Redirect hypervisor input to the host. The VM will exit after it completes initialization.
+	Volumes     []string               // Persistent volumes to attach in the form name:mount_point[:mode]. Builds with volumes are never cached.
 }
 
 // Build Emulator uses a internal shell emulator to run simple shell scripts with support from
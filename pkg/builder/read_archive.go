@@ -3,11 +3,12 @@ package builder
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
-	"io/fs"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -56,22 +57,37 @@ func (d *directoryToArchiveBuildResult) getEntry(
 			CUid:      cEnt.CUid,
 			CGid:      cEnt.CGid,
 			CModTime:  info.ModTime().UnixMicro(),
-			CDevmajor: 0,
-			CDevminor: 0,
+			CDevmajor: cEnt.CDevmajor,
+			CDevminor: cEnt.CDevminor,
+			CXattrs:   cEnt.CXattrs,
 		}
 	} else {
-		var linkname = ""
+		var (
+			linkname string
+			devmajor int64
+			devminor int64
+		)
 
-		if info.Mode().Type() == fs.ModeSymlink {
+		typ = info.Kind()
+
+		size := info.Size()
+
+		switch {
+		case typ == filesystem.TypeSymlink || typ == filesystem.TypeLink:
 			linkname, err = filesystem.GetLinkName(ent)
 			if err != nil {
 				return nil, err
 			}
-			typ = filesystem.TypeSymlink
-		} else if info.Mode().IsDir() {
-			typ = filesystem.TypeDirectory
-		} else {
-			typ = filesystem.TypeRegular
+		case typ.IsDevice():
+			devmajor, devminor, err = filesystem.GetDeviceNumbers(ent)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Only symlinks and regular files have contents.
+		if typ == filesystem.TypeLink || typ.IsSpecial() {
+			size = 0
 		}
 
 		uid, gid, err := filesystem.GetUidAndGid(ent)
@@ -79,17 +95,23 @@ func (d *directoryToArchiveBuildResult) getEntry(
 			return nil, err
 		}
 
+		xattrs, err := filesystem.GetXattrs(ent)
+		if err != nil {
+			return nil, err
+		}
+
 		cacheEnt = &filesystem.CacheEntry{
 			CTypeflag: typ,
 			CName:     name,
 			CLinkname: linkname,
-			CSize:     int64(info.Size()),
+			CSize:     size,
 			CMode:     int64(info.Mode()),
 			CUid:      uid,
 			CGid:      gid,
 			CModTime:  info.ModTime().UnixMicro(),
-			CDevmajor: 0,
-			CDevminor: 0,
+			CDevmajor: devmajor,
+			CDevminor: devminor,
+			CXattrs:   xattrs,
 		}
 	}
 
@@ -103,23 +125,21 @@ func (d *directoryToArchiveBuildResult) writeFileTo(ent filesystem.File, name st
 		ent = starEnt.File
 	}
 
-	if cEnt, ok := ent.(*filesystem.CacheEntry); ok {
-		if cEnt.CTypeflag != filesystem.TypeRegular {
-			cache, err := d.getEntry(ent, name)
-			if err != nil {
-				return err
-			}
-
-			return d.w.WriteEntry(cache, nil)
-		}
-	}
-
-	contents, err := ent.Open()
+	cache, err := d.getEntry(ent, name)
 	if err != nil {
 		return err
 	}
 
-	cache, err := d.getEntry(ent, name)
+	_, isCacheEntry := ent.(*filesystem.CacheEntry)
+
+	// Hard links and special files have no contents. Symlinks from archives
+	// already store their target in the entry.
+	if (isCacheEntry && cache.CTypeflag != filesystem.TypeRegular) ||
+		cache.CTypeflag == filesystem.TypeLink || cache.CTypeflag.IsSpecial() {
+		return d.w.WriteEntry(cache, nil)
+	}
+
+	contents, err := ent.Open()
 	if err != nil {
 		return err
 	}
@@ -252,6 +272,12 @@ func (r *tarToArchiveBuildResult) WriteResult(w io.Writer) error {
 			typeFlag = filesystem.TypeSymlink
 		case tar.TypeLink:
 			typeFlag = filesystem.TypeLink
+		case tar.TypeChar:
+			typeFlag = filesystem.TypeCharDevice
+		case tar.TypeBlock:
+			typeFlag = filesystem.TypeBlockDevice
+		case tar.TypeFifo:
+			typeFlag = filesystem.TypeFifo
 		case tar.TypeXGlobalHeader:
 			continue
 		default:
@@ -269,6 +295,7 @@ func (r *tarToArchiveBuildResult) WriteResult(w io.Writer) error {
 			CModTime:  hdr.ModTime.UnixMicro(),
 			CDevmajor: hdr.Devmajor,
 			CDevminor: hdr.Devminor,
+			CXattrs:   filesystem.XattrsFromPAX(hdr.PAXRecords),
 		}, r.r); err != nil {
 			return err
 		}
@@ -281,8 +308,55 @@ var (
 	_ common.BuildResult = &tarToArchiveBuildResult{}
 )
 
+// The cpio reader doesn't expose the device numbers of device nodes so the raw
+// newc header is recorded as it's read.
+type cpioHeaderRecorder struct {
+	r   io.Reader
+	buf []byte
+}
+
+// Read implements io.Reader.
+func (h *cpioHeaderRecorder) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+
+	h.buf = append(h.buf, p[:n]...)
+
+	return n, err
+}
+
+// Returns the rdevmajor and rdevminor fields of the header read since buf
+// was last cleared.
+func (h *cpioHeaderRecorder) rdev() (int64, int64, error) {
+	// The header follows up to 3 bytes of padding after the last file.
+	idx := bytes.Index(h.buf, []byte("07070"))
+	if idx == -1 || idx > 3 || len(h.buf) < idx+110 {
+		return 0, 0, fmt.Errorf("could not find cpio header")
+	}
+
+	hdr := h.buf[idx : idx+110]
+
+	major, err := strconv.ParseInt(string(hdr[78:86]), 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rdevmajor in cpio header: %w", err)
+	}
+
+	minor, err := strconv.ParseInt(string(hdr[86:94]), 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rdevminor in cpio header: %w", err)
+	}
+
+	return major, minor, nil
+}
+
 type cpioToArchiveBuildResult struct {
-	r *cpio.Reader
+	header *cpioHeaderRecorder
+	r      *cpio.Reader
+}
+
+func newCpioToArchiveBuildResult(r io.Reader) *cpioToArchiveBuildResult {
+	header := &cpioHeaderRecorder{r: r}
+
+	return &cpioToArchiveBuildResult{header: header, r: cpio.NewReader(header)}
 }
 
 // WriteTo implements common.BuildResult.
@@ -290,6 +364,14 @@ func (c *cpioToArchiveBuildResult) WriteResult(w io.Writer) error {
 	ark := filesystem.NewArchiveWriter(w)
 
 	for {
+		// Skip the rest of the last file so only the next header is
+		// recorded.
+		if _, err := io.Copy(io.Discard, c.r); err != nil {
+			return err
+		}
+
+		c.header.buf = c.header.buf[:0]
+
 		hdr, err := c.r.Next()
 		if err == io.EOF {
 			break
@@ -301,19 +383,36 @@ func (c *cpioToArchiveBuildResult) WriteResult(w io.Writer) error {
 
 		var typeFlag = filesystem.TypeRegular
 
-		typ := hdr.Mode &^ cpio.ModePerm
+		typ := hdr.Mode & cpio.ModeType
 
-		switch true {
-		case typ&cpio.TypeReg != 0:
+		switch typ {
+		case cpio.TypeReg:
 			// pass
-		case typ&cpio.TypeDir != 0:
+		case cpio.TypeDir:
 			typeFlag = filesystem.TypeDirectory
-		case typ&cpio.TypeSymlink != 0:
+		case cpio.TypeSymlink:
 			typeFlag = filesystem.TypeSymlink
+		case cpio.TypeChar:
+			typeFlag = filesystem.TypeCharDevice
+		case cpio.TypeBlock:
+			typeFlag = filesystem.TypeBlockDevice
+		case cpio.TypeFifo:
+			typeFlag = filesystem.TypeFifo
+		case cpio.TypeSocket:
+			typeFlag = filesystem.TypeSocket
 		default:
 			return fmt.Errorf("unknown type flag: %d", typ)
 		}
 
+		var devmajor, devminor int64
+
+		if typeFlag == filesystem.TypeCharDevice || typeFlag == filesystem.TypeBlockDevice {
+			devmajor, devminor, err = c.header.rdev()
+			if err != nil {
+				return fmt.Errorf("failed to read device numbers of %s: %w", hdr.Name, err)
+			}
+		}
+
 		if err := ark.WriteEntry(&filesystem.CacheEntry{
 			CTypeflag: typeFlag,
 			CName:     hdr.Name,
@@ -323,6 +422,8 @@ func (c *cpioToArchiveBuildResult) WriteResult(w io.Writer) error {
 			CUid:      hdr.Uid,
 			CGid:      hdr.Guid,
 			CModTime:  hdr.ModTime.UnixMicro(),
+			CDevmajor: devmajor,
+			CDevminor: devminor,
 		}, c.r); err != nil {
 			return err
 		}
@@ -374,7 +475,15 @@ var (
 )
 
 func ReadArchiveSupportsExtracting(kind string) bool {
-	if strings.HasSuffix(kind, ".zip") {
+	if strings.HasSuffix(kind, ".zip") || strings.HasSuffix(kind, ".ext4") {
+		return true
+	}
+
+	if strings.HasSuffix(kind, ".squashfs") || strings.HasSuffix(kind, ".sqfs") {
+		return true
+	}
+
+	if strings.HasSuffix(kind, ".fat") || strings.HasSuffix(kind, ".vfat") {
 		return true
 	}
 
@@ -483,6 +592,28 @@ func (r *ReadArchiveBuildDefinition) Build(ctx common.BuildContext) (common.Buil
 		}
 
 		return &zipToArchiveBuildResult{r: reader}, nil
+	} else if strings.HasSuffix(r.params.Kind, ".ext4") {
+		// Files are read from the image as the archive is written.
+		dir, err := filesystem.OpenExt4Image(fh)
+		if err != nil {
+			return nil, err
+		}
+
+		return &directoryToArchiveBuildResult{dir: dir}, nil
+	} else if strings.HasSuffix(r.params.Kind, ".squashfs") || strings.HasSuffix(r.params.Kind, ".sqfs") {
+		dir, err := filesystem.OpenSquashfsImage(fh)
+		if err != nil {
+			return nil, err
+		}
+
+		return &directoryToArchiveBuildResult{dir: dir}, nil
+	} else if strings.HasSuffix(r.params.Kind, ".fat") || strings.HasSuffix(r.params.Kind, ".vfat") {
+		dir, err := filesystem.OpenFatImage(fh)
+		if err != nil {
+			return nil, err
+		}
+
+		return &directoryToArchiveBuildResult{dir: dir}, nil
 	} else {
 		kind := r.params.Kind
 
@@ -516,7 +647,7 @@ func (r *ReadArchiveBuildDefinition) Build(ctx common.BuildContext) (common.Buil
 		if strings.HasSuffix(kind, ".tar") {
 			return &tarToArchiveBuildResult{r: tar.NewReader(reader)}, nil
 		} else if strings.HasSuffix(kind, ".cpio") {
-			return &cpioToArchiveBuildResult{r: cpio.NewReader(reader)}, nil
+			return newCpioToArchiveBuildResult(reader), nil
 		} else if strings.HasSuffix(kind, ".ar") {
 			return &arToArchiveBuildResult{r: ar.NewReader(reader)}, nil
 		} else {
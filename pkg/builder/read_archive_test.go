@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+// Append a newc cpio entry to buf.
+func writeNewc(buf *bytes.Buffer, name string, mode uint32, rdevmajor uint32, rdevminor uint32, contents string) {
+	fmt.Fprintf(buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		1, mode, 0, 0, 1, 0, len(contents), 0, 0, rdevmajor, rdevminor, len(name)+1, 0)
+
+	buf.WriteString(name + "\x00")
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+
+	buf.WriteString(contents)
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+func TestCpioDeviceNumbers(t *testing.T) {
+	var input bytes.Buffer
+
+	writeNewc(&input, "dev", 0040755, 0, 0, "")
+	writeNewc(&input, "dev/null", 0020666, 1, 3, "")
+	writeNewc(&input, "hello", 0100644, 0, 0, "hello")
+	writeNewc(&input, "dev/nvme0n1p1", 0060660, 259, 300, "")
+	writeNewc(&input, "TRAILER!!!", 0, 0, 0, "")
+
+	var output bytes.Buffer
+
+	if err := newCpioToArchiveBuildResult(&input).WriteResult(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	f := filesystem.NewMemoryFile(filesystem.TypeRegular)
+	if err := f.Overwrite(output.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	ark, err := filesystem.ReadArchiveFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ents, err := ark.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		typ          filesystem.FileType
+		perm         fs.FileMode
+		major, minor int64
+	}
+
+	got := make(map[string]entry)
+	for _, ent := range ents {
+		got[ent.Name()] = entry{ent.Typeflag(), fs.FileMode(ent.Mode()).Perm(), ent.Devmajor(), ent.Devminor()}
+	}
+
+	for name, expected := range map[string]entry{
+		"dev":           {filesystem.TypeDirectory, 0755, 0, 0},
+		"dev/null":      {filesystem.TypeCharDevice, 0666, 1, 3},
+		"hello":         {filesystem.TypeRegular, 0644, 0, 0},
+		"dev/nvme0n1p1": {filesystem.TypeBlockDevice, 0660, 259, 300},
+	} {
+		if got[name] != expected {
+			t.Errorf("%s = %+v, want %+v", name, got[name], expected)
+		}
+	}
+}
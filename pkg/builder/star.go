@@ -2,7 +2,6 @@ package builder
 
 import (
 	"fmt"
-	"log/slog"
 	"strings"
 	"time"
 
@@ -212,7 +211,7 @@ func (def *StarBuildDefinition) NeedsBuild(ctx common.BuildContext, cacheTime ti
 			}
 
 			if needsBuild {
-				slog.Debug("forcing rebuild", "def", argDef)
+				ctx.Database().GetLogger().Debug("forcing rebuild", "def", argDef)
 				return true, nil
 			}
 		}
@@ -0,0 +1,222 @@
+// Package cloudinit generates NoCloud seeds so stock cloud images can be
+// configured by cloud-init when booted under TinyRange.
+package cloudinit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/fat16"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+	"gopkg.in/yaml.v3"
+)
+
+// The volume label cloud-init looks for when searching for a NoCloud seed.
+const SEED_LABEL = "cidata"
+
+// The sshd drop-in that lets TinyRange login the same way it does with the
+// builtin init.
+const sshdConfig = `Port 22
+Port 2222
+PermitRootLogin yes
+PasswordAuthentication yes
+`
+
+type Options struct {
+	Hostname          string
+	SSHAuthorizedKeys []string
+	MacAddress        string
+	CloudInit         config.CloudInitConfig
+}
+
+type writeFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions"`
+}
+
+type chpasswdUser struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	Type     string `yaml:"type"`
+}
+
+type chpasswd struct {
+	Expire bool           `yaml:"expire"`
+	Users  []chpasswdUser `yaml:"users"`
+}
+
+type cloudConfig struct {
+	Hostname          string      `yaml:"hostname"`
+	DisableRoot       bool        `yaml:"disable_root"`
+	SSHPasswordAuth   bool        `yaml:"ssh_pwauth"`
+	SSHAuthorizedKeys []string    `yaml:"ssh_authorized_keys,omitempty"`
+	Chpasswd          chpasswd    `yaml:"chpasswd"`
+	WriteFiles        []writeFile `yaml:"write_files"`
+	Packages          []string    `yaml:"packages,omitempty"`
+	RunCommands       []string    `yaml:"runcmd,omitempty"`
+}
+
+type SeedFile struct {
+	Name     string
+	Contents []byte
+}
+
+// A NoCloud seed. Each field is the contents of the file with the same name.
+type Seed struct {
+	MetaData      []byte
+	UserData      []byte
+	VendorData    []byte
+	NetworkConfig []byte
+}
+
+// Files returns the seed files in the order they are written to disk.
+func (s *Seed) Files() []SeedFile {
+	return []SeedFile{
+		{"meta-data", s.MetaData},
+		{"user-data", s.UserData},
+		{"vendor-data", s.VendorData},
+		{"network-config", s.NetworkConfig},
+	}
+}
+
+// Get returns the contents of a seed file by name.
+func (s *Seed) Get(name string) ([]byte, bool) {
+	for _, file := range s.Files() {
+		if file.Name == name {
+			return file.Contents, true
+		}
+	}
+
+	return nil, false
+}
+
+// Hash returns a stable identifier for the contents of the seed.
+func (s *Seed) Hash() string {
+	var buf bytes.Buffer
+
+	for _, file := range s.Files() {
+		fmt.Fprintf(&buf, "%s:%d:", file.Name, len(file.Contents))
+		buf.Write(file.Contents)
+	}
+
+	return hash.GetSha256Hash(buf.Bytes())
+}
+
+// WriteFat writes the seed as a vfat filesystem labeled cidata.
+func (s *Seed) WriteFat(w io.Writer) error {
+	fs := fat16.NewFat16Writer(SEED_LABEL)
+
+	for _, file := range s.Files() {
+		if err := fs.AddFile(file.Name, file.Contents); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fs.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write seed filesystem: %w", err)
+	}
+
+	return nil
+}
+
+func marshalYaml(header string, v any) ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteString(header)
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func userData(opts Options) ([]byte, error) {
+	if opts.CloudInit.UserData != "" {
+		return []byte(opts.CloudInit.UserData), nil
+	}
+
+	return marshalYaml("#cloud-config\n", &cloudConfig{
+		Hostname:          opts.Hostname,
+		DisableRoot:       false,
+		SSHPasswordAuth:   true,
+		SSHAuthorizedKeys: opts.SSHAuthorizedKeys,
+		Chpasswd: chpasswd{
+			Expire: false,
+			Users: []chpasswdUser{
+				{Name: "root", Password: "insecurepassword", Type: "text"},
+			},
+		},
+		WriteFiles: []writeFile{
+			{
+				Path:        "/etc/ssh/sshd_config.d/10-tinyrange.conf",
+				Content:     sshdConfig,
+				Permissions: "0644",
+			},
+		},
+		Packages:    opts.CloudInit.Packages,
+		RunCommands: opts.CloudInit.RunCommands,
+	})
+}
+
+func networkConfig(opts Options) ([]byte, error) {
+	return marshalYaml("", map[string]any{
+		"version": 2,
+		"ethernets": map[string]any{
+			"eth0": map[string]any{
+				"match":     map[string]string{"macaddress": opts.MacAddress},
+				"set-name":  "eth0",
+				"addresses": []string{"10.42.0.2/16"},
+				"routes": []map[string]string{
+					{"to": "default", "via": "10.42.0.1"},
+				},
+				"nameservers": map[string]any{
+					"addresses": []string{"10.42.0.1"},
+				},
+			},
+		},
+	})
+}
+
+// NewSeed generates the NoCloud seed for a virtual machine.
+func NewSeed(opts Options) (*Seed, error) {
+	user, err := userData(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate user-data: %w", err)
+	}
+
+	network, err := networkConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate network-config: %w", err)
+	}
+
+	seed := &Seed{
+		UserData:      user,
+		VendorData:    []byte{},
+		NetworkConfig: network,
+	}
+
+	// Derive the instance-id from the rest of the seed so cloud-init runs
+	// again whenever the configuration changes.
+	meta, err := marshalYaml("", map[string]string{
+		"instance-id":    "tinyrange-" + seed.Hash()[:16],
+		"local-hostname": opts.Hostname,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate meta-data: %w", err)
+	}
+
+	seed.MetaData = meta
+
+	return seed, nil
+}
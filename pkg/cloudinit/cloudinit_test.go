@@ -0,0 +1,183 @@
+package cloudinit
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/fat16"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNewSeed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+		// Substrings expected in each seed file.
+		expected map[string][]string
+	}{
+		{
+			name: "default",
+			opts: Options{Hostname: "guest", MacAddress: "02:00:00:00:00:01"},
+			expected: map[string][]string{
+				"user-data": {
+					"#cloud-config\n",
+					"hostname: guest\n",
+					"ssh_pwauth: true\n",
+					"path: /etc/ssh/sshd_config.d/10-tinyrange.conf\n",
+				},
+				"meta-data":      {"instance-id: tinyrange-", "local-hostname: guest\n"},
+				"network-config": {`macaddress: "02:00:00:00:00:01"`, "- 10.42.0.2/16\n", "via: 10.42.0.1\n"},
+			},
+		},
+		{
+			name: "packages",
+			opts: Options{
+				Hostname:          "guest",
+				SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA test"},
+				CloudInit: config.CloudInitConfig{
+					Packages:    []string{"curl"},
+					RunCommands: []string{"touch /ready"},
+				},
+			},
+			expected: map[string][]string{
+				"user-data": {
+					"ssh_authorized_keys:\n  - ssh-ed25519 AAAA test\n",
+					"packages:\n  - curl\n",
+					"runcmd:\n  - touch /ready\n",
+				},
+			},
+		},
+		{
+			name: "user data",
+			opts: Options{
+				Hostname:  "guest",
+				CloudInit: config.CloudInitConfig{UserData: "#!/bin/sh\necho hello\n"},
+			},
+			expected: map[string][]string{
+				"user-data": {"#!/bin/sh\necho hello\n"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			seed, err := NewSeed(tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, substrings := range tc.expected {
+				contents, ok := seed.Get(name)
+				if !ok {
+					t.Fatalf("missing seed file %s", name)
+				}
+
+				for _, substring := range substrings {
+					if !strings.Contains(string(contents), substring) {
+						t.Fatalf("expected %s to contain %q, got:\n%s", name, substring, contents)
+					}
+				}
+			}
+
+			// The generated files are valid YAML.
+			for _, name := range []string{"meta-data", "network-config"} {
+				contents, _ := seed.Get(name)
+
+				var v map[string]any
+				if err := yaml.Unmarshal(contents, &v); err != nil {
+					t.Fatalf("failed to parse %s: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSeedInstanceId(t *testing.T) {
+	instanceId := func(opts Options) string {
+		seed, err := NewSeed(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var meta map[string]string
+		if err := yaml.Unmarshal(seed.MetaData, &meta); err != nil {
+			t.Fatal(err)
+		}
+
+		return meta["instance-id"]
+	}
+
+	opts := Options{Hostname: "guest", MacAddress: "02:00:00:00:00:01"}
+
+	first := instanceId(opts)
+	if first != instanceId(opts) {
+		t.Fatal("expected the instance-id to be stable")
+	}
+
+	// cloud-init only runs again if the instance-id changes.
+	opts.CloudInit.Packages = []string{"curl"}
+	if first == instanceId(opts) {
+		t.Fatal("expected the instance-id to change with the configuration")
+	}
+}
+
+func TestWriteFat(t *testing.T) {
+	seed, err := NewSeed(Options{Hostname: "guest", MacAddress: "02:00:00:00:00:01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := seed.WriteFat(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fat16.OpenReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cloud-init finds the seed by it's label.
+	if r.Label() != strings.ToUpper(SEED_LABEL) {
+		t.Fatalf("expected label %q, got %q", strings.ToUpper(SEED_LABEL), r.Label())
+	}
+
+	ents, err := r.ReadDir(r.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := seed.Files()
+	if len(ents) != len(files) {
+		t.Fatalf("expected %d files, got %d", len(files), len(ents))
+	}
+
+	// The names have to match exactly since cloud-init doesn't look for the
+	// 8.3 names.
+	byName := make(map[string]fat16.DirEntry)
+	for _, ent := range ents {
+		byName[ent.Name] = ent
+	}
+
+	for _, file := range files {
+		ent, ok := byName[file.Name]
+		if !ok {
+			t.Fatalf("missing %s", file.Name)
+		}
+
+		f, err := r.Open(ent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(contents, file.Contents) {
+			t.Fatalf("contents of %s do not match", file.Name)
+		}
+	}
+}
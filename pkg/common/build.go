@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"io"
 	"time"
 
@@ -40,6 +41,10 @@ type RedistributableDefinition interface {
 type BuildContext interface {
 	starlark.Value
 
+	// The context the build runs under. Builds should stop when it's
+	// cancelled.
+	Context() context.Context
+
 	DisplayTree()
 	CreateOutput() (io.WriteCloser, error)
 	CreateFile(name string) (string, io.WriteCloser, error)
@@ -53,6 +58,11 @@ type BuildContext interface {
 	ChildContext(source BuildSource, status *BuildStatus, filename string) BuildContext
 	FileFromDigest(digest *filesystem.FileDigest) (filesystem.File, error)
 	FilenameFromDigest(digest *filesystem.FileDigest) (string, error)
+
+	// The log of this build. Output written to it is kept next to the build
+	// result and shown if the build fails.
+	Log() io.Writer
+	SetLog(w io.Writer)
 }
 
 type MacroResult interface {
@@ -1,9 +1,11 @@
 package common
 
 import (
+	"bytes"
 	"embed"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
@@ -74,6 +76,46 @@ func Exists(name string) (bool, error) {
 	return false, err
 }
 
+// WriteSparse copies the contents of r to a file skipping blocks that are all
+// zeros so the resulting image is sparse.
+func WriteSparse(out *os.File, r io.ReaderAt, size int64) error {
+	if err := WriteSparseAt(out, r, 0, size); err != nil {
+		return err
+	}
+
+	return out.Truncate(size)
+}
+
+// WriteSparseAt copies size bytes of r to out starting at offset. Blocks that
+// are all zeros are skipped so out must already read as zeros there.
+func WriteSparseAt(out io.WriterAt, r io.ReaderAt, offset int64, size int64) error {
+	const blockSize = 1024 * 1024
+
+	buf := make([]byte, blockSize)
+	zero := make([]byte, blockSize)
+
+	for off := int64(0); off < size; off += blockSize {
+		n := int64(blockSize)
+		if off+n > size {
+			n = size - off
+		}
+
+		if _, err := r.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+			return err
+		}
+
+		if bytes.Equal(buf[:n], zero[:n]) {
+			continue
+		}
+
+		if _, err := out.WriteAt(buf[:n], offset+off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func Ensure(path string, mode os.FileMode) error {
 	err := os.MkdirAll(path, mode)
 	if err != nil {
@@ -131,6 +173,14 @@ func GetDefaultBuildDir() string {
 	return filepath.Join(cache, "tinyrange", "build")
 }
 
+// Runs commands started by ExecCommand. Init replaces it so the commands are
+// not collected by it's zombie reaper.
+var commandRunner = (*exec.Cmd).Run
+
+func SetCommandRunner(run func(cmd *exec.Cmd) error) {
+	commandRunner = run
+}
+
 func ExecCommand(args []string, environment map[string]string) error {
 	if ok, _ := Exists(args[0]); !ok {
 		return fmt.Errorf("path %s does not exist", args[0])
@@ -147,7 +197,7 @@ func ExecCommand(args []string, environment map[string]string) error {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 	}
 
-	err := cmd.Run()
+	err := commandRunner(cmd)
 	if exit, ok := err.(*exec.ExitError); ok {
 		if exit.ExitCode() == 255 {
 			slog.Warn("command returned exit 255", "args", args)
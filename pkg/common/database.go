@@ -1,6 +1,7 @@
 package common
 
 import (
+	"log/slog"
 	"net/http"
 
 	"github.com/tinyrange/tinyrange/pkg/config"
@@ -44,6 +45,12 @@ type PackageDatabase interface {
 	NewThread(filename string) *starlark.Thread
 	HashDefinition(def BuildDefinition) (string, error)
 	NewBuildContext(source BuildSource) BuildContext
+	// Returns the handler for progress events or nil if there isn't one.
+	Events() EventHandler
+	// Returns the logger builds should write messages to.
+	GetLogger() *slog.Logger
+	// If true builds print more details about what they are doing.
+	IsVerbose() bool
 }
 
 type InstallationPlanBuilder interface {
@@ -13,6 +13,8 @@ func init() {
 	hash.RegisterType(DirectiveRunCommand{})
 	hash.RegisterType(DirectiveEnvironment{})
 	hash.RegisterType(DirectiveList{})
+	hash.RegisterType(DirectiveService{})
+	hash.RegisterType(DirectiveReadinessProbe{})
 }
 
 type Directive interface {
@@ -197,6 +199,144 @@ func (d DirectiveExportPort) Tag() string {
 	return fmt.Sprintf("DirPort_%s_%d", d.Name, d.Port)
 }
 
+// Adds a service supervised by init in the guest. See config.ServiceConfig.
+// The readiness probe is flattened so the directive can be hashed.
+type DirectiveService struct {
+	Name             string
+	Command          []string
+	Environment      []string
+	WorkingDirectory string
+	User             string
+	Restart          string
+	DependsOn        []string
+
+	ReadyTcpPort  int
+	ReadyHttpPath string
+	ReadyHttpPort int
+	ReadyCommand  []string
+	ReadyTimeout  int
+}
+
+// Dependencies implements Directive.
+func (d DirectiveService) Dependencies(ctx BuildContext) ([]DependencyNode, error) {
+	return []DependencyNode{}, nil
+}
+
+// SerializableType implements Directive.
+func (d DirectiveService) SerializableType() string { return "DirectiveService" }
+
+// Config returns the service config of the directive.
+func (d DirectiveService) Config() config.ServiceConfig {
+	svc := config.ServiceConfig{
+		Name:             d.Name,
+		Command:          d.Command,
+		Environment:      d.Environment,
+		WorkingDirectory: d.WorkingDirectory,
+		User:             d.User,
+		Restart:          d.Restart,
+		DependsOn:        d.DependsOn,
+	}
+
+	if d.ReadyTcpPort != 0 || d.ReadyHttpPath != "" || len(d.ReadyCommand) > 0 {
+		svc.Ready = &config.ProbeConfig{
+			TcpPort:  d.ReadyTcpPort,
+			HttpPath: d.ReadyHttpPath,
+			HttpPort: d.ReadyHttpPort,
+			Command:  d.ReadyCommand,
+			Timeout:  d.ReadyTimeout,
+		}
+	}
+
+	return svc
+}
+
+// AsFragments implements Directive.
+func (d DirectiveService) AsFragments(ctx BuildContext, special SpecialDirectiveHandlers) ([]config.Fragment, error) {
+	return []config.Fragment{
+		{Service: &config.ServiceFragment{Service: d.Config()}},
+	}, nil
+}
+
+// Tag implements Directive.
+func (d DirectiveService) Tag() string {
+	return fmt.Sprintf("DirService_%s", d.Name)
+}
+
+// NewServiceDirective converts a service config into a directive.
+func NewServiceDirective(svc config.ServiceConfig) DirectiveService {
+	dir := DirectiveService{
+		Name:             svc.Name,
+		Command:          svc.Command,
+		Environment:      svc.Environment,
+		WorkingDirectory: svc.WorkingDirectory,
+		User:             svc.User,
+		Restart:          svc.Restart,
+		DependsOn:        svc.DependsOn,
+	}
+
+	if probe := svc.Ready; probe != nil {
+		dir.ReadyTcpPort = probe.TcpPort
+		dir.ReadyHttpPath = probe.HttpPath
+		dir.ReadyHttpPort = probe.HttpPort
+		dir.ReadyCommand = probe.Command
+		dir.ReadyTimeout = probe.Timeout
+	}
+
+	return dir
+}
+
+// Adds a probe that must pass before the guest is considered ready. See
+// config.ProbeConfig.
+type DirectiveReadinessProbe struct {
+	TcpPort  int
+	HttpPath string
+	HttpPort int
+	Command  []string
+	Timeout  int
+}
+
+// Dependencies implements Directive.
+func (d DirectiveReadinessProbe) Dependencies(ctx BuildContext) ([]DependencyNode, error) {
+	return []DependencyNode{}, nil
+}
+
+// SerializableType implements Directive.
+func (d DirectiveReadinessProbe) SerializableType() string { return "DirectiveReadinessProbe" }
+
+// Config returns the probe config of the directive.
+func (d DirectiveReadinessProbe) Config() config.ProbeConfig {
+	return config.ProbeConfig{
+		TcpPort:  d.TcpPort,
+		HttpPath: d.HttpPath,
+		HttpPort: d.HttpPort,
+		Command:  d.Command,
+		Timeout:  d.Timeout,
+	}
+}
+
+// AsFragments implements Directive.
+func (d DirectiveReadinessProbe) AsFragments(ctx BuildContext, special SpecialDirectiveHandlers) ([]config.Fragment, error) {
+	return []config.Fragment{
+		{ReadinessProbe: &config.ReadinessProbeFragment{Probe: d.Config()}},
+	}, nil
+}
+
+// Tag implements Directive.
+func (d DirectiveReadinessProbe) Tag() string {
+	return fmt.Sprintf("DirReadinessProbe_%d_%s_%d_%+v", d.TcpPort, d.HttpPath, d.HttpPort, d.Command)
+}
+
+// NewReadinessProbeDirective converts a probe config into a directive.
+func NewReadinessProbeDirective(probe config.ProbeConfig) DirectiveReadinessProbe {
+	return DirectiveReadinessProbe{
+		TcpPort:  probe.TcpPort,
+		HttpPath: probe.HttpPath,
+		HttpPort: probe.HttpPort,
+		Command:  probe.Command,
+		Timeout:  probe.Timeout,
+	}
+}
+
 type DirectiveEnvironment struct {
 	Variables []string
 }
@@ -373,6 +513,8 @@ var (
 	_ Directive = DirectiveLocalFile{}
 	_ Directive = DirectiveArchive{}
 	_ Directive = DirectiveExportPort{}
+	_ Directive = DirectiveService{}
+	_ Directive = DirectiveReadinessProbe{}
 	_ Directive = DirectiveEnvironment{}
 	_ Directive = DirectiveBuiltin{}
 	_ Directive = DirectiveList{}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"io"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+type EventKind string
+
+const (
+	// A definition started building.
+	EventBuildStarted EventKind = "build_started"
+	// A definition was already built and the cached result was used.
+	EventBuildCached EventKind = "build_cached"
+	// A definition finished building.
+	EventBuildFinished EventKind = "build_finished"
+	// A definition failed to build.
+	EventBuildFailed EventKind = "build_failed"
+	// Reports how much of a file has been downloaded.
+	EventDownloadProgress EventKind = "download_progress"
+	// The root filesystem of a virtual machine is being built.
+	EventVMBuildingFilesystem EventKind = "vm_building_filesystem"
+	// The hypervisor is being started.
+	EventVMStarting EventKind = "vm_starting"
+	// The guest finished booting.
+	EventVMReady EventKind = "vm_ready"
+	// The guest is about to power off.
+	EventVMShutdown EventKind = "vm_shutdown"
+	// The hypervisor exited.
+	EventVMExited EventKind = "vm_exited"
+)
+
+// Event reports the progress of a build or virtual machine.
+type Event struct {
+	Kind EventKind `json:"kind"`
+	Time time.Time `json:"time"`
+	// The tag and hash of the definition for build events.
+	Tag  string `json:"tag,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	// The hash of the definition that depends on this one for started and
+	// cached events. Empty for definitions built directly.
+	Parent string `json:"parent,omitempty"`
+	// How long the build took for finished and failed builds.
+	Duration time.Duration `json:"duration,omitempty"`
+	// The size of the build output in bytes.
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// Why the guest was shutdown and the exit codes of its services for
+	// shutdown events.
+	Reason   string               `json:"reason,omitempty"`
+	Services []config.ServiceExit `json:"services,omitempty"`
+
+	// The URL being downloaded and how many bytes of the total have been
+	// received for download events. Total is -1 if it's unknown. Hash is the
+	// definition the download is for.
+	Url   string `json:"url,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+	Total int64  `json:"total,omitempty"`
+}
+
+// EventHandler is called for each event. It may be called from multiple
+// goroutines.
+type EventHandler func(ev Event)
+
+// Emit calls handler with ev if it's not nil. The time of the event is filled
+// in if it's not set.
+func (handler EventHandler) Emit(ev Event) {
+	if handler == nil {
+		return
+	}
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	handler(ev)
+}
+
+// Reports download progress as events instead of drawing a progress bar.
+type downloadProgress struct {
+	handler  EventHandler
+	hash     string
+	url      string
+	total    int64
+	bytes    int64
+	lastEmit time.Time
+}
+
+// Write implements io.Writer.
+func (p *downloadProgress) Write(buf []byte) (int, error) {
+	p.bytes += int64(len(buf))
+
+	if time.Since(p.lastEmit) > 250*time.Millisecond {
+		p.emit()
+	}
+
+	return len(buf), nil
+}
+
+func (p *downloadProgress) emit() {
+	p.lastEmit = time.Now()
+
+	p.handler.Emit(Event{Kind: EventDownloadProgress, Hash: p.hash, Url: p.url, Bytes: p.bytes, Total: p.total})
+}
+
+// Close implements io.Closer.
+func (p *downloadProgress) Close() error {
+	p.emit()
+
+	return nil
+}
+
+// NewDownloadProgress returns a writer that reports how much has been written
+// to it. If handler is nil a progress bar is drawn otherwise download progress
+// events are emitted for the definition with hash.
+func NewDownloadProgress(handler EventHandler, hash string, url string, total int64) io.WriteCloser {
+	if handler == nil {
+		return progressbar.DefaultBytes(total, url)
+	}
+
+	return &downloadProgress{handler: handler, hash: hash, url: url, total: total}
+}
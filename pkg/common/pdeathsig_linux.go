@@ -0,0 +1,12 @@
+package common
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// KillWithParent makes the kernel kill cmd if the current process exits
+// without stopping it.
+func KillWithParent(cmd *exec.Cmd) {
+	sysProcAttr(cmd).Pdeathsig = syscall.SIGKILL
+}
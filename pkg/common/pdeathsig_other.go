@@ -0,0 +1,8 @@
+//go:build !linux
+
+package common
+
+import "os/exec"
+
+// KillWithParent is only supported on Linux.
+func KillWithParent(cmd *exec.Cmd) {}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// The default number of seconds to wait for a probe to pass.
+const DefaultProbeTimeout = 60
+
+// Prober checks readiness probes. TCP and HTTP probes connect to 127.0.0.1
+// using Dial. Command probes are only supported if Run is set.
+type Prober struct {
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+	Run  func(ctx context.Context, args []string) error
+}
+
+func (p Prober) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	if p.Dial != nil {
+		return p.Dial(ctx, network, address)
+	}
+
+	var dialer net.Dialer
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// ValidateProbe returns an error unless exactly one kind of probe is set.
+func ValidateProbe(probe config.ProbeConfig) error {
+	kinds := 0
+
+	if len(probe.Command) > 0 {
+		kinds += 1
+	}
+
+	if probe.HttpPath != "" {
+		if probe.HttpPort <= 0 || probe.HttpPort > 65535 {
+			return fmt.Errorf("http probe has invalid http_port: %d", probe.HttpPort)
+		}
+
+		if !strings.HasPrefix(probe.HttpPath, "/") {
+			return fmt.Errorf("http_path must start with /: %s", probe.HttpPath)
+		}
+
+		kinds += 1
+	} else if probe.HttpPort != 0 {
+		return fmt.Errorf("http_port is set without a http_path")
+	}
+
+	if probe.TcpPort != 0 {
+		if probe.TcpPort < 0 || probe.TcpPort > 65535 {
+			return fmt.Errorf("probe has invalid tcp_port: %d", probe.TcpPort)
+		}
+
+		kinds += 1
+	}
+
+	if kinds == 0 {
+		return fmt.Errorf("probe has no command, http_path or tcp_port")
+	} else if kinds > 1 {
+		return fmt.Errorf("probe can only have one of command, http_path or tcp_port")
+	}
+
+	if probe.Timeout < 0 {
+		return fmt.Errorf("probe has negative timeout: %d", probe.Timeout)
+	}
+
+	return nil
+}
+
+// Check runs probe once and returns an error if it didn't pass.
+func (p Prober) Check(ctx context.Context, probe config.ProbeConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if len(probe.Command) > 0 {
+		if p.Run == nil {
+			return fmt.Errorf("command probes can only be run inside the guest")
+		}
+
+		return p.Run(ctx, probe.Command)
+	} else if probe.HttpPath != "" {
+		client := &http.Client{
+			Transport: &http.Transport{DialContext: p.dial},
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://127.0.0.1:%d%s", probe.HttpPort, probe.HttpPath), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got status %s", resp.Status)
+		}
+
+		return nil
+	} else if probe.TcpPort != 0 {
+		conn, err := p.dial(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", probe.TcpPort))
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	} else {
+		return fmt.Errorf("probe has no command, http_path or tcp_port")
+	}
+}
+
+// Wait runs probe until it passes or its timeout expires.
+func (p Prober) Wait(ctx context.Context, probe config.ProbeConfig) error {
+	timeout := probe.Timeout
+	if timeout == 0 {
+		timeout = DefaultProbeTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	for {
+		err := p.Check(ctx, probe)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("probe did not pass after %ds: %w", timeout, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
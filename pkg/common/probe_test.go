@@ -0,0 +1,129 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+func TestValidateProbe(t *testing.T) {
+	for _, tc := range []struct {
+		probe config.ProbeConfig
+		valid bool
+	}{
+		{config.ProbeConfig{TcpPort: 22}, true},
+		{config.ProbeConfig{HttpPath: "/health", HttpPort: 8080, Timeout: 5}, true},
+		{config.ProbeConfig{Command: []string{"true"}}, true},
+		{config.ProbeConfig{}, false},
+		{config.ProbeConfig{TcpPort: 70000}, false},
+		{config.ProbeConfig{HttpPath: "/health"}, false},
+		{config.ProbeConfig{HttpPath: "health", HttpPort: 80}, false},
+		{config.ProbeConfig{HttpPort: 80}, false},
+		{config.ProbeConfig{TcpPort: 22, Command: []string{"true"}}, false},
+		{config.ProbeConfig{TcpPort: 22, Timeout: -1}, false},
+	} {
+		if err := ValidateProbe(tc.probe); (err == nil) != tc.valid {
+			t.Errorf("ValidateProbe(%+v) = %v", tc.probe, err)
+		}
+	}
+}
+
+// Returns a prober that dials addr for every probe.
+func proberFor(addr string) Prober {
+	return Prober{
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestProberCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	_, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	p := proberFor(server.Listener.Addr().String())
+
+	for _, tc := range []struct {
+		probe config.ProbeConfig
+		pass  bool
+	}{
+		{config.ProbeConfig{TcpPort: port}, true},
+		{config.ProbeConfig{HttpPath: "/ready", HttpPort: port}, true},
+		{config.ProbeConfig{HttpPath: "/other", HttpPort: port}, false},
+		// Command probes need Run.
+		{config.ProbeConfig{Command: []string{"true"}}, false},
+	} {
+		if err := p.Check(context.Background(), tc.probe); (err == nil) != tc.pass {
+			t.Errorf("Check(%+v) = %v", tc.probe, err)
+		}
+	}
+
+	p.Run = func(ctx context.Context, args []string) error {
+		if args[0] != "true" {
+			return fmt.Errorf("exit status 1")
+		}
+
+		return nil
+	}
+
+	if err := p.Check(context.Background(), config.ProbeConfig{Command: []string{"true"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProberWait(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listen.Addr().String()
+	listen.Close()
+
+	p := proberFor(addr)
+
+	// Nothing is listening so the probe times out.
+	start := time.Now()
+	if err := p.Wait(context.Background(), config.ProbeConfig{TcpPort: 1, Timeout: 1}); err == nil {
+		t.Fatal("expected the probe to time out")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("timeout took %s", took)
+	}
+
+	// The probe passes once something starts listening.
+	started := make(chan net.Listener, 1)
+	time.AfterFunc(200*time.Millisecond, func() {
+		listen, err := net.Listen("tcp", addr)
+		if err != nil {
+			close(started)
+			return
+		}
+
+		started <- listen
+	})
+	defer func() {
+		if listen, ok := <-started; ok {
+			listen.Close()
+		}
+	}()
+
+	if err := p.Wait(context.Background(), config.ProbeConfig{TcpPort: 1, Timeout: 5}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package common
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func sysProcAttr(cmd *exec.Cmd) *syscall.SysProcAttr {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	return cmd.SysProcAttr
+}
+
+// InterruptProcess asks a process to exit so it can clean up after itself.
+func InterruptProcess(proc *os.Process) error {
+	return proc.Signal(syscall.SIGTERM)
+}
+
+// StartProcessGroup makes cmd the leader of a new process group when it's
+// started so it can be killed along with its children by KillProcessGroup.
+// The process can't read from the terminal.
+func StartProcessGroup(cmd *exec.Cmd) {
+	sysProcAttr(cmd).Setpgid = true
+}
+
+// KillProcessGroup kills a process started with StartProcessGroup and every
+// process in its group.
+func KillProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
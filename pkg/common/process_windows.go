@@ -0,0 +1,35 @@
+//go:build windows
+
+package common
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+func sysProcAttr(cmd *exec.Cmd) *syscall.SysProcAttr {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	return cmd.SysProcAttr
+}
+
+// InterruptProcess asks a process to exit. Windows has no equivalent of
+// SIGTERM for console processes so it's killed.
+func InterruptProcess(proc *os.Process) error {
+	return proc.Kill()
+}
+
+// StartProcessGroup starts cmd in a new process group.
+func StartProcessGroup(cmd *exec.Cmd) {
+	sysProcAttr(cmd).CreationFlags |= windows.CREATE_NEW_PROCESS_GROUP
+}
+
+// KillProcessGroup kills a process started with StartProcessGroup.
+func KillProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProfileEntry records how one definition was built.
+type ProfileEntry struct {
+	Id   int    `json:"id"`
+	Tag  string `json:"tag"`
+	Hash string `json:"hash,omitempty"`
+	// The id of the definition that depends on this one. -1 for the
+	// definition that was requested.
+	Parent       int   `json:"parent"`
+	Dependencies []int `json:"dependencies,omitempty"`
+
+	Cached bool   `json:"cached"`
+	Error  string `json:"error,omitempty"`
+
+	// When the build started relative to the start of the profile.
+	Start time.Duration `json:"start"`
+	// The total time the build took.
+	Wall time.Duration `json:"wall"`
+	// Time spent waiting for dependencies to build.
+	DependencyWait time.Duration `json:"dependency_wait"`
+	// Time spent on this definition alone.
+	Self time.Duration `json:"self"`
+
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	BytesWritten    int64 `json:"bytes_written"`
+
+	// When the build started and finished. Cached results that were never
+	// started finish when they start.
+	started   time.Time
+	finished  time.Time
+	downloads map[string]int64
+}
+
+// BuildProfile is the report written by build --profile.
+type BuildProfile struct {
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+
+	CacheHits   int `json:"cache_hits"`
+	CacheMisses int `json:"cache_misses"`
+
+	Definitions []*ProfileEntry `json:"definitions"`
+	// The ids of the chain of definitions that took the longest to build
+	// starting with the requested definition.
+	CriticalPath []int `json:"critical_path"`
+}
+
+// BuildProfiler builds a BuildProfile from build events.
+type BuildProfiler struct {
+	mtx     sync.Mutex
+	started time.Time
+	entries []*ProfileEntry
+	// Definitions currently being built keyed by hash. Builds may finish in
+	// any order when dependencies are built in parallel.
+	running map[string]*ProfileEntry
+}
+
+func (p *BuildProfiler) add(ev Event) *ProfileEntry {
+	ent := &ProfileEntry{
+		Id:        len(p.entries),
+		Tag:       ev.Tag,
+		Hash:      ev.Hash,
+		Parent:    -1,
+		Start:     ev.Time.Sub(p.started),
+		started:   ev.Time,
+		finished:  ev.Time,
+		downloads: make(map[string]int64),
+	}
+
+	if parent, ok := p.running[ev.Parent]; ok {
+		ent.Parent = parent.Id
+		parent.Dependencies = append(parent.Dependencies, ent.Id)
+	}
+
+	p.entries = append(p.entries, ent)
+
+	return ent
+}
+
+// The total time covered by spans. Overlapping spans are only counted once.
+func unionDuration(spans [][2]time.Time) time.Duration {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0].Before(spans[j][0]) })
+
+	var (
+		total time.Duration
+		end   time.Time
+	)
+
+	for _, span := range spans {
+		start := span[0]
+		if start.Before(end) {
+			start = end
+		}
+
+		if span[1].After(start) {
+			total += span[1].Sub(start)
+			end = span[1]
+		}
+	}
+
+	return total
+}
+
+func (p *BuildProfiler) finish(ent *ProfileEntry, ev Event) {
+	ent.finished = ev.Time
+	ent.Wall = ent.finished.Sub(ent.started)
+
+	delete(p.running, ent.Hash)
+
+	// Dependencies built in parallel overlap so the time waiting for them is
+	// the union of their spans within this build.
+	var spans [][2]time.Time
+
+	for _, id := range ent.Dependencies {
+		dep := p.entries[id]
+
+		start, end := dep.started, dep.finished
+		if _, ok := p.running[dep.Hash]; ok {
+			end = ent.finished
+		}
+
+		if start.Before(ent.started) {
+			start = ent.started
+		}
+		if end.After(ent.finished) {
+			end = ent.finished
+		}
+
+		spans = append(spans, [2]time.Time{start, end})
+	}
+
+	ent.DependencyWait = unionDuration(spans)
+	ent.Self = ent.Wall - ent.DependencyWait
+}
+
+// Handle records ev. It can be used as an EventHandler.
+func (p *BuildProfiler) Handle(ev Event) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	switch ev.Kind {
+	case EventBuildStarted:
+		ent := p.add(ev)
+
+		p.running[ent.Hash] = ent
+	case EventBuildCached:
+		// Cached results may be returned after the build started.
+		if ent, ok := p.running[ev.Hash]; ok {
+			ent.Cached = true
+			p.finish(ent, ev)
+			return
+		}
+
+		ent := p.add(ev)
+
+		ent.Cached = true
+		ent.BytesWritten = ev.Size
+	case EventBuildFinished:
+		if ent, ok := p.running[ev.Hash]; ok {
+			ent.BytesWritten = ev.Size
+			p.finish(ent, ev)
+		}
+	case EventBuildFailed:
+		// Definitions that failed before starting are not recorded.
+		if ent, ok := p.running[ev.Hash]; ok {
+			ent.Error = ev.Error
+			p.finish(ent, ev)
+		}
+	case EventDownloadProgress:
+		if ent, ok := p.running[ev.Hash]; ok {
+			// Download events report the total received so far.
+			ent.BytesDownloaded += ev.Bytes - ent.downloads[ev.Url]
+			ent.downloads[ev.Url] = ev.Bytes
+		}
+	}
+}
+
+// Report returns the profile of the builds recorded so far.
+func (p *BuildProfiler) Report() *BuildProfile {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	ret := &BuildProfile{
+		Started:      p.started,
+		Duration:     time.Since(p.started),
+		Definitions:  p.entries,
+		CriticalPath: []int{},
+	}
+
+	for _, ent := range p.entries {
+		if ent.Cached {
+			ret.CacheHits += 1
+		} else {
+			ret.CacheMisses += 1
+		}
+	}
+
+	// Start with the longest top level build and follow the slowest
+	// dependency of each definition.
+	var next []int
+	for _, ent := range p.entries {
+		if ent.Parent == -1 {
+			next = append(next, ent.Id)
+		}
+	}
+
+	for len(next) > 0 {
+		slowest := next[0]
+		for _, id := range next[1:] {
+			if p.entries[id].Wall > p.entries[slowest].Wall {
+				slowest = id
+			}
+		}
+
+		ret.CriticalPath = append(ret.CriticalPath, slowest)
+
+		next = p.entries[slowest].Dependencies
+	}
+
+	return ret
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// WriteSummary prints the critical path and the top offenders by the time
+// spent on each definition excluding its dependencies.
+func (profile *BuildProfile) WriteSummary(w io.Writer, top int) {
+	fmt.Fprintf(w, "build took %s (%d cached, %d built)\n",
+		profile.Duration.Round(time.Millisecond), profile.CacheHits, profile.CacheMisses)
+
+	fmt.Fprintf(w, "\ncritical path:\n")
+	for i, id := range profile.CriticalPath {
+		ent := profile.Definitions[id]
+
+		fmt.Fprintf(w, "  %*s%s: %s (self %s)\n",
+			i*2, "", ent.Tag, ent.Wall.Round(time.Millisecond), ent.Self.Round(time.Millisecond))
+	}
+
+	offenders := make([]*ProfileEntry, len(profile.Definitions))
+	copy(offenders, profile.Definitions)
+
+	sort.SliceStable(offenders, func(i, j int) bool {
+		return offenders[i].Self > offenders[j].Self
+	})
+
+	if len(offenders) > top {
+		offenders = offenders[:top]
+	}
+
+	fmt.Fprintf(w, "\ntop offenders:\n")
+	for _, ent := range offenders {
+		fmt.Fprintf(w, "  %10s  %s (downloaded %s, wrote %s)\n",
+			ent.Self.Round(time.Millisecond), ent.Tag,
+			formatBytes(ent.BytesDownloaded), formatBytes(ent.BytesWritten))
+	}
+}
+
+func NewBuildProfiler() *BuildProfiler {
+	return &BuildProfiler{started: time.Now(), running: make(map[string]*ProfileEntry)}
+}
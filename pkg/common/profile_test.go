@@ -0,0 +1,179 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Feeds events to a profiler. Times are seconds after the profile started.
+func profileEvents(events ...Event) *BuildProfile {
+	p := NewBuildProfiler()
+
+	for _, ev := range events {
+		ev.Time = p.started.Add(ev.Duration * time.Second)
+		ev.Duration = 0
+
+		p.Handle(ev)
+	}
+
+	return p.Report()
+}
+
+func started(at time.Duration, hash string, parent string) Event {
+	return Event{Kind: EventBuildStarted, Tag: hash, Hash: hash, Parent: parent, Duration: at}
+}
+
+func finished(at time.Duration, hash string) Event {
+	return Event{Kind: EventBuildFinished, Tag: hash, Hash: hash, Duration: at}
+}
+
+func failed(at time.Duration, hash string) Event {
+	return Event{Kind: EventBuildFailed, Tag: hash, Hash: hash, Error: "exit status 1", Duration: at}
+}
+
+func downloaded(at time.Duration, hash string, url string, bytes int64) Event {
+	return Event{Kind: EventDownloadProgress, Hash: hash, Url: url, Bytes: bytes, Duration: at}
+}
+
+func TestUnionDuration(t *testing.T) {
+	base := time.Now()
+	span := func(start, end time.Duration) [2]time.Time {
+		return [2]time.Time{base.Add(start * time.Second), base.Add(end * time.Second)}
+	}
+
+	for _, tc := range []struct {
+		spans    [][2]time.Time
+		expected time.Duration
+	}{
+		{nil, 0},
+		{[][2]time.Time{span(0, 2)}, 2 * time.Second},
+		{[][2]time.Time{span(0, 2), span(3, 4)}, 3 * time.Second},
+		{[][2]time.Time{span(0, 4), span(1, 3)}, 4 * time.Second},
+		{[][2]time.Time{span(2, 5), span(0, 3)}, 5 * time.Second},
+		{[][2]time.Time{span(1, 1), span(1, 2)}, 1 * time.Second},
+	} {
+		if got := unionDuration(tc.spans); got != tc.expected {
+			t.Errorf("unionDuration(%v) = %s, expected %s", tc.spans, got, tc.expected)
+		}
+	}
+}
+
+func TestBuildProfilerSequential(t *testing.T) {
+	profile := profileEvents(
+		started(0, "root", ""),
+		started(1, "a", "root"),
+		finished(3, "a"),
+		started(4, "b", "root"),
+		finished(5, "b"),
+		Event{Kind: EventBuildCached, Tag: "c", Hash: "c", Parent: "root", Duration: 6},
+		finished(10, "root"),
+	)
+
+	if len(profile.Definitions) != 4 {
+		t.Fatalf("expected 4 definitions, got %d", len(profile.Definitions))
+	}
+
+	root := profile.Definitions[0]
+	if root.Wall != 10*time.Second || root.DependencyWait != 3*time.Second || root.Self != 7*time.Second {
+		t.Fatalf("unexpected times for root: wall %s wait %s self %s", root.Wall, root.DependencyWait, root.Self)
+	}
+
+	if len(root.Dependencies) != 3 {
+		t.Fatalf("expected root to have 3 dependencies, got %v", root.Dependencies)
+	}
+
+	if profile.CacheHits != 1 || profile.CacheMisses != 3 {
+		t.Fatalf("expected 1 hit and 3 misses, got %d and %d", profile.CacheHits, profile.CacheMisses)
+	}
+
+	if got := profile.CriticalPath; len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("unexpected critical path: %v", got)
+	}
+}
+
+func TestBuildProfilerParallel(t *testing.T) {
+	// b and c are built at the same time and finish in the opposite order
+	// they started. The time root waits for them is only counted once.
+	profile := profileEvents(
+		started(0, "root", ""),
+		started(1, "a", "root"),
+		finished(1, "a"),
+		started(2, "b", "root"),
+		started(2, "c", "root"),
+		finished(5, "c"),
+		finished(6, "b"),
+		finished(8, "root"),
+	)
+
+	root := profile.Definitions[0]
+	if len(root.Dependencies) != 3 {
+		t.Fatalf("expected root to have 3 dependencies, got %v", root.Dependencies)
+	}
+
+	if root.DependencyWait != 4*time.Second || root.Self != 4*time.Second {
+		t.Fatalf("unexpected times for root: wait %s self %s", root.DependencyWait, root.Self)
+	}
+
+	b := profile.Definitions[2]
+	c := profile.Definitions[3]
+	if b.Wall != 4*time.Second || c.Wall != 3*time.Second {
+		t.Fatalf("unexpected wall times: b %s c %s", b.Wall, c.Wall)
+	}
+}
+
+func TestBuildProfilerFailed(t *testing.T) {
+	profile := profileEvents(
+		started(0, "root", ""),
+		started(1, "a", "root"),
+		failed(3, "a"),
+		failed(4, "root"),
+		// Definitions that fail before starting are not recorded.
+		failed(5, "missing"),
+	)
+
+	if len(profile.Definitions) != 2 {
+		t.Fatalf("expected 2 definitions, got %d", len(profile.Definitions))
+	}
+
+	for _, ent := range profile.Definitions {
+		if ent.Error == "" {
+			t.Fatalf("expected %s to have failed", ent.Tag)
+		}
+	}
+
+	if root := profile.Definitions[0]; root.Wall != 4*time.Second || root.DependencyWait != 2*time.Second {
+		t.Fatalf("unexpected times for root: wall %s wait %s", root.Wall, root.DependencyWait)
+	}
+
+	var out bytes.Buffer
+	profile.WriteSummary(&out, 5)
+
+	if !strings.Contains(out.String(), "critical path:\n  root: 4s (self 2s)\n    a: 2s (self 2s)\n") {
+		t.Fatalf("unexpected summary:\n%s", out.String())
+	}
+}
+
+func TestBuildProfilerDownloads(t *testing.T) {
+	// Downloads in parallel builds are counted for the definition they
+	// belong to rather than the one that started last.
+	profile := profileEvents(
+		started(0, "root", ""),
+		started(1, "a", "root"),
+		started(2, "b", "root"),
+		downloaded(3, "a", "http://example.com/a", 100),
+		downloaded(3, "b", "http://example.com/b", 50),
+		downloaded(4, "a", "http://example.com/a", 300),
+		downloaded(4, "missing", "http://example.com/c", 1000),
+		finished(5, "a"),
+		finished(5, "b"),
+		finished(6, "root"),
+	)
+
+	for i, expected := range []int64{0, 300, 50} {
+		if got := profile.Definitions[i].BytesDownloaded; got != expected {
+			t.Errorf("expected %s to download %d bytes, got %d", profile.Definitions[i].Tag, expected, got)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 type CPUArchitecture string
@@ -84,6 +85,71 @@ type DefaultInteractiveFragment struct {
 	Args []string `json:"args"`
 }
 
+// Checks if something in the guest is ready. Exactly one of Command, HttpPath
+// or TcpPort should be set.
+type ProbeConfig struct {
+	// Ready when something accepts connections on this TCP port in the guest.
+	TcpPort int `json:"tcp_port,omitempty" yaml:"tcp_port,omitempty"`
+	// Ready when a GET of this path on HttpPort returns 200.
+	HttpPath string `json:"http_path,omitempty" yaml:"http_path,omitempty"`
+	HttpPort int    `json:"http_port,omitempty" yaml:"http_port,omitempty"`
+	// Ready when this command exits with 0. Only run inside the guest.
+	Command []string `json:"command,omitempty" yaml:"command,omitempty"`
+	// Seconds to wait for the probe to pass before giving up (default: 60).
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// A long running process started and supervised by init in the guest.
+type ServiceConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// The command and arguments to run.
+	Command []string `json:"command" yaml:"command"`
+	// Extra environment variables in the form KEY=value.
+	Environment []string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// The directory the service runs in (default: /).
+	WorkingDirectory string `json:"working_directory,omitempty" yaml:"working_directory,omitempty"`
+	// The user to run the service as. Either a name or uid[:gid] (default: root).
+	User string `json:"user,omitempty" yaml:"user,omitempty"`
+	// When to restart the service after it exits (options: [no, on-failure, always], default: on-failure).
+	Restart string `json:"restart,omitempty" yaml:"restart,omitempty"`
+	// The names of services that must be ready before this one starts.
+	DependsOn []string `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
+	// The service is ready once this probe passes. Without a probe the service is ready as soon as it starts.
+	Ready *ProbeConfig `json:"ready,omitempty" yaml:"ready,omitempty"`
+}
+
+// A command sent by the host to init in the guest over the control channel.
+type ControlCommand struct {
+	// The only command is "shutdown".
+	Command string `json:"command"`
+	Reason  string `json:"reason,omitempty"`
+	// Seconds the guest has to shutdown before the host stops it.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// The exit code of a service stopped during shutdown. Services killed by a
+// signal or that never started report -1.
+type ServiceExit struct {
+	Name     string `json:"name"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// Sent by init in the guest to the host just before it powers off.
+type ShutdownReport struct {
+	Reason   string        `json:"reason"`
+	Services []ServiceExit `json:"services"`
+	// Set if the filesystems could not be unmounted.
+	Error string `json:"error,omitempty"`
+}
+
+type ServiceFragment struct {
+	Service ServiceConfig `json:"service" yaml:"service"`
+}
+
+type ReadinessProbeFragment struct {
+	Probe ProbeConfig `json:"probe" yaml:"probe"`
+}
+
 type Fragment struct {
 	// Not supported by TinyRange directly.
 	RunCommand         *RunCommandFragment         `json:"run_command,omitempty" yaml:"run_command"`
@@ -94,6 +160,95 @@ type Fragment struct {
 	Archive            *ArchiveFragment            `json:"archive,omitempty" yaml:"archive"`
 	Builtin            *BuiltinFragment            `json:"builtin,omitempty" yaml:"builtin"`
 	ExportPort         *ExportPortFragment         `json:"export_port,omitempty" yaml:"export_port"`
+	Service            *ServiceFragment            `json:"service,omitempty" yaml:"service"`
+	ReadinessProbe     *ReadinessProbeFragment     `json:"readiness_probe,omitempty" yaml:"readiness_probe"`
+}
+
+// Configures the NoCloud seed passed to cloud-init in stock cloud images.
+type CloudInitConfig struct {
+	// Raw user-data to pass to cloud-init. Replaces the generated #cloud-config if set.
+	UserData string `json:"user_data,omitempty" yaml:"user_data,omitempty"`
+	// Packages to install with the distribution package manager.
+	Packages []string `json:"packages,omitempty" yaml:"packages,omitempty"`
+	// Commands to run on first boot.
+	RunCommands []string `json:"run_commands,omitempty" yaml:"run_commands,omitempty"`
+	// How the seed is provided to the guest (options: [disk, http], default: disk).
+	Datasource string `json:"datasource,omitempty" yaml:"datasource,omitempty"`
+}
+
+// Attaches a persistent volume to the virtual machine.
+type VolumeConfig struct {
+	// The name of a volume created with `tinyrange volume create`.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// A raw ext4 disk image on the host to use instead of a named volume.
+	HostFilename string `json:"host_filename,omitempty" yaml:"host_filename,omitempty"`
+	// Where to mount the volume in the guest.
+	MountPoint string `json:"mount_point" yaml:"mount_point"`
+	// How the volume is attached (options: [disk, overlay], default: disk).
+	// overlay keeps the contents of MountPoint from the generated root and stores changes on the volume.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Attach the volume read-only.
+	ReadOnly bool `json:"read_only,omitempty" yaml:"read_only,omitempty"`
+}
+
+// ParseVolumeSpec parses a volume from the command line in the form
+// name:mount_point[:mode]. If name contains a path separator it's treated as
+// a host filename. The spec is split from the right so host filenames can
+// contain colons like Windows drive letters.
+func ParseVolumeSpec(spec string) (VolumeConfig, error) {
+	invalid := fmt.Errorf("invalid volume syntax (name:mount_point[:mode]): %s", spec)
+
+	rest, last, ok := cutLast(spec, ":")
+	if !ok {
+		return VolumeConfig{}, invalid
+	}
+
+	var vol VolumeConfig
+
+	// The mount point is a absolute path in the guest so anything else is
+	// the mode.
+	if !strings.HasPrefix(last, "/") {
+		if !strings.Contains(rest, ":") {
+			return VolumeConfig{}, invalid
+		}
+
+		switch last {
+		case "disk", "overlay":
+			vol.Mode = last
+		case "ro":
+			vol.ReadOnly = true
+		default:
+			return VolumeConfig{}, fmt.Errorf("unknown volume mode: %s", last)
+		}
+
+		rest, last, ok = cutLast(rest, ":")
+		if !ok {
+			return VolumeConfig{}, invalid
+		}
+	}
+
+	if rest == "" || !strings.HasPrefix(last, "/") {
+		return VolumeConfig{}, invalid
+	}
+
+	if strings.ContainsAny(rest, "/\\") {
+		vol.HostFilename = rest
+	} else {
+		vol.Name = rest
+	}
+
+	vol.MountPoint = last
+
+	return vol, nil
+}
+
+// Like strings.Cut but splits around the last instance of sep.
+func cutLast(s string, sep string) (before string, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+
+	return s, "", false
 }
 
 // A config file that can be passed to TinyRange to configure and execute a virtual machine.
@@ -122,6 +277,38 @@ type TinyRangeConfig struct {
 	HypervisorConfig map[string]string `json:"hypervisor_config" yaml:"hypervisor_config"`
 	// Redirect hypervisor input to the host. The VM will exit after it completes initialization.
 	Debug bool `json:"debug" yaml:"debug"`
+	// The hostname of the guest (default: tinyrange).
+	Hostname string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	// SSH public keys in authorized_keys format that are allowed to login to the guest.
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty" yaml:"ssh_authorized_keys,omitempty"`
+	// User supplied key/value metadata the guest can query from the host metadata service.
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	// A disk image (raw or qcow2) to boot instead of a root filesystem built from RootFsFragments.
+	// If no kernel is specified the image is booted using the hypervisor firmware.
+	DiskImageFilename string `json:"disk_image_filename,omitempty" yaml:"disk_image_filename,omitempty"`
+	// Generate a cloud-init NoCloud seed for the guest.
+	CloudInit *CloudInitConfig `json:"cloud_init,omitempty" yaml:"cloud_init,omitempty"`
+	// Persistent volumes to attach to the guest.
+	Volumes []VolumeConfig `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	// Save the complete state of the virtual machine under this name once the guest reports it's ready.
+	SaveSnapshot string `json:"save_snapshot,omitempty" yaml:"save_snapshot,omitempty"`
+	// Restore a snapshot saved with SaveSnapshot instead of booting. Most other options are taken from the snapshot.
+	RestoreSnapshot string `json:"restore_snapshot,omitempty" yaml:"restore_snapshot,omitempty"`
+	// The unix socket the QMP monitor of the hypervisor listens on (default: a socket in a private temporary directory).
+	MonitorAddress string `json:"monitor_address,omitempty" yaml:"monitor_address,omitempty"`
+	// Seconds to wait for the guest to power off before the hypervisor is stopped (default: 10).
+	// The TinyRange init uses this time to stop services in reverse dependency order and unmount
+	// filesystems.
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty" yaml:"shutdown_timeout,omitempty"`
+	// Services started and supervised by init in the guest.
+	Services []ServiceConfig `json:"services,omitempty" yaml:"services,omitempty"`
+	// The guest is only considered ready once all of these probes pass. Port forwards and SSH
+	// commands wait for the guest to be ready if any probes or services are declared.
+	// TCP and HTTP probes are run from the host. Command probes are run by init in the guest.
+	ReadinessProbes []ProbeConfig `json:"readiness_probes,omitempty" yaml:"readiness_probes,omitempty"`
+	// Write the paths in the root filesystem that later fragments replaced or removed to this file.
+	// Each line has the action (replaced or removed), the path and the fragment separated by tabs.
+	LayerReportFilename string `json:"layer_report_filename,omitempty" yaml:"layer_report_filename,omitempty"`
 }
 
 func (cfg TinyRangeConfig) Resolve(filename string) string {
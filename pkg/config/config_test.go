@@ -0,0 +1,42 @@
+package config
+
+import "testing"
+
+func TestParseVolumeSpec(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		expected VolumeConfig
+	}{
+		{"home:/home", VolumeConfig{Name: "home", MountPoint: "/home"}},
+		{"home:/home:overlay", VolumeConfig{Name: "home", MountPoint: "/home", Mode: "overlay"}},
+		{"home:/home:ro", VolumeConfig{Name: "home", MountPoint: "/home", ReadOnly: true}},
+		{"./data.img:/data", VolumeConfig{HostFilename: "./data.img", MountPoint: "/data"}},
+		{"/srv/data.img:/data:disk", VolumeConfig{HostFilename: "/srv/data.img", MountPoint: "/data", Mode: "disk"}},
+		// Windows paths contain a drive letter.
+		{`C:\data\home.img:/home`, VolumeConfig{HostFilename: `C:\data\home.img`, MountPoint: "/home"}},
+		{`C:\data\home.img:/home:ro`, VolumeConfig{HostFilename: `C:\data\home.img`, MountPoint: "/home", ReadOnly: true}},
+	} {
+		vol, err := ParseVolumeSpec(tc.spec)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", tc.spec, err)
+		}
+
+		if vol != tc.expected {
+			t.Fatalf("expected %q to parse as %+v, got %+v", tc.spec, tc.expected, vol)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"home",
+		"home:",
+		":/home",
+		"home:data",
+		"home:/home:bogus",
+		`C:\home.img`,
+	} {
+		if _, err := ParseVolumeSpec(spec); err == nil {
+			t.Fatalf("expected %q to fail", spec)
+		}
+	}
+}
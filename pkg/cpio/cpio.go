@@ -55,7 +55,21 @@ func (m cpioMode) setMode(mode fs.FileMode) cpioMode {
 }
 
 func makeCpioMode(k cpioKind, mode fs.FileMode) cpioMode {
-	return cpioMode(uint64(k) + uint64(mode))
+	// Only keep the permission bits. The type comes from k and the type bits
+	// of fs.FileMode don't fit in the cpio mode.
+	m := uint64(k) | uint64(mode&07777)
+
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+
+	return cpioMode(m)
 }
 
 func (m cpioMode) mode() fs.FileMode {
@@ -197,6 +211,9 @@ type cpioEntry struct {
 	mtime   time.Time
 	content []byte
 	name    string
+	// The device numbers of character and block devices.
+	rDevMajor uint64
+	rDevMinor uint64
 }
 
 // Children implements entry.
@@ -226,18 +243,18 @@ func (ent *cpioEntry) Write(e entry, w *cpioWriter, namePrefix string) error {
 	}
 
 	hdr := cpioHeader{
-		Ino:      inode,
-		Mode:     makeCpioMode(e.Kind(), ent.mode),
-		Uid:      uint64(ent.uid),
-		Gid:      uint64(ent.gid),
-		NLink:    nLinks,
-		MTime:    uint64(ent.mtime.Unix()),
-		FileSize: uint64(len(ent.content)),
-		DevMajor: 10,
-		DevMinor: 1,
-		// RDevMajor: uint64(n.rDevMajor),
-		// RDevMinor: uint64(n.rDevMinor),
-		Name: namePrefix + ent.name,
+		Ino:       inode,
+		Mode:      makeCpioMode(e.Kind(), ent.mode),
+		Uid:       uint64(ent.uid),
+		Gid:       uint64(ent.gid),
+		NLink:     nLinks,
+		MTime:     uint64(ent.mtime.Unix()),
+		FileSize:  uint64(len(ent.content)),
+		DevMajor:  10,
+		DevMinor:  1,
+		RDevMajor: ent.rDevMajor,
+		RDevMinor: ent.rDevMinor,
+		Name:      namePrefix + ent.name,
 	}
 
 	err := w.writeHeader(hdr)
@@ -279,6 +296,12 @@ func (file *file) makeSymlink(linkname string) {
 	file.content = []byte(linkname)
 }
 
+func (file *file) makeSpecial(kind cpioKind, major int64, minor int64) {
+	file.kind = kind
+	file.rDevMajor = uint64(major)
+	file.rDevMinor = uint64(minor)
+}
+
 func newFile(name string) (*file, error) {
 	if name == "" {
 		return nil, fmt.Errorf("empty name")
@@ -466,6 +489,33 @@ func (fs *Filesystem) AddFromEntry(prefix string, hdr filesystem.Entry) error {
 		} else {
 			ent = fs.root
 		}
+	case filesystem.TypeCharDevice, filesystem.TypeBlockDevice, filesystem.TypeFifo, filesystem.TypeSocket:
+		parent, name, err := fs.openPath(cleanedName, true)
+		if err != nil {
+			return err
+		}
+
+		f, err := parent.create(name)
+		if err != nil {
+			return err
+		}
+
+		var kind cpioKind
+
+		switch hdr.Typeflag() {
+		case filesystem.TypeCharDevice:
+			kind = _CPIO_KIND_CHAR_SPECIAL
+		case filesystem.TypeBlockDevice:
+			kind = _CPIO_KIND_BLOCK_SPECIAL
+		case filesystem.TypeFifo:
+			kind = _CPIO_KIND_NAMED_PIPE
+		default:
+			kind = _CPIO_KIND_SOCKET
+		}
+
+		f.makeSpecial(kind, hdr.Devmajor(), hdr.Devminor())
+
+		ent = f
 	default:
 		return fmt.Errorf("Filesystem.AddFromEntry: Typeflag not implemented: %s", hdr.Typeflag())
 	}
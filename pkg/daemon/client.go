@@ -0,0 +1,186 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/instance"
+)
+
+// DefaultSocket returns the default address of the daemon socket.
+func DefaultSocket(runtimeDir string) string {
+	return filepath.Join(runtimeDir, "daemon.sock")
+}
+
+// Client talks to a daemon over its unix socket.
+type Client struct {
+	client *http.Client
+}
+
+func (c *Client) do(method string, path string, body any, ret any) error {
+	var reqBody io.Reader
+
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		reqBody = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, "http://daemon"+path, reqBody)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+
+		return fmt.Errorf("%s", apiErr.Error)
+	}
+
+	if ret == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(ret)
+}
+
+// Status returns the status of the daemon. Returns a error if the daemon is
+// not running.
+func (c *Client) Status() (*Status, error) {
+	var status Status
+
+	if err := c.do(http.MethodGet, "/v1/status", nil, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// SubmitBuild queues a build and returns without waiting for it.
+func (c *Client) SubmitBuild(req BuildRequest) (*Job, error) {
+	var job Job
+
+	if err := c.do(http.MethodPost, "/v1/builds", req, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (c *Client) GetBuild(id int) (*Job, error) {
+	var job Job
+
+	if err := c.do(http.MethodGet, fmt.Sprintf("/v1/builds/%d", id), nil, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// CancelBuild stops a queued or running build.
+func (c *Client) CancelBuild(id int) error {
+	return c.do(http.MethodPost, fmt.Sprintf("/v1/builds/%d/cancel", id), nil, nil)
+}
+
+// FollowBuild copies the log of a build to out until it finishes and returns
+// the final state of the job.
+func (c *Client) FollowBuild(id int, out io.Writer) (*Job, error) {
+	resp, err := c.client.Get(fmt.Sprintf("http://daemon/v1/builds/%d/logs?follow=1", id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("daemon returned %s", resp.Status)
+	}
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return nil, err
+	}
+
+	return c.GetBuild(id)
+}
+
+// QueryPackages searches a container builder for packages matching query.
+func (c *Client) QueryPackages(builder string, query string) ([]string, error) {
+	var packages []string
+
+	path := "/v1/packages?" + url.Values{"builder": {builder}, "q": {query}}.Encode()
+
+	if err := c.do(http.MethodGet, path, nil, &packages); err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+func (c *Client) ListInstances() ([]*instance.Instance, error) {
+	var instances []*instance.Instance
+
+	if err := c.do(http.MethodGet, "/v1/instances", nil, &instances); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// StartInstance starts a virtual machine in the background.
+func (c *Client) StartInstance(name string, cfg config.TinyRangeConfig) (*instance.Instance, error) {
+	var inst instance.Instance
+
+	if err := c.do(http.MethodPost, "/v1/instances", StartRequest{Name: name, Config: cfg}, &inst); err != nil {
+		return nil, err
+	}
+
+	return &inst, nil
+}
+
+func (c *Client) StopInstance(name string, timeout time.Duration) error {
+	return c.do(
+		http.MethodDelete,
+		fmt.Sprintf("/v1/instances/%s?timeout=%d", url.PathEscape(name), int(timeout.Seconds())),
+		nil, nil,
+	)
+}
+
+func NewClient(address string) *Client {
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", address)
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,600 @@
+// Package daemon implements a long running process that keeps the package
+// database loaded in memory and serves a HTTP/JSON API over a unix socket.
+//
+// Builds are submitted as jobs that run one at a time since the database is
+// not safe for concurrent use. The output of each job is recorded so it can
+// be followed by clients while the build is running.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/buildinfo"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/database"
+	"github.com/tinyrange/tinyrange/pkg/instance"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// The number of finished jobs that are kept so their state and logs can be
+// fetched. Older jobs are forgotten.
+const maxFinishedJobs = 100
+
+// BuildRequest is the body of POST /v1/builds.
+type BuildRequest struct {
+	// The definition to build in the same format as tinyrange build.
+	Definition string `json:"definition"`
+	// Build the definition even if there is a cached result.
+	AlwaysRebuild bool `json:"always_rebuild,omitempty"`
+	// The working directory of the client. Relative filenames in the
+	// definition and in load statements are resolved against it.
+	Cwd string `json:"cwd,omitempty"`
+}
+
+// Job reports the state of a submitted build.
+type Job struct {
+	Id         int       `json:"id"`
+	Definition string    `json:"definition"`
+	State      JobState  `json:"state"`
+	Submitted  time.Time `json:"submitted"`
+	Finished   time.Time `json:"finished"`
+	// The hash of the built definition.
+	Hash string `json:"hash,omitempty"`
+	// The filename of the build result on the host.
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	req    BuildRequest
+	log    *jobLog
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Status is the response of GET /v1/status.
+type Status struct {
+	Version  string    `json:"version"`
+	Pid      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	BuildDir string    `json:"build_dir"`
+	// The container builders that have been loaded into memory.
+	Loaded []string `json:"loaded"`
+}
+
+// StartRequest is the body of POST /v1/instances.
+type StartRequest struct {
+	Name   string                 `json:"name,omitempty"`
+	Config config.TinyRangeConfig `json:"config"`
+}
+
+type Server struct {
+	// Start a virtual machine in the background. Provided by the caller since
+	// it depends on how the supervisor is executed.
+	StartInstance func(cfg config.TinyRangeConfig, name string) (*instance.Instance, error)
+
+	db         *database.PackageDatabase
+	buildDir   string
+	runtimeDir string
+	started    time.Time
+
+	// Held while the database is in use.
+	dbMtx sync.Mutex
+
+	jobMtx    sync.Mutex
+	jobs      []*Job
+	nextId    int
+	queue     chan *Job
+	current   *Job
+	jobLogger slog.Handler
+
+	// Messages are written to stderr and recorded in the log of the running
+	// job.
+	logger *slog.Logger
+}
+
+// The log handler for the running job.
+func (s *Server) jobHandler() slog.Handler {
+	s.jobMtx.Lock()
+	defer s.jobMtx.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+
+	return s.jobLogger
+}
+
+// Forget the oldest finished jobs once there are more than maxFinishedJobs.
+// Must be called with jobMtx held.
+func (s *Server) pruneJobs() {
+	finished := 0
+	for _, job := range s.jobs {
+		if !job.Finished.IsZero() {
+			finished++
+		}
+	}
+
+	jobs := s.jobs[:0]
+	for _, job := range s.jobs {
+		if !job.Finished.IsZero() && finished > maxFinishedJobs {
+			finished--
+			continue
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	clear(s.jobs[len(jobs):])
+
+	s.jobs = jobs
+}
+
+func (s *Server) getJob(r *http.Request) (*Job, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid job id")
+	}
+
+	s.jobMtx.Lock()
+	defer s.jobMtx.Unlock()
+
+	for _, job := range s.jobs {
+		if job.Id == id {
+			return job, nil
+		}
+	}
+
+	return nil, fmt.Errorf("job %d not found", id)
+}
+
+// Return a copy of the job that is safe to encode.
+func (s *Server) snapshotJob(job *Job) Job {
+	s.jobMtx.Lock()
+	defer s.jobMtx.Unlock()
+
+	return *job
+}
+
+func (s *Server) runJob(job *Job) {
+	s.dbMtx.Lock()
+	defer s.dbMtx.Unlock()
+
+	s.jobMtx.Lock()
+	job.State = JobRunning
+	s.current = job
+	s.jobLogger = slog.NewTextHandler(job.log, &slog.HandlerOptions{Level: slog.LevelDebug})
+	s.jobMtx.Unlock()
+
+	hash, output, err := s.build(job.ctx, job.req)
+
+	job.cancel()
+
+	s.jobMtx.Lock()
+	s.current = nil
+	job.Finished = time.Now()
+	job.Hash = hash
+	job.Output = output
+	if err != nil && job.ctx.Err() != nil {
+		job.State = JobCancelled
+		job.Error = err.Error()
+		fmt.Fprintf(job.log, "build cancelled\n")
+	} else if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+		fmt.Fprintf(job.log, "build failed: %s\n", err)
+	} else {
+		job.State = JobSucceeded
+	}
+	s.pruneJobs()
+	s.jobMtx.Unlock()
+
+	job.log.Close()
+}
+
+func (s *Server) build(ctx context.Context, req BuildRequest) (string, string, error) {
+	s.db.WorkingDirectory = req.Cwd
+	defer func() { s.db.WorkingDirectory = "" }()
+
+	macroCtx := s.db.NewMacroContext()
+
+	macro, err := s.db.GetMacroByShorthand(macroCtx, req.Definition)
+	if err != nil {
+		return "", "", err
+	}
+
+	ret, err := macro.Call(macroCtx)
+	if err != nil {
+		return "", "", err
+	}
+
+	def, ok := ret.(common.BuildDefinition)
+	if !ok {
+		return "", "", fmt.Errorf("could not convert %T to BuildDefinition", ret)
+	}
+
+	if _, err := s.db.Build(s.db.NewBuildContextWithContext(ctx, def), def, common.BuildOptions{
+		AlwaysRebuild: req.AlwaysRebuild,
+	}); err != nil {
+		return "", "", err
+	}
+
+	hash, err := s.db.HashDefinition(def)
+	if err != nil {
+		return "", "", err
+	}
+
+	output, err := s.db.FilenameFromHash(hash, ".bin")
+	if err != nil {
+		return "", "", err
+	}
+
+	return hash, output, nil
+}
+
+func (s *Server) worker() {
+	for job := range s.queue {
+		s.runJob(job)
+	}
+}
+
+func (s *Server) writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Debug("failed to write response", "err", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	s.writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.writeJson(w, http.StatusOK, Status{
+		Version:  buildinfo.VERSION,
+		Pid:      os.Getpid(),
+		Started:  s.started,
+		BuildDir: s.buildDir,
+		Loaded:   s.db.LoadedContainerBuilders(),
+	})
+}
+
+func (s *Server) handleSubmitBuild(w http.ResponseWriter, r *http.Request) {
+	var req BuildRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Definition == "" {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("definition is required"))
+		return
+	}
+
+	// The daemon runs in its own directory so it can't guess what a relative
+	// path was meant to be relative to.
+	if req.Cwd != "" && !filepath.IsAbs(req.Cwd) {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("cwd must be absolute: %s", req.Cwd))
+		return
+	}
+
+	if filename, _, ok := strings.Cut(req.Definition, ":"); ok && !filepath.IsAbs(filename) && !strings.HasPrefix(filename, "//") && req.Cwd == "" {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("cwd is required for relative definition %s", req.Definition))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.jobMtx.Lock()
+
+	job := &Job{
+		Id:         s.nextId,
+		Definition: req.Definition,
+		State:      JobQueued,
+		Submitted:  time.Now(),
+		req:        req,
+		log:        newJobLog(),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	// The job is queued while jobMtx is held so it's never visible to
+	// clients unless it was accepted.
+	select {
+	case s.queue <- job:
+	default:
+		s.jobMtx.Unlock()
+		cancel()
+		s.writeError(w, http.StatusServiceUnavailable, fmt.Errorf("too many queued builds"))
+		return
+	}
+
+	s.nextId += 1
+	s.jobs = append(s.jobs, job)
+
+	s.jobMtx.Unlock()
+
+	s.writeJson(w, http.StatusAccepted, s.snapshotJob(job))
+}
+
+func (s *Server) handleListBuilds(w http.ResponseWriter, r *http.Request) {
+	s.jobMtx.Lock()
+
+	jobs := []Job{}
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	s.jobMtx.Unlock()
+
+	s.writeJson(w, http.StatusOK, jobs)
+}
+
+func (s *Server) handleGetBuild(w http.ResponseWriter, r *http.Request) {
+	job, err := s.getJob(r)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	s.writeJson(w, http.StatusOK, s.snapshotJob(job))
+}
+
+// Cancel a queued or running job. Child virtual machines are stopped and
+// partial outputs are removed before the job finishes.
+func (s *Server) handleCancelBuild(w http.ResponseWriter, r *http.Request) {
+	job, err := s.getJob(r)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	job.cancel()
+
+	s.writeJson(w, http.StatusAccepted, s.snapshotJob(job))
+}
+
+// Stream the log of a job. With ?follow=1 the response continues until the
+// job finishes.
+func (s *Server) handleBuildLogs(w http.ResponseWriter, r *http.Request) {
+	job, err := s.getJob(r)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	follow := r.URL.Query().Get("follow") == "1"
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	flusher, _ := w.(http.Flusher)
+
+	offset := 0
+
+	for {
+		data, ok := job.log.readFrom(offset, follow)
+		if !ok || (len(data) == 0 && !follow) {
+			return
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		offset += len(data)
+	}
+}
+
+// Search a container builder for packages. Takes the same query syntax as
+// tinyrange query.
+func (s *Server) handleQueryPackages(w http.ResponseWriter, r *http.Request) {
+	builderName := r.URL.Query().Get("builder")
+	if builderName == "" {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("builder is required"))
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		query = "*"
+	}
+
+	q, err := common.ParsePackageQuery(query)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	q.MatchDirect = true
+	q.MatchPartialName = true
+
+	s.dbMtx.Lock()
+	defer s.dbMtx.Unlock()
+
+	builder, err := s.db.GetContainerBuilder(s.db.NewBuildContext(nil), builderName, config.HostArchitecture)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	results, err := builder.Search(q)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	packages := []string{}
+	for _, result := range results {
+		packages = append(packages, result.String())
+	}
+
+	s.writeJson(w, http.StatusOK, packages)
+}
+
+func (s *Server) handleListInstances(w http.ResponseWriter, r *http.Request) {
+	instances, err := instance.List(s.runtimeDir)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if instances == nil {
+		instances = []*instance.Instance{}
+	}
+
+	s.writeJson(w, http.StatusOK, instances)
+}
+
+func (s *Server) handleStartInstance(w http.ResponseWriter, r *http.Request) {
+	if s.StartInstance == nil {
+		s.writeError(w, http.StatusNotImplemented, fmt.Errorf("starting instances is not supported"))
+		return
+	}
+
+	var req StartRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	inst, err := s.StartInstance(req.Config, req.Name)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.writeJson(w, http.StatusCreated, inst)
+}
+
+func (s *Server) handleStopInstance(w http.ResponseWriter, r *http.Request) {
+	timeout := 10
+
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+
+		timeout, err = strconv.Atoi(value)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout"))
+			return
+		}
+	}
+
+	inst, err := instance.Get(s.runtimeDir, r.PathValue("name"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := inst.Stop(time.Duration(timeout) * time.Second); err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/status", s.handleStatus)
+
+	mux.HandleFunc("GET /v1/builds", s.handleListBuilds)
+	mux.HandleFunc("POST /v1/builds", s.handleSubmitBuild)
+	mux.HandleFunc("GET /v1/builds/{id}", s.handleGetBuild)
+	mux.HandleFunc("GET /v1/builds/{id}/logs", s.handleBuildLogs)
+	mux.HandleFunc("POST /v1/builds/{id}/cancel", s.handleCancelBuild)
+
+	mux.HandleFunc("GET /v1/packages", s.handleQueryPackages)
+
+	mux.HandleFunc("GET /v1/instances", s.handleListInstances)
+	mux.HandleFunc("POST /v1/instances", s.handleStartInstance)
+	mux.HandleFunc("DELETE /v1/instances/{name}", s.handleStopInstance)
+
+	return mux
+}
+
+// Serve listens on the unix socket at address until it's closed.
+func (s *Server) Serve(address string) error {
+	// Remove the socket left behind by a daemon that didn't exit cleanly.
+	if _, err := NewClient(address).Status(); err == nil {
+		return fmt.Errorf("a daemon is already listening on %s", address)
+	}
+
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listen, err := net.Listen("unix", address)
+	if err != nil {
+		return err
+	}
+	defer listen.Close()
+
+	go s.worker()
+
+	s.logger.Info("daemon listening", "address", address)
+
+	return http.Serve(listen, s.handler())
+}
+
+// LoadAll loads every container builder so the first request doesn't have to
+// wait.
+func (s *Server) LoadAll() error {
+	s.dbMtx.Lock()
+	defer s.dbMtx.Unlock()
+
+	return s.db.LoadAll(true)
+}
+
+// New creates a server for db. The logger of db is replaced so messages from
+// builds are recorded in the log of the running job.
+func New(db *database.PackageDatabase, buildDir string, runtimeDir string) *Server {
+	s := &Server{
+		db:         db,
+		buildDir:   buildDir,
+		runtimeDir: runtimeDir,
+		started:    time.Now(),
+		queue:      make(chan *Job, 64),
+	}
+
+	level := slog.LevelInfo
+	if common.IsVerbose() {
+		level = slog.LevelDebug
+	}
+
+	s.logger = slog.New(&teeHandler{
+		base: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}),
+		job:  s.jobHandler,
+	})
+
+	db.Logger = s.logger
+
+	return s
+}
@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// A append-only log that can be followed while it's being written.
+type jobLog struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newJobLog() *jobLog {
+	l := &jobLog{}
+	l.cond = sync.NewCond(&l.mtx)
+	return l
+}
+
+// Write implements io.Writer.
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	n, err := l.buf.Write(p)
+
+	l.cond.Broadcast()
+
+	return n, err
+}
+
+func (l *jobLog) Close() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.closed = true
+
+	l.cond.Broadcast()
+}
+
+// Return the contents of the log after offset. If wait is true it blocks
+// until there is new content or the log is closed. ok is false once all the
+// content of a closed log has been read.
+func (l *jobLog) readFrom(offset int, wait bool) (data []byte, ok bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for wait && offset >= l.buf.Len() && !l.closed {
+		l.cond.Wait()
+	}
+
+	if offset >= l.buf.Len() {
+		return nil, !l.closed
+	}
+
+	return bytes.Clone(l.buf.Bytes()[offset:]), true
+}
+
+// A slog.Handler that passes every record to the original handler and also
+// records it in the log of the running job. Debug messages are always
+// captured since they report the progress of the build.
+type teeHandler struct {
+	base slog.Handler
+	job  func() slog.Handler
+}
+
+// Enabled implements slog.Handler.
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+// Handle implements slog.Handler.
+func (h *teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	if job := h.job(); job != nil {
+		if err := job.Handle(ctx, r.Clone()); err != nil {
+			return err
+		}
+	}
+
+	if h.base.Enabled(ctx, r.Level) {
+		return h.base.Handle(ctx, r)
+	}
+
+	return nil
+}
+
+// WithAttrs implements slog.Handler.
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &teeHandler{
+		base: h.base.WithAttrs(attrs),
+		job: func() slog.Handler {
+			if job := h.job(); job != nil {
+				return job.WithAttrs(attrs)
+			}
+			return nil
+		},
+	}
+}
+
+// WithGroup implements slog.Handler.
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	return &teeHandler{
+		base: h.base.WithGroup(name),
+		job: func() slog.Handler {
+			if job := h.job(); job != nil {
+				return job.WithGroup(name)
+			}
+			return nil
+		},
+	}
+}
+
+var (
+	_ slog.Handler = &teeHandler{}
+)
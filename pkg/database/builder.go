@@ -2,8 +2,8 @@ package database
 
 import (
 	"fmt"
-	"log/slog"
 	"slices"
+	"sync/atomic"
 
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
@@ -22,7 +22,8 @@ type ContainerBuilder struct {
 	SplitDefaultPackages bool
 	db                   common.PackageDatabase
 
-	loaded bool
+	// Read by the daemon without holding the database lock.
+	loaded atomic.Bool
 }
 
 // Attr implements starlark.HasAttrs.
@@ -119,7 +120,7 @@ func (builder *ContainerBuilder) AttrNames() []string {
 }
 
 func (builder *ContainerBuilder) Loaded() bool {
-	return builder.loaded
+	return builder.loaded.Load()
 }
 
 func (builder *ContainerBuilder) Load(ctx common.BuildContext) error {
@@ -133,7 +134,7 @@ func (builder *ContainerBuilder) Load(ctx common.BuildContext) error {
 		return err
 	}
 
-	builder.loaded = true
+	builder.loaded.Store(true)
 
 	return nil
 }
@@ -145,6 +146,7 @@ func (builder *ContainerBuilder) Plan(
 	opts common.PlanOptions,
 ) (common.InstallationPlan, error) {
 	plan := NewInstallationPlan(tags, opts)
+	plan.verbose = ctx.Database().IsVerbose()
 
 	if tags.Contains("defaults") {
 		for _, pkg := range builder.DefaultPackages {
@@ -182,7 +184,7 @@ func (builder *ContainerBuilder) Plan(
 	)
 	if err != nil {
 		if sErr, ok := err.(*starlark.EvalError); ok {
-			slog.Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
+			ctx.Database().GetLogger().Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
 		}
 		return nil, err
 	}
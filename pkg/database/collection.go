@@ -3,7 +3,6 @@ package database
 import (
 	"fmt"
 	"io"
-	"log/slog"
 	"runtime"
 	"slices"
 	"strings"
@@ -149,7 +148,7 @@ func (parser *PackageCollection) Load(ctx common.BuildContext) error {
 		}
 	}
 
-	slog.Debug("built all package sources", "took", time.Since(start))
+	ctx.Database().GetLogger().Debug("built all package sources", "took", time.Since(start))
 	start = time.Now()
 
 	parserCallback, err := ctx.Database().GetBuilder(parser.Filename, parser.Parser)
@@ -192,7 +191,7 @@ func (parser *PackageCollection) Load(ctx common.BuildContext) error {
 	case err := <-errors:
 		return err
 	case <-done:
-		slog.Debug("loaded all packages", "count", len(records), "took", time.Since(start))
+		ctx.Database().GetLogger().Debug("loaded all packages", "count", len(records), "took", time.Since(start))
 
 		return nil
 	}
@@ -251,7 +250,7 @@ func (parser *PackageCollection) InstallerFor(ctx common.BuildContext, pkg *comm
 	ret, err := starlark.Call(ctx.Database().NewThread(parser.Filename), getInstall, starlark.Tuple{pkg, tags}, []starlark.Tuple{})
 	if err != nil {
 		if sErr, ok := err.(*starlark.EvalError); ok {
-			slog.Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
+			ctx.Database().GetLogger().Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
 		}
 
 		return nil, err
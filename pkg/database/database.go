@@ -2,6 +2,7 @@ package database
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,7 +18,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
 	"github.com/tinyrange/tinyrange/pkg/builder"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
@@ -211,11 +211,25 @@ var (
 )
 
 type PackageDatabase struct {
-	// keys are name-arch
+	// keys are name-arch. Guarded by builderMtx once the database is shared.
 	ContainerBuilders map[string]*ContainerBuilder
+	builderMtx        sync.Mutex
 
 	RebuildUserDefinitions bool
 
+	// Relative Starlark filenames are resolved against this directory. If
+	// empty the working directory of the process is used.
+	WorkingDirectory string
+
+	// Called as definitions are built.
+	OnEvent common.EventHandler
+
+	// Where messages are logged. slog.Default() is used if nil.
+	Logger *slog.Logger
+	// Print more details while building like packages that are already
+	// installed.
+	Verbose bool
+
 	mirrors map[string][]string
 
 	memoryCache map[string][]byte
@@ -224,8 +238,12 @@ type PackageDatabase struct {
 	buildStatusMtx sync.Mutex
 	buildStatuses  map[common.BuildDefinition]*common.BuildStatus
 
-	loadedFiles map[string]bool
-	defs        map[string]starlark.Value
+	// The hashes of definitions being built keyed by their build context so
+	// events can name the definition that depends on a build.
+	buildHashMtx sync.Mutex
+	buildHashes  map[common.BuildContext]string
+
+	defs map[string]starlark.Value
 
 	builders map[string]starlark.Callable
 
@@ -235,16 +253,44 @@ type PackageDatabase struct {
 	distributionServer string
 }
 
+// Events implements common.PackageDatabase.
+func (db *PackageDatabase) Events() common.EventHandler {
+	return db.OnEvent
+}
+
 // HashDefinition implements common.PackageDatabase.
 func (db *PackageDatabase) HashDefinition(def common.BuildDefinition) (string, error) {
 	return db.defDb.HashDefinition(def)
 }
 
+// GetLogger implements common.PackageDatabase.
+func (db *PackageDatabase) GetLogger() *slog.Logger {
+	if db.Logger == nil {
+		return slog.Default()
+	}
+
+	return db.Logger
+}
+
+// IsVerbose implements common.PackageDatabase.
+func (db *PackageDatabase) IsVerbose() bool {
+	return db.Verbose
+}
+
 // ShouldRebuildUserDefinitions implements common.PackageDatabase.
 func (db *PackageDatabase) ShouldRebuildUserDefinitions() bool {
 	return db.RebuildUserDefinitions
 }
 
+// Resolve a relative filename against WorkingDirectory.
+func (db *PackageDatabase) resolvePath(name string) string {
+	if db.WorkingDirectory == "" || strings.HasPrefix(name, "//") || filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(db.WorkingDirectory, name)
+}
+
 func (db *PackageDatabase) getFileContents(name string) (string, error) {
 	if strings.HasPrefix(name, "//") {
 		f, err := stdlib.STDLIB.Open(strings.TrimPrefix(name, "//"))
@@ -261,7 +307,7 @@ func (db *PackageDatabase) getFileContents(name string) (string, error) {
 		return string(contents), nil
 	}
 
-	contents, err := os.ReadFile(name)
+	contents, err := os.ReadFile(db.resolvePath(name))
 	if err != nil {
 		return "", err
 	}
@@ -295,7 +341,7 @@ func (db *PackageDatabase) NewThread(filename string) *starlark.Thread {
 			ret, err := starlark.ExecFileOptions(db.getFileOptions(), newThread, module, contents, globals)
 			if err != nil {
 				if sErr, ok := err.(*starlark.EvalError); ok {
-					slog.Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
+					db.GetLogger().Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
 				}
 				return nil, err
 			}
@@ -355,11 +401,46 @@ func (db *PackageDatabase) AddMirror(name string, options []string) error {
 }
 
 func (db *PackageDatabase) AddContainerBuilder(builder *ContainerBuilder) error {
+	db.builderMtx.Lock()
+	defer db.builderMtx.Unlock()
+
 	db.ContainerBuilders[fmt.Sprintf("%s-%s", builder.Name, builder.Architecture)] = builder
 
 	return nil
 }
 
+// Return a snapshot of the container builders. Safe to call while other
+// goroutines are using the database.
+func (db *PackageDatabase) containerBuilders() []*ContainerBuilder {
+	db.builderMtx.Lock()
+	defer db.builderMtx.Unlock()
+
+	var ret []*ContainerBuilder
+	for _, builder := range db.ContainerBuilders {
+		ret = append(ret, builder)
+	}
+
+	return ret
+}
+
+// LoadedContainerBuilders returns the names (name-arch) of the container
+// builders that have been loaded. Safe to call while a build is running.
+func (db *PackageDatabase) LoadedContainerBuilders() []string {
+	db.builderMtx.Lock()
+	defer db.builderMtx.Unlock()
+
+	loaded := []string{}
+	for name, builder := range db.ContainerBuilders {
+		if builder.Loaded() {
+			loaded = append(loaded, name)
+		}
+	}
+
+	slices.Sort(loaded)
+
+	return loaded
+}
+
 func (db *PackageDatabase) LoadFile(filename string) error {
 	thread := db.NewThread(filename)
 
@@ -380,8 +461,17 @@ func (db *PackageDatabase) LoadFile(filename string) error {
 		return err
 	}
 
+	// Replace the definitions from the last time the file was loaded so ones
+	// that have since been removed are not found.
+	prefix := filename + ":"
+	for k := range db.defs {
+		if strings.HasPrefix(k, prefix) {
+			delete(db.defs, k)
+		}
+	}
+
 	for k, v := range defs {
-		db.defs[fmt.Sprintf("%s:%s", filename, k)] = v
+		db.defs[prefix+k] = v
 	}
 
 	return nil
@@ -425,7 +515,7 @@ func (db *PackageDatabase) RunScript(filename string, files map[string]filesyste
 	_, err = starlark.Call(thread, mainFunc, starlark.Tuple{args}, []starlark.Tuple{})
 	if err != nil {
 		if sErr, ok := err.(*starlark.EvalError); ok {
-			slog.Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
+			db.GetLogger().Error("got starlark error", "error", sErr, "backtrace", sErr.Backtrace())
 		}
 		return err
 	}
@@ -441,7 +531,7 @@ func (db *PackageDatabase) LoadAll(parallel bool) error {
 		done := make(chan bool)
 		errors := make(chan error)
 
-		for _, builder := range db.ContainerBuilders {
+		for _, builder := range db.containerBuilders() {
 			wg.Add(1)
 
 			go func(builder *ContainerBuilder) {
@@ -466,7 +556,7 @@ func (db *PackageDatabase) LoadAll(parallel bool) error {
 			return nil
 		}
 	} else {
-		for _, builder := range db.ContainerBuilders {
+		for _, builder := range db.containerBuilders() {
 			if err := builder.Load(ctx); err != nil {
 				return err
 			}
@@ -480,6 +570,12 @@ func (db *PackageDatabase) NewBuildContext(source common.BuildSource) common.Bui
 	return builder.NewBuildContext(source, db)
 }
 
+// NewBuildContextWithContext creates a build context whose builds stop when
+// ctx is cancelled.
+func (db *PackageDatabase) NewBuildContextWithContext(ctx context.Context, source common.BuildSource) common.BuildContext {
+	return builder.NewBuildContextWithContext(ctx, source, db)
+}
+
 func (db *PackageDatabase) updateBuildStatus(def common.BuildDefinition, status *common.BuildStatus) {
 	db.buildStatusMtx.Lock()
 	defer db.buildStatusMtx.Unlock()
@@ -487,11 +583,40 @@ func (db *PackageDatabase) updateBuildStatus(def common.BuildDefinition, status
 	db.buildStatuses[def] = status
 }
 
+// Returns the size of a build output for events or 0 if it can't be read.
+func fileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// Remove the partial output of a failed build along with any files the
+// builder created next to it (see BuildContext.CreateFile).
+func (db *PackageDatabase) removeTemporaryFiles(tmpFilename string) {
+	dir, prefix := filepath.Split(tmpFilename)
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, ent := range ents {
+		if strings.HasPrefix(ent.Name(), prefix) {
+			if err := os.Remove(filepath.Join(dir, ent.Name())); err != nil {
+				db.GetLogger().Warn("failed to remove temporary file", "name", ent.Name(), "err", err)
+			}
+		}
+	}
+}
+
 func (db *PackageDatabase) FilenameFromHash(hash string, suffix string) (string, error) {
 	return filepath.Join(db.buildDir, hash+suffix), nil
 }
 
-func (db *PackageDatabase) downloadFromDistributionServer(hash string, def common.BuildDefinition) (bool, error) {
+func (db *PackageDatabase) downloadFromDistributionServer(ctx context.Context, hash string, def common.BuildDefinition) (bool, error) {
 	if redistributable, ok := def.(common.RedistributableDefinition); !ok || !redistributable.Redistributable() {
 		return false, nil // not redistributable
 	}
@@ -503,7 +628,12 @@ func (db *PackageDatabase) downloadFromDistributionServer(hash string, def commo
 
 	url := fmt.Sprintf("%s/result/%s", db.distributionServer, hash)
 
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return false, err
 	}
@@ -527,7 +657,7 @@ func (db *PackageDatabase) downloadFromDistributionServer(hash string, def commo
 		return false, err
 	}
 
-	pb := progressbar.DefaultBytes(resp.ContentLength, url)
+	pb := common.NewDownloadProgress(db.OnEvent, hash, url, resp.ContentLength)
 	defer pb.Close()
 
 	if _, err := io.Copy(io.MultiWriter(f, pb), resp.Body); err != nil {
@@ -556,10 +686,59 @@ func (db *PackageDatabase) downloadFromDistributionServer(hash string, def commo
 	return true, nil
 }
 
+// Record the hash of the definition built with child. Returns the hash of
+// the definition being built with ctx or "" if it's not a build.
+func (db *PackageDatabase) setBuildHash(ctx common.BuildContext, child common.BuildContext, hash string) string {
+	db.buildHashMtx.Lock()
+	defer db.buildHashMtx.Unlock()
+
+	db.buildHashes[child] = hash
+
+	return db.buildHashes[ctx]
+}
+
+func (db *PackageDatabase) clearBuildHash(child common.BuildContext) {
+	db.buildHashMtx.Lock()
+	defer db.buildHashMtx.Unlock()
+
+	delete(db.buildHashes, child)
+}
+
+// Build builds def or returns the cached result. Stops with the error of
+// the context if it's cancelled.
 func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefinition, opts common.BuildOptions) (filesystem.File, error) {
+	if err := ctx.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	return db.build(ctx, def, opts)
+}
+
+func (db *PackageDatabase) build(ctx common.BuildContext, def common.BuildDefinition, opts common.BuildOptions) (_ filesystem.File, err error) {
 	tag := def.Tag()
 
-	hash, err := db.HashDefinition(def)
+	// Failures are reported with as much of the definition as is known so
+	// they can be matched with the started event.
+	var (
+		requested = time.Now()
+		hash      string
+		parent    string
+	)
+
+	defer func() {
+		if err != nil {
+			db.OnEvent.Emit(common.Event{
+				Kind:     common.EventBuildFailed,
+				Tag:      tag,
+				Hash:     hash,
+				Parent:   parent,
+				Duration: time.Since(requested),
+				Error:    err.Error(),
+			})
+		}
+	}()
+
+	hash, err = db.HashDefinition(def)
 	if err != nil {
 		return nil, err
 	}
@@ -585,6 +764,9 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 	// Get a child context for the build.
 	child := ctx.ChildContext(def, status, tmpFilename)
 
+	parent = db.setBuildHash(ctx, child, hash)
+	defer db.clearBuildHash(child)
+
 	if !opts.AlwaysRebuild {
 		// Check if the file already exists. If it does then return it.
 		if info, err := os.Stat(filename); err == nil {
@@ -611,19 +793,21 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 				// Write the build status.
 				db.updateBuildStatus(def, status)
 
-				slog.Debug("cached", "Tag", def.Tag(), "filename", filename)
+				db.OnEvent.Emit(common.Event{Kind: common.EventBuildCached, Tag: tag, Hash: hash, Parent: parent, Size: info.Size()})
+
+				db.GetLogger().Debug("cached", "Tag", def.Tag(), "filename", filename)
 
 				return filesystem.NewLocalFile(filename, def), nil
 			}
 
 			child.SetHasCached()
 
-			slog.Debug("rebuild requested", "Tag", def.Tag())
+			db.GetLogger().Debug("rebuild requested", "Tag", def.Tag())
 		} else {
-			slog.Debug("building", "Tag", def.Tag())
+			db.GetLogger().Debug("building", "Tag", def.Tag())
 		}
 	} else {
-		slog.Debug("building", "Tag", def.Tag())
+		db.GetLogger().Debug("building", "Tag", def.Tag())
 	}
 
 	defValue, err := db.defDb.MarshalDefinition(def)
@@ -640,9 +824,13 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 		return nil, fmt.Errorf("failed to write definition: %s", err)
 	}
 
+	start := time.Now()
+
+	db.OnEvent.Emit(common.Event{Kind: common.EventBuildStarted, Tag: tag, Hash: hash, Parent: parent})
+
 	if db.distributionServer != "" {
 		// If we have a distribution server then check it first.
-		ok, err := db.downloadFromDistributionServer(hash, def)
+		ok, err := db.downloadFromDistributionServer(ctx.Context(), hash, def)
 		if err != nil {
 			return nil, err
 		}
@@ -652,6 +840,8 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 
 			db.updateBuildStatus(def, status)
 
+			db.OnEvent.Emit(common.Event{Kind: common.EventBuildFinished, Tag: tag, Hash: hash, Duration: time.Since(start), Size: fileSize(filename)})
+
 			// This definition is redistributable so write a manifest.
 			redistributableTag, err := db.FilenameFromHash(hash, ".redistributable")
 			if err != nil {
@@ -673,10 +863,25 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 
 	// If the downloaded tag exists then remove it.
 
+	// Keep the log of the build so it can be read after it finishes.
+	logFilename, err := db.FilenameFromHash(hash, ".log")
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.Create(logFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	child.SetLog(logFile)
+
 	// If not then trigger the build.
 	result, err := def.Build(child)
 	if err != nil {
-		return nil, err
+		db.removeTemporaryFiles(tmpFilename)
+		return nil, withBuildLog(err, logFilename)
 	}
 
 	// If the result is nil then the builder is telling us to use the cached version.
@@ -686,6 +891,8 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 		// Write the build status.
 		db.updateBuildStatus(def, status)
 
+		db.OnEvent.Emit(common.Event{Kind: common.EventBuildCached, Tag: tag, Hash: hash, Size: fileSize(filename)})
+
 		return filesystem.NewLocalFile(filename, def), nil
 	}
 
@@ -700,25 +907,25 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 		// Write the build result to disk. If any of these steps fail then remove the temporary file.
 		if err := result.WriteResult(outFile); err != nil {
 			outFile.Close()
-			os.Remove(tmpFilename)
-			return nil, err
+			db.removeTemporaryFiles(tmpFilename)
+			return nil, withBuildLog(err, logFilename)
 		}
 
 		if err := outFile.Close(); err != nil {
-			os.Remove(tmpFilename)
+			db.removeTemporaryFiles(tmpFilename)
 			return nil, err
 		}
 	} else {
 		// Let the result close the file on it's own.
 		if err := result.WriteResult(nil); err != nil {
-			os.Remove(tmpFilename)
-			return nil, err
+			db.removeTemporaryFiles(tmpFilename)
+			return nil, withBuildLog(err, logFilename)
 		}
 	}
 
 	// Finally rename the temporary file to the final filename.
 	if err := os.Rename(tmpFilename, filename); err != nil {
-		os.Remove(tmpFilename)
+		db.removeTemporaryFiles(tmpFilename)
 		return nil, err
 	}
 
@@ -727,6 +934,8 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 	// Write the build status.
 	db.updateBuildStatus(def, status)
 
+	db.OnEvent.Emit(common.Event{Kind: common.EventBuildFinished, Tag: tag, Hash: hash, Duration: time.Since(start), Size: fileSize(filename)})
+
 	if redistributable, ok := def.(common.RedistributableDefinition); ok && redistributable.Redistributable() {
 		// This definition is redistributable so write a manifest.
 
@@ -778,7 +987,9 @@ func (db *PackageDatabase) GetBuilder(filename string, builder string) (starlark
 }
 
 func (db *PackageDatabase) GetContainerBuilder(ctx common.BuildContext, name string, arch config.CPUArchitecture) (common.ContainerBuilder, error) {
+	db.builderMtx.Lock()
 	builder, ok := db.ContainerBuilders[fmt.Sprintf("%s-%s", name, arch)]
+	db.builderMtx.Unlock()
 	if !ok {
 		return nil, fmt.Errorf("builder %s not found", name)
 	}
@@ -788,7 +999,7 @@ func (db *PackageDatabase) GetContainerBuilder(ctx common.BuildContext, name str
 		if err := builder.Load(ctx); err != nil {
 			return nil, err
 		}
-		slog.Debug("loaded", "builder", builder.DisplayName, "arch", builder.Architecture, "took", time.Since(start))
+		db.GetLogger().Debug("loaded", "builder", builder.DisplayName, "arch", builder.Architecture, "took", time.Since(start))
 	}
 
 	return builder, nil
@@ -818,11 +1029,13 @@ func (db *PackageDatabase) GetMacroByDeclaredName(ctx macro.MacroContext, name s
 		filename = filename + ".star"
 	}
 
-	if _, ok := db.loadedFiles[filename]; !ok {
-		slog.Debug("load file for macro", "filename", filename)
-		if err := db.LoadFile(filename); err != nil {
-			return nil, err
-		}
+	filename = db.resolvePath(filename)
+
+	// Always load the file again so edits are picked up by long running
+	// processes like the daemon.
+	db.GetLogger().Debug("load file for macro", "filename", filename)
+	if err := db.LoadFile(filename); err != nil {
+		return nil, err
 	}
 
 	var macroArgs []string
@@ -970,6 +1183,61 @@ func (db *PackageDatabase) Inspect(def common.BuildDefinition, out io.Writer) er
 		return err
 	}
 
+	return writeArchiveListing(ark, out)
+}
+
+// InspectFile lists the entries of a archive, ext4, squashfs or FAT image on the host.
+func InspectFile(filename string, out io.Writer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if dir, err := filesystem.OpenExt4Image(f); err == nil {
+		fmt.Fprintf(out, "ext4 entries:\n")
+
+		ark, err := filesystem.ArchiveFromDirectory(dir)
+		if err != nil {
+			return err
+		}
+
+		return writeArchiveListing(ark, out)
+	}
+
+	if dir, err := filesystem.OpenSquashfsImage(f); err == nil {
+		fmt.Fprintf(out, "squashfs entries:\n")
+
+		ark, err := filesystem.ArchiveFromDirectory(dir)
+		if err != nil {
+			return err
+		}
+
+		return writeArchiveListing(ark, out)
+	}
+
+	if dir, err := filesystem.OpenFatImage(f); err == nil {
+		fmt.Fprintf(out, "fat entries:\n")
+
+		ark, err := filesystem.ArchiveFromDirectory(dir)
+		if err != nil {
+			return err
+		}
+
+		return writeArchiveListing(ark, out)
+	}
+
+	fmt.Fprintf(out, "archive entries:\n")
+
+	ark, err := filesystem.ReadArchiveFromFile(filesystem.NewLocalFile(filename, nil))
+	if err != nil {
+		return err
+	}
+
+	return writeArchiveListing(ark, out)
+}
+
+func writeArchiveListing(ark filesystem.Archive, out io.Writer) error {
 	ents, err := ark.Entries()
 	if err != nil {
 		return err
@@ -983,6 +1251,12 @@ func (db *PackageDatabase) Inspect(def common.BuildDefinition, out io.Writer) er
 			fmt.Fprintf(out, "R %04d:%04d % 10d %s %s\n", ent.Uid(), ent.Gid(), ent.Size(), ent.ModTime(), ent.Name())
 		case filesystem.TypeSymlink:
 			fmt.Fprintf(out, "S %04d:%04d % 10d %s %s -> %s\n", ent.Uid(), ent.Gid(), ent.Size(), ent.Name(), ent.ModTime(), ent.Linkname())
+		case filesystem.TypeCharDevice:
+			fmt.Fprintf(out, "C %04d:%04d % 4d,% 4d %s %s\n", ent.Uid(), ent.Gid(), ent.Devmajor(), ent.Devminor(), ent.ModTime(), ent.Name())
+		case filesystem.TypeBlockDevice:
+			fmt.Fprintf(out, "B %04d:%04d % 4d,% 4d %s %s\n", ent.Uid(), ent.Gid(), ent.Devmajor(), ent.Devminor(), ent.ModTime(), ent.Name())
+		case filesystem.TypeFifo:
+			fmt.Fprintf(out, "P %04d:%04d % 10d %s %s\n", ent.Uid(), ent.Gid(), 0, ent.ModTime(), ent.Name())
 		}
 	}
 
@@ -1232,9 +1506,9 @@ func New(buildDir string) *PackageDatabase {
 		memoryCache:       make(map[string][]byte),
 		buildCache:        make(map[string]filesystem.File),
 		buildStatuses:     make(map[common.BuildDefinition]*common.BuildStatus),
+		buildHashes:       make(map[common.BuildContext]string),
 		buildDir:          buildDir,
 		defs:              make(map[string]starlark.Value),
-		loadedFiles:       make(map[string]bool),
 		builders:          make(map[string]starlark.Callable),
 	}
 
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/macro"
+	"go.starlark.net/starlark"
+)
+
+func writeStar(t *testing.T, filename string, contents string) {
+	if err := os.WriteFile(filename, []byte(contents), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func declaredTag(t *testing.T, db *PackageDatabase, name string) string {
+	m, err := db.GetMacroByDeclaredName(db.NewMacroContext(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, ok := m.(macro.DefinitionMacro)
+	if !ok {
+		t.Fatalf("unexpected macro type %T", m)
+	}
+
+	return def.Tag()
+}
+
+// Edits to a file have to be picked up by long running processes.
+func TestReloadDeclaredName(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "image.star")
+
+	db := New(t.TempDir())
+
+	writeStar(t, filename, `image = define.build_fs(directives = [], kind = "tar")`)
+
+	before := declaredTag(t, db, filename+":image")
+
+	writeStar(t, filename, `image = define.build_fs(directives = [], kind = "initramfs")`)
+
+	after := declaredTag(t, db, filename+":image")
+
+	if before == after {
+		t.Fatalf("definition was not reloaded: %s", after)
+	}
+
+	// Definitions removed from the file are no longer found.
+	writeStar(t, filename, `other = define.build_fs(directives = [], kind = "tar")`)
+
+	if _, err := db.GetMacroByDeclaredName(db.NewMacroContext(), filename+":image"); err == nil {
+		t.Fatal("expected removed definition to be missing")
+	}
+}
+
+func TestWorkingDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	writeStar(t, filepath.Join(dir, "lib.star"), `kind = "initramfs"`)
+	writeStar(t, filepath.Join(dir, "image.star"), `load("lib.star", "kind")
+
+image = define.build_fs(directives = [], kind = kind)
+`)
+
+	db := New(t.TempDir())
+	db.WorkingDirectory = dir
+
+	// The process is in a different directory to the one the names are
+	// relative to.
+	if tag := declaredTag(t, db, "image.star:image"); tag != "BuildFs_initramfs" {
+		t.Fatalf("unexpected tag: %s", tag)
+	}
+
+	db.WorkingDirectory = ""
+
+	if _, err := db.GetMacroByDeclaredName(db.NewMacroContext(), "image.star:image"); err == nil {
+		t.Fatal("expected relative name to be resolved against the process directory")
+	}
+}
+
+func execStar(db *PackageDatabase, contents string) (starlark.StringDict, error) {
+	return starlark.ExecFileOptions(db.getFileOptions(), db.NewThread("test.star"), "test.star", contents, db.getGlobals("__main__"))
+}
+
+func TestServiceDirective(t *testing.T) {
+	db := New(t.TempDir())
+
+	globals, err := execStar(db, `
+svc = directive.service(
+    name = "web",
+    command = "python3 -m http.server 'port 80'",
+    environment = {"HOME": "/srv"},
+    depends_on = ["db"],
+    ready = directive.readiness_probe(http_path = "/health", http_port = 80, timeout = 10),
+)
+probe = directive.readiness_probe(command = ["test", "-f", "/ready"])
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc, ok := globals["svc"].(*common.StarDirective).Directive.(common.DirectiveService)
+	if !ok {
+		t.Fatalf("unexpected directive %T", globals["svc"].(*common.StarDirective).Directive)
+	}
+
+	if !reflect.DeepEqual(svc.Config(), config.ServiceConfig{
+		Name:        "web",
+		Command:     []string{"python3", "-m", "http.server", "port 80"},
+		Environment: []string{"HOME=/srv"},
+		DependsOn:   []string{"db"},
+		Ready:       &config.ProbeConfig{HttpPath: "/health", HttpPort: 80, Timeout: 10},
+	}) {
+		t.Fatalf("unexpected service config: %+v", svc.Config())
+	}
+
+	probe, ok := globals["probe"].(*common.StarDirective).Directive.(common.DirectiveReadinessProbe)
+	if !ok {
+		t.Fatal("probe is not a readiness probe directive")
+	}
+
+	if !reflect.DeepEqual(probe.Config(), config.ProbeConfig{Command: []string{"test", "-f", "/ready"}}) {
+		t.Fatalf("unexpected probe config: %+v", probe.Config())
+	}
+}
+
+func TestInvalidReadinessProbe(t *testing.T) {
+	db := New(t.TempDir())
+
+	for _, src := range []string{
+		`directive.readiness_probe()`,
+		`directive.readiness_probe(tcp_port = 80, http_path = "/", http_port = 80)`,
+		`directive.readiness_probe(http_path = "/")`,
+		`directive.service(name = "web", command = "true", ready = directive.run_command("true"))`,
+	} {
+		if _, err := execStar(db, src); err == nil {
+			t.Fatalf("expected an error for %s", src)
+		}
+	}
+}
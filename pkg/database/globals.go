@@ -45,6 +45,39 @@ func asDirective(val starlark.Value) (common.Directive, error) {
 	}
 }
 
+// asCommand converts a string split like a shell command or a list of strings
+// into a command.
+func asCommand(val starlark.Value) ([]string, error) {
+	if str, ok := starlark.AsString(val); ok {
+		return shlex.Split(str, true)
+	} else if it, ok := val.(starlark.Iterable); ok {
+		return common.ToStringList(it)
+	} else {
+		return nil, fmt.Errorf("could not convert %s to a command", val.Type())
+	}
+}
+
+// asEnvironment converts a mapping into a list of KEY=value strings.
+func asEnvironment(vars starlark.IterableMapping) ([]string, error) {
+	var variables []string
+
+	for _, item := range vars.Items() {
+		k, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("could not convert %s to string", item[0].Type())
+		}
+
+		v, ok := starlark.AsString(item[1])
+		if !ok {
+			return nil, fmt.Errorf("could not convert %s to string", item[1].Type())
+		}
+
+		variables = append(variables, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return variables, nil
+}
+
 func asDirectiveList(it starlark.Iterable) ([]common.Directive, error) {
 	if it == nil {
 		return nil, nil
@@ -366,6 +399,7 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					archString    string
 					storageSize   int
 					interaction   string
+					volumeList    starlark.Iterable
 				)
 
 				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
@@ -378,6 +412,7 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					"arch?", &archString,
 					"storage_size?", &storageSize,
 					"interaction", &interaction,
+					"volumes?", &volumeList,
 				); err != nil {
 					return starlark.None, err
 				}
@@ -412,6 +447,15 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					return starlark.None, err
 				}
 
+				var volumes []string
+
+				if volumeList != nil {
+					volumes, err = common.ToStringList(volumeList)
+					if err != nil {
+						return starlark.None, err
+					}
+				}
+
 				return builder.NewBuildVmDefinition(
 					directives,
 					kernelDef,
@@ -423,6 +467,7 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					storageSize,
 					interaction,
 					false,
+					volumes,
 				), nil
 			}),
 			"build_fs": starlark.NewBuiltin("define.build_fs", func(
@@ -434,11 +479,17 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 				var (
 					directiveList starlark.Iterable
 					kind          string
+					size          int
+					clusterSize   int
+					journal       bool
 				)
 
 				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
 					"directives", &directiveList,
 					"kind", &kind,
+					"size?", &size,
+					"cluster_size?", &clusterSize,
+					"journal?", &journal,
 				); err != nil {
 					return starlark.None, err
 				}
@@ -448,7 +499,7 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					return starlark.None, err
 				}
 
-				return builder.NewBuildFsDefinition(directives, kind), nil
+				return builder.NewBuildFsDefinition(directives, kind, size, clusterSize, journal), nil
 			}),
 			"build_emulator": starlark.NewBuiltin("define.build_emulator", func(
 				thread *starlark.Thread,
@@ -682,20 +733,9 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					return starlark.None, err
 				}
 
-				var variables []string
-
-				for _, item := range vars.Items() {
-					k, ok := starlark.AsString(item[0])
-					if !ok {
-						return starlark.None, fmt.Errorf("could not convert %s to string", item[0].Type())
-					}
-
-					v, ok := starlark.AsString(item[1])
-					if !ok {
-						return starlark.None, fmt.Errorf("could not convert %s to string", item[1].Type())
-					}
-
-					variables = append(variables, fmt.Sprintf("%s=%s", k, v))
+				variables, err := asEnvironment(vars)
+				if err != nil {
+					return starlark.None, err
 				}
 
 				return &common.StarDirective{Directive: common.DirectiveEnvironment{
@@ -792,6 +832,126 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					InteractiveCommand: cmdArgs,
 				}}, nil
 			}),
+			"readiness_probe": starlark.NewBuiltin("directive.readiness_probe", func(
+				thread *starlark.Thread,
+				fn *starlark.Builtin,
+				args starlark.Tuple,
+				kwargs []starlark.Tuple,
+			) (starlark.Value, error) {
+				var (
+					tcpPort  int
+					httpPath string
+					httpPort int
+					command  starlark.Value
+					timeout  int
+				)
+
+				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+					"tcp_port?", &tcpPort,
+					"http_path?", &httpPath,
+					"http_port?", &httpPort,
+					"command?", &command,
+					"timeout?", &timeout,
+				); err != nil {
+					return starlark.None, err
+				}
+
+				probe := config.ProbeConfig{
+					TcpPort:  tcpPort,
+					HttpPath: httpPath,
+					HttpPort: httpPort,
+					Timeout:  timeout,
+				}
+
+				if command != nil {
+					cmdArgs, err := asCommand(command)
+					if err != nil {
+						return starlark.None, err
+					}
+
+					probe.Command = cmdArgs
+				}
+
+				if err := common.ValidateProbe(probe); err != nil {
+					return starlark.None, err
+				}
+
+				return &common.StarDirective{Directive: common.NewReadinessProbeDirective(probe)}, nil
+			}),
+			"service": starlark.NewBuiltin("directive.service", func(
+				thread *starlark.Thread,
+				fn *starlark.Builtin,
+				args starlark.Tuple,
+				kwargs []starlark.Tuple,
+			) (starlark.Value, error) {
+				var (
+					name             string
+					command          starlark.Value
+					environment      starlark.IterableMapping
+					workingDirectory string
+					user             string
+					restart          string
+					dependsOn        starlark.Iterable
+					ready            starlark.Value
+				)
+
+				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+					"name", &name,
+					"command", &command,
+					"environment?", &environment,
+					"working_directory?", &workingDirectory,
+					"user?", &user,
+					"restart?", &restart,
+					"depends_on?", &dependsOn,
+					"ready?", &ready,
+				); err != nil {
+					return starlark.None, err
+				}
+
+				cmdArgs, err := asCommand(command)
+				if err != nil {
+					return starlark.None, err
+				}
+
+				svc := config.ServiceConfig{
+					Name:             name,
+					Command:          cmdArgs,
+					WorkingDirectory: workingDirectory,
+					User:             user,
+					Restart:          restart,
+				}
+
+				if environment != nil {
+					svc.Environment, err = asEnvironment(environment)
+					if err != nil {
+						return starlark.None, err
+					}
+				}
+
+				if dependsOn != nil {
+					svc.DependsOn, err = common.ToStringList(dependsOn)
+					if err != nil {
+						return starlark.None, err
+					}
+				}
+
+				if ready != nil && ready != starlark.None {
+					dir, err := asDirective(ready)
+					if err != nil {
+						return starlark.None, err
+					}
+
+					probe, ok := dir.(common.DirectiveReadinessProbe)
+					if !ok {
+						return starlark.None, fmt.Errorf("ready must be a directive.readiness_probe")
+					}
+
+					probeConfig := probe.Config()
+					svc.Ready = &probeConfig
+				}
+
+				return &common.StarDirective{Directive: common.NewServiceDirective(svc)}, nil
+			}),
 			"list": starlark.NewBuiltin("directive.list", func(
 				thread *starlark.Thread,
 				fn *starlark.Builtin,
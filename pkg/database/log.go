@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The number of lines of the build log included in build errors.
+const buildLogTailLines = 20
+
+// buildLogError adds the end of the log of the build that failed to its error.
+type buildLogError struct {
+	err      error
+	filename string
+	tail     string
+}
+
+// Error implements error.
+func (e *buildLogError) Error() string {
+	return fmt.Sprintf("%s\n\nlast lines of %s:\n%s", e.err, e.filename, e.tail)
+}
+
+func (e *buildLogError) Unwrap() error { return e.err }
+
+// Read the last lines of a build log.
+func readLogTail(filename string, lines int) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// Only read the end of large logs.
+	offset := max(info.Size()-64*1024, 0)
+
+	buf := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	tokens := strings.Split(strings.TrimRight(string(buf), "\r\n"), "\n")
+	if len(tokens) > lines {
+		tokens = tokens[len(tokens)-lines:]
+	}
+
+	return strings.Join(tokens, "\n"), nil
+}
+
+// Include the tail of the build log in err. Errors from dependencies that
+// already include their own log are returned unchanged.
+func withBuildLog(err error, filename string) error {
+	var logErr *buildLogError
+	if errors.As(err, &logErr) {
+		return err
+	}
+
+	tail, tailErr := readLogTail(filename, buildLogTailLines)
+	if tailErr != nil || strings.TrimSpace(tail) == "" {
+		return err
+	}
+
+	return &buildLogError{err: err, filename: filename, tail: tail}
+}
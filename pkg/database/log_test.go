@@ -0,0 +1,149 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+func TestReadLogTail(t *testing.T) {
+	dir := t.TempDir()
+
+	// Only the end of large logs is read.
+	var large strings.Builder
+	lines := 0
+	for ; large.Len() < 200*1024; lines++ {
+		fmt.Fprintf(&large, "line %d\n", lines)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"short", "one\ntwo\n", "one\ntwo"},
+		{"noNewline", "one\ntwo", "one\ntwo"},
+		{"crlf", "one\r\ntwo\r\n", "one\r\ntwo"},
+		{"long", "1\n2\n3\n4\n5\n", "3\n4\n5"},
+		{"large", large.String(), fmt.Sprintf("line %d\nline %d\nline %d", lines-3, lines-2, lines-1)},
+	} {
+		filename := filepath.Join(dir, tc.name+".log")
+
+		if err := os.WriteFile(filename, []byte(tc.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readLogTail(filename, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+
+	if _, err := readLogTail(filepath.Join(dir, "missing.log"), 3); err == nil {
+		t.Fatal("expected reading a missing log to fail")
+	}
+}
+
+// Returns the definition declared as name in a star file.
+func declaredDefinition(t *testing.T, db *PackageDatabase, name string) common.BuildDefinition {
+	t.Helper()
+
+	ctx := db.NewMacroContext()
+
+	m, err := db.GetMacroByDeclaredName(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := m.Call(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def, ok := ret.(common.BuildDefinition)
+	if !ok {
+		t.Fatalf("could not convert %T to BuildDefinition", ret)
+	}
+
+	return def
+}
+
+func TestBuildLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "failing.star")
+
+	writeStar(t, filename, `
+def build_failing(ctx):
+    for i in range(30):
+        print("step %d" % i)
+    fail("compiler exploded")
+
+def build_parent(ctx, child):
+    print("building child")
+    ctx.build(child)
+
+failing = define.build(build_failing)
+parent = define.build(build_parent, failing)
+`)
+
+	db := New(t.TempDir())
+
+	def := declaredDefinition(t, db, filename+":failing")
+
+	hash, err := db.HashDefinition(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logFilename, err := db.FilenameFromHash(hash, ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Build(db.NewBuildContext(def), def, common.BuildOptions{})
+	if err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	var logErr *buildLogError
+	if !errors.As(err, &logErr) {
+		t.Fatalf("expected the error to include the build log: %v", err)
+	}
+
+	if logErr.filename != logFilename {
+		t.Fatalf("expected the log %s, got %s", logFilename, logErr.filename)
+	}
+
+	// Only the last buildLogTailLines lines are included.
+	var tail []string
+	for i := 30 - buildLogTailLines; i < 30; i++ {
+		tail = append(tail, fmt.Sprintf("step %d", i))
+	}
+
+	expected := fmt.Sprintf("fail: compiler exploded\n\nlast lines of %s:\n%s", logFilename, strings.Join(tail, "\n"))
+	if msg := err.Error(); msg != expected {
+		t.Fatalf("expected the error %q, got %q", expected, msg)
+	}
+
+	// A build that fails because of a dependency reports the log of the
+	// dependency rather than its own.
+	parent := declaredDefinition(t, db, filename+":parent")
+
+	_, err = db.Build(db.NewBuildContext(parent), parent, common.BuildOptions{})
+	if err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	if msg := err.Error(); strings.Count(msg, "last lines of") != 1 || !strings.Contains(msg, "last lines of "+logFilename) {
+		t.Fatalf("expected the log of the dependency: %s", msg)
+	}
+}
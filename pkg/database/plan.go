@@ -23,14 +23,14 @@ type installationTree struct {
 	Dependencies []*installationTree
 }
 
-func (t *installationTree) writeTree(prefix string) error {
+func (t *installationTree) writeTree(prefix string, verbose bool) error {
 	if t.Error != nil {
 		color.Red("%s- [%s]", prefix, t.Error)
 		return nil
 	}
 
 	if t.Installer == nil {
-		if !common.IsVerbose() {
+		if !verbose {
 			return nil
 		}
 
@@ -50,7 +50,7 @@ func (t *installationTree) writeTree(prefix string) error {
 	}
 
 	for _, depend := range t.Dependencies {
-		if err := depend.writeTree(prefix + "  "); err != nil {
+		if err := depend.writeTree(prefix+"  ", verbose); err != nil {
 			return err
 		}
 	}
@@ -83,6 +83,8 @@ type InstallationPlan struct {
 	baseDirectives []common.Directive
 	tags           common.TagList
 	options        common.PlanOptions
+	// If true WriteTree includes packages that are already installed.
+	verbose bool
 
 	installedNames map[string]*installInfo // map of names and versions.
 }
@@ -90,7 +92,7 @@ type InstallationPlan struct {
 // WriteTree implements common.InstallationPlan.
 func (plan *InstallationPlan) WriteTree() error {
 	for _, tree := range plan.trees {
-		if err := tree.writeTree(""); err != nil {
+		if err := tree.writeTree("", plan.verbose); err != nil {
 			return err
 		}
 	}
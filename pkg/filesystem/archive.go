@@ -11,6 +11,7 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -337,6 +338,75 @@ func ArchiveFromFS(eFs embed.FS, base string) (ArrayArchive, error) {
 	return ents, nil
 }
 
+// ArchiveFromDirectory walks dir and returns a entry for each file. The
+// contents of files are read from dir when the entry is opened.
+func ArchiveFromDirectory(dir Directory) (ArrayArchive, error) {
+	var ents ArrayArchive
+
+	var walk func(dir Directory, base string) error
+
+	walk = func(dir Directory, base string) error {
+		children, err := dir.Readdir()
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			name := path.Join(base, child.Name)
+
+			info, err := child.Stat()
+			if err != nil {
+				return err
+			}
+
+			uid, gid, err := GetUidAndGid(child.File)
+			if err != nil {
+				return err
+			}
+
+			ent := SimpleEntry{
+				File:     child.File,
+				uid:      uid,
+				gid:      gid,
+				modTime:  info.ModTime(),
+				mode:     info.Mode(),
+				name:     name,
+				size:     info.Size(),
+				typeFlag: info.Kind(),
+			}
+
+			switch {
+			case ent.typeFlag == TypeSymlink || ent.typeFlag == TypeLink:
+				ent.linkName, err = GetLinkName(child.File)
+				if err != nil {
+					return err
+				}
+			case ent.typeFlag.IsDevice():
+				ent.devmajor, ent.devminor, err = GetDeviceNumbers(child.File)
+				if err != nil {
+					return err
+				}
+			}
+
+			ents = append(ents, ent)
+
+			if childDir, ok := child.File.(Directory); ok {
+				if err := walk(childDir, name); err != nil {
+					return fmt.Errorf("failed to walk %s: %w", name, err)
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(dir, ""); err != nil {
+		return nil, err
+	}
+
+	return ents, nil
+}
+
 const CACHE_ENTRY_SIZE = 1024
 
 type CacheEntry struct {
@@ -355,6 +425,9 @@ type CacheEntry struct {
 	CDevmajor int64    `json:"a"`
 	CDevminor int64    `json:"i"`
 
+	// Extended attributes keyed by their full name.
+	CXattrs map[string][]byte `json:"x,omitempty"`
+
 	// Used for streaming files only.
 	Hash             string `json:"hash,omitempty"`
 	ContentsFilename string `json:"contents,omitempty"`
@@ -70,6 +70,10 @@ func ExtractReaderTo(input io.Reader, kind string, fs *ext4.Ext4Filesystem, filt
 					if err := fs.Mkdir(name, false); err != nil {
 						return err
 					}
+				case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+					if err := fs.Mknod(name, hdr.FileInfo().Mode(), uint32(hdr.Devmajor), uint32(hdr.Devminor)); err != nil {
+						return err
+					}
 				default:
 					return fmt.Errorf("Filesystem.AddFromTar: Typeflag not implemented: %d", hdr.Typeflag)
 				}
@@ -80,12 +84,17 @@ func ExtractReaderTo(input io.Reader, kind string, fs *ext4.Ext4Filesystem, filt
 			if err := fs.Chmod(name, info.Mode()); err != nil {
 				return err
 			}
-			if err := fs.Chown(name, uint16(hdr.Uid), uint16(hdr.Gid)); err != nil {
+			if err := fs.Chown(name, uint32(hdr.Uid), uint32(hdr.Gid)); err != nil {
 				return err
 			}
 			if err := fs.Chtimes(name, hdr.ModTime); err != nil {
 				return err
 			}
+			if xattrs := XattrsFromPAX(hdr.PAXRecords); xattrs != nil && hdr.Typeflag != tar.TypeLink {
+				if err := fs.SetXattrs(name, xattrs); err != nil {
+					return err
+				}
+			}
 		}
 
 		return nil
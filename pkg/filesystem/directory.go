@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"slices"
 	"strings"
 )
 
@@ -256,8 +257,14 @@ func (m *memoryDirectory) Unlink(name string) error {
 		return fmt.Errorf("MutableDirectory methods can not handle paths: %s", name)
 	}
 
+	if _, exists := m.entries[name]; !exists {
+		return fs.ErrNotExist
+	}
+
 	delete(m.entries, name)
 
+	m.names = slices.DeleteFunc(m.names, func(child string) bool { return child == name })
+
 	return nil
 }
 
@@ -396,6 +403,17 @@ func ExtractEntry(ent Entry, dir MutableDirectory) error {
 			return err
 		}
 
+		xattrs, err := GetXattrs(ent)
+		if err != nil {
+			return err
+		}
+
+		if xattrs != nil {
+			if err := child.SetXattrs(xattrs); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	case TypeRegular:
 		return CreateChild(dir, ent.Name(), ent)
@@ -403,6 +421,8 @@ func ExtractEntry(ent Entry, dir MutableDirectory) error {
 		return CreateChild(dir, ent.Name(), ent)
 	case TypeLink:
 		return CreateChild(dir, ent.Name(), ent)
+	case TypeCharDevice, TypeBlockDevice, TypeFifo, TypeSocket:
+		return CreateChild(dir, ent.Name(), ent)
 	default:
 		return fmt.Errorf("unknown Entry type: %s", ent.Typeflag())
 	}
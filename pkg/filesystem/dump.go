@@ -44,6 +44,7 @@ func (v *filesystemValidator) validateFile(f File, p string) error {
 		if target == "" {
 			return fmt.Errorf("%s: link has empty target", p)
 		}
+	case TypeCharDevice, TypeBlockDevice, TypeFifo, TypeSocket:
 	default:
 		return fmt.Errorf("unknown kind: %s", info.Kind())
 	}
@@ -175,6 +175,26 @@ func newDirectoryEntry(target *InodeWrapper, childNode uint32, typ uint8, name s
 	return ent
 }
 
+// The file type stored in the directory entry.
+func direntFileType(mode goFs.FileMode) uint8 {
+	switch {
+	case mode&goFs.ModeSymlink != 0:
+		return 0x7
+	case mode.IsDir():
+		return 0x2
+	case mode&goFs.ModeCharDevice != 0:
+		return 0x3
+	case mode&goFs.ModeDevice != 0:
+		return 0x4
+	case mode&goFs.ModeNamedPipe != 0:
+		return 0x5
+	case mode&goFs.ModeSocket != 0:
+		return 0x6
+	default:
+		return 0x1
+	}
+}
+
 type LinearDirectoryBlock struct {
 	ents         *vm.RegionArray[*DirectoryEntry]
 	paddedRegion *vm.PaddedRegion
@@ -206,16 +226,7 @@ func (d *LinearDirectory) AddEntry(child *InodeWrapper, name string) error {
 
 	blockSize := child.fs.sb.blockSize()
 
-	childMode := child.Mode()
-
-	typ := 0x1
-
-	if childMode&goFs.ModeSymlink != 0 {
-		// Check if this is a symbolic link.
-		typ = 0x7
-	} else if childMode.IsDir() {
-		typ = 0x2
-	}
+	typ := direntFileType(child.Mode())
 
 	block := d.blocks[len(d.blocks)-1]
 
@@ -234,6 +245,17 @@ func (d *LinearDirectory) AddEntry(child *InodeWrapper, name string) error {
 
 		// Make sure the directory entry has enough room to add the new entry.
 		if int(currentLen-lastRecLen) < requiredLen {
+			if len(d.blocks) >= HASHED_DIRECTORY_THRESHOLD {
+				hashed, err := newHashedDirectory(d)
+				if err != nil {
+					return fmt.Errorf("failed to convert to hashed directory: %w", err)
+				}
+
+				d.inode.dir = hashed
+
+				return hashed.AddEntry(child, name)
+			}
+
 			// Otherwise increase the size.
 			if err := d.increaseSize(); err != nil {
 				return fmt.Errorf("failed to increase size: %v", err)
@@ -385,30 +407,8 @@ func newLinearDirectory(fs *Ext4Filesystem, inode *InodeWrapper, tree ExtentTree
 	return dir, nil
 }
 
-type HashedDirectory struct {
-}
-
-// GetChild implements Directory.
-func (*HashedDirectory) GetChild(name string) (*InodeWrapper, error) {
-	return nil, fmt.Errorf("unimplemented")
-}
-
-// AddEntry implements Directory.
-func (*HashedDirectory) AddEntry(child *InodeWrapper, name string) error {
-	return fmt.Errorf("not implemented")
-}
-
-func (d HashedDirectory) String() string {
-	ret := "Directory["
-
-	ret += "\n  HASHED"
-
-	return ret + "\n  ]"
-}
-
 var (
 	_ Directory = &LinearDirectory{}
-	_ Directory = &HashedDirectory{}
 )
 
 type Extent struct {
@@ -551,69 +551,178 @@ func newExtentTree1(fs *Ext4Filesystem, base uint64, blocks int64) (*ExtentTree1
 	return tree, nil
 }
 
+// ExtentTree2 keeps up to 4 extents in the inode. Once they are used the
+// extents are moved to a leaf block referenced by a single index entry in
+// the inode.
 type ExtentTree2 struct {
 	i     *InodeWrapper
 	count int
+
+	// The leaf block once the tree has a index.
+	leaf vm.RawRegion
 }
 
-// AllocateBlocks implements ExtentTree.
-func (t *ExtentTree2) AllocateBlocks(blocks int64) error {
-	// Check that we have enough space in the extentTree to allocate blocks.
-	if t.count > 3 {
-		return fmt.Errorf("no remaining space in extent tree to allocate blocks")
+// The maximum number of extents in the tree.
+func (t *ExtentTree2) max() int {
+	if t.leaf == nil {
+		return 4
 	}
 
-	// Allocate more extents.
-	extents, err := t.i.fs.allocateMultiExtentBlocks(blocks)
+	return (len(t.leaf) - 12) / 12
+}
+
+// Move the extents from the inode into a new leaf block and point the inode
+// at it.
+func (t *ExtentTree2) addIndex() error {
+	fs := t.i.fs
+
+	extents, err := t.Extents()
+	if err != nil {
+		return err
+	}
+
+	block, err := fs.allocateBlocks(1)
 	if err != nil {
 		return err
 	}
 
-	if len(extents)+t.count > 4 {
-		return fmt.Errorf("allocation would exceed the size constraint of a ExtentTree2")
+	leaf := make(vm.RawRegion, fs.sb.blockSize())
+
+	if err := fs.mapRawExtent(leaf, block); err != nil {
+		return err
 	}
 
-	i := 0
+	var header ExtentTreeHeader
 
-	if t.count == 1 && i < len(extents) {
-		extent := extents[i]
+	header.SetMagic(0xF30A)
+	header.SetEntries(uint16(len(extents)))
+	header.SetMax(uint16((len(leaf) - 12) / 12))
+	header.SetDepth(0)
 
-		// Set the fields on the leaf.
-		t.i.node.SetBlock1Block(t.i.node.Block0Block() + uint32(t.i.node.Block0Len()) + extent.FirstFileBlock)
-		t.i.node.SetBlock1Len(extent.Length)
-		t.i.node.SetBlock1Start(extent.StartBlock)
+	copy(leaf, header[:])
 
-		t.i.node.SetBlockEntries(2)
+	for n, extent := range extents {
+		var node ExtentTreeNode
 
-		i += 1
-		t.count += 1
+		node.SetBlock(extent.FirstFileBlock)
+		node.SetLen(extent.Length)
+		node.SetStart(extent.StartBlock)
+
+		copy(leaf[12+n*12:], node[:])
 	}
 
-	if t.count == 2 && i < len(extents) {
-		extent := extents[i]
+	var idx ExtentTreeIdx
 
-		// Set the fields on the leaf.
-		t.i.node.SetBlock2Block(t.i.node.Block1Block() + uint32(t.i.node.Block1Len()) + extent.FirstFileBlock)
-		t.i.node.SetBlock2Len(extent.Length)
-		t.i.node.SetBlock2Start(extent.StartBlock)
+	idx.SetBlock(0)
+	idx.SetLeafLo(uint32(block.StartBlock))
+	idx.SetLeafHi(uint16(block.StartBlock >> 32))
 
-		t.i.node.SetBlockEntries(3)
+	// The index replaces the extents in i_block.
+	clear(t.i.node[52:100])
+	copy(t.i.node[52:64], idx[:])
 
-		i += 1
-		t.count += 1
+	t.i.node.SetBlockEntries(1)
+	t.i.node.SetBlockDepth(1)
+	t.i.node.SetBlocks(t.i.node.Blocks() + fs.sb.blockSize()/512)
+
+	t.leaf = leaf
+
+	return nil
+}
+
+// Add a extent to the end of the tree.
+func (t *ExtentTree2) append(extent *Extent) error {
+	if t.count >= t.max() {
+		return fmt.Errorf("extent tree is full: %d extents", t.count)
 	}
 
-	if t.count == 3 && i < len(extents) {
-		extent := extents[i]
+	if t.leaf != nil {
+		var node ExtentTreeNode
 
-		// Set the fields on the leaf.
-		t.i.node.SetBlock3Block(t.i.node.Block2Block() + uint32(t.i.node.Block2Len()) + extent.FirstFileBlock)
+		node.SetBlock(extent.FirstFileBlock)
+		node.SetLen(extent.Length)
+		node.SetStart(extent.StartBlock)
+
+		copy(t.leaf[12+t.count*12:], node[:])
+
+		t.count += 1
+
+		var header ExtentTreeHeader
+
+		copy(header[:], t.leaf)
+		header.SetEntries(uint16(t.count))
+		copy(t.leaf, header[:])
+
+		return nil
+	}
+
+	// Set the fields on the leaf.
+	switch t.count {
+	case 0:
+		t.i.node.SetBlock0Block(extent.FirstFileBlock)
+		t.i.node.SetBlock0Len(extent.Length)
+		t.i.node.SetBlock0Start(extent.StartBlock)
+	case 1:
+		t.i.node.SetBlock1Block(extent.FirstFileBlock)
+		t.i.node.SetBlock1Len(extent.Length)
+		t.i.node.SetBlock1Start(extent.StartBlock)
+	case 2:
+		t.i.node.SetBlock2Block(extent.FirstFileBlock)
+		t.i.node.SetBlock2Len(extent.Length)
+		t.i.node.SetBlock2Start(extent.StartBlock)
+	case 3:
+		t.i.node.SetBlock3Block(extent.FirstFileBlock)
 		t.i.node.SetBlock3Len(extent.Length)
 		t.i.node.SetBlock3Start(extent.StartBlock)
+	}
 
-		t.i.node.SetBlockEntries(4)
+	t.count += 1
 
-		t.count += 1
+	t.i.node.SetBlockEntries(uint16(t.count))
+
+	return nil
+}
+
+// AllocateBlocks implements ExtentTree.
+func (t *ExtentTree2) AllocateBlocks(blocks int64) error {
+	// Check that we have enough space in the extentTree to allocate blocks.
+	// Every block group needs a extent. A leaf block is added once the inode
+	// is full.
+	needed := int(roundUpDiv(blocks, int64(t.i.fs.sb.BlocksPerGroup())))
+	if limit := (int(t.i.fs.sb.blockSize()) - 12) / 12; t.count+needed > limit {
+		return fmt.Errorf("no remaining space in extent tree to allocate %d blocks: %d of %d extents used", blocks, t.count, limit)
+	}
+
+	existing, err := t.Extents()
+	if err != nil {
+		return err
+	}
+
+	// Allocate more extents.
+	extents, err := t.i.fs.allocateMultiExtentBlocks(blocks)
+	if err != nil {
+		return err
+	}
+
+	if t.leaf == nil && t.count+len(extents) > 4 {
+		if err := t.addIndex(); err != nil {
+			return err
+		}
+	}
+
+	// The new blocks follow the last block of the file.
+	var end uint32
+	if len(existing) > 0 {
+		last := existing[len(existing)-1]
+		end = last.FirstFileBlock + uint32(last.Length)
+	}
+
+	for _, extent := range extents {
+		extent.FirstFileBlock += end
+
+		if err := t.append(extent); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -623,6 +732,22 @@ func (t *ExtentTree2) AllocateBlocks(blocks int64) error {
 func (t *ExtentTree2) Extents() ([]Extent, error) {
 	var ret []Extent
 
+	if t.leaf != nil {
+		for n := 0; n < t.count; n++ {
+			var node ExtentTreeNode
+
+			copy(node[:], t.leaf[12+n*12:])
+
+			ext, err := NewExtent(node.Block(), node.Start(), node.Len())
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, ext)
+		}
+
+		return ret, nil
+	}
+
 	if t.count > 0 {
 		ext, err := NewExtent(
 			t.i.node.Block0Block(),
@@ -762,6 +887,8 @@ type InodeWrapper struct {
 	extentTree ExtentTree
 	dir        Directory
 	linkTarget string
+	// The external xattr block if one has been allocated.
+	xattrBlock []byte
 }
 
 const (
@@ -964,6 +1091,57 @@ func (i *InodeWrapper) addContents(contents vm.MemoryRegion, symlink bool) error
 	return nil
 }
 
+// Mark the inode as a device, FIFO or socket. Special files have no blocks.
+// Device numbers are stored in the first words of i_block using the same
+// encoding as Linux.
+func (i *InodeWrapper) makeSpecial(mode goFs.FileMode, major uint32, minor uint32) error {
+	var kind uint16
+
+	switch {
+	case mode&goFs.ModeCharDevice != 0:
+		kind = S_IFCHR
+	case mode&goFs.ModeDevice != 0:
+		kind = S_IFBLK
+	case mode&goFs.ModeNamedPipe != 0:
+		kind = S_IFIFO
+	case mode&goFs.ModeSocket != 0:
+		kind = S_IFSOCK
+	default:
+		return fmt.Errorf("mode %s is not a special file", mode)
+	}
+
+	i.node.SetMode(kind)
+
+	if err := i.chmod(mode); err != nil {
+		return err
+	}
+
+	if !i.fs.deterministicTime.IsZero() {
+		i.node.SetCtime(uint32(i.fs.deterministicTime.Unix()))
+		i.node.SetMtime(uint32(i.fs.deterministicTime.Unix()))
+		i.node.SetAtime(uint32(i.fs.deterministicTime.Unix()))
+	} else {
+		i.node.SetCtime(uint32(time.Now().Unix()))
+		i.node.SetMtime(uint32(time.Now().Unix()))
+		i.node.SetAtime(uint32(time.Now().Unix()))
+	}
+
+	if kind == S_IFCHR || kind == S_IFBLK {
+		if major < 256 && minor < 256 {
+			// The old encoding in i_block[0].
+			i.node.SetBlockMagic(uint16(major<<8 | minor))
+		} else {
+			// The new encoding in i_block[1].
+			dev := (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+
+			i.node.SetBlockMax(uint16(dev))
+			i.node.SetBlockDepth(uint16(dev >> 16))
+		}
+	}
+
+	return nil
+}
+
 func (i *InodeWrapper) chmod(mode goFs.FileMode) error {
 	oldMode := i.node.Mode()
 
@@ -985,9 +1163,13 @@ func (i *InodeWrapper) chmod(mode goFs.FileMode) error {
 	return nil
 }
 
-func (i *InodeWrapper) chown(uid uint16, gid uint16) error {
-	i.node.SetUid(uid)
-	i.node.SetGid(gid)
+// chown sets the owner of the inode. The upper 16 bits of the IDs are stored
+// in l_i_uid_high and l_i_gid_high.
+func (i *InodeWrapper) chown(uid uint32, gid uint32) error {
+	i.node.SetUid(uint16(uid))
+	i.node.SetUidHigh(uint16(uid >> 16))
+	i.node.SetGid(uint16(gid))
+	i.node.SetGidHigh(uint16(gid >> 16))
 
 	return nil
 }
@@ -1180,6 +1362,9 @@ type Ext4Filesystem struct {
 	inodeCache map[string]*InodeWrapper
 
 	deterministicTime time.Time
+
+	// The journal superblock if AddJournal has been called.
+	journal []byte
 }
 
 func (fs *Ext4Filesystem) allocateMultiExtentBlocks(blocks int64) ([]*Extent, error) {
@@ -1540,6 +1725,35 @@ func (fs *Ext4Filesystem) Symlink(filename string, target string) error {
 	return nil
 }
 
+// Mknod creates a character device, block device, FIFO or socket. The kind is
+// taken from the type bits of mode and the permissions from the rest. major
+// and minor are ignored for FIFOs and sockets.
+func (fs *Ext4Filesystem) Mknod(filename string, mode goFs.FileMode, major uint32, minor uint32) error {
+	node, err := fs.getNode(path.Dir(filename), false, false, true)
+	if err != nil {
+		return err
+	}
+
+	if !node.Mode().IsDir() {
+		return goFs.ErrInvalid
+	}
+
+	f, err := fs.allocateInode()
+	if err != nil {
+		return err
+	}
+
+	if err := f.makeSpecial(mode, major, minor); err != nil {
+		return err
+	}
+
+	if err := node.addDirectoryEntry(f, path.Base(filename)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (fs *Ext4Filesystem) Exists(filename string) bool {
 	_, err := fs.getNode(filename, false, false, false)
 	return err == nil
@@ -1554,7 +1768,7 @@ func (fs *Ext4Filesystem) Chmod(filename string, mode goFs.FileMode) error {
 	return node.chmod(mode)
 }
 
-func (fs *Ext4Filesystem) Chown(filename string, uid uint16, gid uint16) error {
+func (fs *Ext4Filesystem) Chown(filename string, uid uint32, gid uint32) error {
 	node, err := fs.getNode(filename, false, false, false)
 	if err != nil {
 		return err
@@ -1638,6 +1852,8 @@ func (fs *Ext4Filesystem) MakeDeterministic(fsUuid uuid.UUID, createTime time.Ti
 	fs.sb.SetMkfsTime(uint32(createTime.Unix()))
 
 	fs.sb.WriteAt(fsUuid[:], 104)
+	fs.setHashSeed(fsUuid)
+	fs.updateJournalSuperblock()
 
 	rootNode := fs.inodes[2]
 
@@ -1705,7 +1921,9 @@ func CreateExt4Filesystem(_vm *vm.VirtualMemory, offset int64, size int64) (*Ext
 	fs.sb.SetMagic(61267)
 	fs.sb.SetBlocksCount(uint64(blockCount))
 	fs.sb.SetInodesCount(uint32(inodeCount))
-	fs.sb.SetRBlocksCount(3276)
+	// Like mke2fs reserve 5% of the blocks for root. e2fsck rejects images
+	// that reserve more than half of the blocks.
+	fs.sb.SetRBlocksCount(uint64(blockCount / 20))
 	fs.sb.SetLogBlockSize(2)
 	fs.sb.SetLogClusterSize(2)
 	fs.sb.SetBlocksPerGroup(uint32(blocksPerGroup))
@@ -1732,8 +1950,15 @@ func CreateExt4Filesystem(_vm *vm.VirtualMemory, offset int64, size int64) (*Ext
 
 	// Set feature flags.
 	fs.sb.SetFeatureCompat(
-		uint32(Feature_compat_COMPAT_SPARSE_SUPER2),
+		uint32(Feature_compat_COMPAT_SPARSE_SUPER2) |
+			uint32(Feature_compat_COMPAT_EXT_ATTR) |
+			uint32(Feature_compat_COMPAT_DIR_INDEX),
 	)
+
+	// Large directories are indexed with half MD4.
+	fs.setHashSeed(uuid)
+	fs.sb.SetDefHashVersion(DX_HASH_HALF_MD4)
+	fs.sb.SetFlags(fs.sb.Flags() | EXT2_FLAGS_UNSIGNED_HASH)
 	fs.sb.SetFeatureIncompat(
 		uint32(Feature_incompat_INCOMPAT_64BIT) |
 			uint32(Feature_incompat_INCOMPAT_FILETYPE) |
@@ -1,8 +1,18 @@
 package ext4
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	goFs "io/fs"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
+	"github.com/tinyrange/tinyrange/pkg/internal/fscktest"
 	"github.com/tinyrange/vm"
 )
 
@@ -18,3 +28,675 @@ func BenchmarkCreation(b *testing.B) {
 		_ = fs
 	}
 }
+
+func TestChownHighIds(t *testing.T) {
+	_vm := vm.NewVirtualMemory(8*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CreateFile("/file", vm.RawRegion("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		uid uint32 = 100000
+		gid uint32 = 0x12345678
+	)
+
+	if err := fs.Chown("/file", uid, gid); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := fs.getNode("/file", false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the inode back from the image.
+	buf := make([]byte, INODE_SIZE)
+	if _, err := _vm.ReadAt(buf, int64(node.offset)); err != nil {
+		t.Fatal(err)
+	}
+
+	gotUid := uint32(binary.LittleEndian.Uint16(buf[0x02:])) | uint32(binary.LittleEndian.Uint16(buf[0x78:]))<<16
+	gotGid := uint32(binary.LittleEndian.Uint16(buf[0x18:])) | uint32(binary.LittleEndian.Uint16(buf[0x7A:]))<<16
+
+	if gotUid != uid {
+		t.Errorf("uid = %d, want %d", gotUid, uid)
+	}
+	if gotGid != gid {
+		t.Errorf("gid = %d, want %d", gotGid, gid)
+	}
+}
+
+func checkXattrs(t *testing.T, fs *Ext4Filesystem, filename string, want map[string][]byte) {
+	t.Helper()
+
+	got, err := fs.Xattrs(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("got %d xattrs, want %d", len(got), len(want))
+	}
+
+	for name, value := range want {
+		if !bytes.Equal(got[name], value) {
+			t.Errorf("%s = %x, want %x", name, got[name], value)
+		}
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	_vm := vm.NewVirtualMemory(8*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CreateFile("/ping", vm.RawRegion("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.CreateFile("/large", vm.RawRegion("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/dir", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// cap_net_raw+ep
+	capability := []byte{
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	inline := map[string][]byte{
+		"security.capability": capability,
+		"user.empty":          {},
+	}
+
+	large := map[string][]byte{
+		"security.selinux": []byte("system_u:object_r:bin_t:s0\x00"),
+		"user.large":       bytes.Repeat([]byte("a"), 1000),
+		"trusted.b":        []byte("b"),
+	}
+
+	// user::rwx user:1000:r-x group::r-x mask::r-x other::r-x
+	acl := binary.LittleEndian.AppendUint32(nil, 2)
+	for _, ent := range [][3]uint32{
+		{0x01, 7, 0xFFFFFFFF},
+		{0x02, 5, 1000},
+		{0x04, 5, 0xFFFFFFFF},
+		{0x10, 5, 0xFFFFFFFF},
+		{0x20, 5, 0xFFFFFFFF},
+	} {
+		acl = binary.LittleEndian.AppendUint16(acl, uint16(ent[0]))
+		acl = binary.LittleEndian.AppendUint16(acl, uint16(ent[1]))
+		acl = binary.LittleEndian.AppendUint32(acl, ent[2])
+	}
+
+	acls := map[string][]byte{
+		"system.posix_acl_access":  acl,
+		"system.posix_acl_default": acl,
+	}
+
+	for filename, xattrs := range map[string]map[string][]byte{
+		"/ping":  inline,
+		"/large": large,
+		"/dir":   acls,
+	} {
+		if err := fs.SetXattrs(filename, xattrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkXattrs(t, fs, "/ping", inline)
+	checkXattrs(t, fs, "/large", large)
+	checkXattrs(t, fs, "/dir", acls)
+
+	node, err := fs.getNode("/ping", false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.node.FileAclLo() != 0 {
+		t.Errorf("small xattrs were stored in an external block")
+	}
+
+	node, err = fs.getNode("/large", false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.node.FileAclLo() == 0 {
+		t.Errorf("large xattrs were not stored in an external block")
+	}
+}
+
+// Attributes in namespaces ext4 doesn't support are skipped rather than
+// failing the build.
+func TestUnsupportedXattrNamespace(t *testing.T) {
+	_vm := vm.NewVirtualMemory(8*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CreateFile("/file", vm.RawRegion("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetXattrs("/file", map[string][]byte{
+		"com.apple.quarantine": []byte("0081;00000000;Safari;"),
+		"user.kept":            []byte("value"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkXattrs(t, fs, "/file", map[string][]byte{"user.kept": []byte("value")})
+
+	// Other errors are still reported.
+	if err := fs.SetXattrs("/file", map[string][]byte{
+		"user." + strings.Repeat("a", 256): []byte("value"),
+	}); err == nil {
+		t.Fatal("expected an error for a name that's too long")
+	}
+}
+
+func TestHalfMD4Hash(t *testing.T) {
+	// Hashes from `debugfs -R "dx_hash -h 4 [-s 00112233-4455-6677-8899-aabbccddeeff] name"`.
+	seed := [4]uint32{0x33221100, 0x77665544, 0xbbaa9988, 0xffeeddcc}
+
+	for _, tc := range []struct {
+		name     string
+		seeded   uint32
+		unseeded uint32
+	}{
+		{"hello", 0x344ca36e, 0x1746da32},
+		{"a", 0x93752ee6, 0xd5fa7d7a},
+		{"file-00001", 0xdafe4ef2, 0x84e6dbde},
+		{"libc.so.6", 0xeb933632, 0x72ffc88e},
+		{strings.Repeat("x", 40), 0x5bb64504, 0xa58368b6},
+		{"é", 0x0c1a1e28, 0xfda9f3f8},
+	} {
+		if got := HalfMD4Hash(tc.name, seed); got != tc.seeded {
+			t.Errorf("HalfMD4Hash(%q, seed) = %#x, want %#x", tc.name, got, tc.seeded)
+		}
+		if got := HalfMD4Hash(tc.name, [4]uint32{}); got != tc.unseeded {
+			t.Errorf("HalfMD4Hash(%q) = %#x, want %#x", tc.name, got, tc.unseeded)
+		}
+	}
+}
+
+// Read a logical block of the file with the inode at inodeOffset using its
+// extent tree.
+func readFileBlock(t *testing.T, _vm *vm.VirtualMemory, inodeOffset uint64, logical uint32) []byte {
+	t.Helper()
+
+	inode := make([]byte, INODE_SIZE)
+	if _, err := _vm.ReadAt(inode, int64(inodeOffset)); err != nil {
+		t.Fatal(err)
+	}
+
+	node := inode[0x28:]
+
+	// Follow the index entries down to the leaf holding logical.
+	for binary.LittleEndian.Uint16(node[6:]) > 0 {
+		entries := int(binary.LittleEndian.Uint16(node[2:]))
+
+		var leaf uint64
+		for i := 0; i < entries; i++ {
+			idx := node[12+i*12:]
+
+			if binary.LittleEndian.Uint32(idx[0:]) > logical {
+				break
+			}
+			leaf = uint64(binary.LittleEndian.Uint16(idx[8:]))<<32 | uint64(binary.LittleEndian.Uint32(idx[4:]))
+		}
+
+		node = make([]byte, 4096)
+		if _, err := _vm.ReadAt(node, int64(leaf)*4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+
+	for i := 0; i < entries; i++ {
+		ext := node[12+i*12:]
+
+		first := binary.LittleEndian.Uint32(ext[0:])
+		length := uint32(binary.LittleEndian.Uint16(ext[4:]))
+		start := uint64(binary.LittleEndian.Uint16(ext[6:]))<<32 | uint64(binary.LittleEndian.Uint32(ext[8:]))
+
+		if logical >= first && logical < first+length {
+			block := make([]byte, 4096)
+			if _, err := _vm.ReadAt(block, int64(start+uint64(logical-first))*4096); err != nil {
+				t.Fatal(err)
+			}
+			return block
+		}
+	}
+
+	t.Fatalf("logical block %d is not mapped", logical)
+	return nil
+}
+
+// Find the block for hash in a list of dx_entries.
+func dxFind(entries []byte, hash uint32) uint32 {
+	count := int(binary.LittleEndian.Uint16(entries[2:]))
+	block := binary.LittleEndian.Uint32(entries[4:])
+
+	for i := 1; i < count; i++ {
+		if binary.LittleEndian.Uint32(entries[i*8:]) > hash {
+			break
+		}
+		block = binary.LittleEndian.Uint32(entries[i*8+4:])
+	}
+
+	return block
+}
+
+// Look up name in a hashed directory by walking the index in the image.
+func htreeLookup(t *testing.T, _vm *vm.VirtualMemory, seed [4]uint32, dirOffset uint64, name string) (uint32, int) {
+	t.Helper()
+
+	root := readFileBlock(t, _vm, dirOffset, 0)
+	if root[28] != DX_HASH_HALF_MD4 {
+		t.Fatalf("unexpected hash version %d", root[28])
+	}
+
+	levels := int(root[30])
+	hash := HalfMD4Hash(name, seed)
+
+	block := dxFind(root[32:], hash)
+	for i := 0; i < levels; i++ {
+		block = dxFind(readFileBlock(t, _vm, dirOffset, block)[8:], hash)
+	}
+
+	leaf := readFileBlock(t, _vm, dirOffset, block)
+
+	for off := 0; off < len(leaf); {
+		inode := binary.LittleEndian.Uint32(leaf[off:])
+		recLen := int(binary.LittleEndian.Uint16(leaf[off+4:]))
+		nameLen := int(leaf[off+6])
+
+		if inode != 0 && string(leaf[off+8:off+8+nameLen]) == name {
+			return inode, levels
+		}
+
+		off += recLen
+	}
+
+	return 0, levels
+}
+
+func TestHashedDirectory(t *testing.T) {
+	_vm := vm.NewVirtualMemory(64*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CreateFile("/target", vm.RawRegion("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		dir    string
+		count  int
+		name   func(i int) string
+		levels int
+	}{
+		{"/small", 2000, func(i int) string { return fmt.Sprintf("file-%05d", i) }, 0},
+		// Long names need more leaves than fit in the root index.
+		{"/large", 8000, func(i int) string { return fmt.Sprintf("%0255d", i) }, 1},
+		// More blocks than fit in the 4 extents in the inode.
+		{"/huge", 20000, func(i int) string { return fmt.Sprintf("%0255d", i) }, 1},
+	} {
+		if err := fs.Mkdir(tc.dir, false); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < tc.count; i++ {
+			if err := fs.Link(path.Join(tc.dir, tc.name(i)), "/target"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		target, err := fs.getNode("/target", false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir, err := fs.getNode(tc.dir, false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dir.Flags()&InodeFlag_INDEX == 0 {
+			t.Fatalf("%s is not indexed", tc.dir)
+		}
+
+		// Read the seed from the superblock in the image.
+		sb := make([]byte, 1024)
+		if _, err := _vm.ReadAt(sb, 1024); err != nil {
+			t.Fatal(err)
+		}
+
+		var seed [4]uint32
+		for i := range seed {
+			seed[i] = binary.LittleEndian.Uint32(sb[236+i*4:])
+		}
+
+		for i := 0; i < tc.count; i++ {
+			name := tc.name(i)
+
+			inode, levels := htreeLookup(t, _vm, seed, dir.offset, name)
+			if levels != tc.levels {
+				t.Fatalf("%s has %d levels, want %d", tc.dir, levels, tc.levels)
+			}
+			if inode != uint32(target.num) {
+				t.Fatalf("lookup of %s/%s = %d, want %d", tc.dir, name, inode, target.num)
+			}
+		}
+
+		if inode, _ := htreeLookup(t, _vm, seed, dir.offset, "missing"); inode != 0 {
+			t.Errorf("lookup of missing file in %s returned inode %d", tc.dir, inode)
+		}
+
+		r, err := OpenReader(_vm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inode, err := r.ReadInode(uint32(dir.num))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ents, err := r.ReadDir(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ents) != tc.count {
+			t.Fatalf("read %d entries from %s, want %d", len(ents), tc.dir, tc.count)
+		}
+	}
+
+	filename := path.Join(t.TempDir(), "image.ext4")
+
+	out, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, io.NewSectionReader(_vm, 0, _vm.Size())); err != nil {
+		t.Fatal(err)
+	}
+
+	fscktest.Check(t, filename)
+}
+
+func TestHashedDirectoryLimit(t *testing.T) {
+	_vm := vm.NewVirtualMemory(8*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &HashedDirectory{fs: fs}
+
+	// The root holds 508 interior blocks which each hold 511 leaves.
+	const maxBlocks = 1 + 508*512
+
+	nodes, leaves, err := d.layout(maxBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nodes != 508 || leaves != 508*511 {
+		t.Fatalf("unexpected layout: %d nodes %d leaves", nodes, leaves)
+	}
+
+	if _, _, err := d.layout(maxBlocks + 1); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("expected a too large error, got %v", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	_vm := vm.NewVirtualMemory(64*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, 3*1024*1024+123)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+
+	longTarget := "/" + strings.Repeat("x", 100)
+
+	for _, step := range []error{
+		fs.Mkdir("/dir", false),
+		fs.CreateFile("/dir/small", vm.RawRegion("hello")),
+		fs.CreateFile("/large", vm.RawRegion(large)),
+		fs.Symlink("/short", "/dir/small"),
+		fs.Symlink("/long", longTarget),
+		fs.Mknod("/null", goFs.ModeDevice|goFs.ModeCharDevice|0666, 1, 3),
+		fs.Mknod("/disk", goFs.ModeDevice|0660, 259, 300),
+		fs.Chown("/dir/small", 100000, 1000),
+		fs.SetXattrs("/dir/small", map[string][]byte{"user.test": []byte("value")}),
+		fs.Mkdir("/hashed", false),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		if err := fs.Link(fmt.Sprintf("/hashed/file-%04d", i), "/dir/small"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := OpenReader(_vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(filename string) *ReaderInode {
+		t.Helper()
+
+		inode, err := r.ReadInode(ROOT_INODE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	outer:
+		for _, name := range strings.Split(strings.Trim(filename, "/"), "/") {
+			ents, err := r.ReadDir(inode)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, ent := range ents {
+				if ent.Name == name {
+					inode, err = r.ReadInode(ent.Inode)
+					if err != nil {
+						t.Fatal(err)
+					}
+					continue outer
+				}
+			}
+
+			t.Fatalf("%s not found", filename)
+		}
+
+		return inode
+	}
+
+	readAll := func(inode *ReaderInode) []byte {
+		t.Helper()
+
+		f, err := r.Open(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return contents
+	}
+
+	small := lookup("/dir/small")
+	if got := string(readAll(small)); got != "hello" {
+		t.Errorf("/dir/small = %q", got)
+	}
+	if small.Uid() != 100000 || small.Gid() != 1000 {
+		t.Errorf("/dir/small owner = %d:%d", small.Uid(), small.Gid())
+	}
+
+	xattrs, err := r.Xattrs(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(xattrs["user.test"]) != "value" {
+		t.Errorf("/dir/small xattrs = %v", xattrs)
+	}
+
+	if !bytes.Equal(readAll(lookup("/large")), large) {
+		t.Errorf("/large contents differ")
+	}
+
+	for filename, want := range map[string]string{"/short": "/dir/small", "/long": longTarget} {
+		got, err := r.Readlink(lookup(filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s -> %q, want %q", filename, got, want)
+		}
+	}
+
+	for filename, want := range map[string][2]uint32{"/null": {1, 3}, "/disk": {259, 300}} {
+		major, minor := lookup(filename).DeviceNumbers()
+		if major != want[0] || minor != want[1] {
+			t.Errorf("%s = %d,%d, want %d,%d", filename, major, minor, want[0], want[1])
+		}
+	}
+
+	ents, err := r.ReadDir(lookup("/hashed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 500 {
+		t.Errorf("/hashed has %d entries, want 500", len(ents))
+	}
+}
+
+func TestMknodMode(t *testing.T) {
+	_vm := vm.NewVirtualMemory(8*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		filename string
+		mode     goFs.FileMode
+		expected uint16
+	}{
+		{"/null", goFs.ModeDevice | goFs.ModeCharDevice | 0666, S_IFCHR | 0666},
+		{"/sda", goFs.ModeDevice | 0660, S_IFBLK | 0660},
+		{"/fifo", goFs.ModeNamedPipe | goFs.ModeSetgid | 0620, S_IFIFO | S_ISGID | 0620},
+		{"/socket", goFs.ModeSocket | 0755, S_IFSOCK | 0755},
+	} {
+		if err := fs.Mknod(tc.filename, tc.mode, 1, 3); err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := fs.getNode(tc.filename, false, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mode := node.node.Mode(); mode != tc.expected {
+			t.Errorf("%s has mode %o, want %o", tc.filename, mode, tc.expected)
+		}
+	}
+
+	if err := fs.Mknod("/file", 0644, 0, 0); err == nil {
+		t.Error("expected an error for a regular file")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	_vm := vm.NewVirtualMemory(64*1024*1024, 4096)
+
+	fs, err := CreateExt4Filesystem(_vm, 0, _vm.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.AddJournal(JournalOptions{Features: JBD2_FEATURE_INCOMPAT_CSUM_V3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.AddJournal(JournalOptions{}); err == nil {
+		t.Fatal("adding a second journal succeeded")
+	}
+
+	sb := make([]byte, 1024)
+	if _, err := _vm.ReadAt(sb, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.LittleEndian.Uint32(sb[0x5C:])&uint32(Feature_compat_COMPAT_HAS_JOURNAL) == 0 {
+		t.Fatal("has_journal is not set")
+	}
+	if inum := binary.LittleEndian.Uint32(sb[0xE0:]); inum != JOURNAL_INODE {
+		t.Fatalf("s_journal_inum = %d", inum)
+	}
+
+	node := fs.inodes[JOURNAL_INODE]
+
+	// The journal superblock is in the first block of the journal.
+	jsb := readFileBlock(t, _vm, node.offset, 0)
+
+	be := binary.BigEndian
+
+	if magic := be.Uint32(jsb[0x0:]); magic != JBD2_MAGIC_NUMBER {
+		t.Fatalf("journal magic = %x", magic)
+	}
+	if maxlen := be.Uint32(jsb[0x10:]); maxlen != 1024 {
+		t.Errorf("s_maxlen = %d, want 1024", maxlen)
+	}
+	if start := be.Uint32(jsb[0x1C:]); start != 0 {
+		t.Errorf("s_start = %d, journal is not clean", start)
+	}
+	if !bytes.Equal(jsb[0x30:0x40], sb[104:120]) {
+		t.Errorf("journal uuid does not match the filesystem")
+	}
+
+	want := be.Uint32(jsb[0xFC:])
+	be.PutUint32(jsb[0xFC:], 0)
+	if got := ^crc32.Checksum(jsb[:1024], crc32.MakeTable(crc32.Castagnoli)); got != want {
+		t.Errorf("journal checksum = %x, want %x", want, got)
+	}
+}
@@ -0,0 +1,531 @@
+package ext4
+
+// Hashed directories store their entries in leaf blocks sorted by the hash of
+// the name with an index in the first block so lookups only read one leaf.
+// See: https://www.kernel.org/doc/html/latest/filesystems/ext4/dynamic.html#hash-tree-directories
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Linear directories that grow past this many blocks are converted to
+	// hashed directories. Like the kernel a directory is indexed as soon as it
+	// outgrows a single block.
+	HASHED_DIRECTORY_THRESHOLD = 1
+
+	// Hashed directories grow by this multiple of their current size to keep
+	// the number of extents small.
+	HASHED_DIRECTORY_GROWTH = 8
+
+	// s_def_hash_version for half MD4.
+	DX_HASH_HALF_MD4 = 1
+
+	// s_flags bit telling the kernel names are hashed as unsigned chars.
+	EXT2_FLAGS_UNSIGNED_HASH = 0x2
+
+	// The record length of a directory entry with a 255 byte name.
+	maxDirentLength = 264
+)
+
+// The hash is half of a MD4 transform over the name 32 bytes at a time.
+func halfMD4Transform(buf *[4]uint32, in *[8]uint32) {
+	f := func(x, y, z uint32) uint32 { return z ^ (x & (y ^ z)) }
+	g := func(x, y, z uint32) uint32 { return (x & y) + ((x ^ y) & z) }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+
+	const (
+		k1 = 0
+		k2 = 0x5A827999
+		k3 = 0x6ED9EBA1
+	)
+
+	a, b, c, d := buf[0], buf[1], buf[2], buf[3]
+
+	round := func(fn func(x, y, z uint32) uint32, a *uint32, b, c, d uint32, x uint32, s int) {
+		*a = bits.RotateLeft32(*a+fn(b, c, d)+x, s)
+	}
+
+	round(f, &a, b, c, d, in[0]+k1, 3)
+	round(f, &d, a, b, c, in[1]+k1, 7)
+	round(f, &c, d, a, b, in[2]+k1, 11)
+	round(f, &b, c, d, a, in[3]+k1, 19)
+	round(f, &a, b, c, d, in[4]+k1, 3)
+	round(f, &d, a, b, c, in[5]+k1, 7)
+	round(f, &c, d, a, b, in[6]+k1, 11)
+	round(f, &b, c, d, a, in[7]+k1, 19)
+
+	round(g, &a, b, c, d, in[1]+k2, 3)
+	round(g, &d, a, b, c, in[3]+k2, 5)
+	round(g, &c, d, a, b, in[5]+k2, 9)
+	round(g, &b, c, d, a, in[7]+k2, 13)
+	round(g, &a, b, c, d, in[0]+k2, 3)
+	round(g, &d, a, b, c, in[2]+k2, 5)
+	round(g, &c, d, a, b, in[4]+k2, 9)
+	round(g, &b, c, d, a, in[6]+k2, 13)
+
+	round(h, &a, b, c, d, in[3]+k3, 3)
+	round(h, &d, a, b, c, in[7]+k3, 9)
+	round(h, &c, d, a, b, in[2]+k3, 11)
+	round(h, &b, c, d, a, in[6]+k3, 15)
+	round(h, &a, b, c, d, in[1]+k3, 3)
+	round(h, &d, a, b, c, in[5]+k3, 9)
+	round(h, &c, d, a, b, in[0]+k3, 11)
+	round(h, &b, c, d, a, in[4]+k3, 15)
+
+	buf[0] += a
+	buf[1] += b
+	buf[2] += c
+	buf[3] += d
+}
+
+// Same as str2hashbuf_unsigned in the kernel.
+func str2hashbuf(msg []byte, num int) [8]uint32 {
+	var ret [8]uint32
+
+	pad := uint32(len(msg)) | uint32(len(msg))<<8
+	pad |= pad << 16
+
+	if len(msg) > num*4 {
+		msg = msg[:num*4]
+	}
+
+	val := pad
+	out := 0
+
+	for i, c := range msg {
+		val = uint32(c) + (val << 8)
+		if i%4 == 3 {
+			ret[out] = val
+			out++
+			val = pad
+		}
+	}
+
+	if out < num {
+		ret[out] = val
+		out++
+	}
+
+	for ; out < num; out++ {
+		ret[out] = pad
+	}
+
+	return ret
+}
+
+// HalfMD4Hash returns the directory hash of name with the unsigned variant of
+// half MD4. A zero seed uses the default MD4 initial values.
+func HalfMD4Hash(name string, seed [4]uint32) uint32 {
+	buf := seed
+	if seed == [4]uint32{} {
+		buf = [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	}
+
+	msg := []byte(name)
+
+	for {
+		in := str2hashbuf(msg, 8)
+		halfMD4Transform(&buf, &in)
+
+		if len(msg) <= 32 {
+			break
+		}
+		msg = msg[32:]
+	}
+
+	// The lowest bit is used to mark hash collisions in the index.
+	hash := buf[1] &^ 1
+
+	// The largest value means the end of the directory in readdir cookies.
+	if hash == 0x7fffffff<<1 {
+		hash = (0x7fffffff - 1) << 1
+	}
+
+	return hash
+}
+
+// Derive the directory hash seed from the filesystem UUID so deterministic
+// images hash names the same way.
+func (fs *Ext4Filesystem) setHashSeed(fsUuid uuid.UUID) {
+	seed := uuid.NewSHA1(fsUuid, []byte("dir_hash_seed"))
+
+	for i := 0; i < 4; i++ {
+		fs.sb.SetHashSeed(i, binary.LittleEndian.Uint32(seed[i*4:]))
+	}
+}
+
+func (fs *Ext4Filesystem) hashSeed() [4]uint32 {
+	var seed [4]uint32
+
+	for i := range seed {
+		seed[i], _ = fs.sb.HashSeed(i)
+	}
+
+	return seed
+}
+
+func direntLength(name string) int {
+	return (8 + len(name) + 3) &^ 3
+}
+
+func putDirent(buf []byte, inode uint32, recLen int, typ uint8, name string) {
+	binary.LittleEndian.PutUint32(buf[0:], inode)
+	binary.LittleEndian.PutUint16(buf[4:], uint16(recLen))
+	buf[6] = uint8(len(name))
+	buf[7] = typ
+	copy(buf[8:], name)
+}
+
+type hashedEntry struct {
+	name   string
+	typ    uint8
+	target *InodeWrapper
+	hash   uint32
+}
+
+type HashedDirectory struct {
+	fs         *Ext4Filesystem
+	extentTree ExtentTree
+	inode      *InodeWrapper
+	parent     *InodeWrapper
+	ents       map[string]*hashedEntry
+
+	// The total record length of every entry.
+	size int64
+	// The number of blocks allocated to the directory.
+	blocks int64
+
+	// The contents of every block. The blocks are rendered when they are
+	// first read and again after entries are added.
+	data []byte
+}
+
+// The number of index entries in the root and interior blocks.
+func (d *HashedDirectory) rootLimit() int { return (int(d.fs.sb.blockSize()) - 32) / 8 }
+func (d *HashedDirectory) nodeLimit() int { return (int(d.fs.sb.blockSize()) - 8) / 8 }
+
+// Split the blocks of the directory into interior index blocks and leaves.
+func (d *HashedDirectory) layout(blocks int64) (nodes int, leaves int, err error) {
+	if int(blocks-1) <= d.rootLimit() {
+		return 0, int(blocks - 1), nil
+	}
+
+	// Every interior block is followed by up to nodeLimit leaves.
+	nodes = int(roundUpDiv(blocks-1, int64(d.nodeLimit()+1)))
+	leaves = int(blocks-1) - nodes
+
+	if nodes > d.rootLimit() {
+		return 0, 0, fmt.Errorf("hashed directory is too large: %d blocks is more than the %d a two level index can address", blocks, 1+d.rootLimit()*(d.nodeLimit()+1))
+	}
+
+	return nodes, leaves, nil
+}
+
+// Make sure there are enough blocks to hold every entry. Packing the sorted
+// entries never wastes more than the largest entry per leaf.
+func (d *HashedDirectory) ensureBlocks() error {
+	blockSize := int64(d.fs.sb.blockSize())
+
+	leaves := d.size/(blockSize-maxDirentLength) + 1
+
+	required := 1 + leaves
+	if leaves > int64(d.rootLimit()) {
+		required += roundUpDiv(leaves, int64(d.nodeLimit()))
+	}
+
+	if required <= d.blocks {
+		return nil
+	}
+
+	grow := max(required-d.blocks, d.blocks*HASHED_DIRECTORY_GROWTH)
+
+	// Only grow by what's needed once the index is close to full.
+	if _, _, err := d.layout(d.blocks + grow); err != nil {
+		grow = required - d.blocks
+	}
+
+	if _, _, err := d.layout(d.blocks + grow); err != nil {
+		return err
+	}
+
+	if err := d.extentTree.AllocateBlocks(grow); err != nil {
+		return err
+	}
+
+	extents, err := d.extentTree.Extents()
+	if err != nil {
+		return err
+	}
+
+	extents = splitExtentIntoBlocks(extents)
+
+	for i := d.blocks; i < d.blocks+grow; i++ {
+		if err := d.fs.mapRawExtent(&hashedDirectoryBlock{dir: d, index: i}, &extents[i]); err != nil {
+			return err
+		}
+	}
+
+	d.blocks += grow
+
+	d.inode.node.SetNSize(uint64(d.blocks) * uint64(blockSize))
+	d.inode.node.SetBlocks(d.inode.node.Blocks() + uint64(grow*blockSize)/512)
+
+	return nil
+}
+
+func (d *HashedDirectory) addEntry(child *InodeWrapper, name string, typ uint8) error {
+	if _, exists := d.ents[name]; exists || name == "." || name == ".." {
+		return fmt.Errorf("entry %s already exists", name)
+	}
+
+	d.ents[name] = &hashedEntry{name: name, typ: typ, target: child}
+	d.size += int64(direntLength(name))
+	d.data = nil
+
+	return d.ensureBlocks()
+}
+
+// GetChild implements Directory.
+func (d *HashedDirectory) GetChild(name string) (*InodeWrapper, error) {
+	switch name {
+	case ".":
+		return d.inode, nil
+	case "..":
+		return d.parent, nil
+	}
+
+	ent, ok := d.ents[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return ent.target, nil
+}
+
+// AddEntry implements Directory.
+func (d *HashedDirectory) AddEntry(child *InodeWrapper, name string) error {
+	return d.addEntry(child, name, direntFileType(child.Mode()))
+}
+
+// Write dx_entries for the given blocks. The hash of the first entry is
+// implied by the parent so its slot holds the count and limit.
+func putDxEntries(buf []byte, limit int, hashes []uint32, firstBlock int) {
+	binary.LittleEndian.PutUint16(buf[0:], uint16(limit))
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(hashes)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(firstBlock))
+
+	for i := 1; i < len(hashes); i++ {
+		binary.LittleEndian.PutUint32(buf[i*8:], hashes[i])
+		binary.LittleEndian.PutUint32(buf[i*8+4:], uint32(firstBlock+i))
+	}
+}
+
+func (d *HashedDirectory) render() error {
+	if d.data != nil {
+		return nil
+	}
+
+	blockSize := int(d.fs.sb.blockSize())
+	seed := d.fs.hashSeed()
+
+	nodes, leaves, err := d.layout(d.blocks)
+	if err != nil {
+		return err
+	}
+
+	var ents []*hashedEntry
+	for _, ent := range d.ents {
+		ent.hash = HalfMD4Hash(ent.name, seed)
+		ents = append(ents, ent)
+	}
+
+	if len(ents) < leaves {
+		return fmt.Errorf("hashed directory has more leaves than entries")
+	}
+
+	sort.Slice(ents, func(a, b int) bool {
+		if ents[a].hash != ents[b].hash {
+			return ents[a].hash < ents[b].hash
+		}
+		return ents[a].name < ents[b].name
+	})
+
+	data := make([]byte, int64(blockSize)*d.blocks)
+
+	leafBlock := func(i int) []byte {
+		start := (1 + nodes + i) * blockSize
+		return data[start : start+blockSize]
+	}
+
+	// The hash in the index of each leaf.
+	leafHashes := make([]uint32, leaves)
+
+	// Fill leaves in order but start a new leaf for every remaining entry
+	// once there are as many leaves left as entries so every leaf is used.
+	leaf, off, last := 0, 0, 0
+
+	for i, ent := range ents {
+		recLen := direntLength(ent.name)
+
+		if off > 0 && (off+recLen > blockSize || len(ents)-i <= leaves-leaf-1) {
+			binary.LittleEndian.PutUint16(leafBlock(leaf)[last+4:], uint16(blockSize-last))
+
+			leaf += 1
+			off = 0
+
+			leafHashes[leaf] = ent.hash
+			if ent.hash == ents[i-1].hash {
+				// The previous leaf has names with the same hash.
+				leafHashes[leaf] |= 1
+			}
+		}
+
+		putDirent(leafBlock(leaf)[off:], uint32(ent.target.num), recLen, ent.typ, ent.name)
+
+		last = off
+		off += recLen
+	}
+
+	binary.LittleEndian.PutUint16(leafBlock(leaf)[last+4:], uint16(blockSize-last))
+
+	if leaf != leaves-1 {
+		return fmt.Errorf("failed to pack hashed directory: used %d of %d leaves", leaf+1, leaves)
+	}
+
+	// dx_root starts with fake entries for `.` and `..`.
+	root := data[:blockSize]
+
+	putDirent(root[0:], uint32(d.inode.num), 12, 0x2, ".")
+	putDirent(root[12:], uint32(d.parent.num), blockSize-12, 0x2, "..")
+
+	// dx_root_info
+	root[28] = DX_HASH_HALF_MD4
+	root[29] = 8 // info_length
+	if nodes > 0 {
+		root[30] = 1 // indirect_levels
+	}
+
+	if nodes == 0 {
+		putDxEntries(root[32:], d.rootLimit(), leafHashes, 1)
+	} else {
+		var nodeHashes []uint32
+
+		// Spread the leaves evenly between the interior blocks.
+		for n := 0; n < nodes; n++ {
+			first := n * leaves / nodes
+			next := (n + 1) * leaves / nodes
+
+			nodeHashes = append(nodeHashes, leafHashes[first])
+
+			// Interior blocks start with a empty entry covering the block.
+			node := data[(1+n)*blockSize : (2+n)*blockSize]
+			putDirent(node, 0, blockSize, 0, "")
+
+			putDxEntries(node[8:], d.nodeLimit(), leafHashes[first:next], 1+nodes+first)
+		}
+
+		putDxEntries(root[32:], d.rootLimit(), nodeHashes, 1)
+	}
+
+	d.data = data
+
+	return nil
+}
+
+func (d HashedDirectory) String() string {
+	ret := "Directory["
+
+	ret += fmt.Sprintf("\n  HASHED entries=%d blocks=%d", len(d.ents), d.blocks)
+
+	return ret + "\n  ]"
+}
+
+// Convert a linear directory into a hashed directory reusing its blocks.
+func newHashedDirectory(linear *LinearDirectory) (*HashedDirectory, error) {
+	dir := &HashedDirectory{
+		fs:         linear.fs,
+		extentTree: linear.extentTree,
+		inode:      linear.inode,
+		ents:       make(map[string]*hashedEntry),
+	}
+
+	extents, err := dir.extentTree.Extents()
+	if err != nil {
+		return nil, err
+	}
+
+	extents = splitExtentIntoBlocks(extents)
+
+	dir.blocks = int64(len(extents))
+
+	for i := range extents {
+		if err := dir.fs.mapRawExtent(&hashedDirectoryBlock{dir: dir, index: int64(i)}, &extents[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, ent := range linear.ents {
+		switch name {
+		case ".":
+			continue
+		case "..":
+			dir.parent = ent.target
+		default:
+			if err := dir.addEntry(ent.target, name, ent.ent.FileType()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dir.parent == nil {
+		return nil, fmt.Errorf("directory has no parent entry")
+	}
+
+	dir.inode.node.SetFlags(dir.inode.node.Flags() | uint32(InodeFlag_INDEX))
+
+	return dir, nil
+}
+
+// A block of a hashed directory mapped into the image.
+type hashedDirectoryBlock struct {
+	dir   *HashedDirectory
+	index int64
+}
+
+// ReadAt implements vm.MemoryRegion.
+func (b *hashedDirectoryBlock) ReadAt(p []byte, off int64) (int, error) {
+	if err := b.dir.render(); err != nil {
+		return 0, err
+	}
+
+	blockSize := b.Size()
+
+	block := b.dir.data[b.index*blockSize : (b.index+1)*blockSize]
+	if off >= blockSize {
+		return 0, io.EOF
+	}
+
+	return copy(p, block[off:]), nil
+}
+
+// WriteAt implements vm.MemoryRegion.
+func (b *hashedDirectoryBlock) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("hashed directory blocks are read only")
+}
+
+// Size implements vm.MemoryRegion.
+func (b *hashedDirectoryBlock) Size() int64 {
+	return int64(b.dir.fs.sb.blockSize())
+}
+
+var (
+	_ Directory = &HashedDirectory{}
+)
@@ -0,0 +1,170 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/tinyrange/vm"
+)
+
+// JBD2 constants from include/linux/jbd2.h. Unlike the rest of ext4 the
+// journal is big endian.
+const (
+	JOURNAL_INODE = 8
+
+	JBD2_MAGIC_NUMBER     = 0xC03B3998
+	JBD2_SUPERBLOCK_V2    = 4
+	JBD2_MIN_JOURNAL_SIZE = 1024
+	JBD2_CRC32C_CHKSUM    = 4
+
+	JBD2_FEATURE_INCOMPAT_REVOKE       = 0x1
+	JBD2_FEATURE_INCOMPAT_64BIT        = 0x2
+	JBD2_FEATURE_INCOMPAT_ASYNC_COMMIT = 0x4
+	JBD2_FEATURE_INCOMPAT_CSUM_V3      = 0x10
+
+	// s_jnl_blocks holds a copy of i_block, i_size_high and i_size.
+	EXT3_JNL_BACKUP_BLOCKS = 1
+)
+
+// JournalOptions configures the internal journal added by AddJournal.
+type JournalOptions struct {
+	// The size of the journal in filesystem blocks. If 0 the size is picked
+	// from the size of the filesystem using the same table as mke2fs.
+	Blocks int64
+
+	// Extra JBD2_FEATURE_INCOMPAT_* flags. JBD2_FEATURE_INCOMPAT_64BIT is
+	// always set since the filesystem is 64-bit.
+	Features uint32
+}
+
+// DefaultJournalBlocks returns the journal size mke2fs would pick for a
+// filesystem with the given number of blocks.
+func DefaultJournalBlocks(blockCount int64) int64 {
+	switch {
+	case blockCount < 2048:
+		return 0
+	case blockCount < 32768:
+		return 1024
+	case blockCount < 256*1024:
+		return 4096
+	case blockCount < 512*1024:
+		return 8192
+	case blockCount < 4096*1024:
+		return 16384
+	case blockCount < 8192*1024:
+		return 32768
+	case blockCount < 16384*1024:
+		return 65536
+	case blockCount < 32768*1024:
+		return 131072
+	default:
+		return 262144
+	}
+}
+
+// AddJournal creates a empty internal journal in inode 8. The journal is
+// clean so nothing is replayed on the first mount.
+func (fs *Ext4Filesystem) AddJournal(opts JournalOptions) error {
+	if fs.sb.FeatureCompat()&uint32(Feature_compat_COMPAT_HAS_JOURNAL) != 0 {
+		return fmt.Errorf("filesystem already has a journal")
+	}
+
+	blocks := opts.Blocks
+	if blocks == 0 {
+		blocks = DefaultJournalBlocks(int64(fs.sb.BlocksCount()))
+	}
+
+	if blocks < JBD2_MIN_JOURNAL_SIZE {
+		return fmt.Errorf("journal of %d blocks is smaller than the minimum of %d blocks", blocks, JBD2_MIN_JOURNAL_SIZE)
+	}
+
+	inode, ok := fs.inodes[JOURNAL_INODE]
+	if !ok {
+		return fmt.Errorf("journal inode has not been allocated")
+	}
+
+	inode.node.SetMode(S_IFREG | 0600)
+	inode.node.SetLinksCount(1)
+
+	now := time.Now()
+	if !fs.deterministicTime.IsZero() {
+		now = fs.deterministicTime
+	}
+
+	inode.node.SetCtime(uint32(now.Unix()))
+	inode.node.SetMtime(uint32(now.Unix()))
+	inode.node.SetAtime(uint32(now.Unix()))
+
+	if err := inode.allocateExtent(blocks); err != nil {
+		return fmt.Errorf("failed to allocate journal: %w", err)
+	}
+
+	extents, err := inode.extentTree.Extents()
+	if err != nil {
+		return err
+	}
+
+	inode.node.SetNSize(uint64(blocks) * fs.sb.blockSize())
+	inode.node.SetBlocks((uint64(blocks) * fs.sb.blockSize()) / 512)
+
+	// The journal superblock is the first block of the journal.
+	fs.journal = make([]byte, fs.sb.blockSize())
+
+	be := binary.BigEndian
+
+	be.PutUint32(fs.journal[0x0:], JBD2_MAGIC_NUMBER)
+	be.PutUint32(fs.journal[0x4:], JBD2_SUPERBLOCK_V2)
+	be.PutUint32(fs.journal[0xC:], uint32(fs.sb.blockSize()))
+	be.PutUint32(fs.journal[0x10:], uint32(blocks))
+	// s_first: the first block of the log after the superblock.
+	be.PutUint32(fs.journal[0x14:], 1)
+	// s_sequence: the first transaction expected in the log.
+	be.PutUint32(fs.journal[0x18:], 1)
+	be.PutUint32(fs.journal[0x28:], opts.Features|JBD2_FEATURE_INCOMPAT_64BIT)
+	// s_nr_users: the filesystem is the only user of a internal journal.
+	be.PutUint32(fs.journal[0x40:], 1)
+
+	if opts.Features&JBD2_FEATURE_INCOMPAT_CSUM_V3 != 0 {
+		fs.journal[0x50] = JBD2_CRC32C_CHKSUM
+	}
+
+	if err := fs.mapRegion(vm.RawRegion(fs.journal), int64(uint64(extents[0].StartBlock)*fs.sb.blockSize())); err != nil {
+		return err
+	}
+
+	fs.updateJournalSuperblock()
+
+	// Keep a backup of the journal inode in the superblock for e2fsck.
+	for i := 0; i < 15; i++ {
+		fs.sb.SetJnlBlocks(i, binary.LittleEndian.Uint32(inode.node[0x28+i*4:]))
+	}
+	fs.sb.SetJnlBlocks(15, uint32(inode.node.NSize()>>32))
+	fs.sb.SetJnlBlocks(16, uint32(inode.node.NSize()))
+	fs.sb.SetJnlBackupType(EXT3_JNL_BACKUP_BLOCKS)
+
+	fs.sb.SetJournalInum(JOURNAL_INODE)
+	fs.sb.SetFeatureCompat(fs.sb.FeatureCompat() | uint32(Feature_compat_COMPAT_HAS_JOURNAL))
+
+	return nil
+}
+
+// updateJournalSuperblock copies the filesystem UUID into the journal and
+// updates the checksum.
+func (fs *Ext4Filesystem) updateJournalSuperblock() {
+	if fs.journal == nil {
+		return
+	}
+
+	copy(fs.journal[0x30:0x40], fs.sb[104:120])
+
+	if binary.BigEndian.Uint32(fs.journal[0x28:])&JBD2_FEATURE_INCOMPAT_CSUM_V3 != 0 {
+		binary.BigEndian.PutUint32(fs.journal[0xFC:], 0)
+
+		// jbd2 uses crc32c without the final inversion.
+		sum := ^crc32.Checksum(fs.journal[:1024], crc32.MakeTable(crc32.Castagnoli))
+
+		binary.BigEndian.PutUint32(fs.journal[0xFC:], sum)
+	}
+}
@@ -0,0 +1,419 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	goFs "io/fs"
+	"time"
+)
+
+const (
+	EXT4_MAGIC = 0xEF53
+
+	// The inode number of the root directory.
+	ROOT_INODE = 2
+
+	EXTENT_MAGIC = 0xF30A
+)
+
+// Reader reads the files in an existing ext4 image.
+type Reader struct {
+	r              io.ReaderAt
+	sb             Superblock
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup uint32
+	descSize       int64
+	is64Bit        bool
+}
+
+// ReaderInode is a inode read from an image.
+type ReaderInode struct {
+	Num uint32
+
+	node Inode
+	raw  []byte
+}
+
+// Mode returns the permissions and type of the inode.
+func (i *ReaderInode) Mode() goFs.FileMode {
+	return InodeWrapper{node: &i.node}.Mode()
+}
+
+func (i *ReaderInode) Flags() InodeFlags {
+	return InodeFlags(i.node.Flags())
+}
+
+func (i *ReaderInode) Size() int64 {
+	return int64(i.node.NSize())
+}
+
+func (i *ReaderInode) Uid() uint32 {
+	return uint32(i.node.Uid()) | uint32(i.node.UidHigh())<<16
+}
+
+func (i *ReaderInode) Gid() uint32 {
+	return uint32(i.node.Gid()) | uint32(i.node.GidHigh())<<16
+}
+
+func (i *ReaderInode) ModTime() time.Time {
+	return time.Unix(int64(i.node.Mtime()), 0)
+}
+
+// DeviceNumbers returns the major and minor numbers of a device inode. Both
+// the old and new encodings written by makeSpecial are supported.
+func (i *ReaderInode) DeviceNumbers() (uint32, uint32) {
+	if old := uint32(i.node.BlockMagic()); old != 0 {
+		return old >> 8, old & 0xff
+	}
+
+	dev := uint32(i.node.BlockMax()) | uint32(i.node.BlockDepth())<<16
+
+	return (dev & 0xfff00) >> 8, (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
+
+// The 60 bytes of i_block.
+func (i *ReaderInode) blockData() []byte {
+	return i.node[0x28 : 0x28+60]
+}
+
+// OpenReader checks the superblock of r and returns a reader for it.
+func OpenReader(r io.ReaderAt) (*Reader, error) {
+	ret := &Reader{r: r}
+
+	if _, err := r.ReadAt(ret.sb[:], 1024); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	if ret.sb.Magic() != EXT4_MAGIC {
+		return nil, fmt.Errorf("not a ext4 filesystem: bad magic %x", ret.sb.Magic())
+	}
+
+	ret.blockSize = int64(ret.sb.blockSize())
+	ret.inodesPerGroup = ret.sb.InodesPerGroup()
+
+	ret.inodeSize = int64(ret.sb.InodeSize())
+	if ret.sb.RevLevel() == 0 {
+		ret.inodeSize = 128
+	}
+
+	ret.is64Bit = ret.sb.FeatureIncompat()&uint32(Feature_incompat_INCOMPAT_64BIT) != 0
+
+	ret.descSize = 32
+	if ret.is64Bit && ret.sb.DescSize() != 0 {
+		ret.descSize = int64(ret.sb.DescSize())
+	}
+
+	return ret, nil
+}
+
+func (r *Reader) readBlock(block uint64) ([]byte, error) {
+	buf := make([]byte, r.blockSize)
+
+	if _, err := r.r.ReadAt(buf, int64(block)*r.blockSize); err != nil {
+		return nil, fmt.Errorf("failed to read block %d: %w", block, err)
+	}
+
+	return buf, nil
+}
+
+// ReadInode reads the inode with the given number.
+func (r *Reader) ReadInode(num uint32) (*ReaderInode, error) {
+	if num == 0 || num > r.sb.InodesCount() {
+		return nil, fmt.Errorf("invalid inode number: %d", num)
+	}
+
+	group := int64((num - 1) / r.inodesPerGroup)
+	index := int64((num - 1) % r.inodesPerGroup)
+
+	// The descriptors start in the block after the superblock.
+	descOffset := int64(r.sb.FirstDataBlock()+1)*r.blockSize + group*r.descSize
+
+	var desc BlockGroupDescriptor
+	if _, err := r.r.ReadAt(desc[:r.descSize], descOffset); err != nil {
+		return nil, fmt.Errorf("failed to read block group descriptor %d: %w", group, err)
+	}
+
+	inodeTable := uint64(desc.InodeTableLo())
+	if r.descSize >= 64 {
+		inodeTable = desc.InodeTable()
+	}
+
+	ret := &ReaderInode{Num: num, raw: make([]byte, r.inodeSize)}
+
+	if _, err := r.r.ReadAt(ret.raw, int64(inodeTable)*r.blockSize+index*r.inodeSize); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", num, err)
+	}
+
+	copy(ret.node[:], ret.raw)
+
+	return ret, nil
+}
+
+// A contiguous run of blocks in a file.
+type readerExtent struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+	// Unwritten extents read as zeros.
+	unwritten bool
+}
+
+func (r *Reader) extentTreeExtents(node []byte, ret []readerExtent) ([]readerExtent, error) {
+	if binary.LittleEndian.Uint16(node[0:]) != EXTENT_MAGIC {
+		return nil, fmt.Errorf("bad extent header magic")
+	}
+
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	depth := binary.LittleEndian.Uint16(node[6:])
+
+	if 12+entries*12 > len(node) {
+		return nil, fmt.Errorf("extent node has too many entries: %d", entries)
+	}
+
+	for i := 0; i < entries; i++ {
+		ent := node[12+i*12:]
+
+		if depth == 0 {
+			length := uint64(binary.LittleEndian.Uint16(ent[4:]))
+			unwritten := false
+			if length > 32768 {
+				length -= 32768
+				unwritten = true
+			}
+
+			ret = append(ret, readerExtent{
+				logical:   uint64(binary.LittleEndian.Uint32(ent[0:])),
+				physical:  uint64(binary.LittleEndian.Uint16(ent[6:]))<<32 | uint64(binary.LittleEndian.Uint32(ent[8:])),
+				length:    length,
+				unwritten: unwritten,
+			})
+		} else {
+			leaf := uint64(binary.LittleEndian.Uint16(ent[8:]))<<32 | uint64(binary.LittleEndian.Uint32(ent[4:]))
+
+			child, err := r.readBlock(leaf)
+			if err != nil {
+				return nil, err
+			}
+
+			ret, err = r.extentTreeExtents(child, ret)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// Walk a indirect block map from ext2 and ext3. level is the number of
+// indirect blocks between block and the data.
+func (r *Reader) blockMapExtents(block uint64, level int, logical uint64, ret []readerExtent) ([]readerExtent, uint64, error) {
+	perBlock := uint64(r.blockSize / 4)
+
+	span := uint64(1)
+	for i := 0; i < level; i++ {
+		span *= perBlock
+	}
+
+	if block == 0 {
+		// A hole.
+		return ret, logical + span, nil
+	}
+
+	if level == 0 {
+		if n := len(ret); n > 0 && !ret[n-1].unwritten &&
+			ret[n-1].logical+ret[n-1].length == logical &&
+			ret[n-1].physical+ret[n-1].length == block {
+			ret[n-1].length += 1
+		} else {
+			ret = append(ret, readerExtent{logical: logical, physical: block, length: 1})
+		}
+
+		return ret, logical + 1, nil
+	}
+
+	buf, err := r.readBlock(block)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := uint64(0); i < perBlock; i++ {
+		ret, logical, err = r.blockMapExtents(uint64(binary.LittleEndian.Uint32(buf[i*4:])), level-1, logical, ret)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return ret, logical, nil
+}
+
+func (r *Reader) extents(inode *ReaderInode) ([]readerExtent, error) {
+	data := inode.blockData()
+
+	if inode.Flags()&InodeFlag_INLINE_DATA != 0 {
+		return nil, fmt.Errorf("inode %d uses inline data which is not supported", inode.Num)
+	}
+
+	if inode.Flags()&InodeFlag_EXTENTS != 0 {
+		return r.extentTreeExtents(data, nil)
+	}
+
+	var (
+		ret     []readerExtent
+		logical uint64
+		err     error
+	)
+
+	// 12 direct blocks followed by the single, double and triple indirect blocks.
+	for i := 0; i < 15; i++ {
+		level := max(0, i-11)
+
+		ret, logical, err = r.blockMapExtents(uint64(binary.LittleEndian.Uint32(data[i*4:])), level, logical, ret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+type fileReader struct {
+	r       *Reader
+	extents []readerExtent
+	size    int64
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+
+	for len(p) > 0 && off < f.size {
+		blockNum := uint64(off / f.r.blockSize)
+		blockOff := off % f.r.blockSize
+
+		chunk := min(int64(len(p)), f.r.blockSize-blockOff, f.size-off)
+
+		var ext *readerExtent
+		for i := range f.extents {
+			if blockNum >= f.extents[i].logical && blockNum < f.extents[i].logical+f.extents[i].length {
+				ext = &f.extents[i]
+				break
+			}
+		}
+
+		if ext == nil || ext.unwritten {
+			clear(p[:chunk])
+		} else {
+			physical := ext.physical + (blockNum - ext.logical)
+
+			if _, err := f.r.r.ReadAt(p[:chunk], int64(physical)*f.r.blockSize+blockOff); err != nil {
+				return n, err
+			}
+		}
+
+		p = p[chunk:]
+		off += chunk
+		n += int(chunk)
+	}
+
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Open returns a reader for the contents of a regular file, directory or slow
+// symlink.
+func (r *Reader) Open(inode *ReaderInode) (*io.SectionReader, error) {
+	extents, err := r.extents(inode)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NewSectionReader(&fileReader{r: r, extents: extents, size: inode.Size()}, 0, inode.Size()), nil
+}
+
+// Readlink returns the target of a symlink.
+func (r *Reader) Readlink(inode *ReaderInode) (string, error) {
+	if inode.Mode()&goFs.ModeSymlink == 0 {
+		return "", fmt.Errorf("inode %d is not a symlink", inode.Num)
+	}
+
+	// Short targets are stored in i_block.
+	if inode.Flags()&(InodeFlag_EXTENTS|InodeFlag_INLINE_DATA) == 0 && inode.Size() < 60 {
+		return string(inode.blockData()[:inode.Size()]), nil
+	}
+
+	f, err := r.Open(inode)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+// ReaderDirEntry is a entry in a directory.
+type ReaderDirEntry struct {
+	Name  string
+	Inode uint32
+}
+
+// ReadDir lists a directory skipping `.` and `..`. Hashed directories are
+// read as linear directories since the index is hidden in empty entries.
+func (r *Reader) ReadDir(inode *ReaderInode) ([]ReaderDirEntry, error) {
+	if !inode.Mode().IsDir() {
+		return nil, fmt.Errorf("inode %d is not a directory", inode.Num)
+	}
+
+	f, err := r.Open(inode)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []ReaderDirEntry
+
+	block := make([]byte, r.blockSize)
+
+	for off := int64(0); off < inode.Size(); off += r.blockSize {
+		if _, err := f.ReadAt(block, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		for pos := 0; pos+8 <= len(block); {
+			num := binary.LittleEndian.Uint32(block[pos:])
+			recLen := int(binary.LittleEndian.Uint16(block[pos+4:]))
+			nameLen := int(block[pos+6])
+
+			if recLen < 8 || pos+recLen > len(block) || 8+nameLen > recLen {
+				return nil, fmt.Errorf("corrupt directory entry in inode %d", inode.Num)
+			}
+
+			name := string(block[pos+8 : pos+8+nameLen])
+
+			if num != 0 && name != "." && name != ".." {
+				ret = append(ret, ReaderDirEntry{Name: name, Inode: num})
+			}
+
+			pos += recLen
+		}
+	}
+
+	return ret, nil
+}
+
+// Xattrs returns the extended attributes of the inode.
+func (r *Reader) Xattrs(inode *ReaderInode) (map[string][]byte, error) {
+	return readXattrs(r.r, inode.raw, uint64(r.blockSize))
+}
@@ -0,0 +1,430 @@
+package ext4
+
+// Extended attributes are stored in the space after the extra inode fields
+// and if they don't fit there in a single block pointed to by i_file_acl.
+// See: https://www.kernel.org/doc/html/latest/filesystems/ext4/dynamic.html#extended-attributes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/tinyrange/vm"
+)
+
+const (
+	XATTR_MAGIC = 0xEA020000
+
+	// Size of the fixed part of ext4_xattr_entry.
+	XATTR_ENTRY_SIZE = 16
+	// Size of ext4_xattr_header at the start of a xattr block.
+	XATTR_BLOCK_HEADER_SIZE = 32
+
+	// i_extra_isize of inodes with in-inode xattrs. This covers all the
+	// fields after the original 128 byte inode.
+	INODE_EXTRA_SIZE = 32
+	// Offset of the in-inode xattr header.
+	INODE_XATTR_OFFSET = 128 + INODE_EXTRA_SIZE
+)
+
+// Attribute names are stored with the prefix replaced by an index. The POSIX
+// ACL attributes have an empty name.
+var xattrPrefixes = []struct {
+	prefix string
+	index  uint8
+	exact  bool
+}{
+	{"system.posix_acl_access", 2, true},
+	{"system.posix_acl_default", 3, true},
+	{"user.", 1, false},
+	{"trusted.", 4, false},
+	{"security.", 6, false},
+	{"system.", 7, false},
+}
+
+const (
+	// The version of POSIX ACLs used by the kernel xattr API.
+	posixAclXattrVersion = 2
+	// The version of POSIX ACLs in ext4 on disk.
+	ext4AclVersion = 1
+
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// Returned for attributes ext4 can't store like the SCHILY.xattr.com.apple.*
+// attributes in archives created on macOS.
+var errUnsupportedXattrNamespace = errors.New("unsupported xattr namespace")
+
+type xattrEntry struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+func (e xattrEntry) fullName() string {
+	for _, p := range xattrPrefixes {
+		if p.index == e.index {
+			return p.prefix + e.name
+		}
+	}
+
+	return e.name
+}
+
+// Size of the entry including the name padded to 4 bytes.
+func (e xattrEntry) entrySize() int {
+	return (XATTR_ENTRY_SIZE + len(e.name) + 3) &^ 3
+}
+
+func (e xattrEntry) valueSize() int {
+	return (len(e.value) + 3) &^ 3
+}
+
+// Same as ext4_xattr_hash_entry.
+func (e xattrEntry) hash() uint32 {
+	var hash uint32
+
+	for _, c := range []byte(e.name) {
+		hash = (hash << 5) ^ (hash >> 27) ^ uint32(c)
+	}
+
+	value := make([]byte, e.valueSize())
+	copy(value, e.value)
+
+	for i := 0; i < len(value); i += 4 {
+		hash = (hash << 16) ^ (hash >> 16) ^ binary.LittleEndian.Uint32(value[i:])
+	}
+
+	return hash
+}
+
+func newXattrEntry(name string, value []byte) (xattrEntry, error) {
+	for _, p := range xattrPrefixes {
+		if p.exact {
+			if name != p.prefix {
+				continue
+			}
+
+			acl, err := aclToDisk(value)
+			if err != nil {
+				return xattrEntry{}, fmt.Errorf("failed to convert %s: %w", name, err)
+			}
+
+			return xattrEntry{index: p.index, value: acl}, nil
+		}
+
+		if suffix, ok := strings.CutPrefix(name, p.prefix); ok && suffix != "" {
+			if len(suffix) > 255 {
+				return xattrEntry{}, fmt.Errorf("xattr name is too long: %s", name)
+			}
+
+			return xattrEntry{index: p.index, name: suffix, value: value}, nil
+		}
+	}
+
+	return xattrEntry{}, fmt.Errorf("%w: %s", errUnsupportedXattrNamespace, name)
+}
+
+// Convert a POSIX ACL from the xattr API format to the smaller ext4 format
+// which leaves out the ID for entries that don't need one.
+func aclToDisk(value []byte) ([]byte, error) {
+	if len(value) < 4 || (len(value)-4)%8 != 0 {
+		return nil, fmt.Errorf("invalid ACL size: %d", len(value))
+	}
+
+	if version := binary.LittleEndian.Uint32(value); version != posixAclXattrVersion {
+		return nil, fmt.Errorf("unsupported ACL version: %d", version)
+	}
+
+	ret := binary.LittleEndian.AppendUint32(nil, ext4AclVersion)
+
+	for off := 4; off < len(value); off += 8 {
+		tag := binary.LittleEndian.Uint16(value[off:])
+
+		ret = append(ret, value[off:off+4]...)
+
+		switch tag {
+		case aclUser, aclGroup:
+			ret = append(ret, value[off+4:off+8]...)
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+		default:
+			return nil, fmt.Errorf("unknown ACL tag: %x", tag)
+		}
+	}
+
+	return ret, nil
+}
+
+// The inverse of aclToDisk.
+func aclFromDisk(value []byte) ([]byte, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("invalid ACL size: %d", len(value))
+	}
+
+	if version := binary.LittleEndian.Uint32(value); version != ext4AclVersion {
+		return nil, fmt.Errorf("unsupported ACL version: %d", version)
+	}
+
+	ret := binary.LittleEndian.AppendUint32(nil, posixAclXattrVersion)
+
+	for off := 4; off < len(value); {
+		if off+4 > len(value) {
+			return nil, fmt.Errorf("truncated ACL entry")
+		}
+
+		tag := binary.LittleEndian.Uint16(value[off:])
+
+		ret = append(ret, value[off:off+4]...)
+
+		switch tag {
+		case aclUser, aclGroup:
+			if off+8 > len(value) {
+				return nil, fmt.Errorf("truncated ACL entry")
+			}
+
+			ret = append(ret, value[off+4:off+8]...)
+			off += 8
+		default:
+			// The ID is unused and set to ACL_UNDEFINED_ID.
+			ret = binary.LittleEndian.AppendUint32(ret, 0xFFFFFFFF)
+			off += 4
+		}
+	}
+
+	return ret, nil
+}
+
+// Write the entries and values into buf. Values are packed from the end of
+// buf and their offsets are relative to base. Returns false if they don't
+// fit.
+func encodeXattrs(buf []byte, entries []xattrEntry, base int) bool {
+	entryOff := 0
+	valueOff := len(buf)
+
+	for _, ent := range entries {
+		valueOff -= ent.valueSize()
+
+		// Leave room for the 4 zero bytes that end the entries.
+		if entryOff+ent.entrySize()+4 > valueOff {
+			return false
+		}
+
+		var valueOffs uint16
+		if len(ent.value) > 0 {
+			valueOffs = uint16(valueOff + base)
+			copy(buf[valueOff:], ent.value)
+		}
+
+		buf[entryOff] = uint8(len(ent.name))
+		buf[entryOff+1] = ent.index
+		binary.LittleEndian.PutUint16(buf[entryOff+2:], valueOffs)
+		binary.LittleEndian.PutUint32(buf[entryOff+4:], 0)
+		binary.LittleEndian.PutUint32(buf[entryOff+8:], uint32(len(ent.value)))
+		binary.LittleEndian.PutUint32(buf[entryOff+12:], ent.hash())
+		copy(buf[entryOff+XATTR_ENTRY_SIZE:], ent.name)
+
+		entryOff += ent.entrySize()
+	}
+
+	return true
+}
+
+// Parse the entries in buf. Value offsets are relative to base.
+func decodeXattrs(buf []byte, base []byte, ret map[string][]byte) error {
+	for off := 0; off+4 <= len(buf) && binary.LittleEndian.Uint32(buf[off:]) != 0; {
+		if off+XATTR_ENTRY_SIZE > len(buf) {
+			return fmt.Errorf("truncated xattr entry")
+		}
+
+		nameLen := int(buf[off])
+		index := buf[off+1]
+		valueOffs := int(binary.LittleEndian.Uint16(buf[off+2:]))
+		valueSize := int(binary.LittleEndian.Uint32(buf[off+8:]))
+
+		if off+XATTR_ENTRY_SIZE+nameLen > len(buf) || valueOffs+valueSize > len(base) {
+			return fmt.Errorf("xattr entry out of bounds")
+		}
+
+		ent := xattrEntry{
+			index: index,
+			name:  string(buf[off+XATTR_ENTRY_SIZE : off+XATTR_ENTRY_SIZE+nameLen]),
+			value: bytes.Clone(base[valueOffs : valueOffs+valueSize]),
+		}
+
+		if index == 2 || index == 3 {
+			acl, err := aclFromDisk(ent.value)
+			if err != nil {
+				return err
+			}
+
+			ent.value = acl
+		}
+
+		ret[ent.fullName()] = ent.value
+
+		off += ent.entrySize()
+	}
+
+	return nil
+}
+
+// setXattrs replaces the extended attributes of the inode. They are stored
+// inside the inode if they fit otherwise in an external block.
+func (i *InodeWrapper) setXattrs(xattrs map[string][]byte) error {
+	var entries []xattrEntry
+
+	for name, value := range xattrs {
+		ent, err := newXattrEntry(name, value)
+		if errors.Is(err, errUnsupportedXattrNamespace) {
+			slog.Warn("skipping xattr", "inode", i.num, "name", name, "err", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		entries = append(entries, ent)
+	}
+
+	// The kernel searches the entries in a block assuming they are sorted.
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].index != entries[b].index {
+			return entries[a].index < entries[b].index
+		}
+		if len(entries[a].name) != len(entries[b].name) {
+			return len(entries[a].name) < len(entries[b].name)
+		}
+		return entries[a].name < entries[b].name
+	})
+
+	// Clear the in-inode attributes.
+	inline := make([]byte, INODE_SIZE-INODE_XATTR_OFFSET)
+	if _, err := i.node.WriteAt(inline, INODE_XATTR_OFFSET); err != nil {
+		return err
+	}
+
+	if len(entries) == 0 && i.xattrBlock == nil {
+		return nil
+	}
+
+	i.node.SetExtraIsize(INODE_EXTRA_SIZE)
+
+	// Blocks that have already been allocated are reused.
+	if i.xattrBlock == nil && encodeXattrs(inline[4:], entries, 0) {
+		binary.LittleEndian.PutUint32(inline, XATTR_MAGIC)
+
+		if _, err := i.node.WriteAt(inline, INODE_XATTR_OFFSET); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	if i.xattrBlock == nil {
+		ext, err := i.fs.allocateBlocks(1)
+		if err != nil {
+			return err
+		}
+
+		i.xattrBlock = make([]byte, i.fs.sb.blockSize())
+
+		if err := i.fs.mapRawExtent(vm.RawRegion(i.xattrBlock), ext); err != nil {
+			return err
+		}
+
+		i.node.SetFileAclLo(uint32(ext.StartBlock))
+		i.node.SetFileAclHigh(uint16(ext.StartBlock >> 32))
+		i.node.SetBlocks(i.node.Blocks() + i.fs.sb.blockSize()/512)
+	}
+
+	block := i.xattrBlock
+	clear(block)
+
+	if !encodeXattrs(block[XATTR_BLOCK_HEADER_SIZE:], entries, XATTR_BLOCK_HEADER_SIZE) {
+		return fmt.Errorf("xattrs do not fit in a single block")
+	}
+
+	// Same as ext4_xattr_rehash.
+	var hash uint32
+	for _, ent := range entries {
+		hash = (hash << 16) ^ (hash >> 16) ^ ent.hash()
+	}
+
+	binary.LittleEndian.PutUint32(block[0:], XATTR_MAGIC)
+	binary.LittleEndian.PutUint32(block[4:], 1) // h_refcount
+	binary.LittleEndian.PutUint32(block[8:], 1) // h_blocks
+	binary.LittleEndian.PutUint32(block[12:], hash)
+
+	return nil
+}
+
+// SetXattrs replaces the extended attributes of filename. Names include the
+// namespace (for example security.capability). POSIX ACLs are given in the
+// format used by setxattr(2).
+func (fs *Ext4Filesystem) SetXattrs(filename string, xattrs map[string][]byte) error {
+	node, err := fs.getNode(filename, false, false, false)
+	if err != nil {
+		return err
+	}
+
+	return node.setXattrs(xattrs)
+}
+
+// Xattrs reads the extended attributes of filename back from the image.
+func (fs *Ext4Filesystem) Xattrs(filename string) (map[string][]byte, error) {
+	node, err := fs.getNode(filename, false, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, INODE_SIZE)
+	if _, err := fs.vm.ReadAt(raw, int64(node.offset)); err != nil {
+		return nil, err
+	}
+
+	return readXattrs(fs.vm, raw, fs.sb.blockSize())
+}
+
+// Read the in-inode and external xattrs of the raw inode.
+func readXattrs(r io.ReaderAt, raw []byte, blockSize uint64) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+
+	if len(raw) > 128+2 {
+		extraSize := int(binary.LittleEndian.Uint16(raw[0x80:]))
+		if start := 128 + extraSize; extraSize != 0 && start+4 <= len(raw) &&
+			binary.LittleEndian.Uint32(raw[start:]) == XATTR_MAGIC {
+			entries := raw[start+4:]
+
+			if err := decodeXattrs(entries, entries, ret); err != nil {
+				return nil, fmt.Errorf("failed to read in-inode xattrs: %w", err)
+			}
+		}
+	}
+
+	fileAcl := uint64(binary.LittleEndian.Uint32(raw[0x68:])) | uint64(binary.LittleEndian.Uint16(raw[0x76:]))<<32
+	if fileAcl != 0 {
+		block := make([]byte, blockSize)
+		if _, err := r.ReadAt(block, int64(fileAcl*blockSize)); err != nil {
+			return nil, err
+		}
+
+		if magic := binary.LittleEndian.Uint32(block); magic != XATTR_MAGIC {
+			return nil, fmt.Errorf("bad xattr block magic: %x", magic)
+		}
+
+		if err := decodeXattrs(block[XATTR_BLOCK_HEADER_SIZE:], block, ret); err != nil {
+			return nil, fmt.Errorf("failed to read xattr block: %w", err)
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,295 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
+	"github.com/tinyrange/vm"
+)
+
+type ext4File struct {
+	r     *ext4.Reader
+	inode *ext4.ReaderInode
+}
+
+// Digest implements File.
+func (e *ext4File) Digest() *FileDigest { return nil }
+
+// Open implements File.
+func (e *ext4File) Open() (FileHandle, error) {
+	// Symlinks are read as their target like the other File implementations.
+	if e.inode.Mode()&fs.ModeSymlink != 0 {
+		target, err := e.r.Readlink(e.inode)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewNopCloserFileHandle(bytes.NewReader([]byte(target))), nil
+	}
+
+	if !e.inode.Mode().IsRegular() {
+		return nil, fmt.Errorf("inode %d is not a regular file", e.inode.Num)
+	}
+
+	f, err := e.r.Open(e.inode)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNopCloserFileHandle(f), nil
+}
+
+// Stat implements File.
+func (e *ext4File) Stat() (FileInfo, error) { return e, nil }
+
+func (e *ext4File) Kind() FileType     { return FileTypeFromMode(e.inode.Mode()) }
+func (e *ext4File) IsDir() bool        { return e.inode.Mode().IsDir() }
+func (e *ext4File) ModTime() time.Time { return e.inode.ModTime() }
+func (e *ext4File) Mode() fs.FileMode  { return e.inode.Mode() }
+func (e *ext4File) Name() string       { return "" }
+func (e *ext4File) Sys() any           { return e }
+
+// Size implements FileInfo. Only regular files and symlinks have contents.
+func (e *ext4File) Size() int64 {
+	mode := e.inode.Mode()
+	if !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+		return 0
+	}
+
+	return e.inode.Size()
+}
+
+var (
+	_ File     = &ext4File{}
+	_ FileInfo = &ext4File{}
+)
+
+type ext4Directory struct {
+	ext4File
+}
+
+// GetChild implements Directory.
+func (e *ext4Directory) GetChild(name string) (DirectoryEntry, error) {
+	ents, err := e.Readdir()
+	if err != nil {
+		return DirectoryEntry{}, err
+	}
+
+	for _, ent := range ents {
+		if ent.Name == name {
+			return ent, nil
+		}
+	}
+
+	return DirectoryEntry{}, fs.ErrNotExist
+}
+
+// Readdir implements Directory.
+func (e *ext4Directory) Readdir() ([]DirectoryEntry, error) {
+	ents, err := e.r.ReadDir(e.inode)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []DirectoryEntry
+
+	for _, ent := range ents {
+		f, err := openExt4Inode(e.r, ent.Inode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", ent.Name, err)
+		}
+
+		ret = append(ret, DirectoryEntry{File: f, Name: ent.Name})
+	}
+
+	return ret, nil
+}
+
+var (
+	_ Directory = &ext4Directory{}
+)
+
+func openExt4Inode(r *ext4.Reader, num uint32) (File, error) {
+	inode, err := r.ReadInode(num)
+	if err != nil {
+		return nil, err
+	}
+
+	if inode.Mode().IsDir() {
+		return &ext4Directory{ext4File{r: r, inode: inode}}, nil
+	}
+
+	return &ext4File{r: r, inode: inode}, nil
+}
+
+// OpenExt4Image returns the root directory of a ext4 image. Files are read
+// lazily from r so it must stay open while the directory is in use.
+func OpenExt4Image(r io.ReaderAt) (Directory, error) {
+	reader, err := ext4.OpenReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := openExt4Inode(reader, ext4.ROOT_INODE)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, ok := root.(Directory)
+	if !ok {
+		return nil, fmt.Errorf("root inode is not a directory")
+	}
+
+	return dir, nil
+}
+
+// CopyToExt4 copies the contents of dir into the root of fs. Hard links whose
+// target hasn't been written yet are created once everything else is copied.
+func CopyToExt4(dir Directory, fs *ext4.Ext4Filesystem) error {
+	var deferred []func() error
+
+	if err := copyToExt4(dir, fs, "/", &deferred); err != nil {
+		return err
+	}
+
+	for _, fn := range deferred {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyToExt4(dir Directory, fs *ext4.Ext4Filesystem, name string, deferred *[]func() error) error {
+	ents, err := dir.Readdir()
+	if err != nil {
+		return fmt.Errorf("failed to readdir: %w", err)
+	}
+
+	for _, ent := range ents {
+		info, err := ent.File.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat: %w", err)
+		}
+
+		name := path.Join(name, path.Base(ent.Name))
+
+		skip := false
+
+		switch info.Kind() {
+		case TypeDirectory:
+			if err := fs.Mkdir(name, false); err != nil {
+				return fmt.Errorf("failed to mkdir %s: %w", name, err)
+			}
+
+			child, ok := ent.File.(Directory)
+			if !ok {
+				return fmt.Errorf("directory does not implement Directory: %T", ent.File)
+			}
+
+			if err := copyToExt4(child, fs, name, deferred); err != nil {
+				return err
+			}
+		case TypeLink:
+			target, err := GetLinkName(ent.File)
+			if err != nil {
+				return fmt.Errorf("failed to get linkname: %w", err)
+			}
+
+			if err := fs.Link(name, target); err != nil {
+				*deferred = append(*deferred, func() error {
+					if err := fs.Link(name, target); err != nil {
+						return fmt.Errorf("failed to make hard link: %w", err)
+					}
+
+					if err := fs.Chmod(name, info.Mode()); err != nil {
+						return fmt.Errorf("failed to chmod: %w", err)
+					}
+
+					uid, gid, err := GetUidAndGid(ent.File)
+					if err != nil {
+						return fmt.Errorf("failed to GetUidAndGid: %w", err)
+					}
+
+					if err := fs.Chown(name, uint32(uid), uint32(gid)); err != nil {
+						return fmt.Errorf("failed to chown: %w", err)
+					}
+
+					return nil
+				})
+
+				skip = true
+			}
+		case TypeSymlink:
+			target, err := GetLinkName(ent.File)
+			if err != nil {
+				return fmt.Errorf("failed to get linkname: %w", err)
+			}
+
+			if err := fs.Symlink(name, target); err != nil {
+				return fmt.Errorf("failed to make symlink: %w", err)
+			}
+		case TypeRegular:
+			f, err := ent.File.Open()
+			if err != nil {
+				return fmt.Errorf("failed to open file for guest: %T %w", ent.File, err)
+			}
+
+			region := vm.NewReaderRegion(f, info.Size())
+
+			if err := fs.CreateFile(name, region); err != nil {
+				return fmt.Errorf("failed to create file in guest %s: %w", name, err)
+			}
+		case TypeCharDevice, TypeBlockDevice, TypeFifo, TypeSocket:
+			major, minor, err := GetDeviceNumbers(ent.File)
+			if err != nil {
+				return fmt.Errorf("failed to get device numbers: %w", err)
+			}
+
+			mode := info.Kind().ModeType() | info.Mode().Perm()
+
+			if err := fs.Mknod(name, mode, uint32(major), uint32(minor)); err != nil {
+				return fmt.Errorf("failed to create %s in guest %s: %w", info.Kind(), name, err)
+			}
+		default:
+			return fmt.Errorf("unimplemented kind: %s", info.Kind())
+		}
+
+		if !skip {
+			if err := fs.Chmod(name, info.Mode()); err != nil {
+				return fmt.Errorf("failed to chmod: %w", err)
+			}
+
+			uid, gid, err := GetUidAndGid(ent.File)
+			if err != nil {
+				return fmt.Errorf("failed to GetUidAndGid: %w", err)
+			}
+
+			if err := fs.Chown(name, uint32(uid), uint32(gid)); err != nil {
+				return fmt.Errorf("failed to chown: %w", err)
+			}
+
+			// Hard links share the xattrs of their target.
+			if info.Kind() != TypeLink {
+				xattrs, err := GetXattrs(ent.File)
+				if err != nil {
+					return fmt.Errorf("failed to get xattrs: %w", err)
+				}
+
+				if len(xattrs) > 0 {
+					if err := fs.SetXattrs(name, xattrs); err != nil {
+						return fmt.Errorf("failed to set xattrs on %s: %w", name, err)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
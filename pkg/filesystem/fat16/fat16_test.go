@@ -0,0 +1,447 @@
+package fat16
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func writeImage(t *testing.T, w *Fat16Writer) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo returned %d but wrote %d bytes", n, buf.Len())
+	}
+
+	return buf.Bytes()
+}
+
+// A image laid out like a cloud-init seed with a file that spans several
+// clusters.
+func seedImage(t *testing.T, opts Options) []byte {
+	w := NewWriter("CIDATA", opts)
+
+	for _, file := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"meta-data", []byte("instance-id: test\n")},
+		{"user-data", []byte("#cloud-config\n")},
+		{"EFI/BOOT/BOOTX64.EFI", bytes.Repeat([]byte("x"), 1300)},
+	} {
+		if err := w.AddFile(file.name, file.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return writeImage(t, w)
+}
+
+func le16(b []byte, off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+func le32(b []byte, off int) uint32 { return binary.LittleEndian.Uint32(b[off:]) }
+
+// Check the boot sector and FAT against the offsets and values in the FAT
+// specification rather than the generated accessors used by the writer.
+func TestFat16BootSector(t *testing.T) {
+	image := seedImage(t, Options{Format: FormatFat16})
+
+	const (
+		reservedSectors = 1
+		fatSectors      = 17
+		rootDirSectors  = 32
+		clusters        = 4096
+		totalSectors    = reservedSectors + 2*fatSectors + rootDirSectors + clusters
+	)
+
+	if len(image) != totalSectors*SECTOR_SIZE {
+		t.Fatalf("expected a %d byte image, got %d", totalSectors*SECTOR_SIZE, len(image))
+	}
+
+	for _, field := range []struct {
+		name     string
+		got      uint32
+		expected uint32
+	}{
+		{"BS_jmpBoot", uint32(image[0]), 0xEB},
+		{"BPB_BytsPerSec", uint32(le16(image, 11)), 512},
+		{"BPB_SecPerClus", uint32(image[13]), 1},
+		{"BPB_RsvdSecCnt", uint32(le16(image, 14)), reservedSectors},
+		{"BPB_NumFATs", uint32(image[16]), 2},
+		{"BPB_RootEntCnt", uint32(le16(image, 17)), 512},
+		{"BPB_TotSec16", uint32(le16(image, 19)), totalSectors},
+		{"BPB_Media", uint32(image[21]), 0xF8},
+		{"BPB_FATSz16", uint32(le16(image, 22)), fatSectors},
+		{"BPB_TotSec32", le32(image, 32), 0},
+		{"BS_DrvNum", uint32(image[36]), 0x80},
+		{"BS_BootSig", uint32(image[38]), 0x29},
+		{"BS_VolID", le32(image, 39), le32([]byte("CIDA"), 0)},
+		{"Signature", uint32(le16(image, 510)), 0xAA55},
+	} {
+		if field.got != field.expected {
+			t.Errorf("%s: expected %#x, got %#x", field.name, field.expected, field.got)
+		}
+	}
+
+	if label := string(image[43:54]); label != "CIDATA     " {
+		t.Errorf("unexpected BS_VolLab: %q", label)
+	}
+
+	if typ := string(image[54:62]); typ != "FAT16   " {
+		t.Errorf("unexpected BS_FilSysType: %q", typ)
+	}
+
+	// Both copies of the FAT are identical and the directories and files are
+	// allocated contiguously in the order they are stored.
+	fat := image[reservedSectors*SECTOR_SIZE : (reservedSectors+fatSectors)*SECTOR_SIZE]
+	if backup := image[(reservedSectors+fatSectors)*SECTOR_SIZE : (reservedSectors+2*fatSectors)*SECTOR_SIZE]; !bytes.Equal(fat, backup) {
+		t.Error("the FATs are not identical")
+	}
+
+	for cluster, expected := range []uint16{0xFFF8, 0xFFFF, 0xFFFF, 0xFFFF, 5, 6, 0xFFFF, 0xFFFF, 0xFFFF, 0} {
+		if got := le16(fat, cluster*2); got != expected {
+			t.Errorf("FAT entry %d: expected %#x, got %#x", cluster, expected, got)
+		}
+	}
+
+	root := image[(reservedSectors+2*fatSectors)*SECTOR_SIZE:]
+
+	for i, rec := range []struct {
+		name    string
+		attr    byte
+		cluster uint16
+		size    uint32
+	}{
+		{"CIDATA     ", ATTR_VOLUME_ID, 0, 0},
+		{"EFI        ", ATTR_DIRECTORY, 2, 0},
+		{"", ATTR_LONG_NAME, 0, 0},
+		{"META-D~1   ", ATTR_ARCHIVE, 7, 18},
+		{"", ATTR_LONG_NAME, 0, 0},
+		{"USER-D~1   ", ATTR_ARCHIVE, 8, 14},
+	} {
+		ent := root[i*32 : (i+1)*32]
+
+		if rec.name != "" && string(ent[:11]) != rec.name {
+			t.Errorf("record %d: expected DIR_Name %q, got %q", i, rec.name, ent[:11])
+		}
+
+		// Long name entries store characters where the size would be.
+		if rec.attr == ATTR_LONG_NAME {
+			if ent[11] != rec.attr || le16(ent, 26) != 0 {
+				t.Errorf("record %d: expected a long name entry, got % x", i, ent)
+			}
+
+			continue
+		}
+
+		if ent[11] != rec.attr || le16(ent, 26) != rec.cluster || le32(ent, 28) != rec.size {
+			t.Errorf("record %d: unexpected attributes %#x cluster %d size %d", i, ent[11], le16(ent, 26), le32(ent, 28))
+		}
+	}
+
+	// A single long name entry holds up to 13 UTF-16 characters and is
+	// marked as the last entry.
+	lfn := root[2*32 : 3*32]
+	if lfn[0] != 0x41 || lfn[12] != 0 || le16(lfn, 1) != 'm' || le16(lfn, 14) != 'd' || le16(lfn, 22) != 0 || le16(lfn, 24) != 0xFFFF {
+		t.Errorf("unexpected long name entry: % x", lfn)
+	}
+
+	if root[6*32] != 0 {
+		t.Errorf("expected the root directory to end after 6 records")
+	}
+}
+
+func TestFat32BootSector(t *testing.T) {
+	image := seedImage(t, Options{Format: FormatFat32, VolumeId: 0x12345678})
+
+	const (
+		reservedSectors = 32
+		fatSectors      = 512
+		clusters        = 65525
+		totalSectors    = reservedSectors + 2*fatSectors + clusters
+	)
+
+	if len(image) != totalSectors*SECTOR_SIZE {
+		t.Fatalf("expected a %d byte image, got %d", totalSectors*SECTOR_SIZE, len(image))
+	}
+
+	for _, field := range []struct {
+		name     string
+		got      uint32
+		expected uint32
+	}{
+		{"BS_jmpBoot", uint32(image[0]), 0xEB},
+		{"BPB_BytsPerSec", uint32(le16(image, 11)), 512},
+		{"BPB_SecPerClus", uint32(image[13]), 1},
+		{"BPB_RsvdSecCnt", uint32(le16(image, 14)), reservedSectors},
+		{"BPB_NumFATs", uint32(image[16]), 2},
+		{"BPB_RootEntCnt", uint32(le16(image, 17)), 0},
+		{"BPB_TotSec16", uint32(le16(image, 19)), 0},
+		{"BPB_FATSz16", uint32(le16(image, 22)), 0},
+		{"BPB_TotSec32", le32(image, 32), totalSectors},
+		{"BPB_FATSz32", le32(image, 36), fatSectors},
+		{"BPB_RootClus", le32(image, 44), 2},
+		{"BPB_FSInfo", uint32(le16(image, 48)), 1},
+		{"BPB_BkBootSec", uint32(le16(image, 50)), 6},
+		{"BS_BootSig", uint32(image[66]), 0x29},
+		{"BS_VolID", le32(image, 67), 0x12345678},
+		{"Signature", uint32(le16(image, 510)), 0xAA55},
+	} {
+		if field.got != field.expected {
+			t.Errorf("%s: expected %#x, got %#x", field.name, field.expected, field.got)
+		}
+	}
+
+	if label := string(image[71:82]); label != "CIDATA     " {
+		t.Errorf("unexpected BS_VolLab: %q", label)
+	}
+
+	if typ := string(image[82:90]); typ != "FAT32   " {
+		t.Errorf("unexpected BS_FilSysType: %q", typ)
+	}
+
+	if !bytes.Equal(image[:SECTOR_SIZE], image[6*SECTOR_SIZE:7*SECTOR_SIZE]) {
+		t.Error("the backup boot sector does not match")
+	}
+
+	// The root directory, EFI, BOOT, BOOTX64.EFI (3 clusters), meta-data and
+	// user-data use 8 clusters starting at cluster 2.
+	fsInfo := image[SECTOR_SIZE : 2*SECTOR_SIZE]
+	if le32(fsInfo, 0) != 0x41615252 || le32(fsInfo, 484) != 0x61417272 || le32(fsInfo, 508) != 0xAA550000 {
+		t.Errorf("unexpected FSInfo signatures: % x", fsInfo)
+	}
+
+	if free, next := le32(fsInfo, 488), le32(fsInfo, 492); free != clusters-8 || next != 10 {
+		t.Errorf("unexpected FSInfo free count %d and next free %d", free, next)
+	}
+
+	fat := image[reservedSectors*SECTOR_SIZE:]
+	for cluster, expected := range []uint32{0x0FFFFFF8, 0x0FFFFFFF, 0x0FFFFFFF, 0x0FFFFFFF, 0x0FFFFFFF, 6, 7, 0x0FFFFFFF, 0x0FFFFFFF, 0x0FFFFFFF, 0} {
+		if got := le32(fat, cluster*4); got != expected {
+			t.Errorf("FAT entry %d: expected %#x, got %#x", cluster, expected, got)
+		}
+	}
+
+	// The root directory is in the first data cluster and the volume label
+	// is its first record.
+	root := image[(reservedSectors+2*fatSectors)*SECTOR_SIZE:]
+	if string(root[:11]) != "CIDATA     " || root[11] != ATTR_VOLUME_ID {
+		t.Errorf("unexpected volume label record: % x", root[:32])
+	}
+}
+
+func TestShortName(t *testing.T) {
+	used := make(map[string]bool)
+
+	for _, tc := range []struct {
+		name      string
+		short     string
+		needsLong bool
+	}{
+		{"README.TXT", "README  TXT", false},
+		{"EFI", "EFI        ", false},
+		{"readme.txt", "README~1TXT", true},
+		{"README.TXT", "README~2TXT", true},
+		{"grubx64.efi", "GRUBX6~1EFI", true},
+		{"loader.conf", "LOADER~1CON", true},
+		{"archive.tar.gz", "ARCHIV~1GZ ", true},
+		{"a+b", "A_B~1      ", true},
+		{".hidden", "HIDDEN~1   ", true},
+	} {
+		short, needsLong := shortName(tc.name, used)
+
+		if string(short[:]) != tc.short || needsLong != tc.needsLong {
+			t.Errorf("shortName(%q) = %q %v, expected %q %v", tc.name, short, needsLong, tc.short, tc.needsLong)
+		}
+	}
+}
+
+// Walk from the root directory to the entry at path.
+func findEntry(r *Reader, path string) (DirEntry, error) {
+	ent := r.Root()
+
+outer:
+	for _, part := range strings.Split(path, "/") {
+		ents, err := r.ReadDir(ent)
+		if err != nil {
+			return DirEntry{}, err
+		}
+
+		for _, child := range ents {
+			if child.Name == part {
+				ent = child
+				continue outer
+			}
+		}
+
+		return DirEntry{}, fmt.Errorf("%s not found", path)
+	}
+
+	return ent, nil
+}
+
+func TestReader(t *testing.T) {
+	files := map[string][]byte{
+		"EFI/BOOT/BOOTX64.EFI":              bytes.Repeat([]byte("boot"), 20*1024),
+		"loader/entries/arch-fallback.conf": []byte("title Arch Linux (fallback)\n"),
+		"Ünïcode file name.txt":             []byte("unicode"),
+		"EMPTY":                             nil,
+	}
+
+	// Enough entries to need several clusters for the directory.
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("many/File Number %d.txt", i)] = []byte(fmt.Sprint(i))
+	}
+
+	for _, tc := range []struct {
+		opts        Options
+		format      Format
+		clusterSize int64
+	}{
+		{Options{}, FormatFat16, 512},
+		{Options{Format: FormatFat16, ClusterSize: 4096}, FormatFat16, 4096},
+		{Options{Format: FormatFat32}, FormatFat32, 512},
+		{Options{Format: FormatFat32, ClusterSize: 1024, Size: 96 * 1024 * 1024}, FormatFat32, 1024},
+	} {
+		t.Run(fmt.Sprintf("%s-%d", tc.format, tc.clusterSize), func(t *testing.T) {
+			w := NewWriter("ESP", tc.opts)
+
+			for name, contents := range files {
+				if err := w.AddFile(name, contents); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := w.Mkdir("EFI/Linux"); err != nil {
+				t.Fatal(err)
+			}
+
+			image := writeImage(t, w)
+
+			if tc.opts.Size != 0 && int64(len(image)) != tc.opts.Size {
+				t.Fatalf("expected a %d byte image, got %d", tc.opts.Size, len(image))
+			}
+
+			r, err := OpenReader(bytes.NewReader(image))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Format() != tc.format || r.clusterSize != tc.clusterSize || r.Label() != "ESP" {
+				t.Fatalf("unexpected filesystem: %s %d %q", r.Format(), r.clusterSize, r.Label())
+			}
+
+			for name, expected := range files {
+				ent, err := findEntry(r, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				f, err := r.Open(ent)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				contents, err := io.ReadAll(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(contents, expected) {
+					t.Fatalf("contents of %s do not match", name)
+				}
+			}
+
+			if ent, err := findEntry(r, "EFI/Linux"); err != nil || !ent.IsDir() {
+				t.Fatalf("expected EFI/Linux to be a directory: %v", err)
+			}
+
+			many, err := findEntry(r, "many")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ents, err := r.ReadDir(many)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ents) != 200 {
+				t.Fatalf("expected 200 entries, got %d", len(ents))
+			}
+		})
+	}
+}
+
+func TestWriteToIgnoresOrder(t *testing.T) {
+	a := NewWriter("ESP", Options{})
+	b := NewWriter("ESP", Options{})
+
+	names := []string{"b/two", "a/one", "c"}
+	for i := range names {
+		if err := a.AddFile(names[i], []byte(names[i])); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddFile(names[len(names)-1-i], []byte(names[len(names)-1-i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	image := writeImage(t, a)
+
+	if !bytes.Equal(image, writeImage(t, b)) {
+		t.Fatal("the image depends on the order files were added in")
+	}
+
+	if !bytes.Equal(image, writeImage(t, a)) {
+		t.Fatal("writing the image twice gave different results")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	const mb = 1024 * 1024
+
+	for _, tc := range []struct {
+		opts        Options
+		fat32       bool
+		clusterSize uint32
+	}{
+		{Options{Size: 256 * mb}, false, 4096},
+		{Options{Size: 600 * mb}, true, 4096},
+		{Options{Format: FormatFat32, Size: 200 * mb}, true, 512},
+		{Options{Format: FormatFat32, Size: 600 * mb, ClusterSize: 8192}, true, 8192},
+	} {
+		w := NewWriter("", tc.opts)
+
+		l, err := w.layout()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l.fat32 != tc.fat32 || l.clusterSize() != tc.clusterSize {
+			t.Fatalf("unexpected layout for %+v: fat32=%v cluster size %d", tc.opts, l.fat32, l.clusterSize())
+		}
+
+		if int64(l.totalSectors)*SECTOR_SIZE != tc.opts.Size {
+			t.Fatalf("unexpected size for %+v: %d", tc.opts, int64(l.totalSectors)*SECTOR_SIZE)
+		}
+	}
+
+	for _, opts := range []Options{
+		{Format: FormatFat16, Size: 1024 * 1024},
+		{ClusterSize: 3000},
+		{Format: FormatFat16, Size: 8 * 1024 * mb, ClusterSize: 512},
+	} {
+		if _, err := NewWriter("", opts).layout(); err == nil {
+			t.Fatalf("expected an error for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package fat16
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// VFAT long filenames are stored in extra directory entries before the 8.3
+// entry. Each one holds 13 UTF-16 characters of the name.
+const (
+	ATTR_LONG_NAME = ATTR_READ_ONLY | ATTR_HIDDEN | ATTR_SYSTEM | ATTR_VOLUME_ID
+	LFN_CHARS      = 13
+	LFN_LAST_ENTRY = 0x40
+)
+
+func isShortNameChar(c rune) bool {
+	if c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'()-@^_`{}~", c)
+}
+
+// Returns the 8.3 name for filename and whether a long filename entry is needed.
+func shortName(filename string, used map[string]bool) ([11]byte, bool) {
+	var ret [11]byte
+
+	for i := range ret {
+		ret[i] = ' '
+	}
+
+	base, ext := filename, ""
+	if idx := strings.LastIndexByte(filename, '.'); idx > 0 {
+		base, ext = filename[:idx], filename[idx+1:]
+	}
+
+	lossy := false
+
+	convert := func(s string, max int) string {
+		var out strings.Builder
+
+		for _, c := range s {
+			if c == '.' || c == ' ' {
+				lossy = true
+				continue
+			}
+
+			upper := []rune(strings.ToUpper(string(c)))[0]
+			if upper != c {
+				lossy = true
+			}
+
+			if !isShortNameChar(upper) {
+				upper = '_'
+				lossy = true
+			}
+
+			out.WriteRune(upper)
+		}
+
+		str := out.String()
+		if len(str) > max {
+			lossy = true
+			str = str[:max]
+		}
+
+		return str
+	}
+
+	shortBase := convert(base, 8)
+	shortExt := convert(ext, 3)
+
+	if !lossy && !used[shortBase+"."+shortExt] {
+		copy(ret[:8], shortBase)
+		copy(ret[8:], shortExt)
+		used[shortBase+"."+shortExt] = true
+
+		return ret, false
+	}
+
+	for i := 1; ; i++ {
+		tail := fmt.Sprintf("~%d", i)
+
+		prefix := shortBase
+		if len(prefix)+len(tail) > 8 {
+			prefix = prefix[:8-len(tail)]
+		}
+
+		candidate := prefix + tail
+		if used[candidate+"."+shortExt] {
+			continue
+		}
+
+		copy(ret[:8], candidate)
+		copy(ret[8:], shortExt)
+		used[candidate+"."+shortExt] = true
+
+		return ret, true
+	}
+}
+
+func shortNameChecksum(name [11]byte) byte {
+	var sum byte
+
+	for _, c := range name {
+		sum = ((sum & 1) << 7) + (sum >> 1) + c
+	}
+
+	return sum
+}
+
+// Create the long filename entries for name in on-disk order.
+func longNameEntries(name string, checksum byte) []DirectoryRecord {
+	chars := utf16.Encode([]rune(name))
+
+	count := (len(chars) + LFN_CHARS - 1) / LFN_CHARS
+
+	// Terminate the name with a NUL and pad the remainder with 0xFFFF.
+	if len(chars)%LFN_CHARS != 0 {
+		chars = append(chars, 0)
+		for len(chars)%LFN_CHARS != 0 {
+			chars = append(chars, 0xFFFF)
+		}
+	}
+
+	var ret []DirectoryRecord
+
+	for i := count - 1; i >= 0; i-- {
+		var ent DirectoryRecord
+
+		seq := byte(i + 1)
+		if i == count-1 {
+			seq |= LFN_LAST_ENTRY
+		}
+
+		ent[0] = seq
+		ent[11] = ATTR_LONG_NAME
+		ent[13] = checksum
+
+		part := chars[i*LFN_CHARS : (i+1)*LFN_CHARS]
+
+		for j, c := range part {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + j*2
+			case j < 11:
+				off = 14 + (j-5)*2
+			default:
+				off = 28 + (j-11)*2
+			}
+
+			binary.LittleEndian.PutUint16(ent[off:off+2], c)
+		}
+
+		ret = append(ret, ent)
+	}
+
+	return ret
+}
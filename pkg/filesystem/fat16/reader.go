@@ -0,0 +1,419 @@
+package fat16
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Lowercase flags stored in the reserved byte of a directory record by
+// Windows NT for 8.3 names.
+const (
+	NT_LOWERCASE_BASE = 0x08
+	NT_LOWERCASE_EXT  = 0x10
+)
+
+type DirEntry struct {
+	// The long filename if the entry has one, otherwise the 8.3 name.
+	Name string
+
+	Attributes uint8
+	Cluster    uint32
+	Size       uint32
+	ModTime    time.Time
+}
+
+func (e DirEntry) IsDir() bool { return e.Attributes&ATTR_DIRECTORY != 0 }
+
+// Reader reads FAT16 and FAT32 images.
+type Reader struct {
+	r io.ReaderAt
+
+	fat32       bool
+	label       string
+	clusterSize int64
+	clusters    uint32
+	fat         []byte
+
+	// The FAT16 root directory is stored before the data area.
+	rootOffset  int64
+	rootSize    int64
+	rootCluster uint32
+
+	dataOffset int64
+}
+
+// Format returns FormatFat16 or FormatFat32.
+func (r *Reader) Format() Format {
+	if r.fat32 {
+		return FormatFat32
+	}
+	return FormatFat16
+}
+
+// Label returns the volume label from the boot sector.
+func (r *Reader) Label() string { return r.label }
+
+// Root returns a entry for the root directory.
+func (r *Reader) Root() DirEntry {
+	return DirEntry{Attributes: ATTR_DIRECTORY, Cluster: r.rootCluster}
+}
+
+func (r *Reader) next(cluster uint32) uint32 {
+	if r.fat32 {
+		return binary.LittleEndian.Uint32(r.fat[cluster*4:]) & 0x0FFFFFFF
+	}
+
+	return uint32(binary.LittleEndian.Uint16(r.fat[cluster*2:]))
+}
+
+// Follow the cluster chain starting at cluster.
+func (r *Reader) chain(cluster uint32) ([]uint32, error) {
+	endOfChain := uint32(0xFFF8)
+	if r.fat32 {
+		endOfChain = 0x0FFFFFF8
+	}
+
+	var ret []uint32
+
+	for cluster < endOfChain {
+		if cluster < 2 || cluster >= r.clusters+2 {
+			return nil, fmt.Errorf("fat16: invalid cluster in chain: %d", cluster)
+		}
+
+		if len(ret) >= int(r.clusters) {
+			return nil, fmt.Errorf("fat16: cluster chain loops")
+		}
+
+		ret = append(ret, cluster)
+
+		cluster = r.next(cluster)
+	}
+
+	return ret, nil
+}
+
+type chainReader struct {
+	r     *Reader
+	chain []uint32
+}
+
+// ReadAt implements io.ReaderAt.
+func (c *chainReader) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+
+	for len(p) > 0 {
+		idx := off / c.r.clusterSize
+		if idx >= int64(len(c.chain)) {
+			return total, io.EOF
+		}
+
+		within := off % c.r.clusterSize
+		n := min(int64(len(p)), c.r.clusterSize-within)
+
+		pos := c.r.dataOffset + int64(c.chain[idx]-2)*c.r.clusterSize + within
+
+		read, err := c.r.r.ReadAt(p[:n], pos)
+		total += read
+		if err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += n
+	}
+
+	return total, nil
+}
+
+func (r *Reader) readDirBytes(dir DirEntry) ([]byte, error) {
+	if !r.fat32 && dir.Cluster == 0 {
+		buf := make([]byte, r.rootSize)
+		if _, err := r.r.ReadAt(buf, r.rootOffset); err != nil {
+			return nil, err
+		}
+
+		return buf, nil
+	}
+
+	chain, err := r.chain(dir.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, int64(len(chain))*r.clusterSize)
+	if _, err := (&chainReader{r: r, chain: chain}).ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func decodeShortName(rec DirectoryRecord) string {
+	base := strings.TrimRight(string(rec[0:8]), " ")
+	ext := strings.TrimRight(string(rec[8:11]), " ")
+
+	// 0xE5 is used to mark deleted entries so a leading 0xE5 is stored as 0x05.
+	if len(base) > 0 && base[0] == 0x05 {
+		base = "\xE5" + base[1:]
+	}
+
+	if rec.Reserved()&NT_LOWERCASE_BASE != 0 {
+		base = strings.ToLower(base)
+	}
+	if rec.Reserved()&NT_LOWERCASE_EXT != 0 {
+		ext = strings.ToLower(ext)
+	}
+
+	if ext == "" {
+		return base
+	}
+
+	return base + "." + ext
+}
+
+func decodeTimestamp(date uint16, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(
+		1980+int(date>>9), time.Month(date>>5&0xF), int(date&0x1F),
+		int(tm>>11), int(tm>>5&0x3F), int(tm&0x1F)*2,
+		0, time.UTC,
+	)
+}
+
+// ReadDir returns the entries in dir skipping . and .. along with the volume
+// label.
+func (r *Reader) ReadDir(dir DirEntry) ([]DirEntry, error) {
+	if !dir.IsDir() {
+		return nil, fmt.Errorf("fat16: not a directory")
+	}
+
+	buf, err := r.readDirBytes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []DirEntry
+
+	// Long filename entries come before the 8.3 entry in reverse order.
+	var (
+		longName     []uint16
+		longCount    int
+		longChecksum byte
+		longSeen     int
+	)
+
+	resetLong := func() {
+		longName = nil
+		longCount = 0
+		longSeen = 0
+	}
+
+	for off := 0; off+32 <= len(buf); off += 32 {
+		var rec DirectoryRecord
+		copy(rec[:], buf[off:off+32])
+
+		if rec[0] == 0x00 {
+			break
+		}
+
+		if rec[0] == 0xE5 {
+			resetLong()
+			continue
+		}
+
+		if rec.Attributes()&0x3F == ATTR_LONG_NAME {
+			seq := int(rec[0] & 0x1F)
+
+			if rec[0]&LFN_LAST_ENTRY != 0 {
+				longCount = seq
+				longChecksum = rec[13]
+				longName = make([]uint16, seq*LFN_CHARS)
+				longSeen = 0
+			}
+
+			if longName == nil || seq < 1 || seq > longCount || rec[13] != longChecksum {
+				resetLong()
+				continue
+			}
+
+			for j := 0; j < LFN_CHARS; j++ {
+				var pos int
+				switch {
+				case j < 5:
+					pos = 1 + j*2
+				case j < 11:
+					pos = 14 + (j-5)*2
+				default:
+					pos = 28 + (j-11)*2
+				}
+
+				longName[(seq-1)*LFN_CHARS+j] = binary.LittleEndian.Uint16(rec[pos:])
+			}
+
+			longSeen += 1
+
+			continue
+		}
+
+		if rec.Attributes()&ATTR_VOLUME_ID != 0 {
+			resetLong()
+			continue
+		}
+
+		var short [11]byte
+		copy(short[:], rec[:11])
+
+		name := decodeShortName(rec)
+
+		if longName != nil && longSeen == longCount && shortNameChecksum(short) == longChecksum {
+			end := len(longName)
+			for i, c := range longName {
+				if c == 0 {
+					end = i
+					break
+				}
+			}
+
+			name = string(utf16.Decode(longName[:end]))
+		}
+
+		resetLong()
+
+		if name == "." || name == ".." {
+			continue
+		}
+
+		ret = append(ret, DirEntry{
+			Name:       name,
+			Attributes: rec.Attributes(),
+			Cluster:    rec.FirstClusterNumber(),
+			Size:       rec.FileSize(),
+			ModTime:    decodeTimestamp(rec.LastModificationDate(), rec.LastModificationTime()),
+		})
+	}
+
+	return ret, nil
+}
+
+// Open returns a reader for the contents of a file.
+func (r *Reader) Open(file DirEntry) (*io.SectionReader, error) {
+	if file.IsDir() {
+		return nil, fmt.Errorf("fat16: %s is a directory", file.Name)
+	}
+
+	if file.Size == 0 {
+		return io.NewSectionReader(&chainReader{r: r}, 0, 0), nil
+	}
+
+	chain, err := r.chain(file.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(chain))*r.clusterSize < int64(file.Size) {
+		return nil, fmt.Errorf("fat16: cluster chain of %s is shorter than the file", file.Name)
+	}
+
+	return io.NewSectionReader(&chainReader{r: r, chain: chain}, 0, int64(file.Size)), nil
+}
+
+// OpenReader reads the boot sector and FAT of a FAT16 or FAT32 image. FAT12
+// images are not supported.
+func OpenReader(r io.ReaderAt) (*Reader, error) {
+	var bpb BiosParameterBlock
+
+	if _, err := r.ReadAt(bpb[:], 0); err != nil {
+		return nil, fmt.Errorf("fat16: failed to read boot sector: %w", err)
+	}
+
+	if bpb.BootablePartitionSignature() != 0xAA55 {
+		return nil, fmt.Errorf("fat16: invalid boot sector signature")
+	}
+
+	bytesPerSector := int64(bpb.BytesPerSector())
+	sectorsPerCluster := int64(bpb.SectorsPerCluster())
+
+	if bytesPerSector < 512 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0 {
+		return nil, fmt.Errorf("fat16: invalid sector size: %d", bytesPerSector)
+	}
+
+	if sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0 {
+		return nil, fmt.Errorf("fat16: invalid sectors per cluster: %d", sectorsPerCluster)
+	}
+
+	if bpb.FatCount() == 0 || bpb.ReservedSectors() == 0 {
+		return nil, fmt.Errorf("fat16: invalid boot sector")
+	}
+
+	totalSectors := int64(bpb.TotalSectors16())
+	if totalSectors == 0 {
+		totalSectors = int64(bpb.TotalSectors32())
+	}
+
+	fatSectors := int64(bpb.TableSize16())
+	if fatSectors == 0 {
+		// FAT32 moves the size of the FAT to the extended boot record.
+		fatSectors = int64(binary.LittleEndian.Uint32(bpb[36:]))
+	}
+
+	rootDirSectors := (int64(bpb.RootDirectoryEntries())*32 + bytesPerSector - 1) / bytesPerSector
+
+	firstDataSector := int64(bpb.ReservedSectors()) + int64(bpb.FatCount())*fatSectors + rootDirSectors
+	if fatSectors == 0 || firstDataSector >= totalSectors {
+		return nil, fmt.Errorf("fat16: invalid boot sector")
+	}
+
+	clusters := (totalSectors - firstDataSector) / sectorsPerCluster
+
+	ret := &Reader{
+		r:           r,
+		clusterSize: bytesPerSector * sectorsPerCluster,
+		clusters:    uint32(clusters),
+		dataOffset:  firstDataSector * bytesPerSector,
+	}
+
+	var label []byte
+
+	if clusters < 4085 {
+		return nil, fmt.Errorf("fat16: FAT12 is not supported")
+	} else if clusters < MIN_FAT32_CLUSTERS {
+		ret.rootOffset = (firstDataSector - rootDirSectors) * bytesPerSector
+		ret.rootSize = rootDirSectors * bytesPerSector
+		label = bpb[43:54]
+	} else {
+		ret.fat32 = true
+		ret.rootCluster = binary.LittleEndian.Uint32(bpb[44:])
+		label = bpb[71:82]
+	}
+
+	ret.label = strings.TrimRight(string(label), " ")
+	if ret.label == "NO NAME" {
+		ret.label = ""
+	}
+
+	entrySize := int64(2)
+	if ret.fat32 {
+		entrySize = 4
+	}
+
+	// Like Linux only use the clusters the FAT can address. Some tools
+	// create a FAT that's a few entries short.
+	if fatEntries := fatSectors * bytesPerSector / entrySize; fatEntries-2 < clusters {
+		clusters = fatEntries - 2
+		ret.clusters = uint32(clusters)
+	}
+
+	ret.fat = make([]byte, (clusters+2)*entrySize)
+	if _, err := r.ReadAt(ret.fat, int64(bpb.ReservedSectors())*bytesPerSector); err != nil {
+		return nil, fmt.Errorf("fat16: failed to read FAT: %w", err)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,732 @@
+package fat16
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	SECTOR_SIZE        = 512
+	ROOT_DIR_ENTRIES   = 512
+	MIN_FAT16_CLUSTERS = 4096
+	MAX_FAT16_CLUSTERS = 65524
+	MIN_FAT32_CLUSTERS = 65525
+	MAX_FAT32_CLUSTERS = 0x0FFFFFF5
+	MAX_CLUSTER_SIZE   = 64 * 1024
+	AUTO_FAT32_SIZE    = 512 * 1024 * 1024
+
+	// FAT32 keeps a FSInfo sector and a backup of the boot sectors in the
+	// reserved area.
+	FAT32_RESERVED_SECTORS = 32
+	FAT32_FSINFO_SECTOR    = 1
+	FAT32_BACKUP_SECTOR    = 6
+	FAT32_ROOT_CLUSTER     = 2
+	FAT32_END_OF_FILE      = 0x0FFFFFFF
+
+	ATTR_READ_ONLY    = 0x01
+	ATTR_HIDDEN       = 0x02
+	ATTR_SYSTEM       = 0x04
+	ATTR_VOLUME_ID    = 0x08
+	ATTR_DIRECTORY    = 0x10
+	ATTR_ARCHIVE      = 0x20
+	FAT16_END_OF_FILE = 0xFFFF
+)
+
+// The date stamped on every entry so images are reproducible (1980-01-01).
+const fatFixedDate = (0 << 9) | (1 << 5) | 1
+
+type writerFile struct {
+	name     string
+	contents []byte
+
+	dir      bool
+	children []*writerFile
+
+	// Set while the image is written.
+	records      []DirectoryRecord
+	recordIndex  []int
+	firstCluster uint32
+}
+
+func (f *writerFile) child(name string) *writerFile {
+	for _, child := range f.children {
+		if strings.EqualFold(child.name, name) {
+			return child
+		}
+	}
+
+	return nil
+}
+
+type Format int
+
+const (
+	// Use FAT16 unless the contents need more clusters than it can address
+	// or the image is at least AUTO_FAT32_SIZE bytes.
+	FormatAuto Format = iota
+	FormatFat16
+	FormatFat32
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "FAT"
+	case FormatFat16:
+		return "FAT16"
+	case FormatFat32:
+		return "FAT32"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+type Options struct {
+	Format Format
+
+	// The number of bytes in each cluster. Must be a power of two between
+	// SECTOR_SIZE and MAX_CLUSTER_SIZE. If 0 the size is picked to fit the
+	// contents.
+	ClusterSize uint32
+
+	// The size of the image in bytes. If 0 the image is just large enough to
+	// hold the contents.
+	Size int64
+
+	// The volume serial number. If 0 it's derived from the label so images
+	// are reproducible.
+	VolumeId uint32
+}
+
+// Fat16Writer builds a FAT16 or FAT32 image. Files with names that don't fit
+// in 8.3 get VFAT long filename entries.
+type Fat16Writer struct {
+	label string
+	opts  Options
+	root  writerFile
+}
+
+// Walk to the parent of name creating directories as needed. Returns the
+// parent and the last component of name.
+func (w *Fat16Writer) parent(name string) (*writerFile, string, error) {
+	tokens := strings.Split(strings.Trim(name, "/"), "/")
+
+	for _, token := range tokens {
+		if token == "" || token == "." || token == ".." || strings.ContainsRune(token, '\\') {
+			return nil, "", fmt.Errorf("fat16: invalid filename: %q", name)
+		}
+	}
+
+	dir := &w.root
+
+	for _, token := range tokens[:len(tokens)-1] {
+		child := dir.child(token)
+		if child == nil {
+			child = &writerFile{name: token, dir: true}
+			dir.children = append(dir.children, child)
+		} else if !child.dir {
+			return nil, "", fmt.Errorf("fat16: not a directory: %s", token)
+		}
+
+		dir = child
+	}
+
+	return dir, tokens[len(tokens)-1], nil
+}
+
+// AddFile adds a file. Parent directories in name are created as needed.
+func (w *Fat16Writer) AddFile(name string, contents []byte) error {
+	dir, base, err := w.parent(name)
+	if err != nil {
+		return err
+	}
+
+	if dir.child(base) != nil {
+		return fmt.Errorf("fat16: file already exists: %s", name)
+	}
+
+	dir.children = append(dir.children, &writerFile{name: base, contents: contents})
+
+	return nil
+}
+
+// Mkdir adds a directory. It's not an error if the directory already exists.
+func (w *Fat16Writer) Mkdir(name string) error {
+	dir, base, err := w.parent(name)
+	if err != nil {
+		return err
+	}
+
+	if child := dir.child(base); child != nil {
+		if !child.dir {
+			return fmt.Errorf("fat16: file already exists: %s", name)
+		}
+
+		return nil
+	}
+
+	dir.children = append(dir.children, &writerFile{name: base, dir: true})
+
+	return nil
+}
+
+func (w *Fat16Writer) volumeLabel() [11]byte {
+	var ret [11]byte
+
+	for i := range ret {
+		ret[i] = ' '
+	}
+
+	// Volumes without a label conventionally use NO NAME in the boot sector.
+	label := w.label
+	if label == "" {
+		label = "NO NAME"
+	}
+
+	copy(ret[:], strings.ToUpper(label))
+
+	return ret
+}
+
+func dotEntry(name string) DirectoryRecord {
+	var ent DirectoryRecord
+
+	copy(ent[:11], fmt.Sprintf("%-11s", name))
+	ent.SetAttributes(ATTR_DIRECTORY)
+	ent.SetCreationDate(fatFixedDate)
+	ent.SetLastAccessedDate(fatFixedDate)
+	ent.SetLastModificationDate(fatFixedDate)
+
+	return ent
+}
+
+// Build the directory records of dir. Cluster numbers are filled in later.
+func buildRecords(dir *writerFile, isRoot bool) {
+	dir.records = nil
+	dir.recordIndex = nil
+
+	// Sort the entries so the image doesn't depend on the order files were
+	// added in.
+	slices.SortFunc(dir.children, func(a, b *writerFile) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	// Every directory apart from the root starts with . and .. entries.
+	if !isRoot {
+		dir.records = append(dir.records, dotEntry("."), dotEntry(".."))
+	}
+
+	used := make(map[string]bool)
+
+	for _, child := range dir.children {
+		name, needsLong := shortName(child.name, used)
+
+		if needsLong {
+			dir.records = append(dir.records, longNameEntries(child.name, shortNameChecksum(name))...)
+		}
+
+		var ent DirectoryRecord
+
+		copy(ent[:11], name[:])
+		if child.dir {
+			ent.SetAttributes(ATTR_DIRECTORY)
+		} else {
+			ent.SetAttributes(ATTR_ARCHIVE)
+			ent.SetFileSize(uint32(len(child.contents)))
+		}
+		ent.SetCreationDate(fatFixedDate)
+		ent.SetLastAccessedDate(fatFixedDate)
+		ent.SetLastModificationDate(fatFixedDate)
+
+		dir.recordIndex = append(dir.recordIndex, len(dir.records))
+		dir.records = append(dir.records, ent)
+
+		if child.dir {
+			buildRecords(child, false)
+		}
+	}
+}
+
+// The contents of a file or subdirectory stored in the data area.
+func (f *writerFile) data() []byte {
+	if !f.dir {
+		return f.contents
+	}
+
+	ret := make([]byte, len(f.records)*32)
+	for i, ent := range f.records {
+		copy(ret[i*32:], ent[:])
+	}
+
+	return ret
+}
+
+// Call fn for every file and subdirectory below dir in the order they are
+// stored in the data area.
+func walkFiles(dir *writerFile, fn func(f *writerFile)) {
+	for _, child := range dir.children {
+		fn(child)
+
+		if child.dir {
+			walkFiles(child, fn)
+		}
+	}
+}
+
+// The position of each region of the image in sectors.
+type layout struct {
+	fat32             bool
+	sectorsPerCluster uint32
+	reservedSectors   uint32
+	rootDirSectors    uint32
+	fatSectors        uint32
+	totalSectors      uint32
+	clusters          uint32
+}
+
+func (l layout) clusterSize() uint32 { return l.sectorsPerCluster * SECTOR_SIZE }
+
+func (l layout) firstDataSector() uint32 {
+	return l.reservedSectors + 2*l.fatSectors + l.rootDirSectors
+}
+
+func (l layout) format() Format {
+	if l.fat32 {
+		return FormatFat32
+	}
+	return FormatFat16
+}
+
+// The files and directories stored in the data area in order. On FAT32 the
+// root directory is stored there as well.
+func (w *Fat16Writer) dataFiles(fat32 bool) []*writerFile {
+	var ret []*writerFile
+
+	if fat32 {
+		ret = append(ret, &w.root)
+	}
+
+	walkFiles(&w.root, func(f *writerFile) {
+		ret = append(ret, f)
+	})
+
+	return ret
+}
+
+func (w *Fat16Writer) clustersFor(f *writerFile, clusterSize uint32) uint32 {
+	clusters := (uint32(len(f.data())) + clusterSize - 1) / clusterSize
+
+	// The FAT32 root directory always has a cluster even if it's empty.
+	if f == &w.root && clusters == 0 {
+		clusters = 1
+	}
+
+	return clusters
+}
+
+// Try to lay out the filesystem with the given cluster size. Returns false if
+// the contents don't fit or the cluster count is out of range for the format.
+func (w *Fat16Writer) tryLayout(fat32 bool, clusterSize uint32) (layout, bool) {
+	l := layout{fat32: fat32, sectorsPerCluster: clusterSize / SECTOR_SIZE}
+
+	entrySize := uint32(2)
+	minClusters, maxClusters := uint32(MIN_FAT16_CLUSTERS), uint32(MAX_FAT16_CLUSTERS)
+	if fat32 {
+		entrySize = 4
+		minClusters, maxClusters = MIN_FAT32_CLUSTERS, MAX_FAT32_CLUSTERS
+		l.reservedSectors = FAT32_RESERVED_SECTORS
+	} else {
+		l.reservedSectors = 1
+		l.rootDirSectors = ROOT_DIR_ENTRIES * 32 / SECTOR_SIZE
+	}
+
+	var needed uint64
+	for _, f := range w.dataFiles(fat32) {
+		needed += uint64(w.clustersFor(f, clusterSize))
+	}
+
+	if needed > uint64(maxClusters) {
+		return layout{}, false
+	}
+
+	fatSectorsFor := func(clusters uint64) uint64 {
+		return ((clusters+2)*uint64(entrySize) + SECTOR_SIZE - 1) / SECTOR_SIZE
+	}
+
+	metadata := uint64(l.reservedSectors + l.rootDirSectors)
+
+	var total, fatSectors, clusters uint64
+
+	if w.opts.Size != 0 {
+		total = uint64(w.opts.Size) / SECTOR_SIZE
+		if total <= metadata {
+			return layout{}, false
+		}
+
+		// Size the FAT as if the whole image was data. This wastes a few
+		// sectors but the FAT is always large enough.
+		fatSectors = fatSectorsFor((total - metadata) / uint64(l.sectorsPerCluster))
+		if total <= metadata+2*fatSectors {
+			return layout{}, false
+		}
+
+		clusters = (total - metadata - 2*fatSectors) / uint64(l.sectorsPerCluster)
+		if clusters < needed {
+			return layout{}, false
+		}
+	} else {
+		// Linux decides the FAT type from the number of clusters so make
+		// sure there are enough of them for the format to be detected.
+		clusters = max(needed, uint64(minClusters))
+		fatSectors = fatSectorsFor(clusters)
+		total = metadata + 2*fatSectors + clusters*uint64(l.sectorsPerCluster)
+	}
+
+	if clusters < uint64(minClusters) || clusters > uint64(maxClusters) || total > 0xFFFFFFFF {
+		return layout{}, false
+	}
+
+	l.fatSectors = uint32(fatSectors)
+	l.totalSectors = uint32(total)
+	l.clusters = uint32(clusters)
+
+	return l, true
+}
+
+// The cluster sizes to try in order of preference.
+func (w *Fat16Writer) clusterSizes(fat32 bool) []uint32 {
+	if w.opts.ClusterSize != 0 {
+		return []uint32{w.opts.ClusterSize}
+	}
+
+	var ret []uint32
+
+	// Prefer the cluster sizes used by other formatting tools for large
+	// FAT32 volumes to keep the FAT small.
+	if fat32 && w.opts.Size != 0 {
+		const mb = 1024 * 1024
+
+		switch {
+		case w.opts.Size > 32*1024*mb:
+			ret = append(ret, 32*1024)
+		case w.opts.Size > 16*1024*mb:
+			ret = append(ret, 16*1024)
+		case w.opts.Size > 8*1024*mb:
+			ret = append(ret, 8*1024)
+		case w.opts.Size > 260*mb:
+			ret = append(ret, 4*1024)
+		}
+	}
+
+	for size := uint32(SECTOR_SIZE); size <= 32*1024; size *= 2 {
+		ret = append(ret, size)
+	}
+
+	return ret
+}
+
+func (w *Fat16Writer) layout() (layout, error) {
+	if size := w.opts.ClusterSize; size != 0 {
+		if size < SECTOR_SIZE || size > MAX_CLUSTER_SIZE || size&(size-1) != 0 {
+			return layout{}, fmt.Errorf("fat16: invalid cluster size: %d", size)
+		}
+	}
+
+	if w.opts.Size < 0 || w.opts.Size%SECTOR_SIZE != 0 {
+		return layout{}, fmt.Errorf("fat16: image size %d is not a multiple of the sector size", w.opts.Size)
+	}
+
+	var formats []bool
+	switch w.opts.Format {
+	case FormatAuto:
+		// Like mkfs.fat large volumes are always FAT32.
+		if w.opts.Size >= AUTO_FAT32_SIZE {
+			formats = []bool{true}
+		} else {
+			formats = []bool{false, true}
+		}
+	case FormatFat16:
+		formats = []bool{false}
+	case FormatFat32:
+		formats = []bool{true}
+	default:
+		return layout{}, fmt.Errorf("fat16: unknown format: %s", w.opts.Format)
+	}
+
+	for _, fat32 := range formats {
+		for _, clusterSize := range w.clusterSizes(fat32) {
+			if l, ok := w.tryLayout(fat32, clusterSize); ok {
+				return l, nil
+			}
+		}
+	}
+
+	if w.opts.Size != 0 {
+		return layout{}, fmt.Errorf("fat16: contents do not fit in a %d byte %s filesystem", w.opts.Size, w.opts.Format)
+	}
+
+	return layout{}, fmt.Errorf("fat16: contents too large for a %s filesystem", w.opts.Format)
+}
+
+// Fill out the boot sector. FAT32 moves the extended boot record to make
+// space for more fields so it's written by offset.
+func (w *Fat16Writer) bootSector(l layout, label [11]byte) BiosParameterBlock {
+	var bpb BiosParameterBlock
+
+	volumeId := w.opts.VolumeId
+	if volumeId == 0 {
+		volumeId = binary.LittleEndian.Uint32(label[:4])
+	}
+
+	copy(bpb[3:11], "MSWIN4.1")
+	bpb.SetBytesPerSector(SECTOR_SIZE)
+	bpb.SetSectorsPerCluster(uint8(l.sectorsPerCluster))
+	bpb.SetReservedSectors(uint16(l.reservedSectors))
+	bpb.SetFatCount(2)
+	if l.totalSectors < 0x10000 && !l.fat32 {
+		bpb.SetTotalSectors16(uint16(l.totalSectors))
+	} else {
+		bpb.SetTotalSectors32(l.totalSectors)
+	}
+	bpb.SetMediaDescriptorType(0xF8)
+	bpb.SetSectorsPerTrack(32)
+	bpb.SetHeadSideCount(64)
+	bpb.SetBootablePartitionSignature(0xAA55)
+
+	if !l.fat32 {
+		copy(bpb[0:3], []byte{0xEB, 0x3C, 0x90})
+		bpb.SetRootDirectoryEntries(ROOT_DIR_ENTRIES)
+		bpb.SetTableSize16(uint16(l.fatSectors))
+		bpb.SetDriveNumber(0x80)
+		bpb.SetSignature(0x29)
+		bpb.SetVolumeId(volumeId)
+		for i, c := range label {
+			bpb.SetVolumeLabel(i, c)
+		}
+		for i, c := range []byte("FAT16   ") {
+			bpb.SetSystemIdentifier(i, c)
+		}
+
+		return bpb
+	}
+
+	copy(bpb[0:3], []byte{0xEB, 0x58, 0x90})
+	binary.LittleEndian.PutUint32(bpb[36:], l.fatSectors)
+	binary.LittleEndian.PutUint32(bpb[44:], FAT32_ROOT_CLUSTER)
+	binary.LittleEndian.PutUint16(bpb[48:], FAT32_FSINFO_SECTOR)
+	binary.LittleEndian.PutUint16(bpb[50:], FAT32_BACKUP_SECTOR)
+	bpb[64] = 0x80
+	bpb[66] = 0x29
+	binary.LittleEndian.PutUint32(bpb[67:], volumeId)
+	copy(bpb[71:82], label[:])
+	copy(bpb[82:90], "FAT32   ")
+
+	return bpb
+}
+
+func fsInfoSector(freeClusters uint32, nextFree uint32) []byte {
+	buf := make([]byte, SECTOR_SIZE)
+
+	binary.LittleEndian.PutUint32(buf[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(buf[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(buf[488:], freeClusters)
+	binary.LittleEndian.PutUint32(buf[492:], nextFree)
+	binary.LittleEndian.PutUint32(buf[508:], 0xAA550000)
+
+	return buf
+}
+
+func (w *Fat16Writer) addLabelRecord() {
+	if w.label == "" {
+		return
+	}
+
+	label := w.volumeLabel()
+
+	var ent DirectoryRecord
+
+	copy(ent[:11], label[:])
+	ent.SetAttributes(ATTR_VOLUME_ID)
+	ent.SetLastModificationDate(fatFixedDate)
+
+	root := &w.root
+
+	root.records = append([]DirectoryRecord{ent}, root.records...)
+	for i := range root.recordIndex {
+		root.recordIndex[i] += 1
+	}
+}
+
+// WriteTo writes the complete filesystem image to out. The output only
+// depends on the files added and the options.
+func (w *Fat16Writer) WriteTo(out io.Writer) (int64, error) {
+	root := &w.root
+
+	buildRecords(root, true)
+	w.addLabelRecord()
+
+	l, err := w.layout()
+	if err != nil {
+		return 0, err
+	}
+
+	if !l.fat32 && len(root.records) > ROOT_DIR_ENTRIES {
+		return 0, fmt.Errorf("fat16: too many entries in root directory: %d > %d", len(root.records), ROOT_DIR_ENTRIES)
+	}
+
+	clusterSize := l.clusterSize()
+
+	files := w.dataFiles(l.fat32)
+
+	// Allocate clusters for each file and directory contiguously.
+	fat := make([]byte, l.fatSectors*SECTOR_SIZE)
+
+	setEntry := func(cluster uint32, val uint32) {
+		if l.fat32 {
+			binary.LittleEndian.PutUint32(fat[cluster*4:], val)
+		} else {
+			binary.LittleEndian.PutUint16(fat[cluster*2:], uint16(val))
+		}
+	}
+
+	endOfFile := uint32(FAT16_END_OF_FILE)
+	if l.fat32 {
+		endOfFile = FAT32_END_OF_FILE
+		setEntry(0, 0x0FFFFFF8)
+	} else {
+		setEntry(0, 0xFFF8)
+	}
+	setEntry(1, endOfFile)
+
+	root.firstCluster = 0
+
+	var nextCluster uint32 = 2
+
+	for _, f := range files {
+		f.firstCluster = 0
+
+		clusters := w.clustersFor(f, clusterSize)
+		if clusters == 0 {
+			continue
+		}
+
+		first := nextCluster
+		for i := uint32(0); i < clusters; i++ {
+			val := first + i + 1
+			if i == clusters-1 {
+				val = endOfFile
+			}
+			setEntry(first+i, val)
+		}
+
+		f.firstCluster = first
+
+		nextCluster += clusters
+	}
+
+	// Point the directory records at the allocated clusters. The root
+	// directory is referred to as cluster 0 even on FAT32.
+	var link func(dir *writerFile)
+	link = func(dir *writerFile) {
+		parent := dir.firstCluster
+		if dir == root {
+			parent = 0
+		}
+
+		for i, child := range dir.children {
+			dir.records[dir.recordIndex[i]].SetFirstClusterNumber(child.firstCluster)
+
+			if child.dir {
+				child.records[0].SetFirstClusterNumber(child.firstCluster)
+				child.records[1].SetFirstClusterNumber(parent)
+
+				link(child)
+			}
+		}
+	}
+	link(root)
+
+	bpb := w.bootSector(l, w.volumeLabel())
+
+	// Write the image out in order.
+	var total int64
+
+	write := func(b []byte) error {
+		n, err := out.Write(b)
+		total += int64(n)
+		return err
+	}
+
+	reserved := make([]byte, l.reservedSectors*SECTOR_SIZE)
+	copy(reserved, bpb[:])
+
+	if l.fat32 {
+		fsInfo := fsInfoSector(l.clusters-(nextCluster-2), nextCluster)
+
+		copy(reserved[FAT32_FSINFO_SECTOR*SECTOR_SIZE:], fsInfo)
+		copy(reserved[FAT32_BACKUP_SECTOR*SECTOR_SIZE:], bpb[:])
+		copy(reserved[(FAT32_BACKUP_SECTOR+1)*SECTOR_SIZE:], fsInfo)
+	}
+
+	if err := write(reserved); err != nil {
+		return total, err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := write(fat); err != nil {
+			return total, err
+		}
+	}
+
+	if !l.fat32 {
+		rootBytes := make([]byte, l.rootDirSectors*SECTOR_SIZE)
+		copy(rootBytes, root.data())
+
+		if err := write(rootBytes); err != nil {
+			return total, err
+		}
+	}
+
+	for _, f := range files {
+		if f.firstCluster == 0 {
+			continue
+		}
+
+		data := f.data()
+
+		buf := make([]byte, w.clustersFor(f, clusterSize)*clusterSize)
+		copy(buf, data)
+
+		if err := write(buf); err != nil {
+			return total, err
+		}
+	}
+
+	// Pad the rest of the image with zeros.
+	remaining := int64(l.totalSectors)*SECTOR_SIZE - total
+	if _, err := io.CopyN(out, zeroReader{}, remaining); err != nil {
+		return total, err
+	}
+	total += remaining
+
+	return total, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// NewWriter creates a writer for a image with the given volume label.
+func NewWriter(label string, opts Options) *Fat16Writer {
+	return &Fat16Writer{label: label, opts: opts, root: writerFile{dir: true}}
+}
+
+func NewFat16Writer(label string) *Fat16Writer {
+	return NewWriter(label, Options{Format: FormatFat16})
+}
@@ -0,0 +1,130 @@
+package filesystem
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/filesystem/fat16"
+)
+
+type fatFile struct {
+	r   *fat16.Reader
+	ent fat16.DirEntry
+}
+
+// Digest implements File.
+func (e *fatFile) Digest() *FileDigest { return nil }
+
+// Open implements File.
+func (e *fatFile) Open() (FileHandle, error) {
+	f, err := e.r.Open(e.ent)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNopCloserFileHandle(f), nil
+}
+
+// Stat implements File.
+func (e *fatFile) Stat() (FileInfo, error) { return e, nil }
+
+func (e *fatFile) Kind() FileType     { return FileTypeFromMode(e.Mode()) }
+func (e *fatFile) IsDir() bool        { return e.ent.IsDir() }
+func (e *fatFile) ModTime() time.Time { return e.ent.ModTime }
+func (e *fatFile) Name() string       { return "" }
+func (e *fatFile) Sys() any           { return e }
+
+// Mode implements FileInfo. FAT doesn't store permissions so they are derived
+// from the read only attribute.
+func (e *fatFile) Mode() fs.FileMode {
+	var mode fs.FileMode = 0644
+	if e.ent.IsDir() {
+		mode = fs.ModeDir | 0755
+	}
+
+	if e.ent.Attributes&fat16.ATTR_READ_ONLY != 0 {
+		mode &^= 0222
+	}
+
+	return mode
+}
+
+// Size implements FileInfo.
+func (e *fatFile) Size() int64 {
+	if e.ent.IsDir() {
+		return 0
+	}
+
+	return int64(e.ent.Size)
+}
+
+var (
+	_ File     = &fatFile{}
+	_ FileInfo = &fatFile{}
+)
+
+type fatDirectory struct {
+	fatFile
+}
+
+// GetChild implements Directory.
+func (e *fatDirectory) GetChild(name string) (DirectoryEntry, error) {
+	ents, err := e.Readdir()
+	if err != nil {
+		return DirectoryEntry{}, err
+	}
+
+	for _, ent := range ents {
+		if ent.Name == name {
+			return ent, nil
+		}
+	}
+
+	return DirectoryEntry{}, fs.ErrNotExist
+}
+
+// Readdir implements Directory.
+func (e *fatDirectory) Readdir() ([]DirectoryEntry, error) {
+	ents, err := e.r.ReadDir(e.ent)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []DirectoryEntry
+
+	for _, ent := range ents {
+		ret = append(ret, DirectoryEntry{File: newFatFile(e.r, ent), Name: ent.Name})
+	}
+
+	return ret, nil
+}
+
+var (
+	_ Directory = &fatDirectory{}
+)
+
+func newFatFile(r *fat16.Reader, ent fat16.DirEntry) File {
+	if ent.IsDir() {
+		return &fatDirectory{fatFile{r: r, ent: ent}}
+	}
+
+	return &fatFile{r: r, ent: ent}
+}
+
+// OpenFatImage returns the root directory of a FAT16 or FAT32 image. Files are
+// read lazily from r so it must stay open while the directory is in use.
+func OpenFatImage(r io.ReaderAt) (Directory, error) {
+	reader, err := fat16.OpenReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, ok := newFatFile(reader, reader.Root()).(Directory)
+	if !ok {
+		return nil, fmt.Errorf("root is not a directory")
+	}
+
+	return dir, nil
+}
@@ -30,11 +30,80 @@ func GetLinkName(ent File) (string, error) {
 		return GetLinkName(ent.File)
 	case SimpleEntry:
 		return ent.linkName, nil
+	case *ext4File:
+		if ent.inode.Mode()&fs.ModeSymlink == 0 {
+			return "", fs.ErrInvalid
+		}
+		return ent.r.Readlink(ent.inode)
+	case *squashfsFile:
+		if ent.inode.Mode()&fs.ModeSymlink == 0 {
+			return "", fs.ErrInvalid
+		}
+		return ent.inode.Target(), nil
 	default:
 		return "", fmt.Errorf("GetLinkName not implemented: %T", ent)
 	}
 }
 
+// GetDeviceNumbers returns the major and minor device numbers of a character
+// or block device.
+func GetDeviceNumbers(ent File) (int64, int64, error) {
+	switch ent := ent.(type) {
+	case *StarFile:
+		return GetDeviceNumbers(ent.File)
+	case *CacheEntry:
+		return ent.CDevmajor, ent.CDevminor, nil
+	case *memoryFile:
+		return ent.devmajor, ent.devminor, nil
+	case *overlayFile:
+		return GetDeviceNumbers(ent.File)
+	case SimpleEntry:
+		return ent.devmajor, ent.devminor, nil
+	case *ext4File:
+		major, minor := ent.inode.DeviceNumbers()
+		return int64(major), int64(minor), nil
+	case *squashfsFile:
+		major, minor := ent.inode.DeviceNumbers()
+		return int64(major), int64(minor), nil
+	default:
+		return 0, 0, fmt.Errorf("GetDeviceNumbers not implemented: %T", ent)
+	}
+}
+
+// GetXattrs returns the extended attributes of a file keyed by their full
+// name. Files that don't support them return nil.
+func GetXattrs(ent File) (map[string][]byte, error) {
+	switch ent := ent.(type) {
+	case *StarDirectory:
+		return GetXattrs(ent.Directory)
+	case *StarFile:
+		return GetXattrs(ent.File)
+	case *memoryDirectory:
+		return GetXattrs(ent.memoryFile)
+	case *memoryFile:
+		return ent.xattrs, nil
+	case *overlayFile:
+		if ent.xattrs != nil {
+			return ent.xattrs, nil
+		}
+		return GetXattrs(ent.File)
+	case *CacheEntry:
+		return ent.CXattrs, nil
+	case SimpleEntry:
+		return GetXattrs(ent.File)
+	case *ext4Directory:
+		return GetXattrs(&ent.ext4File)
+	case *ext4File:
+		return ent.r.Xattrs(ent.inode)
+	case *squashfsDirectory:
+		return GetXattrs(&ent.squashfsFile)
+	case *squashfsFile:
+		return ent.r.Xattrs(ent.inode)
+	default:
+		return nil, nil
+	}
+}
+
 func GetUidAndGid(ent File) (int, int, error) {
 	switch ent := ent.(type) {
 	case *StarDirectory:
@@ -51,6 +120,18 @@ func GetUidAndGid(ent File) (int, int, error) {
 		return ent.CUid, ent.CGid, nil
 	case SimpleEntry:
 		return ent.uid, ent.gid, nil
+	case *ext4Directory:
+		return GetUidAndGid(&ent.ext4File)
+	case *ext4File:
+		return int(ent.inode.Uid()), int(ent.inode.Gid()), nil
+	case *squashfsDirectory:
+		return GetUidAndGid(&ent.squashfsFile)
+	case *squashfsFile:
+		return int(ent.inode.Uid()), int(ent.inode.Gid()), nil
+	case *fatDirectory:
+		return 0, 0, nil
+	case *fatFile:
+		return 0, 0, nil
 	case *LocalFile:
 		return 0, 0, nil // local files are normally build definitions.
 	default:
@@ -114,6 +195,7 @@ type MutableFile interface {
 	Chown(uid int, gid int) error
 	Chtimes(mtime time.Time) error
 	Overwrite(contents []byte) error
+	SetXattrs(xattrs map[string][]byte) error
 }
 
 type FileType byte
@@ -123,8 +205,64 @@ const (
 	TypeDirectory
 	TypeSymlink
 	TypeLink
+	TypeCharDevice
+	TypeBlockDevice
+	TypeFifo
+	TypeSocket
 )
 
+// IsDevice returns true for character and block devices.
+func (t FileType) IsDevice() bool {
+	return t == TypeCharDevice || t == TypeBlockDevice
+}
+
+// IsSpecial returns true for devices, FIFOs and sockets. These have no
+// contents and are created with a mknod call.
+func (t FileType) IsSpecial() bool {
+	return t.IsDevice() || t == TypeFifo || t == TypeSocket
+}
+
+// ModeType returns the fs.FileMode type bits for t.
+func (t FileType) ModeType() fs.FileMode {
+	switch t {
+	case TypeDirectory:
+		return fs.ModeDir
+	case TypeSymlink:
+		return fs.ModeSymlink
+	case TypeCharDevice:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case TypeBlockDevice:
+		return fs.ModeDevice
+	case TypeFifo:
+		return fs.ModeNamedPipe
+	case TypeSocket:
+		return fs.ModeSocket
+	default:
+		return 0
+	}
+}
+
+// FileTypeFromMode returns the FileType for the type bits of mode. Hard links
+// can't be detected from the mode so they are returned as TypeRegular.
+func FileTypeFromMode(mode fs.FileMode) FileType {
+	switch {
+	case mode.IsDir():
+		return TypeDirectory
+	case mode&fs.ModeSymlink != 0:
+		return TypeSymlink
+	case mode&fs.ModeDevice != 0 && mode&fs.ModeCharDevice != 0:
+		return TypeCharDevice
+	case mode&fs.ModeDevice != 0:
+		return TypeBlockDevice
+	case mode&fs.ModeNamedPipe != 0:
+		return TypeFifo
+	case mode&fs.ModeSocket != 0:
+		return TypeSocket
+	default:
+		return TypeRegular
+	}
+}
+
 func (t FileType) String() string {
 	switch t {
 	case TypeRegular:
@@ -135,6 +273,14 @@ func (t FileType) String() string {
 		return "Symlink"
 	case TypeLink:
 		return "Link"
+	case TypeCharDevice:
+		return "CharDevice"
+	case TypeBlockDevice:
+		return "BlockDevice"
+	case TypeFifo:
+		return "Fifo"
+	case TypeSocket:
+		return "Socket"
 	default:
 		return "<unknown>"
 	}
@@ -165,13 +311,7 @@ type osStat struct {
 
 // Kind implements FileInfo.
 func (o *osStat) Kind() FileType {
-	if o.IsDir() {
-		return TypeDirectory
-	} else if o.Mode().Type() == fs.ModeSymlink {
-		return TypeSymlink
-	} else {
-		return TypeRegular
-	}
+	return FileTypeFromMode(o.Mode())
 }
 
 var (
@@ -320,12 +460,13 @@ func NewLazyRemoteFile(client *http.Client, url string, expectedSize int64) io.R
 type overlayFile struct {
 	File
 
-	kind  FileType
-	size  int64
-	mTime time.Time
-	mode  fs.FileMode
-	uid   int
-	gid   int
+	kind   FileType
+	size   int64
+	mTime  time.Time
+	mode   fs.FileMode
+	uid    int
+	gid    int
+	xattrs map[string][]byte
 }
 
 func (m *overlayFile) Kind() FileType      { return m.kind }
@@ -359,6 +500,13 @@ func (m *overlayFile) Chtimes(mtime time.Time) error {
 	return nil
 }
 
+// SetXattrs implements MutableFile.
+func (m *overlayFile) SetXattrs(xattrs map[string][]byte) error {
+	m.xattrs = xattrs
+
+	return nil
+}
+
 // Overwrite implements MutableFile.
 func (o *overlayFile) Overwrite(contents []byte) error {
 	return fmt.Errorf("OverlayFiles do not support being overwritten")
@@ -430,6 +578,9 @@ type memoryFile struct {
 	uid      int
 	gid      int
 	contents []byte
+	devmajor int64
+	devminor int64
+	xattrs   map[string][]byte
 }
 
 func (m *memoryFile) Kind() FileType      { return m.kind }
@@ -463,6 +614,13 @@ func (m *memoryFile) Chtimes(mtime time.Time) error {
 	return nil
 }
 
+// SetXattrs implements MutableFile.
+func (m *memoryFile) SetXattrs(xattrs map[string][]byte) error {
+	m.xattrs = xattrs
+
+	return nil
+}
+
 // Open implements MutableFile.
 func (m *memoryFile) Open() (FileHandle, error) {
 	return NewNopCloserFileHandle(bytes.NewReader(m.contents)), nil
@@ -500,6 +658,25 @@ func NewSymlink(target string) MutableFile {
 	}
 }
 
+// NewSpecialFile creates a device, FIFO or socket. The device numbers are
+// ignored for FIFOs and sockets.
+func NewSpecialFile(kind FileType, devmajor int64, devminor int64) (MutableFile, error) {
+	if !kind.IsSpecial() {
+		return nil, fmt.Errorf("%s is not a special file type", kind)
+	}
+
+	if !kind.IsDevice() {
+		devmajor, devminor = 0, 0
+	}
+
+	return &memoryFile{
+		kind:     kind,
+		mode:     kind.ModeType() | fs.FileMode(0644),
+		devmajor: devmajor,
+		devminor: devminor,
+	}, nil
+}
+
 func NewHardLink(target string) (MutableFile, error) {
 	target = strings.TrimPrefix(target, ".")
 	if !strings.HasPrefix(target, "/") {
@@ -524,10 +701,12 @@ type SimpleEntry struct {
 	name     string
 	size     int64
 	typeFlag FileType
+	devmajor int64
+	devminor int64
 }
 
-func (s SimpleEntry) Devmajor() int64    { return 0 }
-func (s SimpleEntry) Devminor() int64    { return 0 }
+func (s SimpleEntry) Devmajor() int64    { return s.devmajor }
+func (s SimpleEntry) Devminor() int64    { return s.devminor }
 func (s SimpleEntry) Uid() int           { return s.uid }
 func (s SimpleEntry) Gid() int           { return s.gid }
 func (s SimpleEntry) Linkname() string   { return s.linkName }
@@ -0,0 +1,286 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// A path that was replaced or removed by a later fragment.
+type LayerChange struct {
+	Action string
+	Path   string
+	// The fragment that made the change.
+	Layer string
+}
+
+// FragmentOptions controls how ApplyFragment finds the files referred to by
+// fragments.
+type FragmentOptions struct {
+	// Resolve returns the local path of a host filename. The filename is used
+	// unchanged if nil.
+	Resolve func(filename string) string
+	// OpenArchive reads the archive of a archive fragment. If nil the archive
+	// is read from the resolved host filename.
+	OpenArchive func(filename string) (Archive, error)
+	// Builtin returns the file for a builtin fragment. Builtin fragments are
+	// an error if nil.
+	Builtin func(builtin config.BuiltinFragment) (File, error)
+	// OnChange is called for every path replaced or removed by a fragment.
+	OnChange func(change LayerChange)
+}
+
+func (opts FragmentOptions) resolve(filename string) string {
+	if opts.Resolve == nil {
+		return filename
+	}
+
+	return opts.Resolve(filename)
+}
+
+func (opts FragmentOptions) recordChange(action string, name string, layer string) {
+	if opts.OnChange == nil {
+		return
+	}
+
+	name = "/" + strings.TrimPrefix(path.Clean(name), "/")
+
+	opts.OnChange(LayerChange{Action: action, Path: name, Layer: layer})
+}
+
+// Create f at name replacing any file a earlier fragment put there.
+func (opts FragmentOptions) replaceChild(dir MutableDirectory, name string, f File, layer string) error {
+	replaced, err := ReplaceChild(dir, name, f)
+	if err != nil {
+		return err
+	}
+
+	if replaced {
+		opts.recordChange("replaced", name, layer)
+	}
+
+	return nil
+}
+
+// ApplyFragment adds the contents of frag to dir. Fragments are applied like
+// image layers so files from later fragments replace the ones before them and
+// archives can remove paths using whiteouts.
+func ApplyFragment(dir MutableDirectory, frag config.Fragment, opts FragmentOptions) error {
+	if localFile := frag.LocalFile; localFile != nil {
+		file := NewLocalFile(opts.resolve(localFile.HostFilename), nil)
+
+		overlay, err := NewOverlayFile(file)
+		if err != nil {
+			return err
+		}
+
+		if localFile.Executable {
+			if err := overlay.Chmod(fs.FileMode(0755)); err != nil {
+				return err
+			}
+		}
+
+		return opts.replaceChild(dir, localFile.GuestFilename, overlay, localFile.HostFilename)
+	} else if fileContents := frag.FileContents; fileContents != nil {
+		file := NewMemoryFile(TypeRegular)
+
+		if err := file.Overwrite(fileContents.Contents); err != nil {
+			return err
+		}
+
+		if fileContents.Executable {
+			if err := file.Chmod(fs.FileMode(0755)); err != nil {
+				return err
+			}
+		}
+
+		return opts.replaceChild(dir, fileContents.GuestFilename, file, "file_contents")
+	} else if builtin := frag.Builtin; builtin != nil {
+		if opts.Builtin == nil {
+			return fmt.Errorf("unknown builtin: %s", builtin.Name)
+		}
+
+		file, err := opts.Builtin(*builtin)
+		if err != nil {
+			return err
+		}
+
+		return opts.replaceChild(dir, builtin.GuestFilename, file, "builtin:"+builtin.Name)
+	} else if ark := frag.Archive; ark != nil {
+		var (
+			archive Archive
+			err     error
+		)
+
+		if opts.OpenArchive != nil {
+			archive, err = opts.OpenArchive(ark.HostFilename)
+		} else {
+			archive, err = ReadArchiveFromFile(NewLocalFile(opts.resolve(ark.HostFilename), nil))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		return applyArchive(dir, archive, ark.Target, ark.HostFilename, opts)
+	} else {
+		return fmt.Errorf("unknown fragment kind")
+	}
+}
+
+// Extract archive to target in dir applying whiteouts.
+func applyArchive(dir MutableDirectory, archive Archive, target string, layer string, opts FragmentOptions) error {
+	entries, err := archive.Entries()
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	// Paths added by this archive. Whiteouts only hide files from earlier
+	// fragments.
+	added := make(map[string]bool)
+
+	for _, ent := range entries {
+		// TODO(joshua): Why is this not filepath.join?
+		name := target + "/" + ent.Name()
+
+		var file MutableFile
+
+		// Set when a directory from a earlier fragment is merged with this
+		// entry. The entry replaces all of its metadata.
+		merged := false
+
+		if name != "/" {
+			if whiteout, opaque, ok := ParseWhiteout(name); ok {
+				if opaque {
+					removed, err := ClearDirectory(dir, whiteout, func(child string) bool {
+						return added[path.Join(whiteout, child)]
+					})
+					if err != nil {
+						return fmt.Errorf("failed to apply opaque whiteout %s: %w", name, err)
+					}
+
+					for _, p := range removed {
+						opts.recordChange("removed", p, layer)
+					}
+				} else if !added[whiteout] && Exists(dir, whiteout) {
+					if err := Remove(dir, whiteout); err != nil {
+						return fmt.Errorf("failed to apply whiteout %s: %w", name, err)
+					}
+
+					opts.recordChange("removed", whiteout, layer)
+				}
+
+				continue
+			}
+
+			// Directories are merged with existing directories and
+			// symlinks to them. Anything else is replaced including
+			// when the type changes.
+			var existingDir MutableDirectory
+
+			if Exists(dir, name) {
+				if ent.Typeflag() == TypeDirectory {
+					existingDir, _ = OpenDirectory(dir, name)
+				}
+
+				if existingDir == nil {
+					if err := Remove(dir, name); err != nil {
+						return fmt.Errorf("failed to replace %s: %w", name, err)
+					}
+
+					opts.recordChange("replaced", name, layer)
+				}
+			}
+
+			added[path.Clean(name)] = true
+
+			dirname := path.Dir(name)
+
+			if !Exists(dir, dirname) && path.Clean(name) != dirname {
+				if _, err := Mkdir(dir, dirname); err != nil {
+					return err
+				}
+			}
+
+			switch ent.Typeflag() {
+			case TypeDirectory:
+				name = strings.TrimSuffix(name, "/")
+
+				if existingDir != nil {
+					file = existingDir
+					merged = true
+					break
+				}
+
+				file, err = Mkdir(dir, name)
+				if err != nil {
+					return err
+				}
+			case TypeSymlink:
+				symlink := NewSymlink(ent.Linkname())
+
+				file = symlink
+
+				if err := CreateChild(dir, name, symlink); err != nil {
+					return err
+				}
+			case TypeLink:
+				link, err := NewHardLink(ent.Linkname())
+				if err != nil {
+					return err
+				}
+
+				file = link
+
+				if err := CreateChild(dir, name, link); err != nil {
+					return err
+				}
+			case TypeRegular:
+				file, err = NewOverlayFile(ent)
+				if err != nil {
+					return err
+				}
+
+				if err := CreateChild(dir, name, ent); err != nil {
+					return err
+				}
+			case TypeCharDevice, TypeBlockDevice, TypeFifo, TypeSocket:
+				file, err = NewSpecialFile(ent.Typeflag(), ent.Devmajor(), ent.Devminor())
+				if err != nil {
+					return err
+				}
+
+				if err := CreateChild(dir, name, file); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unimplemented entry type: %s", ent.Typeflag())
+			}
+		} else {
+			file = dir
+		}
+
+		if err := file.Chown(ent.Uid(), ent.Gid()); err != nil {
+			return fmt.Errorf("failed to chown: %w", err)
+		}
+
+		if err := file.Chmod(fs.FileMode(ent.Mode())); err != nil {
+			return fmt.Errorf("failed to chmod: %w", err)
+		}
+
+		xattrs, err := GetXattrs(ent)
+		if err != nil {
+			return fmt.Errorf("failed to get xattrs: %w", err)
+		}
+
+		if xattrs != nil || merged {
+			if err := file.SetXattrs(xattrs); err != nil {
+				return fmt.Errorf("failed to set xattrs: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
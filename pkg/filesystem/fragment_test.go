@@ -0,0 +1,213 @@
+package filesystem
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// Returns a archive entry for name. Directories are created if contents is
+// nil.
+func testEntry(t *testing.T, name string, contents []byte) Entry {
+	t.Helper()
+
+	if contents == nil {
+		return SimpleEntry{File: NewMemoryDirectory(), mode: fs.ModeDir | 0755, name: name, typeFlag: TypeDirectory}
+	}
+
+	f := NewMemoryFile(TypeRegular)
+	if err := f.Overwrite(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	return SimpleEntry{File: f, mode: 0644, name: name, size: int64(len(contents)), typeFlag: TypeRegular}
+}
+
+func TestApplyFragmentChanges(t *testing.T) {
+	contents := func(name string) config.Fragment {
+		return config.Fragment{FileContents: &config.FileContentsFragment{
+			GuestFilename: name,
+			Contents:      []byte(name),
+		}}
+	}
+
+	for _, tc := range []struct {
+		name string
+		// Paths created before the archive is applied.
+		base    []string
+		archive []string
+		changes []LayerChange
+		exists  []string
+		missing []string
+	}{
+		{
+			name:    "Replace",
+			base:    []string{"/etc/motd"},
+			archive: []string{"etc/", "etc/motd"},
+			changes: []LayerChange{{"replaced", "/etc/motd", "layer"}},
+			exists:  []string{"/etc/motd"},
+		},
+		{
+			name:    "Whiteout",
+			base:    []string{"/etc/motd", "/etc/hostname"},
+			archive: []string{"etc/", "etc/.wh.motd"},
+			changes: []LayerChange{{"removed", "/etc/motd", "layer"}},
+			exists:  []string{"/etc/hostname"},
+			missing: []string{"/etc/motd", "/etc/.wh.motd"},
+		},
+		{
+			name:    "WhiteoutMissing",
+			archive: []string{"etc/", "etc/.wh.motd"},
+			exists:  []string{"/etc"},
+			missing: []string{"/etc/motd"},
+		},
+		{
+			name:    "WhiteoutAddedBySameLayer",
+			archive: []string{"etc/", "etc/motd", "etc/.wh.motd"},
+			exists:  []string{"/etc/motd"},
+		},
+		{
+			name:    "Opaque",
+			base:    []string{"/etc/motd", "/etc/hostname", "/usr/bin/sh"},
+			archive: []string{"etc/", "etc/issue", "etc/.wh..wh..opq"},
+			changes: []LayerChange{
+				{"removed", "/etc/motd", "layer"},
+				{"removed", "/etc/hostname", "layer"},
+			},
+			exists:  []string{"/etc/issue", "/usr/bin/sh"},
+			missing: []string{"/etc/motd", "/etc/hostname"},
+		},
+		{
+			name:    "ReplaceAtRoot",
+			base:    []string{"/init"},
+			archive: []string{"init"},
+			changes: []LayerChange{{"replaced", "/init", "layer"}},
+			exists:  []string{"/init"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := NewMemoryDirectory()
+
+			for _, name := range tc.base {
+				if err := ApplyFragment(dir, contents(name), FragmentOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var archive ArrayArchive
+			for _, name := range tc.archive {
+				if name[len(name)-1] == '/' {
+					archive = append(archive, testEntry(t, name, nil))
+				} else {
+					archive = append(archive, testEntry(t, name, []byte("layer")))
+				}
+			}
+
+			var changes []LayerChange
+
+			if err := ApplyFragment(dir, config.Fragment{Archive: &config.ArchiveFragment{
+				HostFilename: "layer",
+				Target:       "/",
+			}}, FragmentOptions{
+				OpenArchive: func(filename string) (Archive, error) { return archive, nil },
+				OnChange:    func(change LayerChange) { changes = append(changes, change) },
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(changes, tc.changes) {
+				t.Errorf("expected changes %+v, got %+v", tc.changes, changes)
+			}
+
+			for _, name := range tc.exists {
+				if !Exists(dir, name) {
+					t.Errorf("expected %s to exist", name)
+				}
+			}
+
+			for _, name := range tc.missing {
+				if Exists(dir, name) {
+					t.Errorf("expected %s to be removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyFragmentDirectoryMetadata(t *testing.T) {
+	dir := NewMemoryDirectory()
+
+	apply := func(archive ArrayArchive) {
+		t.Helper()
+
+		if err := ApplyFragment(dir, config.Fragment{Archive: &config.ArchiveFragment{
+			HostFilename: "layer",
+			Target:       "/",
+		}}, FragmentOptions{
+			OpenArchive: func(filename string) (Archive, error) { return archive, nil },
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base := NewMemoryDirectory()
+	if err := base.SetXattrs(map[string][]byte{"user.base": []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	apply(ArrayArchive{
+		SimpleEntry{File: base, mode: fs.ModeDir | 0755, name: "data/", typeFlag: TypeDirectory},
+		testEntry(t, "data/file", []byte("base")),
+	})
+
+	layer := NewMemoryDirectory()
+	if err := layer.SetXattrs(map[string][]byte{"user.layer": []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later layer changes the mode, owner and xattrs of the directory.
+	apply(ArrayArchive{
+		SimpleEntry{File: layer, mode: fs.ModeDir | 0700, uid: 1000, gid: 1000, name: "data/", typeFlag: TypeDirectory},
+	})
+
+	ent, err := OpenPath(dir, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := ent.File
+
+	info, err := data.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode() != fs.ModeDir|0700 {
+		t.Errorf("expected mode %s, got %s", fs.ModeDir|0700, info.Mode())
+	}
+
+	uid, gid, err := GetUidAndGid(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uid != 1000 || gid != 1000 {
+		t.Errorf("expected owner 1000:1000, got %d:%d", uid, gid)
+	}
+
+	xattrs, err := GetXattrs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(xattrs, map[string][]byte{"user.layer": []byte("2")}) {
+		t.Errorf("expected the xattrs of the later layer, got %v", xattrs)
+	}
+
+	// The contents of the directory are merged.
+	if !Exists(dir, "/data/file") {
+		t.Error("expected /data/file to exist")
+	}
+}
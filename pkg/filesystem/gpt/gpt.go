@@ -0,0 +1,173 @@
+// Package gpt writes GUID partition tables.
+package gpt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SECTOR_SIZE = 512
+
+	HEADER_SIGNATURE = "EFI PART"
+	HEADER_REVISION  = 0x00010000
+	HEADER_SIZE      = 92
+
+	ENTRY_COUNT = 128
+	ENTRY_SIZE  = 128
+
+	// The number of sectors used by the partition entries.
+	ENTRY_SECTORS = ENTRY_COUNT * ENTRY_SIZE / SECTOR_SIZE
+
+	// Partitions are aligned to 1MiB like most partitioning tools.
+	ALIGNMENT = 1024 * 1024
+
+	MBR_TYPE_PROTECTIVE = 0xEE
+)
+
+var (
+	TYPE_EFI_SYSTEM       = uuid.MustParse("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	TYPE_LINUX_FILESYSTEM = uuid.MustParse("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+)
+
+type Partition struct {
+	Type uuid.UUID
+	GUID uuid.UUID
+	Name string
+
+	// The offset and size of the partition in bytes. Both must be a multiple
+	// of SECTOR_SIZE.
+	Start int64
+	Size  int64
+
+	Attributes uint64
+}
+
+// FirstUsableOffset returns the first byte after the primary table.
+func FirstUsableOffset() int64 {
+	return (2 + ENTRY_SECTORS) * SECTOR_SIZE
+}
+
+// LastUsableOffset returns the end of the space usable by partitions on a
+// disk of diskSize bytes. The backup table is stored after it.
+func LastUsableOffset(diskSize int64) int64 {
+	return diskSize - (1+ENTRY_SECTORS)*SECTOR_SIZE
+}
+
+// GUIDs are stored with the first three fields little endian.
+func encodeGUID(buf []byte, id uuid.UUID) {
+	binary.LittleEndian.PutUint32(buf[0:], binary.BigEndian.Uint32(id[0:]))
+	binary.LittleEndian.PutUint16(buf[4:], binary.BigEndian.Uint16(id[4:]))
+	binary.LittleEndian.PutUint16(buf[6:], binary.BigEndian.Uint16(id[6:]))
+	copy(buf[8:16], id[8:16])
+}
+
+func protectiveMBR(diskSectors int64) []byte {
+	mbr := make([]byte, SECTOR_SIZE)
+
+	entry := mbr[446:]
+
+	// Start at CHS 0/0/2 and end at the maximum CHS address.
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = MBR_TYPE_PROTECTIVE
+	copy(entry[5:8], []byte{0xFF, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	binary.LittleEndian.PutUint32(entry[12:], uint32(min(diskSectors-1, 0xFFFFFFFF)))
+
+	mbr[510] = 0x55
+	mbr[511] = 0xAA
+
+	return mbr
+}
+
+func header(diskGUID uuid.UUID, current int64, backup int64, entriesLba int64, lastUsable int64, entriesCrc uint32) []byte {
+	buf := make([]byte, SECTOR_SIZE)
+
+	copy(buf[0:8], HEADER_SIGNATURE)
+	binary.LittleEndian.PutUint32(buf[8:], HEADER_REVISION)
+	binary.LittleEndian.PutUint32(buf[12:], HEADER_SIZE)
+	binary.LittleEndian.PutUint64(buf[24:], uint64(current))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(backup))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(FirstUsableOffset()/SECTOR_SIZE))
+	binary.LittleEndian.PutUint64(buf[48:], uint64(lastUsable))
+	encodeGUID(buf[56:], diskGUID)
+	binary.LittleEndian.PutUint64(buf[72:], uint64(entriesLba))
+	binary.LittleEndian.PutUint32(buf[80:], ENTRY_COUNT)
+	binary.LittleEndian.PutUint32(buf[84:], ENTRY_SIZE)
+	binary.LittleEndian.PutUint32(buf[88:], entriesCrc)
+
+	binary.LittleEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(buf[:HEADER_SIZE]))
+
+	return buf
+}
+
+// Write writes a protective MBR along with the primary and backup partition
+// tables for a disk of diskSize bytes. The contents of the partitions are
+// left untouched.
+func Write(w io.WriterAt, diskSize int64, diskGUID uuid.UUID, partitions []Partition) error {
+	if diskSize%SECTOR_SIZE != 0 {
+		return fmt.Errorf("gpt: disk size %d is not a multiple of the sector size", diskSize)
+	}
+
+	if len(partitions) > ENTRY_COUNT {
+		return fmt.Errorf("gpt: too many partitions: %d", len(partitions))
+	}
+
+	diskSectors := diskSize / SECTOR_SIZE
+	lastLba := diskSectors - 1
+	lastUsable := LastUsableOffset(diskSize)/SECTOR_SIZE - 1
+
+	entries := make([]byte, ENTRY_COUNT*ENTRY_SIZE)
+
+	for i, part := range partitions {
+		if part.Start%SECTOR_SIZE != 0 || part.Size%SECTOR_SIZE != 0 || part.Size <= 0 {
+			return fmt.Errorf("gpt: partition %s is not aligned to sectors", part.Name)
+		}
+
+		if part.Start < FirstUsableOffset() || part.Start+part.Size > LastUsableOffset(diskSize) {
+			return fmt.Errorf("gpt: partition %s does not fit on the disk", part.Name)
+		}
+
+		name := utf16.Encode([]rune(part.Name))
+		if len(name) > 36 {
+			return fmt.Errorf("gpt: partition name is too long: %s", part.Name)
+		}
+
+		entry := entries[i*ENTRY_SIZE:]
+
+		encodeGUID(entry[0:], part.Type)
+		encodeGUID(entry[16:], part.GUID)
+		binary.LittleEndian.PutUint64(entry[32:], uint64(part.Start/SECTOR_SIZE))
+		binary.LittleEndian.PutUint64(entry[40:], uint64((part.Start+part.Size)/SECTOR_SIZE-1))
+		binary.LittleEndian.PutUint64(entry[48:], part.Attributes)
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry[56+j*2:], c)
+		}
+	}
+
+	entriesCrc := crc32.ChecksumIEEE(entries)
+
+	backupEntriesLba := lastLba - ENTRY_SECTORS
+
+	for _, write := range []struct {
+		lba  int64
+		data []byte
+	}{
+		{0, protectiveMBR(diskSectors)},
+		{1, header(diskGUID, 1, lastLba, 2, lastUsable, entriesCrc)},
+		{2, entries},
+		{backupEntriesLba, entries},
+		{lastLba, header(diskGUID, lastLba, 1, backupEntriesLba, lastUsable, entriesCrc)},
+	} {
+		if _, err := w.WriteAt(write.data, write.lba*SECTOR_SIZE); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+// A in memory disk implementing io.WriterAt.
+type disk []byte
+
+func (d disk) WriteAt(p []byte, off int64) (int, error) {
+	return copy(d[off:], p), nil
+}
+
+func (d disk) sector(lba int64) []byte {
+	return d[lba*SECTOR_SIZE : (lba+1)*SECTOR_SIZE]
+}
+
+func decodeGUID(buf []byte) uuid.UUID {
+	var id uuid.UUID
+
+	binary.BigEndian.PutUint32(id[0:], binary.LittleEndian.Uint32(buf[0:]))
+	binary.BigEndian.PutUint16(id[4:], binary.LittleEndian.Uint16(buf[4:]))
+	binary.BigEndian.PutUint16(id[6:], binary.LittleEndian.Uint16(buf[6:]))
+	copy(id[8:], buf[8:16])
+
+	return id
+}
+
+type parsedHeader struct {
+	current     uint64
+	backup      uint64
+	firstUsable uint64
+	lastUsable  uint64
+	diskGUID    uuid.UUID
+	entriesLba  uint64
+	entries     []byte
+}
+
+// Parse and check the header at lba and the entries it points to.
+func parseHeader(t *testing.T, d disk, lba int64) parsedHeader {
+	hdr := d.sector(lba)
+
+	if string(hdr[0:8]) != HEADER_SIGNATURE {
+		t.Fatalf("header at %d has signature %q", lba, hdr[0:8])
+	}
+
+	if rev := binary.LittleEndian.Uint32(hdr[8:]); rev != 0x00010000 {
+		t.Fatalf("header at %d has revision %x", lba, rev)
+	}
+
+	size := binary.LittleEndian.Uint32(hdr[12:])
+	if size != 92 {
+		t.Fatalf("header at %d has size %d", lba, size)
+	}
+
+	// The header CRC is calculated with the CRC field zeroed.
+	check := append([]byte{}, hdr[:size]...)
+	binary.LittleEndian.PutUint32(check[16:], 0)
+	if crc := crc32.ChecksumIEEE(check); crc != binary.LittleEndian.Uint32(hdr[16:]) {
+		t.Fatalf("header at %d has bad CRC", lba)
+	}
+
+	ret := parsedHeader{
+		current:     binary.LittleEndian.Uint64(hdr[24:]),
+		backup:      binary.LittleEndian.Uint64(hdr[32:]),
+		firstUsable: binary.LittleEndian.Uint64(hdr[40:]),
+		lastUsable:  binary.LittleEndian.Uint64(hdr[48:]),
+		diskGUID:    decodeGUID(hdr[56:]),
+		entriesLba:  binary.LittleEndian.Uint64(hdr[72:]),
+	}
+
+	count := binary.LittleEndian.Uint32(hdr[80:])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:])
+
+	if count != 128 || entrySize != 128 {
+		t.Fatalf("header at %d has %d entries of %d bytes", lba, count, entrySize)
+	}
+
+	start := int64(ret.entriesLba) * SECTOR_SIZE
+	ret.entries = d[start : start+int64(count*entrySize)]
+
+	if crc := crc32.ChecksumIEEE(ret.entries); crc != binary.LittleEndian.Uint32(hdr[88:]) {
+		t.Fatalf("entries of header at %d have bad CRC", lba)
+	}
+
+	return ret
+}
+
+func TestWrite(t *testing.T) {
+	const size = 64 * 1024 * 1024
+
+	diskGUID := uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef")
+	espGUID := uuid.New()
+	rootGUID := uuid.New()
+
+	d := make(disk, size)
+
+	if err := Write(d, size, diskGUID, []Partition{
+		{Type: TYPE_EFI_SYSTEM, GUID: espGUID, Name: "EFI System Partition", Start: 1024 * 1024, Size: 8 * 1024 * 1024},
+		{Type: TYPE_LINUX_FILESYSTEM, GUID: rootGUID, Name: "root", Start: 9 * 1024 * 1024, Size: 32 * 1024 * 1024, Attributes: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	mbr := d.sector(0)
+	if mbr[510] != 0x55 || mbr[511] != 0xAA || mbr[446+4] != 0xEE {
+		t.Fatal("missing protective MBR")
+	}
+	if lba := binary.LittleEndian.Uint32(mbr[446+8:]); lba != 1 {
+		t.Fatalf("protective partition starts at %d", lba)
+	}
+
+	lastLba := int64(size/SECTOR_SIZE - 1)
+
+	primary := parseHeader(t, d, 1)
+	backup := parseHeader(t, d, lastLba)
+
+	if primary.current != 1 || primary.backup != uint64(lastLba) || primary.entriesLba != 2 {
+		t.Fatalf("unexpected primary header: %+v", primary)
+	}
+
+	// The backup entries are just before the backup header at the end of
+	// the disk.
+	if backup.current != uint64(lastLba) || backup.backup != 1 || backup.entriesLba != uint64(lastLba-32) {
+		t.Fatalf("unexpected backup header: %+v", backup)
+	}
+
+	if primary.firstUsable != 34 || primary.lastUsable != uint64(lastLba-33) {
+		t.Fatalf("unexpected usable range: %d-%d", primary.firstUsable, primary.lastUsable)
+	}
+
+	if primary.diskGUID != diskGUID || backup.diskGUID != diskGUID {
+		t.Fatalf("unexpected disk GUID: %s", primary.diskGUID)
+	}
+
+	// The GUID is mixed endian on disk.
+	if hdr := d.sector(1); !bytes.Equal(hdr[56:64], []byte{0x67, 0x45, 0x23, 0x01, 0xab, 0x89, 0xef, 0xcd}) {
+		t.Fatalf("disk GUID is not mixed endian: %x", hdr[56:72])
+	}
+
+	if !bytes.Equal(primary.entries, backup.entries) {
+		t.Fatal("backup entries do not match the primary entries")
+	}
+
+	for i, expected := range []struct {
+		typ        uuid.UUID
+		guid       uuid.UUID
+		name       string
+		first      uint64
+		last       uint64
+		attributes uint64
+	}{
+		{TYPE_EFI_SYSTEM, espGUID, "EFI System Partition", 2048, 18431, 0},
+		{TYPE_LINUX_FILESYSTEM, rootGUID, "root", 18432, 83967, 1},
+	} {
+		entry := primary.entries[i*128 : (i+1)*128]
+
+		var name []uint16
+		for j := 56; j < 128; j += 2 {
+			c := binary.LittleEndian.Uint16(entry[j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+
+		if decodeGUID(entry[0:]) != expected.typ ||
+			decodeGUID(entry[16:]) != expected.guid ||
+			binary.LittleEndian.Uint64(entry[32:]) != expected.first ||
+			binary.LittleEndian.Uint64(entry[40:]) != expected.last ||
+			binary.LittleEndian.Uint64(entry[48:]) != expected.attributes ||
+			string(utf16.Decode(name)) != expected.name {
+			t.Fatalf("unexpected entry %d: %x", i, entry)
+		}
+	}
+
+	// The remaining entries are unused.
+	if !bytes.Equal(primary.entries[256:], make([]byte, 126*128)) {
+		t.Fatal("unused entries are not zero")
+	}
+
+	// Check the table with util-linux if it's installed.
+	if _, err := exec.LookPath("partx"); err == nil {
+		filename := filepath.Join(t.TempDir(), "disk.img")
+
+		if err := os.WriteFile(filename, d, os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := exec.Command("partx", "--show", "--output", "START,END,NAME", "--noheadings", filename).CombinedOutput()
+		if err != nil {
+			t.Fatalf("partx failed: %v\n%s", err, out)
+		}
+
+		if fields := strings.Fields(string(out)); strings.Join(fields, " ") != "2048 18431 EFI System Partition 18432 83967 root" {
+			t.Fatalf("unexpected partx output: %s", out)
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	const size = 16 * 1024 * 1024
+
+	for _, part := range []Partition{
+		// Overlaps the primary table.
+		{Name: "a", Start: 0, Size: 1024 * 1024},
+		// Overlaps the backup table.
+		{Name: "b", Start: 1024 * 1024, Size: size - 1024*1024},
+		// Not aligned to sectors.
+		{Name: "c", Start: 1024*1024 + 1, Size: 1024 * 1024},
+		{Name: strings.Repeat("d", 37), Start: 1024 * 1024, Size: 1024 * 1024},
+	} {
+		if err := Write(make(disk, size), size, uuid.Nil, []Partition{part}); err == nil {
+			t.Fatalf("expected an error for %+v", part)
+		}
+	}
+
+	if err := Write(make(disk, size), size+1, uuid.Nil, nil); err == nil {
+		t.Fatal("expected an error for a unaligned disk size")
+	}
+}
@@ -0,0 +1,125 @@
+package filesystem
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Archives can delete paths from earlier layers using OCI style whiteouts.
+// A file named .wh.<name> removes <name> from the same directory and a file
+// named .wh..wh..opq hides everything earlier layers put in its directory.
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = ".wh..wh..opq"
+)
+
+// ParseWhiteout returns the path removed by the whiteout file at p. opaque is
+// true if p hides the contents of its directory. ok is false if p isn't a
+// whiteout.
+func ParseWhiteout(p string) (target string, opaque bool, ok bool) {
+	dirname, base := path.Split(path.Clean(p))
+
+	if base == WhiteoutOpaque {
+		return path.Clean(dirname), true, true
+	}
+
+	if name, found := strings.CutPrefix(base, WhiteoutPrefix); found && name != "" {
+		return path.Join(dirname, name), false, true
+	}
+
+	return "", false, false
+}
+
+// Remove deletes the file, symlink or directory at p.
+func Remove(dir Directory, p string) error {
+	p = path.Clean(strings.TrimPrefix(p, "/"))
+	if p == "." {
+		return fmt.Errorf("can not remove the root directory")
+	}
+
+	parent, err := OpenDirectory(dir, path.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	return parent.Unlink(path.Base(p))
+}
+
+// OpenDirectory returns the directory at p following symlinks.
+func OpenDirectory(dir Directory, p string) (MutableDirectory, error) {
+	// Relative symlinks are resolved from the parent of p.
+	p = path.Clean(strings.TrimPrefix(p, "/"))
+
+	ent, err := OpenPath(dir, p)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := resolveDirectory(dir, ent.File, p)
+	if err != nil {
+		return nil, err
+	}
+
+	mut := getMutable(target)
+	if mut == nil {
+		return nil, fmt.Errorf("directory %T is not mutable", target)
+	}
+
+	return mut, nil
+}
+
+// ClearDirectory removes every child of the directory at p except the ones
+// keep returns true for. Returns the paths that were removed.
+func ClearDirectory(dir Directory, p string, keep func(name string) bool) ([]string, error) {
+	if !Exists(dir, p) {
+		// Nothing to clear.
+		return nil, nil
+	}
+
+	mut, err := OpenDirectory(dir, p)
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := mut.Readdir()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+
+	for _, child := range children {
+		if keep != nil && keep(child.Name) {
+			continue
+		}
+
+		if err := mut.Unlink(child.Name); err != nil {
+			return nil, err
+		}
+
+		removed = append(removed, path.Join(p, child.Name))
+	}
+
+	return removed, nil
+}
+
+// ReplaceChild creates f at p removing anything already there. Returns true if
+// an existing file was replaced.
+func ReplaceChild(dir Directory, p string, f File) (bool, error) {
+	replaced := false
+
+	if Exists(dir, p) {
+		if err := Remove(dir, p); err != nil {
+			return false, err
+		}
+
+		replaced = true
+	}
+
+	if err := CreateChild(dir, p, f); err != nil {
+		return false, err
+	}
+
+	return replaced, nil
+}
@@ -0,0 +1,29 @@
+package filesystem
+
+import "testing"
+
+func TestParseWhiteout(t *testing.T) {
+	for _, tc := range []struct {
+		path   string
+		target string
+		opaque bool
+		ok     bool
+	}{
+		{"/etc/.wh.motd", "/etc/motd", false, true},
+		{"etc/.wh.motd", "etc/motd", false, true},
+		{"/.wh.etc", "/etc", false, true},
+		{"/etc/.wh..wh..opq", "/etc", true, true},
+		{"/.wh..wh..opq", "/", true, true},
+		{"//etc//.wh.motd", "/etc/motd", false, true},
+		{"/etc/.wh.", "", false, false},
+		{"/etc/motd", "", false, false},
+		{"/etc/.wh.motd/file", "", false, false},
+		{"/etc/wh.motd", "", false, false},
+	} {
+		target, opaque, ok := ParseWhiteout(tc.path)
+		if target != tc.target || opaque != tc.opaque || ok != tc.ok {
+			t.Errorf("ParseWhiteout(%q) = %q, %v, %v; expected %q, %v, %v",
+				tc.path, target, opaque, ok, tc.target, tc.opaque, tc.ok)
+		}
+	}
+}
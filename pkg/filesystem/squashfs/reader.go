@@ -0,0 +1,696 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Reader reads the files in a squashfs image.
+type Reader struct {
+	r    io.ReaderAt
+	sb   Superblock
+	comp compressor
+
+	ids       []uint32
+	fragments []fragmentEntry
+
+	xattrKvStart uint64
+	xattrIds     []byte
+
+	// Decompressed metadata blocks keyed by their offset in the image along
+	// with the offset of the next block.
+	metadata map[uint64]metadataBlock
+}
+
+type metadataBlock struct {
+	data []byte
+	next uint64
+}
+
+// Inode is a inode read from a image.
+type Inode struct {
+	Num uint32
+
+	kind    int
+	perm    uint16
+	uid     uint32
+	gid     uint32
+	modTime uint32
+
+	links uint32
+	size  uint64
+
+	dirStart  uint64
+	dirOffset uint16
+
+	blocksStart uint64
+	blockSizes  []uint32
+	fragment    uint32
+	fragOffset  uint32
+
+	target string
+	device uint32
+
+	xattr uint32
+}
+
+// Mode returns the permissions and type of the inode.
+func (i *Inode) Mode() fs.FileMode {
+	mode := fs.FileMode(i.perm & 0o777)
+
+	if i.perm&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if i.perm&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if i.perm&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	switch i.kind {
+	case TYPE_DIR:
+		mode |= fs.ModeDir
+	case TYPE_SYMLINK:
+		mode |= fs.ModeSymlink
+	case TYPE_BLKDEV:
+		mode |= fs.ModeDevice
+	case TYPE_CHRDEV:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case TYPE_FIFO:
+		mode |= fs.ModeNamedPipe
+	case TYPE_SOCKET:
+		mode |= fs.ModeSocket
+	}
+
+	return mode
+}
+
+// Size returns the size of a regular file or the length of a symlink target.
+func (i *Inode) Size() int64 {
+	switch i.kind {
+	case TYPE_FILE:
+		return int64(i.size)
+	case TYPE_SYMLINK:
+		return int64(len(i.target))
+	default:
+		return 0
+	}
+}
+
+func (i *Inode) Uid() uint32        { return i.uid }
+func (i *Inode) Gid() uint32        { return i.gid }
+func (i *Inode) Links() uint32      { return i.links }
+func (i *Inode) ModTime() time.Time { return time.Unix(int64(i.modTime), 0) }
+
+// Target returns the target of a symlink.
+func (i *Inode) Target() string { return i.target }
+
+// DeviceNumbers returns the major and minor numbers of a device inode.
+func (i *Inode) DeviceNumbers() (uint32, uint32) {
+	return decodeDevice(i.device)
+}
+
+// OpenReader checks the superblock of r and reads the id and fragment tables.
+func OpenReader(r io.ReaderAt) (*Reader, error) {
+	ret := &Reader{r: r, metadata: make(map[uint64]metadataBlock)}
+
+	buf := make([]byte, SUPERBLOCK_SIZE)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	if err := ret.sb.unmarshal(buf); err != nil {
+		return nil, err
+	}
+
+	var err error
+
+	ret.comp, err = newCompressor(ret.sb.Compression, ret.sb.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := ret.readTable(ret.sb.IdTableStart, int(ret.sb.IdCount)*4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read id table: %w", err)
+	}
+
+	for i := 0; i < int(ret.sb.IdCount); i++ {
+		ret.ids = append(ret.ids, binary.LittleEndian.Uint32(ids[i*4:]))
+	}
+
+	if ret.sb.FragmentTableStart != INVALID_TABLE && ret.sb.FragmentCount > 0 {
+		fragments, err := ret.readTable(ret.sb.FragmentTableStart, int(ret.sb.FragmentCount)*16)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fragment table: %w", err)
+		}
+
+		ret.fragments = make([]fragmentEntry, ret.sb.FragmentCount)
+		if err := binary.Read(bytes.NewReader(fragments), binary.LittleEndian, ret.fragments); err != nil {
+			return nil, err
+		}
+	}
+
+	if ret.sb.XattrIdTableStart != INVALID_TABLE {
+		header := make([]byte, 16)
+		if _, err := r.ReadAt(header, int64(ret.sb.XattrIdTableStart)); err != nil {
+			return nil, fmt.Errorf("failed to read xattr table: %w", err)
+		}
+
+		ret.xattrKvStart = binary.LittleEndian.Uint64(header[0:])
+		count := binary.LittleEndian.Uint32(header[8:])
+
+		ret.xattrIds, err = ret.readTable(ret.sb.XattrIdTableStart+16, int(count)*16)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xattr id table: %w", err)
+		}
+	}
+
+	return ret, nil
+}
+
+func (r *Reader) readMetadataBlock(start uint64) (metadataBlock, error) {
+	if block, ok := r.metadata[start]; ok {
+		return block, nil
+	}
+
+	var header [2]byte
+	if _, err := r.r.ReadAt(header[:], int64(start)); err != nil {
+		return metadataBlock{}, fmt.Errorf("failed to read metadata block at %d: %w", start, err)
+	}
+
+	size := binary.LittleEndian.Uint16(header[:])
+	compressed := size&METADATA_UNCOMPRESSED == 0
+	size &^= METADATA_UNCOMPRESSED
+
+	data := make([]byte, size)
+	if _, err := r.r.ReadAt(data, int64(start)+2); err != nil {
+		return metadataBlock{}, fmt.Errorf("failed to read metadata block at %d: %w", start, err)
+	}
+
+	if compressed {
+		var err error
+
+		data, err = r.comp.decompress(data)
+		if err != nil {
+			return metadataBlock{}, fmt.Errorf("failed to decompress metadata block at %d: %w", start, err)
+		}
+	}
+
+	if len(data) > METADATA_SIZE {
+		return metadataBlock{}, fmt.Errorf("oversized metadata block at %d", start)
+	}
+
+	block := metadataBlock{data: data, next: start + 2 + uint64(size)}
+
+	r.metadata[start] = block
+
+	return block, nil
+}
+
+// Read length bytes of metadata starting at offset in the block at start.
+func (r *Reader) readMetadata(start uint64, offset int, length int) ([]byte, error) {
+	var ret []byte
+
+	for len(ret) < length {
+		block, err := r.readMetadataBlock(start)
+		if err != nil {
+			return nil, err
+		}
+
+		if offset > len(block.data) {
+			return nil, fmt.Errorf("metadata offset %d is outside of the block at %d", offset, start)
+		}
+
+		ret = append(ret, block.data[offset:min(len(block.data), offset+length-len(ret))]...)
+
+		start = block.next
+		offset = 0
+	}
+
+	return ret, nil
+}
+
+// metadataReader reads a stream of metadata crossing block boundaries.
+type metadataReader struct {
+	r      *Reader
+	start  uint64
+	offset int
+}
+
+func (m *metadataReader) read(length int) ([]byte, error) {
+	buf, err := m.r.readMetadata(m.start, m.offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	// Advance to the position after the read.
+	for length > 0 {
+		block, err := m.r.readMetadataBlock(m.start)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.offset+length < len(block.data) {
+			m.offset += length
+			break
+		}
+
+		length -= len(block.data) - m.offset
+		m.start = block.next
+		m.offset = 0
+	}
+
+	return buf, nil
+}
+
+func (m *metadataReader) readValues(values ...any) error {
+	for _, val := range values {
+		buf, err := m.read(binary.Size(val))
+		if err != nil {
+			return err
+		}
+
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read a table of length bytes stored as metadata blocks listed at start.
+func (r *Reader) readTable(start uint64, length int) ([]byte, error) {
+	blocks := (length + METADATA_SIZE - 1) / METADATA_SIZE
+
+	pointers := make([]byte, blocks*8)
+	if _, err := r.r.ReadAt(pointers, int64(start)); err != nil {
+		return nil, err
+	}
+
+	var ret []byte
+
+	for i := 0; i < blocks; i++ {
+		block, err := r.readMetadataBlock(binary.LittleEndian.Uint64(pointers[i*8:]))
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, block.data...)
+	}
+
+	if len(ret) < length {
+		return nil, fmt.Errorf("table at %d is truncated", start)
+	}
+
+	return ret[:length], nil
+}
+
+func (r *Reader) lookupId(idx uint16) (uint32, error) {
+	if int(idx) >= len(r.ids) {
+		return 0, fmt.Errorf("invalid id index: %d", idx)
+	}
+
+	return r.ids[idx], nil
+}
+
+// Root returns the root directory.
+func (r *Reader) Root() (*Inode, error) {
+	return r.ReadInode(r.sb.RootInode)
+}
+
+// ReadInode reads the inode with the given reference.
+func (r *Reader) ReadInode(ref uint64) (*Inode, error) {
+	m := &metadataReader{r: r, start: r.sb.InodeTableStart + ref>>16, offset: int(ref & 0xffff)}
+
+	var (
+		kind, perm, uid, gid uint16
+		inode                = &Inode{fragment: INVALID_FRAGMENT, xattr: INVALID_XATTR, links: 1}
+	)
+
+	if err := m.readValues(&kind, &perm, &uid, &gid, &inode.modTime, &inode.Num); err != nil {
+		return nil, err
+	}
+
+	inode.perm = perm
+
+	var err error
+
+	if inode.uid, err = r.lookupId(uid); err != nil {
+		return nil, err
+	}
+	if inode.gid, err = r.lookupId(gid); err != nil {
+		return nil, err
+	}
+
+	inode.kind = int(kind)
+	if inode.kind > TYPE_EXTENDED {
+		inode.kind -= TYPE_EXTENDED
+	}
+
+	switch kind {
+	case TYPE_DIR:
+		var (
+			start          uint32
+			size, offset   uint16
+			parent, nlinks uint32
+		)
+
+		err = m.readValues(&start, &nlinks, &size, &offset, &parent)
+
+		inode.links = nlinks
+		inode.dirStart = uint64(start)
+		inode.dirOffset = offset
+		inode.size = uint64(size)
+	case TYPE_DIR + TYPE_EXTENDED:
+		var (
+			nlinks, size, start, parent uint32
+			indexCount, offset          uint16
+		)
+
+		err = m.readValues(&nlinks, &size, &start, &parent, &indexCount, &offset, &inode.xattr)
+
+		inode.links = nlinks
+		inode.dirStart = uint64(start)
+		inode.dirOffset = offset
+		inode.size = uint64(size)
+	case TYPE_FILE:
+		var start, size uint32
+
+		err = m.readValues(&start, &inode.fragment, &inode.fragOffset, &size)
+
+		inode.blocksStart = uint64(start)
+		inode.size = uint64(size)
+	case TYPE_FILE + TYPE_EXTENDED:
+		var sparse uint64
+
+		err = m.readValues(&inode.blocksStart, &inode.size, &sparse, &inode.links, &inode.fragment, &inode.fragOffset, &inode.xattr)
+	case TYPE_SYMLINK, TYPE_SYMLINK + TYPE_EXTENDED:
+		var size uint32
+
+		if err = m.readValues(&inode.links, &size); err != nil {
+			break
+		}
+
+		var target []byte
+		if target, err = m.read(int(size)); err != nil {
+			break
+		}
+		inode.target = string(target)
+
+		if kind != TYPE_SYMLINK {
+			err = m.readValues(&inode.xattr)
+		}
+	case TYPE_BLKDEV, TYPE_CHRDEV, TYPE_BLKDEV + TYPE_EXTENDED, TYPE_CHRDEV + TYPE_EXTENDED:
+		err = m.readValues(&inode.links, &inode.device)
+		if err == nil && kind > TYPE_EXTENDED {
+			err = m.readValues(&inode.xattr)
+		}
+	case TYPE_FIFO, TYPE_SOCKET, TYPE_FIFO + TYPE_EXTENDED, TYPE_SOCKET + TYPE_EXTENDED:
+		err = m.readValues(&inode.links)
+		if err == nil && kind > TYPE_EXTENDED {
+			err = m.readValues(&inode.xattr)
+		}
+	default:
+		return nil, fmt.Errorf("unknown inode type: %d", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inode: %w", err)
+	}
+
+	if inode.kind == TYPE_FILE {
+		blocks := inode.size / uint64(r.sb.BlockSize)
+		if inode.fragment == INVALID_FRAGMENT && inode.size%uint64(r.sb.BlockSize) != 0 {
+			blocks += 1
+		}
+
+		inode.blockSizes = make([]uint32, blocks)
+		if err := m.readValues(inode.blockSizes); err != nil {
+			return nil, fmt.Errorf("failed to read block list: %w", err)
+		}
+	}
+
+	return inode, nil
+}
+
+// DirEntry is a entry in a directory.
+type DirEntry struct {
+	Name  string
+	Inode uint64
+}
+
+// ReadDir lists the entries in a directory.
+func (r *Reader) ReadDir(inode *Inode) ([]DirEntry, error) {
+	if inode.kind != TYPE_DIR {
+		return nil, fmt.Errorf("inode %d is not a directory", inode.Num)
+	}
+
+	m := &metadataReader{r: r, start: r.sb.DirectoryTableStart + inode.dirStart, offset: int(inode.dirOffset)}
+
+	// The size includes the . and .. entries which are not stored.
+	remaining := int64(inode.size) - 3
+
+	var ret []DirEntry
+
+	for remaining > 0 {
+		var count, start, num uint32
+
+		if err := m.readValues(&count, &start, &num); err != nil {
+			return nil, err
+		}
+		remaining -= 12
+
+		if count+1 > DIR_HEADER_MAX_ENTRIES {
+			return nil, fmt.Errorf("corrupt directory header in inode %d", inode.Num)
+		}
+
+		for i := uint32(0); i <= count; i++ {
+			var (
+				offset, kind, nameSize uint16
+				delta                  int16
+			)
+
+			if err := m.readValues(&offset, &delta, &kind, &nameSize); err != nil {
+				return nil, err
+			}
+
+			name, err := m.read(int(nameSize) + 1)
+			if err != nil {
+				return nil, err
+			}
+			remaining -= 8 + int64(nameSize) + 1
+
+			ret = append(ret, DirEntry{Name: string(name), Inode: uint64(start)<<16 | uint64(offset)})
+		}
+	}
+
+	return ret, nil
+}
+
+func (r *Reader) readDataBlock(start uint64, size uint32) ([]byte, error) {
+	compressed := size&DATA_UNCOMPRESSED == 0
+	size &^= DATA_UNCOMPRESSED
+
+	data := make([]byte, size)
+	if _, err := r.r.ReadAt(data, int64(start)); err != nil {
+		return nil, err
+	}
+
+	if compressed {
+		var err error
+
+		data, err = r.comp.decompress(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress block at %d: %w", start, err)
+		}
+	}
+
+	return data, nil
+}
+
+type fileReader struct {
+	r      *Reader
+	inode  *Inode
+	starts []uint64
+
+	// The last block read.
+	cached      int
+	cachedBlock []byte
+}
+
+func (f *fileReader) block(i int) ([]byte, error) {
+	if i == f.cached {
+		return f.cachedBlock, nil
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	blockSize := int(f.r.sb.BlockSize)
+
+	if i < len(f.inode.blockSizes) {
+		if f.inode.blockSizes[i] == 0 {
+			data = make([]byte, blockSize)
+		} else {
+			data, err = f.r.readDataBlock(f.starts[i], f.inode.blockSizes[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if int(f.inode.fragment) >= len(f.r.fragments) {
+			return nil, fmt.Errorf("invalid fragment index: %d", f.inode.fragment)
+		}
+
+		frag := f.r.fragments[f.inode.fragment]
+
+		fragment, err := f.r.readDataBlock(frag.Start, frag.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		tail := int(f.inode.size % uint64(blockSize))
+		if int(f.inode.fragOffset)+tail > len(fragment) {
+			return nil, fmt.Errorf("fragment %d is truncated", f.inode.fragment)
+		}
+
+		data = fragment[f.inode.fragOffset : int(f.inode.fragOffset)+tail]
+	}
+
+	f.cached = i
+	f.cachedBlock = data
+
+	return data, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	size := int64(f.inode.size)
+
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	blockSize := int64(f.r.sb.BlockSize)
+
+	n := 0
+
+	for len(p) > 0 && off < size {
+		data, err := f.block(int(off / blockSize))
+		if err != nil {
+			return n, err
+		}
+
+		blockOff := off % blockSize
+		if blockOff >= int64(len(data)) {
+			return n, fmt.Errorf("block %d of inode %d is truncated", off/blockSize, f.inode.Num)
+		}
+
+		copied := copy(p, data[blockOff:min(int64(len(data)), blockOff+size-off)])
+
+		p = p[copied:]
+		off += int64(copied)
+		n += copied
+	}
+
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Open returns a reader for the contents of a regular file.
+func (r *Reader) Open(inode *Inode) (*io.SectionReader, error) {
+	if inode.kind != TYPE_FILE {
+		return nil, fmt.Errorf("inode %d is not a regular file", inode.Num)
+	}
+
+	f := &fileReader{r: r, inode: inode, cached: -1}
+
+	start := inode.blocksStart
+	for _, size := range inode.blockSizes {
+		f.starts = append(f.starts, start)
+		start += uint64(size &^ DATA_UNCOMPRESSED)
+	}
+
+	return io.NewSectionReader(f, 0, int64(inode.size)), nil
+}
+
+// Xattrs returns the extended attributes of the inode.
+func (r *Reader) Xattrs(inode *Inode) (map[string][]byte, error) {
+	if inode.xattr == INVALID_XATTR {
+		return nil, nil
+	}
+
+	if int(inode.xattr)*16+16 > len(r.xattrIds) {
+		return nil, fmt.Errorf("invalid xattr index: %d", inode.xattr)
+	}
+
+	ent := r.xattrIds[inode.xattr*16:]
+
+	ref := binary.LittleEndian.Uint64(ent[0:])
+	count := binary.LittleEndian.Uint32(ent[8:])
+
+	m := &metadataReader{r: r, start: r.xattrKvStart + ref>>16, offset: int(ref & 0xffff)}
+
+	ret := make(map[string][]byte)
+
+	for i := uint32(0); i < count; i++ {
+		var kind, nameSize uint16
+
+		if err := m.readValues(&kind, &nameSize); err != nil {
+			return nil, err
+		}
+
+		name, err := m.read(int(nameSize))
+		if err != nil {
+			return nil, err
+		}
+
+		var valueSize uint32
+		if err := m.readValues(&valueSize); err != nil {
+			return nil, err
+		}
+
+		value, err := m.read(int(valueSize))
+		if err != nil {
+			return nil, err
+		}
+
+		if kind&XATTR_VALUE_OOL != 0 {
+			// The value is a reference to where the value is stored.
+			if len(value) != 8 {
+				return nil, fmt.Errorf("corrupt out of line xattr value")
+			}
+
+			ref := binary.LittleEndian.Uint64(value)
+			valueReader := &metadataReader{r: r, start: r.xattrKvStart + ref>>16, offset: int(ref & 0xffff)}
+
+			if err := valueReader.readValues(&valueSize); err != nil {
+				return nil, err
+			}
+
+			value, err = valueReader.read(int(valueSize))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		prefix := int(kind &^ XATTR_VALUE_OOL)
+		if prefix >= len(xattrPrefixes) {
+			return nil, fmt.Errorf("unknown xattr prefix: %d", prefix)
+		}
+
+		ret[xattrPrefixes[prefix]+string(name)] = value
+	}
+
+	return ret, nil
+}
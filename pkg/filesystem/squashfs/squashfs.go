@@ -0,0 +1,295 @@
+// Package squashfs reads and writes squashfs 4.0 images.
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/xi2/xz"
+)
+
+const (
+	SQUASHFS_MAGIC = 0x73717368
+
+	SUPERBLOCK_SIZE = 96
+
+	// The uncompressed size of a metadata block.
+	METADATA_SIZE = 8192
+
+	// Set in the header of a metadata block that is stored uncompressed.
+	METADATA_UNCOMPRESSED = 0x8000
+
+	// Set in the size of a data block or fragment that is stored uncompressed.
+	DATA_UNCOMPRESSED = 1 << 24
+
+	DEFAULT_BLOCK_SIZE = 128 * 1024
+
+	// Used for missing tables and missing fragments and xattrs.
+	INVALID_TABLE    = 0xFFFFFFFFFFFFFFFF
+	INVALID_FRAGMENT = 0xFFFFFFFF
+	INVALID_XATTR    = 0xFFFFFFFF
+
+	// The maximum number of entries after a directory header.
+	DIR_HEADER_MAX_ENTRIES = 256
+	MAX_NAME_LENGTH        = 256
+)
+
+// Superblock flags.
+const (
+	FLAG_UNCOMPRESSED_INODES    = 0x1
+	FLAG_UNCOMPRESSED_DATA      = 0x2
+	FLAG_UNCOMPRESSED_FRAGMENTS = 0x8
+	FLAG_NO_FRAGMENTS           = 0x10
+	FLAG_ALWAYS_FRAGMENTS       = 0x20
+	FLAG_DUPLICATES             = 0x40
+	FLAG_EXPORTABLE             = 0x80
+	FLAG_UNCOMPRESSED_XATTRS    = 0x100
+	FLAG_NO_XATTRS              = 0x200
+	FLAG_COMPRESSOR_OPTIONS     = 0x400
+	FLAG_UNCOMPRESSED_IDS       = 0x800
+)
+
+// Inode types. Extended types are the basic type plus 7.
+const (
+	TYPE_DIR     = 1
+	TYPE_FILE    = 2
+	TYPE_SYMLINK = 3
+	TYPE_BLKDEV  = 4
+	TYPE_CHRDEV  = 5
+	TYPE_FIFO    = 6
+	TYPE_SOCKET  = 7
+
+	TYPE_EXTENDED = 7
+)
+
+// Xattr name prefixes. Only these namespaces can be stored in a image.
+const (
+	XATTR_USER     = 0
+	XATTR_TRUSTED  = 1
+	XATTR_SECURITY = 2
+
+	// Set on the type when the value is a reference to a value stored elsewhere.
+	XATTR_VALUE_OOL = 0x100
+)
+
+var xattrPrefixes = []string{
+	XATTR_USER:     "user.",
+	XATTR_TRUSTED:  "trusted.",
+	XATTR_SECURITY: "security.",
+}
+
+type Compression uint16
+
+const (
+	CompressionGzip Compression = 1
+	CompressionLzma Compression = 2
+	CompressionLzo  Compression = 3
+	CompressionXz   Compression = 4
+	CompressionLz4  Compression = 5
+	CompressionZstd Compression = 6
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionLzma:
+		return "lzma"
+	case CompressionLzo:
+		return "lzo"
+	case CompressionXz:
+		return "xz"
+	case CompressionLz4:
+		return "lz4"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", c)
+	}
+}
+
+// ParseCompression returns the compression with the name used by mksquashfs.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	default:
+		return 0, fmt.Errorf("unsupported squashfs compression: %s", name)
+	}
+}
+
+type Superblock struct {
+	InodeCount          uint32
+	ModTime             uint32
+	BlockSize           uint32
+	FragmentCount       uint32
+	Compression         Compression
+	BlockLog            uint16
+	Flags               uint16
+	IdCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInode           uint64
+	BytesUsed           uint64
+	IdTableStart        uint64
+	XattrIdTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+func (sb *Superblock) marshal() []byte {
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.LittleEndian, uint32(SQUASHFS_MAGIC))
+	binary.Write(buf, binary.LittleEndian, sb)
+
+	return buf.Bytes()
+}
+
+func (sb *Superblock) unmarshal(buf []byte) error {
+	if len(buf) < SUPERBLOCK_SIZE {
+		return fmt.Errorf("short superblock")
+	}
+
+	if magic := binary.LittleEndian.Uint32(buf); magic != SQUASHFS_MAGIC {
+		return fmt.Errorf("not a squashfs image: bad magic %x", magic)
+	}
+
+	if err := binary.Read(bytes.NewReader(buf[4:]), binary.LittleEndian, sb); err != nil {
+		return err
+	}
+
+	if sb.VersionMajor != 4 || sb.VersionMinor != 0 {
+		return fmt.Errorf("unsupported squashfs version: %d.%d", sb.VersionMajor, sb.VersionMinor)
+	}
+
+	if sb.BlockSize != 1<<sb.BlockLog {
+		return fmt.Errorf("corrupt superblock: block size %d does not match log %d", sb.BlockSize, sb.BlockLog)
+	}
+
+	return nil
+}
+
+var errXzUnsupported = errors.New("writing xz compressed squashfs images is not supported")
+
+type compressor interface {
+	compress(src []byte) ([]byte, error)
+	decompress(src []byte) ([]byte, error)
+}
+
+type zlibCompressor struct{}
+
+// compress implements compressor.
+func (zlibCompressor) compress(src []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	w, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress implements compressor.
+func (zlibCompressor) decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// xzCompressor only supports reading images. There is no xz encoder
+// available so images written by mksquashfs with -comp xz can be opened but
+// not created.
+type xzCompressor struct {
+	blockSize uint32
+}
+
+// compress implements compressor.
+func (xzCompressor) compress(src []byte) ([]byte, error) {
+	return nil, errXzUnsupported
+}
+
+// decompress implements compressor.
+func (c xzCompressor) decompress(src []byte) ([]byte, error) {
+	// Linux limits the dictionary to the block size.
+	r, err := xz.NewReader(bytes.NewReader(src), c.blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// compress implements compressor.
+func (c *zstdCompressor) compress(src []byte) ([]byte, error) {
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+// decompress implements compressor.
+func (c *zstdCompressor) decompress(src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, nil)
+}
+
+func newCompressor(c Compression, blockSize uint32) (compressor, error) {
+	switch c {
+	case CompressionGzip:
+		return zlibCompressor{}, nil
+	case CompressionXz:
+		return xzCompressor{blockSize: blockSize}, nil
+	case CompressionZstd:
+		// Linux sizes the decompression window from the block size.
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(int(blockSize)),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return &zstdCompressor{enc: enc, dec: dec}, nil
+	default:
+		return nil, fmt.Errorf("unsupported squashfs compression: %s", c)
+	}
+}
+
+// Encode device numbers like new_encode_dev in Linux.
+func encodeDevice(major uint32, minor uint32) uint32 {
+	return (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+}
+
+func decodeDevice(dev uint32) (uint32, uint32) {
+	return (dev & 0xfff00) >> 8, (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
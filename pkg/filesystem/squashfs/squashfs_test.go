@@ -0,0 +1,375 @@
+package squashfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	goFs "io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func buildImage(t *testing.T, filename string, opts Options) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewWriter(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1700000000, 0)
+
+	dir := Header{Mode: goFs.ModeDir | 0755, ModTime: mtime}
+	file := Header{Mode: 0644, Uid: 1000, Gid: 100000, ModTime: mtime}
+
+	if err := w.Mkdir("/", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/etc", "/dev", "/big"} {
+		if err := w.Mkdir(name, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.CreateFile("/etc/hostname", Header{
+		Mode:    0644,
+		ModTime: mtime,
+		Xattrs: map[string][]byte{
+			"user.comment":     []byte("hello"),
+			"security.selinux": []byte("system_u:object_r:etc_t:s0"),
+			"system.ignored":   []byte("dropped"),
+		},
+	}, strings.NewReader("tinyrange\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateFile("/etc/large", file, bytes.NewReader(largeContents())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.CreateFile("/etc/sparse", file, bytes.NewReader(sparseContents())); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Link("/etc/hardlink", "/etc/hostname"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Symlink("/etc/localtime", "/usr/share/zoneinfo/UTC", Header{Mode: goFs.ModeSymlink | 0777, ModTime: mtime}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Mknod("/dev/null", Header{Mode: goFs.ModeDevice | goFs.ModeCharDevice | 0666, ModTime: mtime}, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Mknod("/dev/sda1", Header{Mode: goFs.ModeDevice | 0660, ModTime: mtime}, 8, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough entries to need several directory headers and metadata blocks.
+	for i := 0; i < 1000; i++ {
+		if err := w.CreateFile(fmt.Sprintf("/big/file%04d", i), file, strings.NewReader(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func largeContents() []byte {
+	var buf bytes.Buffer
+
+	for i := 0; buf.Len() < 300*1024; i++ {
+		fmt.Fprintf(&buf, "line %d\n", i)
+	}
+
+	return buf.Bytes()
+}
+
+func sparseContents() []byte {
+	buf := make([]byte, 3*DEFAULT_BLOCK_SIZE+10)
+	copy(buf[2*DEFAULT_BLOCK_SIZE:], "data")
+	return buf
+}
+
+func lookup(t *testing.T, r *Reader, name string) *Inode {
+	inode, err := r.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		ents, err := r.ReadDir(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+
+		for _, ent := range ents {
+			if ent.Name == part {
+				inode, err = r.ReadInode(ent.Inode)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Fatalf("%s not found", name)
+		}
+	}
+
+	return inode
+}
+
+func readFile(t *testing.T, r *Reader, name string) []byte {
+	f, err := r.Open(lookup(t, r, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, comp := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(comp.String(), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "image.sqfs")
+
+			buildImage(t, filename, Options{Compression: comp})
+
+			f, err := os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			r, err := OpenReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := string(readFile(t, r, "/etc/hostname")); got != "tinyrange\n" {
+				t.Fatalf("unexpected contents of /etc/hostname: %q", got)
+			}
+
+			if !bytes.Equal(readFile(t, r, "/etc/large"), largeContents()) {
+				t.Fatal("contents of /etc/large do not match")
+			}
+
+			if !bytes.Equal(readFile(t, r, "/etc/sparse"), sparseContents()) {
+				t.Fatal("contents of /etc/sparse do not match")
+			}
+
+			if got := string(readFile(t, r, "/big/file0999")); got != "999" {
+				t.Fatalf("unexpected contents of /big/file0999: %q", got)
+			}
+
+			hostname := lookup(t, r, "/etc/hostname")
+			hardlink := lookup(t, r, "/etc/hardlink")
+			if hostname.Num != hardlink.Num || hostname.Links() != 2 {
+				t.Fatalf("hard link not preserved: %d %d %d", hostname.Num, hardlink.Num, hostname.Links())
+			}
+
+			xattrs, err := r.Xattrs(hostname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(xattrs) != 2 || string(xattrs["user.comment"]) != "hello" || string(xattrs["security.selinux"]) != "system_u:object_r:etc_t:s0" {
+				t.Fatalf("unexpected xattrs: %v", xattrs)
+			}
+
+			large := lookup(t, r, "/etc/large")
+			if large.Uid() != 1000 || large.Gid() != 100000 || large.Mode() != 0644 {
+				t.Fatalf("unexpected metadata: %d %d %s", large.Uid(), large.Gid(), large.Mode())
+			}
+
+			localtime := lookup(t, r, "/etc/localtime")
+			if localtime.Mode()&goFs.ModeSymlink == 0 || localtime.Target() != "/usr/share/zoneinfo/UTC" {
+				t.Fatalf("unexpected symlink: %s %q", localtime.Mode(), localtime.Target())
+			}
+
+			null := lookup(t, r, "/dev/null")
+			if major, minor := null.DeviceNumbers(); null.Mode()&goFs.ModeCharDevice == 0 || major != 1 || minor != 3 {
+				t.Fatalf("unexpected device: %s %d:%d", null.Mode(), major, minor)
+			}
+
+			sda1 := lookup(t, r, "/dev/sda1")
+			if major, minor := sda1.DeviceNumbers(); sda1.Mode()&goFs.ModeCharDevice != 0 || major != 8 || minor != 300 {
+				t.Fatalf("unexpected device: %s %d:%d", sda1.Mode(), major, minor)
+			}
+
+			big := lookup(t, r, "/big")
+			ents, err := r.ReadDir(big)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ents) != 1000 {
+				t.Fatalf("expected 1000 entries, got %d", len(ents))
+			}
+		})
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	dir := t.TempDir()
+
+	buildImage(t, filepath.Join(dir, "a.sqfs"), Options{Compression: CompressionZstd})
+	buildImage(t, filepath.Join(dir, "b.sqfs"), Options{Compression: CompressionZstd})
+
+	a, err := os.ReadFile(filepath.Join(dir, "a.sqfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "b.sqfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a, b) {
+		t.Fatal("images are not identical")
+	}
+
+	if len(a)%4096 != 0 {
+		t.Fatalf("image size %d is not padded", len(a))
+	}
+}
+
+func TestNoFragments(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "image.sqfs")
+
+	buildImage(t, filename, Options{NoFragments: true, BlockSize: 4096})
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := OpenReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.sb.FragmentCount != 0 || r.sb.Flags&FLAG_NO_FRAGMENTS == 0 {
+		t.Fatalf("unexpected fragments: %d %x", r.sb.FragmentCount, r.sb.Flags)
+	}
+
+	if !bytes.Equal(readFile(t, r, "/etc/large"), largeContents()) {
+		t.Fatal("contents of /etc/large do not match")
+	}
+
+	if !bytes.Equal(readFile(t, r, "/etc/sparse"), sparseContents()) {
+		t.Fatal("contents of /etc/sparse do not match")
+	}
+}
+
+func TestXz(t *testing.T) {
+	if _, err := NewWriter(nil, Options{Compression: CompressionXz}); err == nil {
+		t.Fatal("expected writing xz images to fail")
+	}
+
+	xzPath, err := exec.LookPath("xz")
+	if err != nil {
+		t.Skip("xz not found")
+	}
+
+	// Blocks in images written by mksquashfs are xz streams with CRC32 checks
+	// and a dictionary no larger than the block size.
+	contents := largeContents()
+
+	cmd := exec.Command(xzPath, "--format=xz", "--check=crc32", fmt.Sprintf("--lzma2=dict=%d", DEFAULT_BLOCK_SIZE), "--stdout")
+	cmd.Stdin = bytes.NewReader(contents)
+
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comp, err := newCompressor(CompressionXz, DEFAULT_BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := comp.decompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, contents) {
+		t.Fatal("decompressed contents do not match")
+	}
+}
+
+func TestUnsquashfs(t *testing.T) {
+	unsquashfs, err := exec.LookPath("unsquashfs")
+	if err != nil {
+		t.Skip("unsquashfs not found")
+	}
+
+	for _, comp := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(comp.String(), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "image.sqfs")
+
+			buildImage(t, filename, Options{Compression: comp})
+
+			out, err := exec.Command(unsquashfs, "-d", "root", "-l", filename).CombinedOutput()
+			if err != nil {
+				t.Fatalf("unsquashfs failed: %v\n%s", err, out)
+			}
+
+			var got []string
+			for _, line := range strings.Split(string(out), "\n") {
+				if line == "root" || strings.HasPrefix(line, "root/") {
+					got = append(got, line)
+				}
+			}
+			sort.Strings(got)
+
+			expected := []string{
+				"root",
+				"root/big",
+				"root/dev",
+				"root/dev/null",
+				"root/dev/sda1",
+				"root/etc",
+				"root/etc/hardlink",
+				"root/etc/hostname",
+				"root/etc/large",
+				"root/etc/localtime",
+				"root/etc/sparse",
+			}
+			for i := 0; i < 1000; i++ {
+				expected = append(expected, fmt.Sprintf("root/big/file%04d", i))
+			}
+			sort.Strings(expected)
+
+			if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+				t.Fatalf("unexpected listing:\n%s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,912 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	// The compression used for data and metadata. Defaults to gzip.
+	Compression Compression
+
+	// The size of data blocks. Must be a power of two between 4K and 1M.
+	// Defaults to 128K.
+	BlockSize uint32
+
+	// Store the ends of files in full blocks rather than packing them into
+	// fragments.
+	NoFragments bool
+
+	// The modification time stored in the superblock.
+	ModTime time.Time
+}
+
+// Header holds the metadata of a entry added to a image.
+type Header struct {
+	Mode    fs.FileMode
+	Uid     uint32
+	Gid     uint32
+	ModTime time.Time
+
+	// Extended attributes keyed by their full name. Only the user, trusted
+	// and security namespaces can be stored in squashfs so others are
+	// dropped.
+	Xattrs map[string][]byte
+}
+
+// Convert the permission bits of mode to the Unix representation.
+func unixPermissions(mode fs.FileMode) uint16 {
+	perm := uint16(mode.Perm())
+
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 0o1000
+	}
+
+	return perm
+}
+
+type writerNode struct {
+	kind   int
+	header Header
+
+	children map[string]*writerNode
+
+	blocksStart uint64
+	blockSizes  []uint32
+	size        uint64
+	sparse      uint64
+	fragment    uint32
+	fragOffset  uint32
+
+	target string
+	device uint32
+
+	// The number of directory entries referencing the node.
+	links uint32
+
+	num     uint32
+	ref     uint64
+	written bool
+}
+
+// Metadata is stored in a series of blocks each holding up to 8K of
+// uncompressed data.
+type metadataWriter struct {
+	comp compressor
+	buf  []byte
+	out  bytes.Buffer
+
+	// The offset of each block in out.
+	blockStarts []uint64
+}
+
+// The reference to the next byte written. The upper bits hold the offset of
+// the block and the lower 16 bits hold the offset in the uncompressed block.
+func (m *metadataWriter) ref() uint64 {
+	return uint64(m.out.Len())<<16 | uint64(len(m.buf))
+}
+
+func (m *metadataWriter) flushBlock(block []byte) error {
+	m.blockStarts = append(m.blockStarts, uint64(m.out.Len()))
+
+	compressed, err := m.comp.compress(block)
+	if err != nil {
+		return err
+	}
+
+	header := uint16(len(compressed))
+	if len(compressed) >= len(block) {
+		compressed = block
+		header = uint16(len(block)) | METADATA_UNCOMPRESSED
+	}
+
+	binary.Write(&m.out, binary.LittleEndian, header)
+	m.out.Write(compressed)
+
+	return nil
+}
+
+func (m *metadataWriter) write(p []byte) error {
+	m.buf = append(m.buf, p...)
+
+	for len(m.buf) >= METADATA_SIZE {
+		if err := m.flushBlock(m.buf[:METADATA_SIZE]); err != nil {
+			return err
+		}
+
+		m.buf = slices.Clone(m.buf[METADATA_SIZE:])
+	}
+
+	return nil
+}
+
+func (m *metadataWriter) writeValues(values ...any) error {
+	buf := new(bytes.Buffer)
+
+	for _, val := range values {
+		if err := binary.Write(buf, binary.LittleEndian, val); err != nil {
+			return err
+		}
+	}
+
+	return m.write(buf.Bytes())
+}
+
+func (m *metadataWriter) flush() error {
+	if len(m.buf) > 0 {
+		if err := m.flushBlock(m.buf); err != nil {
+			return err
+		}
+
+		m.buf = nil
+	}
+
+	return nil
+}
+
+type fragmentEntry struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+// Writer creates a squashfs image. File contents are compressed and written
+// as they are added. The tables are written by Close.
+type Writer struct {
+	w      io.WriteSeeker
+	opts   Options
+	comp   compressor
+	offset uint64
+
+	root *writerNode
+
+	fragment  []byte
+	fragments []fragmentEntry
+
+	inodes     *metadataWriter
+	dirs       *metadataWriter
+	inodeCount uint32
+
+	ids     []uint32
+	idIndex map[uint32]uint16
+
+	xattrKv    *metadataWriter
+	xattrIds   []byte
+	xattrIndex map[string]uint32
+}
+
+// NewWriter returns a writer for a image starting at the current position of w.
+func NewWriter(w io.WriteSeeker, opts Options) (*Writer, error) {
+	if opts.Compression == 0 {
+		opts.Compression = CompressionGzip
+	}
+
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DEFAULT_BLOCK_SIZE
+	}
+
+	if opts.BlockSize < 4096 || opts.BlockSize > 1024*1024 || bits.OnesCount32(opts.BlockSize) != 1 {
+		return nil, fmt.Errorf("invalid squashfs block size: %d", opts.BlockSize)
+	}
+
+	if opts.Compression == CompressionXz {
+		return nil, errXzUnsupported
+	}
+
+	comp, err := newCompressor(opts.Compression, opts.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Writer{
+		w:    w,
+		opts: opts,
+		comp: comp,
+		root: &writerNode{
+			kind:     TYPE_DIR,
+			header:   Header{Mode: fs.ModeDir | 0755},
+			children: make(map[string]*writerNode),
+		},
+		idIndex:    make(map[uint32]uint16),
+		xattrIndex: make(map[string]uint32),
+	}
+
+	// Leave space for the superblock which is written by Close.
+	if err := ret.writeRaw(make([]byte, SUPERBLOCK_SIZE)); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (w *Writer) writeRaw(p []byte) error {
+	n, err := w.w.Write(p)
+	w.offset += uint64(n)
+	return err
+}
+
+// Compress and write a block. Returns the size stored in the block list.
+func (w *Writer) writeBlock(block []byte) (uint32, error) {
+	compressed, err := w.comp.compress(block)
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint32(len(compressed))
+	if len(compressed) >= len(block) {
+		compressed = block
+		size = uint32(len(block)) | DATA_UNCOMPRESSED
+	}
+
+	if err := w.writeRaw(compressed); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (w *Writer) flushFragment() error {
+	if len(w.fragment) == 0 {
+		return nil
+	}
+
+	start := w.offset
+
+	size, err := w.writeBlock(w.fragment)
+	if err != nil {
+		return err
+	}
+
+	w.fragments = append(w.fragments, fragmentEntry{Start: start, Size: size})
+	w.fragment = w.fragment[:0]
+
+	return nil
+}
+
+func (w *Writer) lookup(name string) (*writerNode, error) {
+	node := w.root
+
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+
+		if node.kind != TYPE_DIR {
+			return nil, fmt.Errorf("%s: not a directory", name)
+		}
+
+		child, ok := node.children[part]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+
+		node = child
+	}
+
+	return node, nil
+}
+
+func (w *Writer) add(name string, node *writerNode) error {
+	name = path.Clean("/" + name)
+
+	base := path.Base(name)
+	if base == "/" {
+		return fmt.Errorf("can not replace the root directory")
+	}
+
+	if len(base) > MAX_NAME_LENGTH {
+		return fmt.Errorf("name is too long: %s", base)
+	}
+
+	parent, err := w.lookup(path.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	if parent.kind != TYPE_DIR {
+		return fmt.Errorf("%s: not a directory", path.Dir(name))
+	}
+
+	if _, ok := parent.children[base]; ok {
+		return fmt.Errorf("%s: %w", name, fs.ErrExist)
+	}
+
+	node.links += 1
+	parent.children[base] = node
+
+	return nil
+}
+
+// Mkdir creates a directory. If the directory already exists its metadata is
+// replaced like extracting a archive over a existing tree.
+func (w *Writer) Mkdir(name string, hdr Header) error {
+	if node, err := w.lookup(name); err == nil && node.kind == TYPE_DIR {
+		node.header = hdr
+		return nil
+	}
+
+	return w.add(name, &writerNode{
+		kind:     TYPE_DIR,
+		header:   hdr,
+		children: make(map[string]*writerNode),
+	})
+}
+
+// CreateFile creates a regular file with the contents of r.
+func (w *Writer) CreateFile(name string, hdr Header, r io.Reader) error {
+	node := &writerNode{
+		kind:        TYPE_FILE,
+		header:      hdr,
+		blocksStart: w.offset,
+		fragment:    INVALID_FRAGMENT,
+	}
+
+	blockSize := int(w.opts.BlockSize)
+	buf := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		node.size += uint64(n)
+
+		chunk := buf[:n]
+
+		if n == blockSize && isZero(chunk) {
+			// Sparse blocks are stored with a size of 0.
+			node.blockSizes = append(node.blockSizes, 0)
+			node.sparse += uint64(n)
+		} else if n < blockSize && !w.opts.NoFragments {
+			// The tail is read after the blocks of the file so flushing the
+			// fragment here keeps the blocks contiguous.
+			if len(w.fragment)+n > blockSize {
+				if err := w.flushFragment(); err != nil {
+					return err
+				}
+			}
+
+			node.fragOffset = uint32(len(w.fragment))
+			node.fragment = uint32(len(w.fragments))
+			w.fragment = append(w.fragment, chunk...)
+		} else {
+			size, err := w.writeBlock(chunk)
+			if err != nil {
+				return err
+			}
+
+			node.blockSizes = append(node.blockSizes, size)
+		}
+
+		if n < blockSize {
+			break
+		}
+	}
+
+	return w.add(name, node)
+}
+
+// Symlink creates a symbolic link to target.
+func (w *Writer) Symlink(name string, target string, hdr Header) error {
+	return w.add(name, &writerNode{
+		kind:   TYPE_SYMLINK,
+		header: hdr,
+		target: target,
+	})
+}
+
+// Link creates a hard link to the existing file at target.
+func (w *Writer) Link(name string, target string) error {
+	node, err := w.lookup(target)
+	if err != nil {
+		return err
+	}
+
+	if node.kind == TYPE_DIR {
+		return fmt.Errorf("can not hard link to directory %s", target)
+	}
+
+	return w.add(name, node)
+}
+
+// Mknod creates a device, FIFO or socket. The type is taken from the mode of
+// the header.
+func (w *Writer) Mknod(name string, hdr Header, major uint32, minor uint32) error {
+	node := &writerNode{header: hdr}
+
+	switch mode := hdr.Mode; {
+	case mode&fs.ModeCharDevice != 0:
+		node.kind = TYPE_CHRDEV
+		node.device = encodeDevice(major, minor)
+	case mode&fs.ModeDevice != 0:
+		node.kind = TYPE_BLKDEV
+		node.device = encodeDevice(major, minor)
+	case mode&fs.ModeNamedPipe != 0:
+		node.kind = TYPE_FIFO
+	case mode&fs.ModeSocket != 0:
+		node.kind = TYPE_SOCKET
+	default:
+		return fmt.Errorf("mode %s is not a special file", mode)
+	}
+
+	return w.add(name, node)
+}
+
+func (w *Writer) idIndexOf(id uint32) (uint16, error) {
+	if idx, ok := w.idIndex[id]; ok {
+		return idx, nil
+	}
+
+	if len(w.ids) == math.MaxUint16+1 {
+		return 0, fmt.Errorf("too many unique uids and gids")
+	}
+
+	idx := uint16(len(w.ids))
+	w.ids = append(w.ids, id)
+	w.idIndex[id] = idx
+
+	return idx, nil
+}
+
+// Write the xattrs of a node and return the index in the xattr id table.
+// Identical sets of xattrs are only stored once.
+func (w *Writer) xattrIndexOf(xattrs map[string][]byte) (uint32, error) {
+	type xattr struct {
+		kind  uint16
+		name  string
+		value []byte
+	}
+
+	var list []xattr
+
+	for name, value := range xattrs {
+		for kind, prefix := range xattrPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				list = append(list, xattr{uint16(kind), name, value})
+				break
+			}
+		}
+	}
+
+	if len(list) == 0 {
+		return INVALID_XATTR, nil
+	}
+
+	slices.SortFunc(list, func(a, b xattr) int { return strings.Compare(a.name, b.name) })
+
+	key := new(strings.Builder)
+	for _, x := range list {
+		fmt.Fprintf(key, "%q=%q;", x.name, x.value)
+	}
+
+	if idx, ok := w.xattrIndex[key.String()]; ok {
+		return idx, nil
+	}
+
+	ref := w.xattrKv.ref()
+	size := 0
+
+	for _, x := range list {
+		suffix := strings.TrimPrefix(x.name, xattrPrefixes[x.kind])
+
+		if err := w.xattrKv.writeValues(x.kind, uint16(len(suffix)), []byte(suffix), uint32(len(x.value)), x.value); err != nil {
+			return 0, err
+		}
+
+		size += len(x.name) + 1 + len(x.value)
+	}
+
+	idx := uint32(len(w.xattrIds) / 16)
+
+	w.xattrIds = binary.LittleEndian.AppendUint64(w.xattrIds, ref)
+	w.xattrIds = binary.LittleEndian.AppendUint32(w.xattrIds, uint32(len(list)))
+	w.xattrIds = binary.LittleEndian.AppendUint32(w.xattrIds, uint32(size))
+
+	w.xattrIndex[key.String()] = idx
+
+	return idx, nil
+}
+
+// Number the nodes in the order they are written so each directory comes
+// after its children and the root is last.
+func (w *Writer) numberNodes(node *writerNode) {
+	if node.num != 0 {
+		return
+	}
+
+	for _, name := range sortedNames(node.children) {
+		w.numberNodes(node.children[name])
+	}
+
+	w.inodeCount += 1
+	node.num = w.inodeCount
+}
+
+func sortedNames(children map[string]*writerNode) []string {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+func (w *Writer) writeDirectory(node *writerNode) (uint64, uint32, error) {
+	ref := w.dirs.ref()
+	size := uint32(0)
+
+	names := sortedNames(node.children)
+
+	for len(names) > 0 {
+		first := node.children[names[0]]
+
+		count := 0
+		for count < len(names) && count < DIR_HEADER_MAX_ENTRIES {
+			child := node.children[names[count]]
+
+			// Every entry after a header has to be in the same inode block
+			// and within 32K of the header inode number.
+			delta := int64(child.num) - int64(first.num)
+			if child.ref>>16 != first.ref>>16 || delta < math.MinInt16 || delta > math.MaxInt16 {
+				break
+			}
+
+			count += 1
+		}
+
+		if err := w.dirs.writeValues(uint32(count-1), uint32(first.ref>>16), first.num); err != nil {
+			return 0, 0, err
+		}
+		size += 12
+
+		for _, name := range names[:count] {
+			child := node.children[name]
+
+			if err := w.dirs.writeValues(
+				uint16(child.ref&0xffff),
+				int16(int64(child.num)-int64(first.num)),
+				uint16(child.kind),
+				uint16(len(name)-1),
+				[]byte(name),
+			); err != nil {
+				return 0, 0, err
+			}
+			size += 8 + uint32(len(name))
+		}
+
+		names = names[count:]
+	}
+
+	return ref, size, nil
+}
+
+func (w *Writer) writeNode(node *writerNode, parent uint32) error {
+	if node.written {
+		return nil
+	}
+
+	var (
+		dirRef  uint64
+		dirSize uint32
+		subdirs uint32
+	)
+
+	if node.kind == TYPE_DIR {
+		for _, name := range sortedNames(node.children) {
+			child := node.children[name]
+
+			if child.kind == TYPE_DIR {
+				subdirs += 1
+			}
+
+			if err := w.writeNode(child, node.num); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		dirRef, dirSize, err = w.writeDirectory(node)
+		if err != nil {
+			return err
+		}
+	}
+
+	uid, err := w.idIndexOf(node.header.Uid)
+	if err != nil {
+		return err
+	}
+
+	gid, err := w.idIndexOf(node.header.Gid)
+	if err != nil {
+		return err
+	}
+
+	xattr, err := w.xattrIndexOf(node.header.Xattrs)
+	if err != nil {
+		return err
+	}
+
+	mtime := uint32(0)
+	if !node.header.ModTime.IsZero() {
+		mtime = uint32(max(node.header.ModTime.Unix(), 0))
+	}
+
+	extended := xattr != INVALID_XATTR
+
+	switch node.kind {
+	case TYPE_DIR:
+		// The size includes the . and .. entries which are not stored.
+		extended = extended || dirSize+3 > math.MaxUint16
+	case TYPE_FILE:
+		extended = extended || node.links > 1 || node.sparse != 0 ||
+			node.blocksStart > math.MaxUint32 || node.size > math.MaxUint32
+	}
+
+	kind := node.kind
+	if extended {
+		kind += TYPE_EXTENDED
+	}
+
+	node.ref = w.inodes.ref()
+
+	if err := w.inodes.writeValues(
+		uint16(kind),
+		unixPermissions(node.header.Mode),
+		uid,
+		gid,
+		mtime,
+		node.num,
+	); err != nil {
+		return err
+	}
+
+	switch kind {
+	case TYPE_DIR:
+		err = w.inodes.writeValues(
+			uint32(dirRef>>16), 2+subdirs, uint16(dirSize+3), uint16(dirRef&0xffff), parent,
+		)
+	case TYPE_DIR + TYPE_EXTENDED:
+		// No directory index is written so lookups scan the listing.
+		err = w.inodes.writeValues(
+			2+subdirs, dirSize+3, uint32(dirRef>>16), parent, uint16(0), uint16(dirRef&0xffff), xattr,
+		)
+	case TYPE_FILE:
+		err = w.inodes.writeValues(
+			uint32(node.blocksStart), node.fragment, node.fragOffset, uint32(node.size), node.blockSizes,
+		)
+	case TYPE_FILE + TYPE_EXTENDED:
+		err = w.inodes.writeValues(
+			node.blocksStart, node.size, node.sparse, node.links, node.fragment, node.fragOffset, xattr, node.blockSizes,
+		)
+	case TYPE_SYMLINK, TYPE_SYMLINK + TYPE_EXTENDED:
+		err = w.inodes.writeValues(node.links, uint32(len(node.target)), []byte(node.target))
+		if err == nil && extended {
+			err = w.inodes.writeValues(xattr)
+		}
+	case TYPE_BLKDEV, TYPE_CHRDEV, TYPE_BLKDEV + TYPE_EXTENDED, TYPE_CHRDEV + TYPE_EXTENDED:
+		err = w.inodes.writeValues(node.links, node.device)
+		if err == nil && extended {
+			err = w.inodes.writeValues(xattr)
+		}
+	case TYPE_FIFO, TYPE_SOCKET, TYPE_FIFO + TYPE_EXTENDED, TYPE_SOCKET + TYPE_EXTENDED:
+		err = w.inodes.writeValues(node.links)
+		if err == nil && extended {
+			err = w.inodes.writeValues(xattr)
+		}
+	default:
+		err = fmt.Errorf("unknown inode type: %d", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	node.written = true
+
+	return nil
+}
+
+// Write a table stored as metadata blocks followed by a list of pointers to
+// each block. Returns the offset of the pointer list.
+func (w *Writer) writeTable(entries []byte) (uint64, error) {
+	table := &metadataWriter{comp: w.comp}
+
+	if err := table.write(entries); err != nil {
+		return 0, err
+	}
+
+	if err := table.flush(); err != nil {
+		return 0, err
+	}
+
+	base := w.offset
+
+	if err := w.writeRaw(table.out.Bytes()); err != nil {
+		return 0, err
+	}
+
+	start := w.offset
+
+	var pointers []byte
+	for _, blockStart := range table.blockStarts {
+		pointers = binary.LittleEndian.AppendUint64(pointers, base+blockStart)
+	}
+
+	if err := w.writeRaw(pointers); err != nil {
+		return 0, err
+	}
+
+	return start, nil
+}
+
+// Close writes the inodes, directories and tables followed by the superblock.
+// The image is padded to a multiple of 4K so it can be used as a block device.
+func (w *Writer) Close() error {
+	if err := w.flushFragment(); err != nil {
+		return err
+	}
+
+	w.inodes = &metadataWriter{comp: w.comp}
+	w.dirs = &metadataWriter{comp: w.comp}
+	w.xattrKv = &metadataWriter{comp: w.comp}
+
+	w.numberNodes(w.root)
+
+	// The parent of the root directory is one past the last inode.
+	if err := w.writeNode(w.root, w.inodeCount+1); err != nil {
+		return err
+	}
+
+	sb := &Superblock{
+		InodeCount:         w.inodeCount,
+		BlockSize:          w.opts.BlockSize,
+		FragmentCount:      uint32(len(w.fragments)),
+		Compression:        w.opts.Compression,
+		BlockLog:           uint16(bits.TrailingZeros32(w.opts.BlockSize)),
+		IdCount:            uint16(len(w.ids)),
+		VersionMajor:       4,
+		VersionMinor:       0,
+		RootInode:          w.root.ref,
+		XattrIdTableStart:  INVALID_TABLE,
+		FragmentTableStart: INVALID_TABLE,
+		ExportTableStart:   INVALID_TABLE,
+	}
+
+	if !w.opts.ModTime.IsZero() {
+		sb.ModTime = uint32(max(w.opts.ModTime.Unix(), 0))
+	}
+
+	if w.opts.NoFragments {
+		sb.Flags |= FLAG_NO_FRAGMENTS
+	}
+
+	if len(w.xattrIds) == 0 {
+		sb.Flags |= FLAG_NO_XATTRS
+	}
+
+	for _, table := range []*metadataWriter{w.inodes, w.dirs} {
+		if err := table.flush(); err != nil {
+			return err
+		}
+	}
+
+	sb.InodeTableStart = w.offset
+	if err := w.writeRaw(w.inodes.out.Bytes()); err != nil {
+		return err
+	}
+
+	sb.DirectoryTableStart = w.offset
+	if err := w.writeRaw(w.dirs.out.Bytes()); err != nil {
+		return err
+	}
+
+	var err error
+
+	if len(w.fragments) > 0 {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, w.fragments)
+
+		sb.FragmentTableStart, err = w.writeTable(buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	ids := new(bytes.Buffer)
+	binary.Write(ids, binary.LittleEndian, w.ids)
+
+	sb.IdTableStart, err = w.writeTable(ids.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if len(w.xattrIds) > 0 {
+		if err := w.xattrKv.flush(); err != nil {
+			return err
+		}
+
+		kvStart := w.offset
+		if err := w.writeRaw(w.xattrKv.out.Bytes()); err != nil {
+			return err
+		}
+
+		idTable := &metadataWriter{comp: w.comp}
+		if err := idTable.write(w.xattrIds); err != nil {
+			return err
+		}
+		if err := idTable.flush(); err != nil {
+			return err
+		}
+
+		base := w.offset
+		if err := w.writeRaw(idTable.out.Bytes()); err != nil {
+			return err
+		}
+
+		sb.XattrIdTableStart = w.offset
+
+		header := binary.LittleEndian.AppendUint64(nil, kvStart)
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(w.xattrIds)/16))
+		header = binary.LittleEndian.AppendUint32(header, 0)
+		for _, blockStart := range idTable.blockStarts {
+			header = binary.LittleEndian.AppendUint64(header, base+blockStart)
+		}
+
+		if err := w.writeRaw(header); err != nil {
+			return err
+		}
+	}
+
+	sb.BytesUsed = w.offset
+
+	if pad := (4096 - w.offset%4096) % 4096; pad > 0 {
+		if err := w.writeRaw(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+
+	end := int64(w.offset)
+
+	if _, err := w.w.Seek(-end, io.SeekCurrent); err != nil {
+		return err
+	}
+
+	if _, err := w.w.Write(sb.marshal()); err != nil {
+		return err
+	}
+
+	if _, err := w.w.Seek(end-SUPERBLOCK_SIZE, io.SeekCurrent); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
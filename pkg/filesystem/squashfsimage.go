@@ -0,0 +1,146 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/filesystem/squashfs"
+)
+
+type squashfsFile struct {
+	r     *squashfs.Reader
+	inode *squashfs.Inode
+}
+
+// Digest implements File.
+func (e *squashfsFile) Digest() *FileDigest { return nil }
+
+// Open implements File.
+func (e *squashfsFile) Open() (FileHandle, error) {
+	// Symlinks are read as their target like the other File implementations.
+	if e.inode.Mode()&fs.ModeSymlink != 0 {
+		return NewNopCloserFileHandle(bytes.NewReader([]byte(e.inode.Target()))), nil
+	}
+
+	if !e.inode.Mode().IsRegular() {
+		return nil, fmt.Errorf("inode %d is not a regular file", e.inode.Num)
+	}
+
+	f, err := e.r.Open(e.inode)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNopCloserFileHandle(f), nil
+}
+
+// Stat implements File.
+func (e *squashfsFile) Stat() (FileInfo, error) { return e, nil }
+
+func (e *squashfsFile) Kind() FileType     { return FileTypeFromMode(e.inode.Mode()) }
+func (e *squashfsFile) IsDir() bool        { return e.inode.Mode().IsDir() }
+func (e *squashfsFile) ModTime() time.Time { return e.inode.ModTime() }
+func (e *squashfsFile) Mode() fs.FileMode  { return e.inode.Mode() }
+func (e *squashfsFile) Name() string       { return "" }
+func (e *squashfsFile) Sys() any           { return e }
+
+// Size implements FileInfo. Only regular files and symlinks have contents.
+func (e *squashfsFile) Size() int64 {
+	mode := e.inode.Mode()
+	if !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+		return 0
+	}
+
+	return e.inode.Size()
+}
+
+var (
+	_ File     = &squashfsFile{}
+	_ FileInfo = &squashfsFile{}
+)
+
+type squashfsDirectory struct {
+	squashfsFile
+}
+
+// GetChild implements Directory.
+func (e *squashfsDirectory) GetChild(name string) (DirectoryEntry, error) {
+	ents, err := e.Readdir()
+	if err != nil {
+		return DirectoryEntry{}, err
+	}
+
+	for _, ent := range ents {
+		if ent.Name == name {
+			return ent, nil
+		}
+	}
+
+	return DirectoryEntry{}, fs.ErrNotExist
+}
+
+// Readdir implements Directory.
+func (e *squashfsDirectory) Readdir() ([]DirectoryEntry, error) {
+	ents, err := e.r.ReadDir(e.inode)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []DirectoryEntry
+
+	for _, ent := range ents {
+		f, err := openSquashfsInode(e.r, ent.Inode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", ent.Name, err)
+		}
+
+		ret = append(ret, DirectoryEntry{File: f, Name: ent.Name})
+	}
+
+	return ret, nil
+}
+
+var (
+	_ Directory = &squashfsDirectory{}
+)
+
+func openSquashfsInode(r *squashfs.Reader, ref uint64) (File, error) {
+	inode, err := r.ReadInode(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSquashfsFile(r, inode), nil
+}
+
+func newSquashfsFile(r *squashfs.Reader, inode *squashfs.Inode) File {
+	if inode.Mode().IsDir() {
+		return &squashfsDirectory{squashfsFile{r: r, inode: inode}}
+	}
+
+	return &squashfsFile{r: r, inode: inode}
+}
+
+// OpenSquashfsImage returns the root directory of a squashfs image. Files are read
+// lazily from r so it must stay open while the directory is in use.
+func OpenSquashfsImage(r io.ReaderAt) (Directory, error) {
+	reader, err := squashfs.OpenReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	inode, err := reader.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, ok := newSquashfsFile(reader, inode).(Directory)
+	if !ok {
+		return nil, fmt.Errorf("root inode is not a directory")
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,43 @@
+package filesystem
+
+import "strings"
+
+// Tar archives store extended attributes as PAX records with this prefix
+// followed by the attribute name.
+const PAXXattrPrefix = "SCHILY.xattr."
+
+// XattrsFromPAX returns the extended attributes in the PAX records of a tar
+// header or nil if there are none.
+func XattrsFromPAX(records map[string]string) map[string][]byte {
+	var ret map[string][]byte
+
+	for key, value := range records {
+		name, ok := strings.CutPrefix(key, PAXXattrPrefix)
+		if !ok || name == "" {
+			continue
+		}
+
+		if ret == nil {
+			ret = make(map[string][]byte)
+		}
+
+		ret[name] = []byte(value)
+	}
+
+	return ret
+}
+
+// XattrsToPAX converts extended attributes into PAX records for a tar header.
+func XattrsToPAX(xattrs map[string][]byte) map[string]string {
+	if len(xattrs) == 0 {
+		return nil
+	}
+
+	ret := make(map[string]string)
+
+	for name, value := range xattrs {
+		ret[PAXXattrPrefix+name] = string(value)
+	}
+
+	return ret
+}
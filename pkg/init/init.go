@@ -3,10 +3,12 @@ package init
 import (
 	_ "embed"
 	"fmt"
+	"io/fs"
 	"os"
 
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
 )
 
 //go:embed init
@@ -36,3 +38,50 @@ func GetInitExecutable(arch config.CPUArchitecture) ([]byte, error) {
 		return buf, nil
 	}
 }
+
+// BuiltinFile returns the file for a builtin fragment.
+func BuiltinFile(builtin config.BuiltinFragment) (filesystem.File, error) {
+	switch builtin.Name {
+	case "init":
+		exec, err := GetInitExecutable(builtin.Architecture)
+		if err != nil {
+			return nil, err
+		}
+
+		file := filesystem.NewMemoryFile(filesystem.TypeRegular)
+
+		if err := file.Overwrite(exec); err != nil {
+			return nil, err
+		}
+
+		if err := file.Chmod(fs.FileMode(0755)); err != nil {
+			return nil, err
+		}
+
+		return file, nil
+	case "init.star":
+		file := filesystem.NewMemoryFile(filesystem.TypeRegular)
+
+		if err := file.Overwrite(INIT_SCRIPT); err != nil {
+			return nil, err
+		}
+
+		return file, nil
+	case "tinyrange":
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get executable: %w", err)
+		}
+
+		return filesystem.NewLocalFile(exe, nil), nil
+	case "tinyrange_qemu.star":
+		local, err := common.GetAdjacentExecutable("tinyrange_qemu.star")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tinyrange_qemu.star: %w", err)
+		}
+
+		return filesystem.NewLocalFile(local, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown builtin: %s", builtin.Name)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package instance
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start the supervisor in a new session so it survives the terminal closing.
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,315 @@
+// Package instance tracks virtual machines running in the background under a
+// supervisor process.
+//
+// Each instance has a directory in the runtime directory containing its
+// config, the captured console output and two unix sockets the supervisor
+// listens on. control.sock serves a small HTTP API used to stop the
+// instance and console.sock proxies the hypervisor console.
+package instance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type Instance struct {
+	// The name of the instance.
+	Name string `json:"name"`
+	// The process ID of the supervisor.
+	Pid int `json:"pid"`
+	// When the instance was started.
+	Started time.Time `json:"started"`
+	// The way the user interacts with the guest (ssh or serial).
+	Interaction string `json:"interaction"`
+	// The number of CPU cores allocated to the guest.
+	CPUCores int `json:"cpu_cores"`
+	// The amount of memory allocated to the guest in megabytes.
+	MemoryMB int `json:"memory_mb"`
+	// The host address forwarded to the SSH server in the guest.
+	SshAddress string `json:"ssh_address,omitempty"`
+	// Guest ports forwarded to the same port on localhost.
+	ForwardedPorts []int `json:"forwarded_ports,omitempty"`
+	// The unix socket of the QMP monitor of the hypervisor.
+	MonitorAddress string `json:"monitor_address,omitempty"`
+
+	dir string
+}
+
+// The directory holding the state of the instance.
+func (inst *Instance) Dir() string { return inst.dir }
+
+// The config the instance was started with.
+func (inst *Instance) ConfigFilename() string { return filepath.Join(inst.dir, "config.json") }
+
+// The captured console output of the hypervisor.
+func (inst *Instance) LogFilename() string { return filepath.Join(inst.dir, "console.log") }
+
+func (inst *Instance) consoleSocket() string    { return filepath.Join(inst.dir, "console.sock") }
+func (inst *Instance) controlSocket() string    { return filepath.Join(inst.dir, "control.sock") }
+func (inst *Instance) metadataFilename() string { return filepath.Join(inst.dir, "instance.json") }
+
+// Save writes the instance metadata so it can be seen by other processes.
+func (inst *Instance) Save() error {
+	metadata, err := json.MarshalIndent(inst, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(inst.metadataFilename()+".tmp", metadata, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(inst.metadataFilename()+".tmp", inst.metadataFilename())
+}
+
+// A HTTP client that talks to the supervisor over the control socket.
+func (inst *Instance) controlClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", inst.controlSocket())
+			},
+		},
+	}
+}
+
+// Alive returns true if the supervisor is running and answering requests.
+func (inst *Instance) Alive() bool {
+	resp, err := inst.controlClient(1 * time.Second).Get("http://supervisor/v1/status")
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// DialConsole connects to the hypervisor console.
+func (inst *Instance) DialConsole() (net.Conn, error) {
+	return net.Dial("unix", inst.consoleSocket())
+}
+
+// Stop asks the supervisor to shutdown the guest gracefully waiting up to
+// timeout before the hypervisor is stopped. If the supervisor doesn't respond
+// it's killed.
+func (inst *Instance) Stop(timeout time.Duration) error {
+	resp, err := inst.controlClient(timeout+10*time.Second).Post(
+		fmt.Sprintf("http://supervisor/v1/stop?timeout=%d", int(timeout.Seconds())),
+		"text/plain", nil,
+	)
+	if err == nil {
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return inst.Remove()
+		}
+	}
+
+	if inst.Pid != 0 {
+		proc, err := os.FindProcess(inst.Pid)
+		if err == nil {
+			proc.Kill()
+		}
+	}
+
+	return inst.Remove()
+}
+
+// Remove deletes the state of the instance.
+func (inst *Instance) Remove() error {
+	return os.RemoveAll(inst.dir)
+}
+
+// DefaultRuntimeDir returns the directory instances are tracked in. It's not
+// shared between users.
+func DefaultRuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tinyrange")
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tinyrange-%d", os.Getuid()))
+}
+
+func generateName() (string, error) {
+	buf := make([]byte, 4)
+
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return "vm-" + hex.EncodeToString(buf), nil
+}
+
+// New creates the state for a new instance. If name is "" a name is
+// generated.
+func New(runtimeDir string, name string) (*Instance, error) {
+	if name == "" {
+		var err error
+
+		name, err = generateName()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid instance name: %q", name)
+	}
+
+	dir := filepath.Join(runtimeDir, name)
+
+	if ok, _ := common.Exists(dir); ok {
+		if existing, err := Get(runtimeDir, name); err == nil && existing.Alive() {
+			return nil, fmt.Errorf("instance %s is already running", name)
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Instance{Name: name, Started: time.Now(), dir: dir}, nil
+}
+
+// Open returns a instance created with New from inside the supervisor before
+// its metadata has been saved.
+func Open(runtimeDir string, name string) (*Instance, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid instance name: %q", name)
+	}
+
+	dir := filepath.Join(runtimeDir, name)
+
+	if ok, _ := common.Exists(dir); !ok {
+		return nil, fmt.Errorf("instance %s does not exist", name)
+	}
+
+	return &Instance{Name: name, Started: time.Now(), dir: dir}, nil
+}
+
+// Get looks up a instance by name.
+func Get(runtimeDir string, name string) (*Instance, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid instance name: %q", name)
+	}
+
+	inst := &Instance{dir: filepath.Join(runtimeDir, name)}
+
+	metadata, err := os.ReadFile(inst.metadataFilename())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("instance %s does not exist", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(metadata, inst); err != nil {
+		return nil, fmt.Errorf("failed to read instance %s: %w", name, err)
+	}
+
+	return inst, nil
+}
+
+// List returns all running instances sorted by name. The state of instances
+// whose supervisor has exited is removed.
+func List(runtimeDir string) ([]*Instance, error) {
+	ents, err := os.ReadDir(runtimeDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ret []*Instance
+
+	for _, ent := range ents {
+		if !ent.IsDir() || strings.HasPrefix(ent.Name(), ".") {
+			continue
+		}
+
+		inst, err := Get(runtimeDir, ent.Name())
+		if err != nil {
+			// The supervisor might still be starting.
+			continue
+		}
+
+		if !inst.Alive() {
+			inst.Remove()
+			continue
+		}
+
+		ret = append(ret, inst)
+	}
+
+	return ret, nil
+}
+
+// The output of the supervisor process itself.
+func (inst *Instance) supervisorLogFilename() string {
+	return filepath.Join(inst.dir, "supervisor.log")
+}
+
+// Start runs exe with args as the supervisor of the instance in the
+// background and waits until it's ready. The supervisor is expected to call
+// Serve and then Save.
+func (inst *Instance) Start(exe string, args []string) error {
+	out, err := os.Create(inst.supervisorLogFilename())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cmd := exec.Command(exe, args...)
+
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	setDetached(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start supervisor: %w", err)
+	}
+
+	exited := make(chan error, 1)
+
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case err := <-exited:
+			log, _ := os.ReadFile(inst.supervisorLogFilename())
+
+			return fmt.Errorf("supervisor exited before the instance started: %v\n%s", err, log)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if started, err := Get(filepath.Dir(inst.dir), inst.Name); err == nil && started.Alive() {
+			*inst = *started
+
+			// Let the supervisor outlive this process.
+			return cmd.Process.Release()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package instance
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set in the environment of the test binary when it's started as the
+// supervisor of a instance.
+const fakeSupervisorEnv = "TINYRANGE_TEST_SUPERVISOR"
+
+// Act like the supervisor and a hypervisor that echos console input. The
+// arguments are the runtime directory and the name of the instance.
+func runFakeSupervisor(runtimeDir string, name string) error {
+	inst, err := Open(runtimeDir, name)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+
+	console, err := inst.Serve(func(timeout time.Duration) error {
+		close(stopped)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+
+	if _, err := console.Write([]byte("hypervisor started\n")); err != nil {
+		return err
+	}
+
+	inst.Interaction = "serial"
+
+	if err := inst.Save(); err != nil {
+		return err
+	}
+
+	go io.Copy(console, console)
+
+	<-stopped
+
+	return nil
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeSupervisorEnv) != "" {
+		if err := runFakeSupervisor(os.Args[1], os.Args[2]); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestStartAttachStop(t *testing.T) {
+	runtimeDir := t.TempDir()
+
+	t.Setenv(fakeSupervisorEnv, "1")
+
+	inst, err := New(runtimeDir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inst.Start(os.Args[0], []string{runtimeDir, "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if inst.Pid == 0 || inst.Pid == os.Getpid() || inst.Interaction != "serial" {
+		t.Fatalf("unexpected instance: %+v", inst)
+	}
+
+	if _, err := New(runtimeDir, "test"); err == nil {
+		t.Fatal("expected creating a running instance to fail")
+	}
+
+	instances, err := List(runtimeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 1 || instances[0].Name != "test" {
+		t.Fatalf("unexpected instances: %+v", instances)
+	}
+
+	conn, err := inst.DialConsole()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Input is passed to the hypervisor which echos it back.
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "hello\n" {
+		t.Fatalf("expected the input to be echoed, got %q", line)
+	}
+
+	log, err := os.ReadFile(inst.LogFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(log), "hypervisor started\nhello\n") {
+		t.Fatalf("unexpected console log: %q", log)
+	}
+
+	if err := inst.Stop(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(inst.Dir()); !os.IsNotExist(err) {
+		t.Fatalf("expected the instance to be removed: %v", err)
+	}
+
+	if _, err := Get(runtimeDir, "test"); err == nil {
+		t.Fatal("expected the instance to be gone")
+	}
+}
+
+func TestConsoleSlowClient(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := os.Create(filepath.Join(dir, "console.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	console := &Console{log: log, clients: make(map[net.Conn]chan []byte)}
+	console.input, console.inputW = io.Pipe()
+	defer console.Close()
+
+	listen, err := net.Listen("unix", filepath.Join(dir, "console.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	go console.serve(listen)
+
+	// A client that never reads.
+	conn, err := net.Dial("unix", filepath.Join(dir, "console.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	clients := func() int {
+		console.mtx.Lock()
+		defer console.mtx.Unlock()
+
+		return len(console.clients)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); clients() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("client was never attached")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The hypervisor keeps writing even though the client has stopped
+	// reading.
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		chunk := make([]byte, 64*1024)
+		for i := 0; i < 4*consoleClientBuffer; i++ {
+			console.Write(chunk)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes to the console blocked on a slow client")
+	}
+
+	if n := clients(); n != 0 {
+		t.Fatalf("expected the slow client to be disconnected, got %d clients", n)
+	}
+}
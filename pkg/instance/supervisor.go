@@ -0,0 +1,180 @@
+package instance
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The number of writes buffered for each attached client. Clients that fall
+// further behind are disconnected so they can't stall the hypervisor.
+const consoleClientBuffer = 256
+
+// Console captures the output of the hypervisor to the console log and
+// copies it to all attached clients. Input from attached clients is passed to
+// the hypervisor.
+type Console struct {
+	log *os.File
+
+	mtx     sync.Mutex
+	clients map[net.Conn]chan []byte
+
+	input  *io.PipeReader
+	inputW *io.PipeWriter
+}
+
+// Write implements io.Writer.
+func (c *Console) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+
+	if len(c.clients) > 0 {
+		buf := bytes.Clone(p)
+
+		for conn, out := range c.clients {
+			select {
+			case out <- buf:
+			default:
+				slog.Debug("disconnecting slow console client")
+				c.removeClient(conn)
+			}
+		}
+	}
+
+	c.mtx.Unlock()
+
+	return c.log.Write(p)
+}
+
+// Must be called with mtx held.
+func (c *Console) removeClient(conn net.Conn) {
+	if out, ok := c.clients[conn]; ok {
+		close(out)
+		delete(c.clients, conn)
+	}
+
+	conn.Close()
+}
+
+// Copy the output of the hypervisor to conn until the client is removed.
+func (c *Console) writeClient(conn net.Conn, out chan []byte) {
+	for buf := range out {
+		if _, err := conn.Write(buf); err != nil {
+			// Stops the input loop which removes the client.
+			conn.Close()
+		}
+	}
+}
+
+// Read implements io.Reader.
+func (c *Console) Read(p []byte) (int, error) {
+	return c.input.Read(p)
+}
+
+func (c *Console) serve(listen net.Listener) {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+
+		out := make(chan []byte, consoleClientBuffer)
+
+		c.mtx.Lock()
+		c.clients[conn] = out
+		c.mtx.Unlock()
+
+		go c.writeClient(conn, out)
+
+		go func() {
+			// Errors just mean the client detached.
+			io.Copy(c.inputW, conn)
+
+			c.mtx.Lock()
+			c.removeClient(conn)
+			c.mtx.Unlock()
+		}()
+	}
+}
+
+func (c *Console) Close() error {
+	c.mtx.Lock()
+	for conn := range c.clients {
+		c.removeClient(conn)
+	}
+	c.mtx.Unlock()
+
+	c.inputW.Close()
+
+	return c.log.Close()
+}
+
+var (
+	_ io.ReadWriter = &Console{}
+)
+
+// Serve starts listening on the control and console sockets of the instance
+// from inside the supervisor. stop is called when the user requests the
+// instance be stopped and should only return once the guest has exited.
+func (inst *Instance) Serve(stop func(timeout time.Duration) error) (*Console, error) {
+	log, err := os.Create(inst.LogFilename())
+	if err != nil {
+		return nil, err
+	}
+
+	console := &Console{log: log, clients: make(map[net.Conn]chan []byte)}
+
+	console.input, console.inputW = io.Pipe()
+
+	consoleListen, err := net.Listen("unix", inst.consoleSocket())
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	go console.serve(consoleListen)
+
+	controlListen, err := net.Listen("unix", inst.controlSocket())
+	if err != nil {
+		log.Close()
+		consoleListen.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("POST /v1/stop", func(w http.ResponseWriter, r *http.Request) {
+		timeout, err := strconv.Atoi(r.URL.Query().Get("timeout"))
+		if err != nil {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+
+		if err := stop(time.Duration(timeout) * time.Second); err != nil {
+			slog.Warn("failed to stop instance", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	go func() {
+		if err := http.Serve(controlListen, mux); err != nil {
+			slog.Debug("control socket closed", "err", err)
+		}
+	}()
+
+	inst.Pid = os.Getpid()
+
+	return console, nil
+}
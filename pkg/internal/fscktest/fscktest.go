@@ -0,0 +1,21 @@
+// Package fscktest checks filesystem images written by tests.
+package fscktest
+
+import (
+	"os/exec"
+	"testing"
+)
+
+// Run e2fsck on a ext4 image if it's installed.
+func Check(t testing.TB, filename string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		t.Log("e2fsck not found, skipping check")
+		return
+	}
+
+	if out, err := exec.Command("e2fsck", "-fn", filename).CombinedOutput(); err != nil {
+		t.Fatalf("e2fsck failed: %v\n%s", err, out)
+	}
+}
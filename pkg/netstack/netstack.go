@@ -57,9 +57,10 @@ func generateMacAddress() (net.HardwareAddr, error) {
 }
 
 type NetworkInterface struct {
-	NetSend    string
-	NetRecv    string
-	MacAddress string
+	NetSend        string
+	NetRecv        string
+	MacAddress     string
+	HostMacAddress string
 
 	udpConn *net.UDPConn
 
@@ -201,13 +202,25 @@ func (ns *NetStack) ListenPacketInternal(network string, address string) (net.Pa
 }
 
 func (ns *NetStack) AttachNetworkInterface() (*NetworkInterface, error) {
-	nic := &NetworkInterface{}
-
 	hostMac, err := generateMacAddress()
 	if err != nil {
 		return nil, err
 	}
 
+	deviceMac, err := generateMacAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	return ns.AttachNetworkInterfaceWithAddresses(hostMac, deviceMac)
+}
+
+// Attach a network interface using fixed MAC addresses for the host and the
+// guest device. Used when restoring a snapshot since the guest has already
+// learned both addresses.
+func (ns *NetStack) AttachNetworkInterfaceWithAddresses(hostMac net.HardwareAddr, deviceMac net.HardwareAddr) (*NetworkInterface, error) {
+	nic := &NetworkInterface{}
+
 	ns.nextNicId += 1
 
 	nicId := tcpip.NICID(ns.nextNicId)
@@ -252,7 +265,7 @@ func (ns *NetStack) AttachNetworkInterface() (*NetworkInterface, error) {
 		tcpip.MaskFromBytes(make([]byte, 4)),
 	)
 	if addrErr != nil {
-		return nil, err
+		return nil, addrErr
 	}
 
 	ns.nStack.AddRoute(tcpip.Route{
@@ -326,11 +339,6 @@ func (ns *NetStack) AttachNetworkInterface() (*NetworkInterface, error) {
 		return nil, err
 	}
 
-	deviceMac, err := generateMacAddress()
-	if err != nil {
-		return nil, err
-	}
-
 	go func() {
 		for {
 			pkt := nic.channel.ReadContext(context.Background())
@@ -366,6 +374,7 @@ func (ns *NetStack) AttachNetworkInterface() (*NetworkInterface, error) {
 	}()
 
 	nic.MacAddress = deviceMac.String()
+	nic.HostMacAddress = hostMac.String()
 
 	ns.interfaces = append(ns.interfaces, nic)
 
@@ -0,0 +1,274 @@
+// Package snapshot stores the saved state of virtual machines so they can be
+// restored without booting and provisioning from scratch.
+//
+// Each snapshot is a directory containing a qcow2 overlay that receives all
+// guest writes along with the saved memory and device state, and the config
+// used to start the virtual machine. The overlay is backed by either a raw
+// image of the generated root filesystem stored next to it or the disk image
+// the virtual machine booted from.
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// The tag the state is saved under inside the overlay.
+const SNAPSHOT_TAG = "tinyrange"
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type Snapshot struct {
+	// The name of the snapshot.
+	Name string `json:"name"`
+	// When the snapshot was saved.
+	Created time.Time `json:"created"`
+	// The config the virtual machine was started with.
+	Config config.TinyRangeConfig `json:"config"`
+	// The MAC address of the guest network device.
+	MacAddress string `json:"mac_address"`
+	// The MAC address of the host side of the network. The guest has it in
+	// its ARP cache so it needs to stay the same.
+	HostMacAddress string `json:"host_mac_address"`
+
+	dir string
+	// Where the snapshot is renamed to when it's committed. Empty once the
+	// snapshot is in place.
+	target string
+}
+
+// The raw image of the generated root filesystem.
+func (s *Snapshot) BaseImage() string {
+	return filepath.Join(s.dir, "base.img")
+}
+
+// The qcow2 overlay that holds guest writes and the saved state.
+func (s *Snapshot) Overlay() string {
+	return filepath.Join(s.dir, "overlay.qcow2")
+}
+
+func (s *Snapshot) metadataFilename() string {
+	return filepath.Join(s.dir, "snapshot.json")
+}
+
+// Write the snapshot metadata and move the snapshot into place, replacing any
+// existing snapshot with the same name. Until this is called the snapshot
+// can't be restored.
+func (s *Snapshot) Commit() error {
+	s.Created = time.Now()
+
+	metadata, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(s.metadataFilename(), metadata, 0644); err != nil {
+		return err
+	}
+
+	if s.target == "" {
+		return nil
+	}
+
+	// A directory can't be renamed over a non-empty one so move the old
+	// snapshot aside first and only remove it once the new one is in place.
+	var old string
+	if ok, _ := common.Exists(s.target); ok {
+		old = s.dir + ".old"
+		if err := os.Rename(s.target, old); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(s.dir, s.target); err != nil {
+		if old != "" {
+			if err := os.Rename(old, s.target); err != nil {
+				slog.Warn("failed to restore old snapshot", "dir", old, "err", err)
+			}
+		}
+		return err
+	}
+
+	s.dir = s.target
+	s.target = ""
+
+	if old != "" {
+		if err := os.RemoveAll(old); err != nil {
+			slog.Warn("failed to remove old snapshot", "dir", old, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// Discard removes a snapshot that was never committed. It does nothing once
+// the snapshot has been committed.
+func (s *Snapshot) Discard() error {
+	if s.target == "" {
+		return nil
+	}
+
+	return os.RemoveAll(s.dir)
+}
+
+func snapshotDir(buildDir string) string {
+	return filepath.Join(buildDir, "snapshots")
+}
+
+// Create a new snapshot in a temporary directory next to the final one. Any
+// existing snapshot with the same name is kept until the new one is
+// committed.
+func Create(buildDir string, name string) (*Snapshot, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+
+	parent, err := filepath.Abs(snapshotDir(buildDir))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := common.Ensure(parent, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// Snapshot names can't start with a dot so this never collides with one.
+	dir, err := os.MkdirTemp(parent, "."+name+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{Name: name, dir: dir, target: filepath.Join(parent, name)}, nil
+}
+
+// Write a generated root filesystem to the base image of the snapshot.
+// Returns the filename of the base image.
+func (s *Snapshot) WriteBaseImage(root io.ReaderAt, size int64) (string, error) {
+	out, err := os.Create(s.BaseImage())
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if err := common.WriteSparse(out, root, size); err != nil {
+		return "", fmt.Errorf("failed to write base image: %w", err)
+	}
+
+	return s.BaseImage(), nil
+}
+
+// Create the qcow2 overlay on top of a backing disk image using qemu-img.
+// The backing image must not change while the snapshot exists.
+func (s *Snapshot) CreateOverlay(backing string, backingFormat string) error {
+	qemuImg, err := common.GetAdjacentExecutable("qemu-img")
+	if err != nil {
+		return fmt.Errorf("qemu-img is required to create snapshots: %w", err)
+	}
+
+	if backing == s.BaseImage() {
+		// The snapshot directory is renamed when it's committed so refer to
+		// the base image relative to the overlay.
+		backing = filepath.Base(backing)
+	} else {
+		backing, err = filepath.Abs(backing)
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command(qemuImg,
+		"create", "-f", "qcow2",
+		"-b", backing, "-F", backingFormat,
+		s.Overlay(),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create overlay: %w: %s", err, output)
+	}
+
+	return nil
+}
+
+// Get looks up a saved snapshot by name.
+func Get(buildDir string, name string) (*Snapshot, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+
+	dir, err := filepath.Abs(filepath.Join(snapshotDir(buildDir), name))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{dir: dir}
+
+	metadata, err := os.ReadFile(s.metadataFilename())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("snapshot %s does not exist", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(metadata, s); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", name, err)
+	}
+
+	return s, nil
+}
+
+// List returns all saved snapshots sorted by name.
+func List(buildDir string) ([]*Snapshot, error) {
+	ents, err := os.ReadDir(snapshotDir(buildDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ret []*Snapshot
+
+	for _, ent := range ents {
+		// Skip snapshots that are still being written.
+		if !ent.IsDir() || !validName.MatchString(ent.Name()) {
+			continue
+		}
+
+		// Skip snapshots that were never committed.
+		if ok, _ := common.Exists(filepath.Join(snapshotDir(buildDir), ent.Name(), "snapshot.json")); !ok {
+			continue
+		}
+
+		s, err := Get(buildDir, ent.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, s)
+	}
+
+	return ret, nil
+}
+
+// Remove deletes a snapshot and its disk images.
+func Remove(buildDir string, name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name: %q", name)
+	}
+
+	dir := filepath.Join(snapshotDir(buildDir), name)
+
+	if ok, _ := common.Exists(dir); !ok {
+		return fmt.Errorf("snapshot %s does not exist", name)
+	}
+
+	return os.RemoveAll(dir)
+}
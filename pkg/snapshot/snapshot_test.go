@@ -0,0 +1,115 @@
+package snapshot
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createWithBase(t *testing.T, buildDir string, name string, contents string) *Snapshot {
+	t.Helper()
+
+	s, err := Create(buildDir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.WriteBaseImage(bytes.NewReader([]byte(contents)), int64(len(contents))); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func readBase(t *testing.T, buildDir string, name string) string {
+	t.Helper()
+
+	s, err := Get(buildDir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(s.BaseImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(contents)
+}
+
+func TestCommitReplacesExisting(t *testing.T) {
+	buildDir := t.TempDir()
+
+	first := createWithBase(t, buildDir, "test", "first")
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := createWithBase(t, buildDir, "test", "second")
+
+	// The old snapshot stays usable until the new one is committed.
+	if got := readBase(t, buildDir, "test"); got != "first" {
+		t.Fatalf("base image before commit = %q, want %q", got, "first")
+	}
+
+	if err := second.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readBase(t, buildDir, "test"); got != "second" {
+		t.Fatalf("base image after commit = %q, want %q", got, "second")
+	}
+
+	if want := filepath.Join(snapshotDir(buildDir), "test", "base.img"); second.BaseImage() != want {
+		t.Fatalf("BaseImage() = %q, want %q", second.BaseImage(), want)
+	}
+
+	ents, err := os.ReadDir(snapshotDir(buildDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("snapshot directory has %d entries, want 1", len(ents))
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	buildDir := t.TempDir()
+
+	first := createWithBase(t, buildDir, "test", "first")
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := createWithBase(t, buildDir, "test", "second")
+
+	list, err := List(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("List() returned %d snapshots, want 1", len(list))
+	}
+
+	if err := second.Discard(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readBase(t, buildDir, "test"); got != "first" {
+		t.Fatalf("base image after discard = %q, want %q", got, "first")
+	}
+
+	// Discarding a committed snapshot does nothing.
+	if err := first.Discard(); err != nil {
+		t.Fatal(err)
+	}
+
+	ents, err := os.ReadDir(snapshotDir(buildDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Name() != "test" {
+		t.Fatalf("snapshot directory = %v, want only test", ents)
+	}
+}
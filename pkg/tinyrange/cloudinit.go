@@ -0,0 +1,100 @@
+package tinyrange
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tinyrange/tinyrange/pkg/cloudinit"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	virtualMachine "github.com/tinyrange/tinyrange/pkg/vm"
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// Work out the format of a disk image from it's header. Most cloud images use
+// qcow2 even when they have a .img extension.
+func detectDiskFormat(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to open disk image: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, len(qcow2Magic))
+
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", fmt.Errorf("failed to read disk image header: %w", err)
+	}
+
+	if bytes.Equal(header, qcow2Magic) {
+		return "qcow2", nil
+	}
+
+	return "raw", nil
+}
+
+// Write the seed to the build directory as a vfat image. The filename is
+// derived from the contents so unchanged seeds are reused.
+func (tr *TinyRange) writeCloudInitSeed(seed *cloudinit.Seed) (string, error) {
+	filename := filepath.Join(tr.buildDir, "cloudinit_"+seed.Hash()+".img")
+
+	if ok, _ := common.Exists(filename); ok {
+		return filename, nil
+	}
+
+	out, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return "", err
+	}
+
+	if err := seed.WriteFat(out); err != nil {
+		out.Close()
+		return "", err
+	}
+
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+func (tr *TinyRange) attachCloudInit(vm *virtualMachine.VirtualMachine, macAddress string) error {
+	seed, err := cloudinit.NewSeed(cloudinit.Options{
+		Hostname:          tr.metadata.hostname(),
+		SSHAuthorizedKeys: tr.cfg.SSHAuthorizedKeys,
+		MacAddress:        macAddress,
+		CloudInit:         *tr.cfg.CloudInit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to generate cloud-init seed: %w", err)
+	}
+
+	// The seed is always available from the metadata service.
+	tr.metadata.cloudInitSeed = seed
+
+	switch tr.cfg.CloudInit.Datasource {
+	case "", "disk":
+		filename, err := tr.writeCloudInitSeed(seed)
+		if err != nil {
+			return fmt.Errorf("failed to write cloud-init seed: %w", err)
+		}
+
+		tr.logger.Debug("attaching cloud-init seed", "filename", filename)
+
+		vm.SetCloudInit(filename, "")
+	case "http":
+		vm.SetCloudInit("", "http://10.42.0.1/nocloud/")
+	default:
+		return fmt.Errorf("unknown cloud-init datasource: %s", tr.cfg.CloudInit.Datasource)
+	}
+
+	return nil
+}
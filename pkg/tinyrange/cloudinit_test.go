@@ -0,0 +1,51 @@
+package tinyrange
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectDiskFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, tc := range []struct {
+		name     string
+		header   []byte
+		expected string
+	}{
+		{"cloud.qcow2", []byte{'Q', 'F', 'I', 0xfb, 0, 0, 0, 3}, "qcow2"},
+		// Cloud images often use .img for qcow2 images.
+		{"cloud.img", []byte{'Q', 'F', 'I', 0xfb, 0, 0, 0, 2}, "qcow2"},
+		{"disk.img", make([]byte, 512), "raw"},
+		{"short.img", []byte{'Q', 'F', 'I', 0xfb}, "qcow2"},
+	} {
+		filename := filepath.Join(dir, tc.name)
+		if err := os.WriteFile(filename, tc.header, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		format, err := detectDiskFormat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if format != tc.expected {
+			t.Fatalf("expected %s to be %s, got %s", tc.name, tc.expected, format)
+		}
+	}
+
+	// Images too short to have a header can't be used.
+	empty := filepath.Join(dir, "empty.img")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := detectDiskFormat(empty); err == nil {
+		t.Fatal("expected a empty image to fail")
+	}
+
+	if _, err := detectDiskFormat(filepath.Join(dir, "missing.img")); err == nil {
+		t.Fatal("expected a missing image to fail")
+	}
+}
@@ -0,0 +1,65 @@
+package tinyrange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/instance"
+	"github.com/tinyrange/tinyrange/pkg/netstack"
+	virtualMachine "github.com/tinyrange/tinyrange/pkg/vm"
+)
+
+// Run the virtual machine as a background instance. The console is captured
+// by the instance and the metadata is saved once the control socket is ready
+// so other processes can find it. Returns when the hypervisor exits.
+func (tr *TinyRange) runDetached(vm *virtualMachine.VirtualMachine, nic *netstack.NetworkInterface) error {
+	inst := tr.instance
+
+	console, err := inst.Serve(func(timeout time.Duration) error {
+		// A timeout of 0 asks for the guest to be stopped right away.
+		if timeout == 0 {
+			return vm.Shutdown()
+		}
+
+		return tr.shutdownGraceful(vm, "instance stopped", timeout)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start supervisor: %w", err)
+	}
+	defer console.Close()
+
+	tr.console = console
+
+	inst.CPUCores = tr.cfg.CPUCores
+	inst.MemoryMB = tr.cfg.MemoryMB
+
+	inst.MonitorAddress, err = vm.MonitorAddress()
+	if err != nil {
+		return err
+	}
+
+	if err := inst.Save(); err != nil {
+		return fmt.Errorf("failed to save instance: %w", err)
+	}
+
+	return tr.runHeadless(vm, nic)
+}
+
+// RunDetached runs the virtual machine in the foreground of the supervisor
+// process for inst. See instance.Instance.Start.
+func RunDetached(ctx context.Context, buildDir string, cfg config.TinyRangeConfig, inst *instance.Instance) error {
+	tr := &TinyRange{
+		buildDir: buildDir,
+		cfg:      cfg,
+		client:   http.DefaultClient,
+		instance: inst,
+		ctx:      ctx,
+		verbose:  common.IsVerbose(),
+	}
+
+	return tr.runWithConfig()
+}
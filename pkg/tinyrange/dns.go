@@ -10,6 +10,7 @@ import (
 type dnsServer struct {
 	server    *dns.Server
 	dnsLookup func(name string) (string, error)
+	logger    *slog.Logger
 }
 
 func (s *dnsServer) parseQuery(r *dns.Msg, m *dns.Msg) {
@@ -18,7 +19,7 @@ func (s *dnsServer) parseQuery(r *dns.Msg, m *dns.Msg) {
 		case dns.TypeA:
 			ip, err := s.dnsLookup(q.Name)
 			if err != nil {
-				slog.Error("error resolving dns", "name", q.Name, "err", err)
+				s.logger.Error("error resolving dns", "name", q.Name, "err", err)
 				m.SetRcode(r, dns.RcodeServerFailure)
 				return
 			}
@@ -29,7 +30,7 @@ func (s *dnsServer) parseQuery(r *dns.Msg, m *dns.Msg) {
 					m.Answer = append(m.Answer, rr)
 				}
 			} else {
-				slog.Error("DNS Query for unknown name", "name", q.Name)
+				s.logger.Error("DNS Query for unknown name", "name", q.Name)
 				m.SetRcode(r, dns.RcodeNameError)
 				return
 			}
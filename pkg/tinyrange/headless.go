@@ -0,0 +1,83 @@
+package tinyrange
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/netstack"
+	virtualMachine "github.com/tinyrange/tinyrange/pkg/vm"
+)
+
+// Run the virtual machine without a interactive session until the hypervisor
+// exits or the context is cancelled.
+func (tr *TinyRange) runHeadless(vm *virtualMachine.VirtualMachine, nic *netstack.NetworkInterface) error {
+	if tr.console != nil {
+		vm.SetConsole(tr.console)
+	}
+
+	stop := context.AfterFunc(tr.ctx, func() {
+		if err := tr.shutdown(vm, "interrupted"); err != nil {
+			tr.logger.Warn("failed to shutdown virtual machine", "err", err)
+		}
+	})
+	defer stop()
+
+	tr.onEvent.Emit(common.Event{Kind: common.EventVMStarting})
+
+	notReady := tr.stopIfNotReady(vm)
+
+	err := vm.Run(nic, false)
+	if readyErr := notReady(); readyErr != nil {
+		err = readyErr
+	}
+
+	ev := common.Event{Kind: common.EventVMExited}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	tr.onEvent.Emit(ev)
+
+	if ctxErr := tr.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
+// HeadlessOptions configures RunHeadless.
+type HeadlessOptions struct {
+	// The directory for built definitions and temporary files.
+	BuildDir string
+	// Connected to the hypervisor console. The output is discarded if nil.
+	Console io.ReadWriter
+	// Called as the virtual machine starts, becomes ready and exits.
+	OnEvent common.EventHandler
+	// Where messages are logged (default: slog.Default()).
+	Logger *slog.Logger
+	// Ask the hypervisor script to print more details.
+	Verbose bool
+}
+
+// RunHeadless runs the virtual machine described by cfg without a interactive
+// session. Returns when the hypervisor exits or after the virtual machine is
+// shutdown because ctx was cancelled.
+func RunHeadless(ctx context.Context, cfg config.TinyRangeConfig, opts HeadlessOptions) error {
+	tr := &TinyRange{
+		buildDir: opts.BuildDir,
+		cfg:      cfg,
+		client:   http.DefaultClient,
+		headless: true,
+		console:  opts.Console,
+		ctx:      ctx,
+		onEvent:  opts.OnEvent,
+		logger:   opts.Logger,
+		verbose:  opts.Verbose,
+	}
+
+	return tr.runWithConfig()
+}
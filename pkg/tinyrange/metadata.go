@@ -0,0 +1,463 @@
+package tinyrange
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/cloudinit"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+const DEFAULT_HOSTNAME = "tinyrange"
+
+// The subset of the virtual machine config that is visible to the guest.
+type guestConfig struct {
+	Hostname      string            `json:"hostname"`
+	Architecture  string            `json:"architecture"`
+	CPUCores      int               `json:"cpu_cores"`
+	MemoryMB      int               `json:"memory_mb"`
+	StorageSize   int               `json:"storage_size"`
+	Interaction   string            `json:"interaction"`
+	ExportedPorts []int             `json:"exported_ports"`
+	Metadata      map[string]string `json:"metadata"`
+}
+
+// metadataServer is the HTTP API the guest can reach on 10.42.0.1:80.
+//
+// GET  /v1/config          the guest visible VM config as JSON.
+// GET  /v1/hostname        the hostname of the guest.
+// GET  /v1/ssh_keys        the authorized SSH keys one per line.
+// GET  /v1/metadata        all user metadata as JSON.
+// GET  /v1/metadata/{key}  a single metadata value.
+// POST /v1/ready           signal that the guest has finished booting (body: guestReadyReport).
+// POST /v1/log             append the request body to the host log.
+// GET  /v1/volumes         the persistent volumes attached to the guest.
+// GET  /v1/services        the services init should start and supervise.
+// GET  /v1/probes          the readiness probes init should run in the guest.
+// GET  /v1/control         wait for the next command from the host (body: config.ControlCommand).
+// POST /v1/shutdown        report the guest is about to power off (body: config.ShutdownReport).
+// GET  /nocloud/{name}     the cloud-init NoCloud seed if one is configured.
+type metadataServer struct {
+	cfg           config.TinyRangeConfig
+	exportedPorts []int
+	start         time.Time
+	cloudInitSeed *cloudinit.Seed
+	volumes       []guestVolume
+	services      []config.ServiceConfig
+	probes        []config.ProbeConfig
+	// Runs the TCP and HTTP readiness probes against the guest.
+	prober common.Prober
+
+	// Called once when the guest reports it is ready and all the readiness
+	// probes have passed.
+	onReady func()
+
+	readyOnce sync.Once
+	ready     chan struct{}
+	readyErr  error
+	// How long after start the guest has to become ready.
+	readyTimeout time.Duration
+
+	// Commands waiting to be sent to the guest.
+	control chan config.ControlCommand
+	// Closed the first time the guest asks for a command.
+	controlOnce sync.Once
+	controlled  chan struct{}
+
+	// Called when the guest reports it's about to power off.
+	onShutdown func(report config.ShutdownReport)
+
+	logger *slog.Logger
+}
+
+// Sent by init in the guest when it has finished booting.
+type guestReadyReport struct {
+	// Set if a service or command probe in the guest failed.
+	Error string `json:"error,omitempty"`
+}
+
+// How long the guest has to boot and report it's ready. The timeouts of the
+// readiness probes are added to this.
+const guestBootTimeout = 5 * time.Minute
+
+// Returns the time the guest has to become ready. Service and host probes are
+// run one after another so the worst case is the sum of their timeouts.
+func readyTimeout(services []config.ServiceConfig, probes []config.ProbeConfig) time.Duration {
+	ret := guestBootTimeout
+
+	add := func(probe config.ProbeConfig) {
+		timeout := probe.Timeout
+		if timeout == 0 {
+			timeout = common.DefaultProbeTimeout
+		}
+
+		ret += time.Duration(timeout) * time.Second
+	}
+
+	for _, svc := range services {
+		if svc.Ready != nil {
+			add(*svc.Ready)
+		}
+	}
+
+	for _, probe := range probes {
+		add(probe)
+	}
+
+	return ret
+}
+
+// Returns true if the guest has to pass probes before it's ready. Host
+// actions only wait for the guest to be ready in that case since guests that
+// don't run the TinyRange init never report they are ready.
+func (m *metadataServer) hasReadinessChecks() bool {
+	return len(m.services) > 0 || len(m.probes) > 0
+}
+
+func (m *metadataServer) hostname() string {
+	if m.cfg.Hostname != "" {
+		return m.cfg.Hostname
+	}
+
+	return DEFAULT_HOSTNAME
+}
+
+func (m *metadataServer) metadata() map[string]string {
+	if m.cfg.Metadata == nil {
+		return map[string]string{}
+	}
+
+	return m.cfg.Metadata
+}
+
+func (m *metadataServer) writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		m.logger.Warn("metadata: failed to encode response", "err", err)
+	}
+}
+
+func (m *metadataServer) writeText(w http.ResponseWriter, s string) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	fmt.Fprint(w, s)
+}
+
+func (m *metadataServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	interaction := m.cfg.Interaction
+	if interaction == "" {
+		interaction = "ssh"
+	}
+
+	m.writeJson(w, &guestConfig{
+		Hostname:      m.hostname(),
+		Architecture:  string(m.cfg.Architecture),
+		CPUCores:      m.cfg.CPUCores,
+		MemoryMB:      m.cfg.MemoryMB,
+		StorageSize:   m.cfg.StorageSize,
+		Interaction:   interaction,
+		ExportedPorts: m.exportedPorts,
+		Metadata:      m.metadata(),
+	})
+}
+
+func (m *metadataServer) handleHostname(w http.ResponseWriter, r *http.Request) {
+	m.writeText(w, m.hostname())
+}
+
+func (m *metadataServer) handleSshKeys(w http.ResponseWriter, r *http.Request) {
+	var keys strings.Builder
+
+	for _, key := range m.cfg.SSHAuthorizedKeys {
+		keys.WriteString(strings.TrimSpace(key) + "\n")
+	}
+
+	m.writeText(w, keys.String())
+}
+
+func (m *metadataServer) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	m.writeJson(w, m.metadata())
+}
+
+func (m *metadataServer) handleMetadataKey(w http.ResponseWriter, r *http.Request) {
+	val, ok := m.metadata()[r.PathValue("key")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.writeText(w, val)
+}
+
+func (m *metadataServer) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes := m.volumes
+	if volumes == nil {
+		volumes = []guestVolume{}
+	}
+
+	m.writeJson(w, volumes)
+}
+
+func (m *metadataServer) handleServices(w http.ResponseWriter, r *http.Request) {
+	services := m.services
+	if services == nil {
+		services = []config.ServiceConfig{}
+	}
+
+	m.writeJson(w, services)
+}
+
+func (m *metadataServer) handleProbes(w http.ResponseWriter, r *http.Request) {
+	probes := []config.ProbeConfig{}
+
+	for _, probe := range m.probes {
+		if len(probe.Command) > 0 {
+			probes = append(probes, probe)
+		}
+	}
+
+	m.writeJson(w, probes)
+}
+
+// Run the host side readiness probes then mark the guest as ready.
+func (m *metadataServer) checkReadiness(report guestReadyReport) {
+	var err error
+
+	if report.Error != "" {
+		err = fmt.Errorf("guest reported: %s", report.Error)
+	}
+
+	for _, probe := range m.probes {
+		if err != nil {
+			break
+		}
+
+		if len(probe.Command) > 0 {
+			// Already run by init in the guest.
+			continue
+		}
+
+		err = m.prober.Wait(context.Background(), probe)
+	}
+
+	if err != nil {
+		m.logger.Error("guest did not become ready", "err", err)
+	} else {
+		m.logger.Debug("guest is ready", "took", time.Since(m.start))
+	}
+
+	m.readyErr = err
+
+	close(m.ready)
+
+	if err == nil && m.onReady != nil {
+		m.onReady()
+	}
+}
+
+func (m *metadataServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	var report guestReadyReport
+
+	// Older guests don't send a report.
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.guestReady(report)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// guestReady starts checking the readiness probes the first time it's called.
+func (m *metadataServer) guestReady(report guestReadyReport) {
+	m.readyOnce.Do(func() {
+		m.logger.Debug("guest reported ready", "took", time.Since(m.start))
+
+		go m.checkReadiness(report)
+	})
+}
+
+func (m *metadataServer) handleLog(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "guest"
+	}
+
+	scan := bufio.NewScanner(r.Body)
+	for scan.Scan() {
+		m.logger.Info(scan.Text(), "source", source)
+	}
+	if err := scan.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// How long a request for a control command is held open before the guest
+// has to ask again.
+const controlPollTimeout = 30 * time.Second
+
+func (m *metadataServer) handleControl(w http.ResponseWriter, r *http.Request) {
+	m.controlOnce.Do(func() { close(m.controlled) })
+
+	select {
+	case cmd := <-m.control:
+		m.writeJson(w, &cmd)
+	case <-time.After(controlPollTimeout):
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+}
+
+func (m *metadataServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	var report config.ShutdownReport
+
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.logger.Info("guest is shutting down", "reason", report.Reason)
+
+	for _, svc := range report.Services {
+		m.logger.Info("service stopped", "name", svc.Name, "exit_code", svc.ExitCode)
+	}
+
+	if report.Error != "" {
+		m.logger.Warn("guest did not shutdown cleanly", "err", report.Error)
+	}
+
+	if m.onShutdown != nil {
+		m.onShutdown(report)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestShutdown asks init in the guest to stop its services, unmount the
+// filesystems and power off. Returns false if the guest isn't listening for
+// commands.
+func (m *metadataServer) RequestShutdown(reason string, timeout int) bool {
+	select {
+	case <-m.controlled:
+	default:
+		return false
+	}
+
+	select {
+	case m.control <- config.ControlCommand{Command: "shutdown", Reason: reason, Timeout: timeout}:
+		return true
+	default:
+		// A shutdown has already been requested.
+		return true
+	}
+}
+
+func (m *metadataServer) handleNoCloud(w http.ResponseWriter, r *http.Request) {
+	if m.cloudInitSeed == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	contents, ok := m.cloudInitSeed.Get(r.PathValue("name"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Write(contents)
+}
+
+// Ready returns a channel that is closed once the guest calls /v1/ready and
+// the readiness probes have been checked.
+func (m *metadataServer) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// WaitReady waits for the guest to be ready if it has readiness checks.
+// Returns an error if a probe failed or the guest wasn't ready within
+// readyTimeout of starting. Returns ctx.Err() if ctx is cancelled first.
+func (m *metadataServer) WaitReady(ctx context.Context) error {
+	if !m.hasReadinessChecks() {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(m.start.Add(m.readyTimeout)))
+	defer timer.Stop()
+
+	select {
+	case <-m.ready:
+		return m.readyErr
+	case <-timer.C:
+		return fmt.Errorf("guest did not become ready within %s", m.readyTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *metadataServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/config", m.handleConfig)
+	mux.HandleFunc("GET /v1/hostname", m.handleHostname)
+	mux.HandleFunc("GET /v1/ssh_keys", m.handleSshKeys)
+	mux.HandleFunc("GET /v1/metadata", m.handleMetadata)
+	mux.HandleFunc("GET /v1/metadata/{key}", m.handleMetadataKey)
+	mux.HandleFunc("GET /v1/volumes", m.handleVolumes)
+	mux.HandleFunc("GET /v1/services", m.handleServices)
+	mux.HandleFunc("GET /v1/probes", m.handleProbes)
+	mux.HandleFunc("POST /v1/ready", m.handleReady)
+	mux.HandleFunc("POST /v1/log", m.handleLog)
+	mux.HandleFunc("GET /v1/control", m.handleControl)
+	mux.HandleFunc("POST /v1/shutdown", m.handleShutdown)
+	mux.HandleFunc("GET /nocloud/{name}", m.handleNoCloud)
+
+	return mux
+}
+
+func (m *metadataServer) Serve(listen net.Listener) error {
+	return http.Serve(listen, m.Handler())
+}
+
+func newMetadataServer(cfg config.TinyRangeConfig, exportedPorts []int) *metadataServer {
+	// Services can be declared in the config or added by directives.
+	services := append([]config.ServiceConfig{}, cfg.Services...)
+
+	probes := append([]config.ProbeConfig{}, cfg.ReadinessProbes...)
+
+	for _, frag := range cfg.RootFsFragments {
+		if frag.Service != nil {
+			services = append(services, frag.Service.Service)
+		}
+		if frag.ReadinessProbe != nil {
+			probes = append(probes, frag.ReadinessProbe.Probe)
+		}
+	}
+
+	return &metadataServer{
+		cfg:           cfg,
+		exportedPorts: exportedPorts,
+		start:         time.Now(),
+		services:      services,
+		probes:        probes,
+		ready:         make(chan struct{}),
+		readyTimeout:  readyTimeout(services, probes),
+		control:       make(chan config.ControlCommand, 1),
+		controlled:    make(chan struct{}),
+		logger:        slog.Default(),
+	}
+}
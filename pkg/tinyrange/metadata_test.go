@@ -0,0 +1,194 @@
+package tinyrange
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+func TestReadyTimeout(t *testing.T) {
+	got := readyTimeout(
+		[]config.ServiceConfig{
+			{Name: "a", Ready: &config.ProbeConfig{TcpPort: 80, Timeout: 10}},
+			{Name: "b"},
+		},
+		[]config.ProbeConfig{{TcpPort: 22}},
+	)
+
+	if expected := guestBootTimeout + 70*time.Second; got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	newServer := func() *metadataServer {
+		m := newMetadataServer(config.TinyRangeConfig{
+			ReadinessProbes: []config.ProbeConfig{{TcpPort: 22, Timeout: 1}},
+		}, nil)
+
+		m.prober.Dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+
+			return dialer.DialContext(ctx, network, listen.Addr().String())
+		}
+
+		return m
+	}
+
+	// Guests without readiness checks never report they are ready.
+	if err := newMetadataServer(config.TinyRangeConfig{}, nil).WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Ready", func(t *testing.T) {
+		m := newServer()
+
+		readyCalled := make(chan struct{})
+		m.onReady = func() { close(readyCalled) }
+
+		m.guestReady(guestReadyReport{})
+
+		if err := m.WaitReady(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		<-readyCalled
+	})
+
+	t.Run("GuestError", func(t *testing.T) {
+		m := newServer()
+
+		m.guestReady(guestReadyReport{Error: "service web failed"})
+
+		if err := m.WaitReady(context.Background()); err == nil {
+			t.Fatal("expected the guest error to be returned")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		m := newServer()
+		m.readyTimeout = 100 * time.Millisecond
+
+		if err := m.WaitReady(context.Background()); err == nil {
+			t.Fatal("expected a timeout")
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		m := newServer()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := m.WaitReady(ctx); err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestShutdownControl(t *testing.T) {
+	m := newMetadataServer(config.TinyRangeConfig{}, nil)
+
+	reports := make(chan config.ShutdownReport, 1)
+	m.onShutdown = func(report config.ShutdownReport) { reports <- report }
+
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+
+	// The guest hasn't asked for a command yet so it can't be asked to
+	// shutdown over the control channel.
+	if m.RequestShutdown("test", 5) {
+		t.Fatal("expected the shutdown request to fail before the guest polls")
+	}
+
+	commands := make(chan config.ControlCommand, 1)
+	errs := make(chan error, 1)
+
+	go func() {
+		resp, err := http.Get(server.URL + "/v1/control")
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer resp.Body.Close()
+
+		var cmd config.ControlCommand
+		if err := json.NewDecoder(resp.Body).Decode(&cmd); err != nil {
+			errs <- err
+			return
+		}
+
+		commands <- cmd
+	}()
+
+	<-m.controlled
+
+	if !m.RequestShutdown("test", 5) {
+		t.Fatal("expected the shutdown request to be sent")
+	}
+
+	select {
+	case cmd := <-commands:
+		expected := config.ControlCommand{Command: "shutdown", Reason: "test", Timeout: 5}
+		if cmd != expected {
+			t.Fatalf("expected %+v, got %+v", expected, cmd)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the control command")
+	}
+
+	report := config.ShutdownReport{
+		Reason: "test",
+		Services: []config.ServiceExit{
+			{Name: "web", ExitCode: 0},
+			{Name: "db", ExitCode: -1},
+		},
+	}
+
+	body, err := json.Marshal(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(server.URL+"/v1/shutdown", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if got := <-reports; !reflect.DeepEqual(got, report) {
+		t.Fatalf("expected %+v, got %+v", report, got)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tr := &TinyRange{}
+	if got := tr.shutdownTimeout(); got != defaultShutdownTimeout*time.Second {
+		t.Fatalf("expected the default timeout, got %s", got)
+	}
+
+	tr.cfg.ShutdownTimeout = 30
+	if got := tr.shutdownTimeout(); got != 30*time.Second {
+		t.Fatalf("expected 30s, got %s", got)
+	}
+}
@@ -0,0 +1,118 @@
+package tinyrange
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/netstack"
+	"github.com/tinyrange/tinyrange/pkg/snapshot"
+	virtualMachine "github.com/tinyrange/tinyrange/pkg/vm"
+)
+
+// Snapshots can only capture disks stored in the qcow2 overlay. Writable
+// volumes would drift from the saved memory state so they are rejected.
+func (tr *TinyRange) checkSnapshotVolumes() error {
+	for _, vol := range tr.cfg.Volumes {
+		if !vol.ReadOnly {
+			return fmt.Errorf("snapshots can only be used with read-only volumes")
+		}
+	}
+
+	return nil
+}
+
+// Create the snapshot named by SaveSnapshot. If diskImage is "" the root
+// filesystem is generated and stored as the base image of the snapshot.
+func (tr *TinyRange) createSnapshot(diskImage string, diskFormat string) (_ *snapshot.Snapshot, err error) {
+	if err := tr.checkSnapshotVolumes(); err != nil {
+		return nil, err
+	}
+
+	s, err := snapshot.Create(tr.buildDir, tr.cfg.SaveSnapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			s.Discard()
+		}
+	}()
+
+	if diskImage == "" {
+		vmem, fsSize, err := tr.buildRootFilesystem()
+		if err != nil {
+			return nil, err
+		}
+
+		diskImage, err = s.WriteBaseImage(vmem, fsSize)
+		if err != nil {
+			return nil, err
+		}
+
+		diskFormat = "raw"
+	}
+
+	if err := s.CreateOverlay(diskImage, diskFormat); err != nil {
+		return nil, err
+	}
+
+	s.Config = tr.cfg
+	s.Config.SaveSnapshot = ""
+
+	return s, nil
+}
+
+// Save the state of the running virtual machine into the snapshot and commit
+// it so it can be restored.
+func (tr *TinyRange) saveSnapshot(vm *virtualMachine.VirtualMachine, s *snapshot.Snapshot, nic *netstack.NetworkInterface) error {
+	start := time.Now()
+
+	if err := vm.SaveSnapshot(snapshot.SNAPSHOT_TAG); err != nil {
+		return err
+	}
+
+	s.MacAddress = nic.MacAddress
+	s.HostMacAddress = nic.HostMacAddress
+
+	if err := s.Commit(); err != nil {
+		return fmt.Errorf("failed to commit snapshot: %w", err)
+	}
+
+	tr.logger.Info("saved snapshot", "name", s.Name, "took", time.Since(start))
+
+	return nil
+}
+
+// Load the snapshot named by RestoreSnapshot and replace the config with the
+// one the snapshot was saved with.
+func (tr *TinyRange) loadSnapshot() (*snapshot.Snapshot, error) {
+	if tr.exportFilesystem != "" || tr.listenNbd != "" {
+		return nil, fmt.Errorf("exporting the filesystem is not supported when restoring a snapshot")
+	}
+
+	s, err := snapshot.Get(tr.buildDir, tr.cfg.RestoreSnapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	tr.cfg = s.Config
+
+	return s, nil
+}
+
+// Attach a network interface with the same addresses the guest saw when the
+// snapshot was saved.
+func attachSnapshotNetworkInterface(ns *netstack.NetStack, s *snapshot.Snapshot) (*netstack.NetworkInterface, error) {
+	hostMac, err := net.ParseMAC(s.HostMacAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host MAC address in snapshot: %w", err)
+	}
+
+	deviceMac, err := net.ParseMAC(s.MacAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address in snapshot: %w", err)
+	}
+
+	return ns.AttachNetworkInterfaceWithAddresses(hostMac, deviceMac)
+}
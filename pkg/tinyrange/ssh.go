@@ -95,7 +95,36 @@ func getFd(reader io.Reader) (fd int, ok bool) {
 	return fd, term.IsTerminal(fd)
 }
 
-func connectOverSsh(ns *netstack.NetStack, address string, username string, password string) error {
+// Dials the SSH server in the guest.
+type sshDialer func(ctx context.Context, address string) (net.Conn, error)
+
+func dialNetstack(ns *netstack.NetStack) sshDialer {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		return ns.DialInternalContext(ctx, "tcp", address)
+	}
+}
+
+// AttachOverSsh opens a interactive shell in a guest whose SSH server is
+// forwarded to address on the host.
+func AttachOverSsh(address string) error {
+	dial := func(ctx context.Context, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	for {
+		err := connectOverSsh(context.Background(), dial, address, "root", "insecurepassword")
+		if err == ErrRestart {
+			continue
+		}
+
+		return err
+	}
+}
+
+// Connect to the SSH server at address and run a interactive shell. Returns
+// the error of ctx if it's cancelled before the shell exits.
+func connectOverSsh(ctx context.Context, dial sshDialer, address string, username string, password string) error {
 	config := &ssh.ClientConfig{
 		User: username,
 		Auth: []ssh.AuthMethod{
@@ -113,10 +142,14 @@ func connectOverSsh(ns *netstack.NetStack, address string, username string, pass
 	)
 
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
 		defer cancel()
 
-		conn, err = ns.DialInternalContext(ctx, "tcp", address)
+		conn, err = dial(dialCtx, address)
 		if err != nil {
 			if !errors.Is(err, context.DeadlineExceeded) {
 				slog.Debug("failed to connect", "err", err)
@@ -206,12 +239,14 @@ func connectOverSsh(ns *netstack.NetStack, address string, username string, pass
 		close <- closeExit
 	}()
 
-	switch <-close {
-	case closeExit:
+	select {
+	case kind := <-close:
+		if kind == closeRestart {
+			return ErrRestart
+		}
+
 		return nil
-	case closeRestart:
-		return ErrRestart
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return nil
 }
@@ -2,17 +2,13 @@ package tinyrange
 
 import (
 	"context"
-	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
-	goFs "io/fs"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"path"
-	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -21,15 +17,18 @@ import (
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
 	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
 	initExec "github.com/tinyrange/tinyrange/pkg/init"
+	"github.com/tinyrange/tinyrange/pkg/instance"
 	"github.com/tinyrange/tinyrange/pkg/netstack"
 	_ "github.com/tinyrange/tinyrange/pkg/platform"
+	"github.com/tinyrange/tinyrange/pkg/snapshot"
 	virtualMachine "github.com/tinyrange/tinyrange/pkg/vm"
 	gonbd "github.com/tinyrange/tinyrange/third_party/go-nbd"
 	"github.com/tinyrange/vm"
 )
 
 type vmBackend struct {
-	vm *vm.VirtualMemory
+	vm     *vm.VirtualMemory
+	logger *slog.Logger
 }
 
 // Close implements common.Backend.
@@ -44,7 +43,7 @@ func (*vmBackend) PreferredBlockSize() int64 { return 4096 }
 func (vm *vmBackend) ReadAt(p []byte, off int64) (n int, err error) {
 	n, err = vm.vm.ReadAt(p, off)
 	if err != nil {
-		slog.Error("vmBackend readAt", "len", len(p), "off", off, "err", err)
+		vm.logger.Error("vmBackend readAt", "len", len(p), "off", off, "err", err)
 		return 0, nil
 	}
 
@@ -55,7 +54,7 @@ func (vm *vmBackend) ReadAt(p []byte, off int64) (n int, err error) {
 func (vm *vmBackend) WriteAt(p []byte, off int64) (n int, err error) {
 	n, err = vm.vm.WriteAt(p, off)
 	if err != nil {
-		slog.Error("vmBackend writeAt", "len", len(p), "off", off, "err", err)
+		vm.logger.Error("vmBackend writeAt", "len", len(p), "off", off, "err", err)
 		return 0, nil
 	}
 
@@ -73,367 +72,114 @@ func (*vmBackend) Sync() error {
 }
 
 type TinyRange struct {
-	buildDir           string
-	cfg                config.TinyRangeConfig
-	debug              bool
-	forwardSsh         bool
-	exportFilesystem   string
-	listenNbd          string
-	streamingServer    string
-	client             *http.Client
-	deferredFilesystem []func() error
+	buildDir         string
+	cfg              config.TinyRangeConfig
+	debug            bool
+	forwardSsh       bool
+	exportFilesystem string
+	listenNbd        string
+	streamingServer  string
+	client           *http.Client
+	metadata         *metadataServer
+	// Set if the virtual machine is run in the background.
+	instance *instance.Instance
+	// If true the virtual machine runs without a interactive session and
+	// the hypervisor console is connected to console.
+	headless bool
+	console  io.ReadWriter
+	ctx      context.Context
+	onEvent  common.EventHandler
+	logger   *slog.Logger
+	// If true the hypervisor script is asked to print more details.
+	verbose bool
+	// Closed when runWithConfig returns.
+	closers []io.Closer
+
+	// Paths replaced or removed by later fragments of the root filesystem.
+	layerChanges []filesystem.LayerChange
 }
 
-func (tr *TinyRange) fragmentToFilesystem(frag config.Fragment, dir filesystem.MutableDirectory) error {
-	if localFile := frag.LocalFile; localFile != nil {
-		file := filesystem.NewLocalFile(tr.cfg.Resolve(localFile.HostFilename), nil)
-
-		overlay, err := filesystem.NewOverlayFile(file)
-		if err != nil {
-			return err
-		}
-
-		if localFile.Executable {
-			if err := overlay.Chmod(goFs.FileMode(0755)); err != nil {
-				return err
-			}
-		}
-
-		if err := filesystem.CreateChild(dir, localFile.GuestFilename, overlay); err != nil {
-			return err
-		}
-
-		return nil
-	} else if fileContents := frag.FileContents; fileContents != nil {
-		file := filesystem.NewMemoryFile(filesystem.TypeRegular)
-
-		if err := file.Overwrite(fileContents.Contents); err != nil {
-			return err
-		}
-
-		if fileContents.Executable {
-			if err := file.Chmod(goFs.FileMode(0755)); err != nil {
-				return err
-			}
-		}
-
-		if err := filesystem.CreateChild(dir, fileContents.GuestFilename, file); err != nil {
-			return err
-		}
-
-		return nil
-	} else if builtin := frag.Builtin; builtin != nil {
-		if builtin.Name == "init" {
-			exec, err := initExec.GetInitExecutable(builtin.Architecture)
-			if err != nil {
-				return err
-			}
-
-			file := filesystem.NewMemoryFile(filesystem.TypeRegular)
-
-			if err := file.Overwrite(exec); err != nil {
-				return err
-			}
-
-			if err := file.Chmod(goFs.FileMode(0755)); err != nil {
-				return err
-			}
-
-			if err := filesystem.CreateChild(dir, builtin.GuestFilename, file); err != nil {
-				return err
-			}
-
-			return nil
-		} else if builtin.Name == "init.star" {
-			file := filesystem.NewMemoryFile(filesystem.TypeRegular)
-
-			if err := file.Overwrite(initExec.INIT_SCRIPT); err != nil {
-				return err
-			}
-
-			if err := filesystem.CreateChild(dir, builtin.GuestFilename, file); err != nil {
-				return err
-			}
-
-			return nil
-		} else if builtin.Name == "tinyrange" {
-			exe, err := os.Executable()
-			if err != nil {
-				return fmt.Errorf("failed to get executable: %w", err)
-			}
-
-			file := filesystem.NewLocalFile(exe, nil)
-
-			if err := filesystem.CreateChild(dir, builtin.GuestFilename, file); err != nil {
-				return err
-			}
-
-			return nil
-		} else if builtin.Name == "tinyrange_qemu.star" {
-			local, err := common.GetAdjacentExecutable("tinyrange_qemu.star")
-			if err != nil {
-				return fmt.Errorf("failed to get tinyrange_qemu.star: %w", err)
-			}
-
-			file := filesystem.NewLocalFile(local, nil)
-
-			if err := filesystem.CreateChild(dir, builtin.GuestFilename, file); err != nil {
-				return err
-			}
-
-			return nil
-		} else {
-			return fmt.Errorf("unknown builtin: %s", builtin.Name)
-		}
-	} else if ark := frag.Archive; ark != nil {
-		var (
-			archive filesystem.Archive
-			err     error
-		)
-
-		if tr.streamingServer != "" {
-			f := filesystem.NewRemoteFile(tr.client, tr.streamingServer+ark.HostFilename)
-
-			archive, err = filesystem.ReadArchiveFromStreamingServer(tr.client, tr.streamingServer, f)
-			if err != nil {
-				return fmt.Errorf("failed to download archive: %w", err)
-			}
-		} else {
-			f := filesystem.NewLocalFile(tr.cfg.Resolve(ark.HostFilename), nil)
-
-			archive, err = filesystem.ReadArchiveFromFile(f)
-			if err != nil {
-				return fmt.Errorf("failed to read archive: %w", err)
-			}
-		}
-
-		entries, err := archive.Entries()
-		if err != nil {
-			return fmt.Errorf("failed to read archive: %w", err)
-		}
-
-		for _, ent := range entries {
-			// TODO(joshua): Why is this not filepath.join?
-			name := ark.Target + "/" + ent.Name()
-
-			var file filesystem.MutableFile
-
-			if name != "/" {
-				if filesystem.Exists(dir, name) {
-					continue
-				}
-
-				dirname := path.Dir(name)
-
-				if !filesystem.Exists(dir, dirname) && path.Clean(name) != dirname {
-					// slog.Info("mkdir", "dirname", dirname)
-					if _, err := filesystem.Mkdir(dir, dirname); err != nil {
-						return err
-					}
-				}
-
-				switch ent.Typeflag() {
-				case filesystem.TypeDirectory:
-					// slog.Info("directory", "name", name)
-					name = strings.TrimSuffix(name, "/")
-
-					file, err = filesystem.Mkdir(dir, name)
-					if err != nil {
-						return err
-					}
-				case filesystem.TypeSymlink:
-					// slog.Info("symlink", "name", name)
-					symlink := filesystem.NewSymlink(ent.Linkname())
-
-					file = symlink
-
-					if err := filesystem.CreateChild(dir, name, symlink); err != nil {
-						return err
-					}
-				case filesystem.TypeLink:
-					// slog.Info("link", "name", name, "target", ent.Linkname())
-					link, err := filesystem.NewHardLink(ent.Linkname())
-					if err != nil {
-						return err
-					}
-
-					file = link
-
-					if err := filesystem.CreateChild(dir, name, link); err != nil {
-						return err
-					}
-				case filesystem.TypeRegular:
-					// slog.Info("reg", "name", name)
-					file, err = filesystem.NewOverlayFile(ent)
-					if err != nil {
-						return err
-					}
-
-					if err := filesystem.CreateChild(dir, name, ent); err != nil {
-						return err
-					}
-				default:
-					return fmt.Errorf("unimplemented entry type: %s", ent.Typeflag())
-				}
-			} else {
-				file = dir
-			}
-
-			if err := file.Chown(ent.Uid(), ent.Gid()); err != nil {
-				return fmt.Errorf("failed to chown in guest: %w", err)
-			}
-
-			if err := file.Chmod(goFs.FileMode(ent.Mode())); err != nil {
-				return fmt.Errorf("failed to chmod in guest: %w", err)
-			}
-		}
+func (tr *TinyRange) closeOnExit(c io.Closer) {
+	tr.closers = append(tr.closers, c)
+}
 
+// Write the paths replaced or removed by later fragments to the layer report.
+func (tr *TinyRange) writeLayerReport() error {
+	if tr.cfg.LayerReportFilename == "" {
 		return nil
-	} else {
-		return fmt.Errorf("unknown fragment kind")
 	}
-}
 
-// Recurse into an filesystem.Directory and put all it's contents into a ext4 filesystem.
-func (tr *TinyRange) filesystemToExt4(dir filesystem.Directory, fs *ext4.Ext4Filesystem, name string) error {
-	ents, err := dir.Readdir()
+	f, err := os.Create(tr.cfg.LayerReportFilename)
 	if err != nil {
-		return fmt.Errorf("failed to readdir: %w", err)
+		return err
 	}
+	defer f.Close()
 
-	for _, ent := range ents {
-		info, err := ent.File.Stat()
-		if err != nil {
-			return fmt.Errorf("failed to stat: %w", err)
+	for _, change := range tr.layerChanges {
+		if _, err := fmt.Fprintf(f, "%s\t%s\t%s\n", change.Action, change.Path, change.Layer); err != nil {
+			return err
 		}
+	}
 
-		name := path.Join(name, path.Base(ent.Name))
-
-		skip := false
-
-		switch info.Kind() {
-		case filesystem.TypeDirectory:
-			if err := fs.Mkdir(name, false); err != nil {
-				return fmt.Errorf("failed to mkdir %s: %w", name, err)
-			}
-
-			child, ok := ent.File.(filesystem.Directory)
-			if !ok {
-				return fmt.Errorf("directory does not implement Directory: %T", ent.File)
-			}
-
-			if err := tr.filesystemToExt4(child, fs, name); err != nil {
-				return err
-			}
-		case filesystem.TypeLink:
-			target, err := filesystem.GetLinkName(ent.File)
-			if err != nil {
-				return fmt.Errorf("failed to get linkname: %w", err)
-			}
-
-			if err := fs.Link(name, target); err != nil {
-				tr.deferredFilesystem = append(tr.deferredFilesystem, func() error {
-					if err := fs.Link(name, target); err != nil {
-						return fmt.Errorf("failed to make hard link: %w", err)
-					}
-
-					if err := fs.Chmod(name, info.Mode()); err != nil {
-						return fmt.Errorf("failed to chmod: %w", err)
-					}
-
-					uid, gid, err := filesystem.GetUidAndGid(ent.File)
-					if err != nil {
-						return fmt.Errorf("failed to GetUidAndGid: %w", err)
-					}
-
-					if err := fs.Chown(name, uint16(uid), uint16(gid)); err != nil {
-						return fmt.Errorf("failed to chown: %w", err)
-					}
-
-					return nil
-				})
-
-				skip = true
-			}
-		case filesystem.TypeSymlink:
-			target, err := filesystem.GetLinkName(ent.File)
-			if err != nil {
-				return fmt.Errorf("failed to get linkname: %w", err)
-			}
-
-			if err := fs.Symlink(name, target); err != nil {
-				return fmt.Errorf("failed to make symlink: %w", err)
-			}
-		case filesystem.TypeRegular:
-			f, err := ent.File.Open()
-			if err != nil {
-				return fmt.Errorf("failed to open file for guest: %T %w", ent.File, err)
-			}
-
-			region := vm.NewReaderRegion(f, info.Size())
+	return nil
+}
 
-			if err := fs.CreateFile(name, region); err != nil {
-				return fmt.Errorf("failed to create file in guest %s: %w", name, err)
+// Add the contents of frag to dir. Fragments are applied like image layers
+// so files from later fragments replace the ones before them.
+func (tr *TinyRange) fragmentToFilesystem(frag config.Fragment, dir filesystem.MutableDirectory) error {
+	return filesystem.ApplyFragment(dir, frag, filesystem.FragmentOptions{
+		Resolve: tr.cfg.Resolve,
+		OpenArchive: func(filename string) (filesystem.Archive, error) {
+			if tr.streamingServer == "" {
+				return filesystem.ReadArchiveFromFile(filesystem.NewLocalFile(tr.cfg.Resolve(filename), nil))
 			}
-		default:
-			return fmt.Errorf("unimplemented kind: %s", info.Kind())
-		}
 
-		if !skip {
-			if err := fs.Chmod(name, info.Mode()); err != nil {
-				return fmt.Errorf("failed to chmod: %w", err)
-			}
+			f := filesystem.NewRemoteFile(tr.client, tr.streamingServer+filename)
 
-			uid, gid, err := filesystem.GetUidAndGid(ent.File)
+			archive, err := filesystem.ReadArchiveFromStreamingServer(tr.client, tr.streamingServer, f)
 			if err != nil {
-				return fmt.Errorf("failed to GetUidAndGid: %w", err)
+				return nil, fmt.Errorf("failed to download archive: %w", err)
 			}
 
-			if err := fs.Chown(name, uint16(uid), uint16(gid)); err != nil {
-				return fmt.Errorf("failed to chown: %w", err)
-			}
-		}
-	}
+			return archive, nil
+		},
+		Builtin: initExec.BuiltinFile,
+		OnChange: func(change filesystem.LayerChange) {
+			tr.logger.Debug("layer override", "action", change.Action, "path", change.Path, "layer", change.Layer)
 
-	return nil
+			tr.layerChanges = append(tr.layerChanges, change)
+		},
+	})
 }
 
-func (tr *TinyRange) runWithConfig() error {
-	if tr.cfg.StorageSize == 0 || tr.cfg.CPUCores == 0 || tr.cfg.MemoryMB == 0 {
-		return fmt.Errorf("invalid config")
-	}
-
-	if tr.cfg.Debug {
-		slog.Warn("enabling hypervisor debug mode")
-		tr.debug = true
-	}
-
-	interaction := tr.cfg.Interaction
-	if interaction == "" {
-		interaction = "ssh"
-	}
-
+// Build the root filesystem from the config fragments as a ext4 image.
+// Returns the image and it's size in bytes.
+func (tr *TinyRange) buildRootFilesystem() (*vm.VirtualMemory, int64, error) {
 	start := time.Now()
 
-	var exportedPorts []int
+	tr.onEvent.Emit(common.Event{Kind: common.EventVMBuildingFilesystem})
 
 	root := filesystem.NewMemoryDirectory()
 
 	for _, frag := range tr.cfg.RootFsFragments {
-		if port := frag.ExportPort; port != nil {
-			exportedPorts = append(exportedPorts, port.Port)
-		} else {
-			if err := tr.fragmentToFilesystem(frag, root); err != nil {
-				return fmt.Errorf("failed to extract fragment to filesystem: %w", err)
-			}
+		if frag.ExportPort != nil || frag.Service != nil || frag.ReadinessProbe != nil {
+			continue
+		}
+
+		if err := tr.fragmentToFilesystem(frag, root); err != nil {
+			return nil, 0, fmt.Errorf("failed to extract fragment to filesystem: %w", err)
 		}
 	}
 
-	slog.Debug("built filesystem tree", "took", time.Since(start))
+	tr.logger.Debug("built filesystem tree", "took", time.Since(start))
+
+	if err := tr.writeLayerReport(); err != nil {
+		return nil, 0, fmt.Errorf("failed to write layer report: %w", err)
+	}
 
 	totalSize, err := filesystem.GetTotalSize(root)
 	if err != nil {
-		return fmt.Errorf("could not compute total size")
+		return nil, 0, fmt.Errorf("could not compute total size")
 	}
 
 	fsSize := int64(tr.cfg.StorageSize * 1024 * 1024)
@@ -441,7 +187,7 @@ func (tr *TinyRange) runWithConfig() error {
 	if int64(float64(totalSize)*1.5) > fsSize {
 		targetSize := int64(float64(totalSize)*1.5) / 128 / 1024 / 1024
 
-		slog.Debug("resize filesystem", "new", fmt.Sprintf("%dmb", targetSize*128))
+		tr.logger.Debug("resize filesystem", "new", fmt.Sprintf("%dmb", targetSize*128))
 
 		fsSize = targetSize * 128 * 1024 * 1024
 	}
@@ -452,59 +198,64 @@ func (tr *TinyRange) runWithConfig() error {
 
 	fs, err := ext4.CreateExt4Filesystem(vmem, 0, fsSize)
 	if err != nil {
-		return fmt.Errorf("failed to create ext4 filesystem: %w", err)
+		return nil, 0, fmt.Errorf("failed to create ext4 filesystem: %w", err)
 	}
 
-	if err := tr.filesystemToExt4(root, fs, "/"); err != nil {
-		return fmt.Errorf("failed to convert filesystem to ext4: %w", err)
+	if err := filesystem.CopyToExt4(root, fs); err != nil {
+		return nil, 0, fmt.Errorf("failed to convert filesystem to ext4: %w", err)
 	}
 
-	for _, deferred := range tr.deferredFilesystem {
-		if err := deferred(); err != nil {
-			return err
-		}
-	}
+	tr.logger.Debug("built filesystem", "took", time.Since(start))
+
+	return vmem, fsSize, nil
+}
 
-	slog.Debug("built filesystem", "took", time.Since(start))
+// Build the root filesystem and serve it over NBD. Returns "" if the
+// filesystem was exported instead of being used to start a virtual machine.
+func (tr *TinyRange) serveRootFilesystem() (string, error) {
+	vmem, fsSize, err := tr.buildRootFilesystem()
+	if err != nil {
+		return "", err
+	}
 
 	if tr.exportFilesystem != "" {
 		start := time.Now()
 
 		out, err := os.Create(tr.exportFilesystem)
 		if err != nil {
-			return err
+			return "", err
 		}
 		defer out.Close()
 
 		if _, err := io.Copy(out, io.NewSectionReader(vmem, 0, fsSize)); err != nil {
-			return err
+			return "", err
 		}
 
-		slog.Debug("exported filesystem", "took", time.Since(start))
+		tr.logger.Debug("exported filesystem", "took", time.Since(start))
 
-		return nil
+		return "", nil
 	}
 
 	if tr.listenNbd != "" {
 		listener, err := net.Listen("tcp", tr.listenNbd)
 		if err != nil {
-			return fmt.Errorf("failed to listen: %v", err)
+			return "", fmt.Errorf("failed to listen: %v", err)
 		}
 
-		slog.Info("nbd listening on", "addr", listener.Addr().String())
+		tr.logger.Info("nbd listening on", "addr", listener.Addr().String())
 
-		backend := &vmBackend{vm: vmem}
+		backend := &vmBackend{vm: vmem, logger: tr.logger}
 
 		for {
 			conn, err := listener.Accept()
 			if errors.Is(err, net.ErrClosed) {
-				return nil
+				return "", nil
 			} else if err != nil {
-				return err
+				return "", err
 			}
 
 			go func(conn net.Conn) {
-				slog.Debug("got nbd connection", "remote", conn.RemoteAddr().String())
+				tr.logger.Debug("got nbd connection", "remote", conn.RemoteAddr().String())
 				err = gonbd.Handle(conn, []gonbd.Export{{
 					Name:        "",
 					Description: "",
@@ -516,20 +267,20 @@ func (tr *TinyRange) runWithConfig() error {
 					MaximumBlockSize:   32*1024*1024 - 1,
 				})
 				if err != nil {
-					slog.Warn("nbd server failed to handle", "error", err)
+					tr.logger.Warn("nbd server failed to handle", "error", err)
 				}
 			}(conn)
 		}
 	}
 
-	start = time.Now()
-
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
+		return "", fmt.Errorf("failed to listen: %v", err)
 	}
 
-	backend := &vmBackend{vm: vmem}
+	tr.closeOnExit(listener)
+
+	backend := &vmBackend{vm: vmem, logger: tr.logger}
 
 	go func() {
 		for {
@@ -537,12 +288,12 @@ func (tr *TinyRange) runWithConfig() error {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			} else if err != nil {
-				slog.Error("nbd server failed to accept", "error", err)
+				tr.logger.Error("nbd server failed to accept", "error", err)
 				return
 			}
 
 			go func(conn net.Conn) {
-				slog.Debug("got nbd connection", "remote", conn.RemoteAddr().String())
+				tr.logger.Debug("got nbd connection", "remote", conn.RemoteAddr().String())
 				err = gonbd.Handle(conn, []gonbd.Export{{
 					Name:        "",
 					Description: "",
@@ -554,12 +305,121 @@ func (tr *TinyRange) runWithConfig() error {
 					MaximumBlockSize:   32*1024*1024 - 1,
 				})
 				if err != nil {
-					slog.Warn("nbd server failed to handle", "error", err)
+					tr.logger.Warn("nbd server failed to handle", "error", err)
 				}
 			}(conn)
 		}
 	}()
 
+	return "nbd://" + listener.Addr().String(), nil
+}
+
+func (tr *TinyRange) runWithConfig() error {
+	if tr.ctx == nil {
+		tr.ctx = context.Background()
+	}
+
+	if tr.logger == nil {
+		tr.logger = slog.Default()
+	}
+
+	defer func() {
+		for _, c := range tr.closers {
+			c.Close()
+		}
+	}()
+
+	var (
+		restore *snapshot.Snapshot
+		save    *snapshot.Snapshot
+		err     error
+	)
+
+	if tr.cfg.RestoreSnapshot != "" {
+		restore, err = tr.loadSnapshot()
+		if err != nil {
+			return fmt.Errorf("failed to load snapshot: %w", err)
+		}
+	}
+
+	if tr.cfg.StorageSize == 0 || tr.cfg.CPUCores == 0 || tr.cfg.MemoryMB == 0 {
+		return fmt.Errorf("invalid config")
+	}
+
+	if tr.cfg.Debug {
+		tr.logger.Warn("enabling hypervisor debug mode")
+		tr.debug = true
+	}
+
+	interaction := tr.cfg.Interaction
+	if interaction == "" {
+		interaction = "ssh"
+	}
+
+	var exportedPorts []int
+
+	for _, frag := range tr.cfg.RootFsFragments {
+		if port := frag.ExportPort; port != nil {
+			exportedPorts = append(exportedPorts, port.Port)
+		}
+	}
+
+	var (
+		diskImage     string
+		diskFormat    = "raw"
+		diskEphemeral = true
+	)
+
+	if restore != nil {
+		diskImage = restore.Overlay()
+		diskFormat = "qcow2"
+		diskEphemeral = false
+	} else if tr.cfg.DiskImageFilename != "" {
+		if tr.exportFilesystem != "" || tr.listenNbd != "" {
+			return fmt.Errorf("exporting the filesystem is not supported when booting a disk image")
+		}
+
+		diskImage = tr.cfg.Resolve(tr.cfg.DiskImageFilename)
+
+		diskFormat, err = detectDiskFormat(diskImage)
+		if err != nil {
+			return err
+		}
+	} else if tr.cfg.SaveSnapshot == "" {
+		diskImage, err = tr.serveRootFilesystem()
+		if err != nil {
+			return err
+		}
+
+		if diskImage == "" {
+			return nil
+		}
+	}
+
+	if tr.cfg.SaveSnapshot != "" && restore == nil {
+		if tr.exportFilesystem != "" || tr.listenNbd != "" {
+			return fmt.Errorf("exporting the filesystem is not supported when saving a snapshot")
+		}
+
+		// Guest writes go to a qcow2 overlay so they can be saved with the
+		// rest of the virtual machine state.
+		save, err = tr.createSnapshot(diskImage, diskFormat)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := save.Discard(); err != nil {
+				tr.logger.Warn("failed to remove unsaved snapshot", "err", err)
+			}
+		}()
+
+		diskImage = save.Overlay()
+		diskFormat = "qcow2"
+		diskEphemeral = false
+	}
+
+	start := time.Now()
+
 	ns := netstack.New()
 
 	// out, err := os.Create("local/network.pcap")
@@ -581,48 +441,118 @@ func (tr *TinyRange) runWithConfig() error {
 		tr.cfg.Architecture,
 		tr.cfg.Resolve(tr.cfg.KernelFilename),
 		tr.cfg.Resolve(tr.cfg.InitFilesystemFilename),
-		"nbd://"+listener.Addr().String(),
+		diskImage,
 		tr.cfg.Interaction,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to make virtual machine: %w", err)
 	}
 
-	nic, err := ns.AttachNetworkInterface()
+	virtualMachine.SetLogger(tr.logger)
+	virtualMachine.SetVerbose(tr.verbose)
+	virtualMachine.SetDiskFormat(diskFormat)
+	virtualMachine.SetDiskEphemeral(diskEphemeral)
+
+	var nic *netstack.NetworkInterface
+
+	if restore != nil {
+		nic, err = attachSnapshotNetworkInterface(ns, restore)
+	} else {
+		nic, err = ns.AttachNetworkInterface()
+	}
 	if err != nil {
 		return fmt.Errorf("failed to attach network interface: %w", err)
 	}
 
-	// Create internal HTTP server.
+	if tr.cfg.MonitorAddress != "" {
+		virtualMachine.SetMonitorAddress(tr.cfg.MonitorAddress)
+	}
+
+	if restore != nil {
+		virtualMachine.SetLoadSnapshot(snapshot.SNAPSHOT_TAG)
+	}
+
+	// Create the metadata server the guest can query on host.internal.
 	{
 		listen, err := ns.ListenInternal("tcp", ":80")
 		if err != nil {
 			return fmt.Errorf("failed to listen internal: %w", err)
 		}
 
-		mux := http.NewServeMux()
+		tr.metadata = newMetadataServer(tr.cfg, exportedPorts)
+		tr.metadata.logger = tr.logger
 
-		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", 4096*1024*1024))
-			io.CopyN(w, rand.Reader, 4096*1024*1024)
-		})
+		// Probes address the guest as 127.0.0.1.
+		tr.metadata.prober.Dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+
+			return ns.DialInternalContext(ctx, network, net.JoinHostPort("10.42.0.2", port))
+		}
+
+		tr.metadata.onReady = func() {
+			tr.onEvent.Emit(common.Event{Kind: common.EventVMReady})
+
+			if save != nil {
+				go func() {
+					// Give the guest time to receive the response before
+					// pausing it. Otherwise the restored guest would wait
+					// on a connection that no longer exists.
+					time.Sleep(1 * time.Second)
+
+					if err := tr.saveSnapshot(virtualMachine, save, nic); err != nil {
+						tr.logger.Error("failed to save snapshot", "err", err)
+					}
+				}()
+			}
+		}
+
+		tr.metadata.onShutdown = func(report config.ShutdownReport) {
+			tr.onEvent.Emit(common.Event{
+				Kind:     common.EventVMShutdown,
+				Reason:   report.Reason,
+				Error:    report.Error,
+				Services: report.Services,
+			})
+		}
+
+		// A restored guest has already booted so it won't report it's ready.
+		if restore != nil {
+			tr.metadata.guestReady(guestReadyReport{})
+		}
 
 		go func() {
-			slog.Error("failed to serve", "err", http.Serve(listen, mux))
+			tr.logger.Error("failed to serve metadata", "err", tr.metadata.Serve(listen))
 		}()
 	}
 
+	volumes, err := tr.attachVolumes(virtualMachine)
+	if err != nil {
+		return fmt.Errorf("failed to attach volumes: %w", err)
+	}
+
+	tr.metadata.volumes = volumes
+
+	if tr.cfg.CloudInit != nil {
+		if err := tr.attachCloudInit(virtualMachine, nic.MacAddress); err != nil {
+			return err
+		}
+	}
+
 	// Create DNS server.
 	{
 		dnsServer := &dnsServer{
+			logger: tr.logger,
 			dnsLookup: func(name string) (string, error) {
-				if name == "tinyrange." {
+				if name == "tinyrange." || name == tr.metadata.hostname()+"." {
 					return "10.42.0.2", nil
 				} else if name == "host.internal." {
 					return "10.42.0.1", nil
 				}
 
-				slog.Debug("doing DNS lookup", "name", name)
+				tr.logger.Debug("doing DNS lookup", "name", name)
 
 				// Do a DNS lookup on the host.
 				addr, err := net.ResolveIPAddr("ip4", name)
@@ -652,23 +582,35 @@ func (tr *TinyRange) runWithConfig() error {
 		go func() {
 			err := dnsServer.server.ActivateAndServe()
 			if err != nil {
-				slog.Error("dns: failed to start server", "error", err.Error())
+				tr.logger.Error("dns: failed to start server", "error", err.Error())
 			}
 		}()
 	}
 
 	// Create forwarder for SSH connection.
-	if tr.forwardSsh {
-		sshListen, err := net.Listen("tcp", "localhost:2222")
+	if tr.forwardSsh || (tr.instance != nil && interaction != "serial") {
+		sshAddress := "localhost:2222"
+		if tr.instance != nil {
+			// Multiple instances can run at the same time.
+			sshAddress = "127.0.0.1:0"
+		}
+
+		sshListen, err := net.Listen("tcp", sshAddress)
 		if err != nil {
 			return err
 		}
 
+		tr.closeOnExit(sshListen)
+
+		if tr.instance != nil {
+			tr.instance.SshAddress = sshListen.Addr().String()
+		}
+
 		go func() {
 			for {
 				conn, err := sshListen.Accept()
 				if err != nil {
-					slog.Error("failed to accept", "err", err)
+					tr.logger.Error("failed to accept", "err", err)
 					return
 				}
 
@@ -677,13 +619,13 @@ func (tr *TinyRange) runWithConfig() error {
 
 					clientConn, err := ns.DialInternalContext(context.Background(), "tcp", "10.42.0.2:2222")
 					if err != nil {
-						slog.Error("failed to dial vm ssh", "err", err)
+						tr.logger.Error("failed to dial vm ssh", "err", err)
 						return
 					}
 					defer clientConn.Close()
 
 					if err := common.Proxy(clientConn, conn, 4096); err != nil {
-						slog.Error("failed to proxy ssh connection", "err", err)
+						tr.logger.Error("failed to proxy ssh connection", "err", err)
 						return
 					}
 				}()
@@ -697,26 +639,33 @@ func (tr *TinyRange) runWithConfig() error {
 			return err
 		}
 
+		tr.closeOnExit(portListen)
+
 		go func() {
 			for {
 				conn, err := portListen.Accept()
 				if err != nil {
-					slog.Error("failed to accept", "err", err)
+					tr.logger.Error("failed to accept", "err", err)
 					return
 				}
 
 				go func() {
 					defer conn.Close()
 
+					if err := tr.metadata.WaitReady(tr.ctx); err != nil {
+						tr.logger.Error("not forwarding connection", "port", port, "err", err)
+						return
+					}
+
 					clientConn, err := ns.DialInternalContext(context.Background(), "tcp", fmt.Sprintf("10.42.0.2:%d", port))
 					if err != nil {
-						slog.Error("failed to dial vm port", "err", err)
+						tr.logger.Error("failed to dial vm port", "err", err)
 						return
 					}
 					defer clientConn.Close()
 
 					if err := common.Proxy(clientConn, conn, 4096); err != nil {
-						slog.Error("failed to proxy connection", "err", err)
+						tr.logger.Error("failed to proxy connection", "err", err)
 						return
 					}
 				}()
@@ -724,16 +673,41 @@ func (tr *TinyRange) runWithConfig() error {
 		}()
 	}
 
-	slog.Debug("starting virtual machine", "took", time.Since(start))
+	tr.logger.Debug("starting virtual machine", "took", time.Since(start))
+
+	if tr.instance != nil {
+		tr.instance.Interaction = interaction
+		tr.instance.ForwardedPorts = exportedPorts
+
+		return tr.runDetached(virtualMachine, nic)
+	}
+
+	if tr.headless {
+		return tr.runHeadless(virtualMachine, nic)
+	}
+
+	tr.onEvent.Emit(common.Event{Kind: common.EventVMStarting})
 
 	if interaction == "ssh" || interaction == "vnc" {
+		// Stop waiting for the guest if the hypervisor fails.
+		ctx, cancel := context.WithCancelCause(tr.ctx)
+		defer cancel(nil)
+
 		go func() {
 			if err := virtualMachine.Run(nic, tr.debug); err != nil {
-				slog.Error("failed to run virtual machine", "err", err)
-				os.Exit(1)
+				if tr.ctx.Err() != nil {
+					// The virtual machine was stopped because tinyrange
+					// was interrupted.
+					return
+				}
+
+				cancel(fmt.Errorf("failed to run virtual machine: %w", err))
+				return
 			}
+
+			tr.onEvent.Emit(common.Event{Kind: common.EventVMExited})
 		}()
-		defer virtualMachine.Shutdown()
+		defer tr.shutdown(virtualMachine, "ssh session ended")
 
 		// return nil
 
@@ -741,11 +715,22 @@ func (tr *TinyRange) runWithConfig() error {
 			go runVncClient(ns, "10.42.0.2:5901")
 		}
 
+		// Commands run over SSH wait for the services in the guest.
+		if err := tr.metadata.WaitReady(ctx); err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+
+			return fmt.Errorf("guest did not become ready: %w", err)
+		}
+
 		// Start a loop so SSH can be restarted when requested by the user.
 		for {
-			err = connectOverSsh(ns, "10.42.0.2:2222", "root", "insecurepassword")
+			err = connectOverSsh(ctx, dialNetstack(ns), "10.42.0.2:2222", "root", "insecurepassword")
 			if err == ErrRestart {
 				continue
+			} else if ctx.Err() != nil {
+				return context.Cause(ctx)
 			} else if err != nil {
 				return fmt.Errorf("failed to connect over ssh: %w", err)
 			}
@@ -753,10 +738,30 @@ func (tr *TinyRange) runWithConfig() error {
 			return nil
 		}
 	} else if interaction == "serial" {
-		if err := virtualMachine.Run(nic, true); err != nil {
+		stop := context.AfterFunc(tr.ctx, func() {
+			if err := tr.shutdown(virtualMachine, "interrupted"); err != nil {
+				tr.logger.Warn("failed to shutdown virtual machine", "err", err)
+			}
+		})
+		defer stop()
+
+		notReady := tr.stopIfNotReady(virtualMachine)
+
+		err := virtualMachine.Run(nic, true)
+		if readyErr := notReady(); readyErr != nil {
+			return readyErr
+		}
+
+		if err != nil {
+			if ctxErr := tr.ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+
 			return err
 		}
-		defer virtualMachine.Shutdown()
+
+		tr.onEvent.Emit(common.Event{Kind: common.EventVMExited})
+		defer tr.shutdown(virtualMachine, "console exited")
 
 		return nil
 	} else {
@@ -764,24 +769,115 @@ func (tr *TinyRange) runWithConfig() error {
 	}
 }
 
-func RunWithConfig(
-	buildDir string,
-	cfg config.TinyRangeConfig,
-	debug bool,
-	forwardSsh bool,
-	exportFilesystem string,
-	listenNbd string,
-	streamingServer string,
-) error {
+// Stop the virtual machine if the guest has readiness checks and doesn't pass
+// them in time. Used when no host action waits for the guest to be ready. The
+// returned function stops waiting and returns the readiness error if the
+// virtual machine was stopped because of it.
+func (tr *TinyRange) stopIfNotReady(vm *virtualMachine.VirtualMachine) func() error {
+	ctx, cancel := context.WithCancel(tr.ctx)
+	failed := make(chan error, 1)
+
+	go func() {
+		err := tr.metadata.WaitReady(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		tr.logger.Error("stopping virtual machine", "err", err)
+
+		failed <- fmt.Errorf("guest did not become ready: %w", err)
+
+		if err := tr.shutdown(vm, "guest did not become ready"); err != nil {
+			tr.logger.Warn("failed to shutdown virtual machine", "err", err)
+		}
+	}()
+
+	return func() error {
+		cancel()
+
+		select {
+		case err := <-failed:
+			return err
+		default:
+			return nil
+		}
+	}
+}
+
+// Stop the virtual machine. The guest is given ShutdownTimeout seconds to
+// stop its services and power off before the hypervisor is stopped.
+func (tr *TinyRange) shutdown(vm *virtualMachine.VirtualMachine, reason string) error {
+	return tr.shutdownGraceful(vm, reason, tr.shutdownTimeout())
+}
+
+// Ask init in the guest to stop its services and unmount the filesystems
+// before powering off. Guests that don't listen on the control channel get
+// the ACPI power button instead. The hypervisor is stopped if the guest is
+// still running after timeout.
+func (tr *TinyRange) shutdownGraceful(vm *virtualMachine.VirtualMachine, reason string, timeout time.Duration) error {
+	if tr.metadata == nil || !tr.metadata.RequestShutdown(reason, int(timeout/time.Second)) {
+		return vm.ShutdownGraceful(timeout)
+	}
+
+	if !vm.WaitExit(timeout) {
+		tr.logger.Warn("guest did not shutdown in time", "timeout", timeout)
+	}
+
+	return vm.Shutdown()
+}
+
+// The default number of seconds the guest has to shutdown.
+const defaultShutdownTimeout = 10
+
+func (tr *TinyRange) shutdownTimeout() time.Duration {
+	timeout := tr.cfg.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// RunOptions configures RunWithConfig.
+type RunOptions struct {
+	// The directory for built definitions and temporary files.
+	BuildDir string
+	// Connect the hypervisor to the terminal. The guest exits as soon as it
+	// finishes starting.
+	Debug bool
+	// Forward the SSH server of the guest to the host.
+	ForwardSsh bool
+	// Write the root filesystem image to this file on the host.
+	ExportFilesystem string
+	// Listen with a NBD server on this address.
+	ListenNbd string
+	// The address of a streaming server to read the root filesystem from.
+	StreamingServer string
+	// Called as the virtual machine starts, becomes ready and exits.
+	OnEvent common.EventHandler
+	// Where messages are logged (default: slog.Default()).
+	Logger *slog.Logger
+	// Ask the hypervisor script to print more details.
+	Verbose bool
+}
+
+// RunWithConfig runs the virtual machine described by cfg with the
+// interaction from the config. Returns when the session ends or after the
+// virtual machine is shutdown because ctx was cancelled.
+func RunWithConfig(ctx context.Context, cfg config.TinyRangeConfig, opts RunOptions) error {
 	tr := &TinyRange{
-		buildDir:         buildDir,
+		buildDir:         opts.BuildDir,
 		cfg:              cfg,
-		debug:            debug,
-		forwardSsh:       forwardSsh,
-		exportFilesystem: exportFilesystem,
-		listenNbd:        listenNbd,
-		streamingServer:  streamingServer,
+		debug:            opts.Debug,
+		forwardSsh:       opts.ForwardSsh,
+		exportFilesystem: opts.ExportFilesystem,
+		listenNbd:        opts.ListenNbd,
+		streamingServer:  opts.StreamingServer,
 		client:           http.DefaultClient,
+		ctx:              ctx,
+		onEvent:          opts.OnEvent,
+		logger:           opts.Logger,
+		verbose:          opts.Verbose,
 	}
 
 	return tr.runWithConfig()
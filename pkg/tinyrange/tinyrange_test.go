@@ -0,0 +1,42 @@
+package tinyrange
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+func TestWriteLayerReport(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "layers.txt")
+
+	tr := &TinyRange{
+		cfg: config.TinyRangeConfig{LayerReportFilename: filename},
+		layerChanges: []filesystem.LayerChange{
+			{Action: "replaced", Path: "/etc/motd", Layer: "file_contents"},
+			{Action: "removed", Path: "/etc/hostname", Layer: "layer.tar"},
+		},
+	}
+
+	if err := tr.writeLayerReport(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "replaced\t/etc/motd\tfile_contents\nremoved\t/etc/hostname\tlayer.tar\n"
+	if string(report) != expected {
+		t.Fatalf("expected %q, got %q", expected, report)
+	}
+
+	// Nothing is written without a filename.
+	tr.cfg.LayerReportFilename = ""
+	if err := tr.writeLayerReport(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package tinyrange
+
+import (
+	"fmt"
+
+	virtualMachine "github.com/tinyrange/tinyrange/pkg/vm"
+	"github.com/tinyrange/tinyrange/pkg/volume"
+)
+
+// A volume as seen by the guest. Returned by /v1/volumes on the metadata server.
+type guestVolume struct {
+	Name       string `json:"name"`
+	Device     string `json:"device"`
+	MountPoint string `json:"mount_point"`
+	Mode       string `json:"mode"`
+	ReadOnly   bool   `json:"read_only"`
+}
+
+// Attach all volumes from the config to the virtual machine and return the
+// guest view of them.
+func (tr *TinyRange) attachVolumes(vm *virtualMachine.VirtualMachine) ([]guestVolume, error) {
+	var ret []guestVolume
+
+	for i, cfg := range tr.cfg.Volumes {
+		if i >= 25 {
+			return nil, fmt.Errorf("too many volumes attached")
+		}
+
+		var (
+			name     string
+			filename string
+		)
+
+		if cfg.HostFilename != "" {
+			name = fmt.Sprintf("volume%d", i)
+			filename = tr.cfg.Resolve(cfg.HostFilename)
+		} else if cfg.Name != "" {
+			vol, err := volume.Get(tr.buildDir, cfg.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			name = vol.Name
+			filename = vol.Filename
+		} else {
+			return nil, fmt.Errorf("volume %d has no name or host filename", i)
+		}
+
+		if cfg.MountPoint == "" {
+			return nil, fmt.Errorf("volume %s has no mount point", name)
+		}
+
+		mode := cfg.Mode
+		if mode == "" {
+			mode = "disk"
+		}
+
+		switch mode {
+		case "disk":
+		case "overlay":
+			if cfg.ReadOnly {
+				return nil, fmt.Errorf("volume %s: overlay volumes can not be read-only", name)
+			}
+		default:
+			return nil, fmt.Errorf("volume %s: unknown mode: %s", name, mode)
+		}
+
+		// Held until the virtual machine exits.
+		lock, err := volume.Lock(filename, cfg.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+
+		tr.closeOnExit(lock)
+
+		vm.AddDisk(filename, "raw", cfg.ReadOnly)
+
+		ret = append(ret, guestVolume{
+			Name: name,
+			// The root filesystem is /dev/vda so volumes start at /dev/vdb.
+			Device:     fmt.Sprintf("/dev/vd%c", 'b'+i),
+			MountPoint: cfg.MountPoint,
+			Mode:       mode,
+			ReadOnly:   cfg.ReadOnly,
+		})
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,255 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"go.starlark.net/starlark"
+)
+
+// Wait up to timeout for the hypervisor process to exit. Returns true if it
+// has exited.
+func (vm *VirtualMachine) waitForExit(timeout time.Duration) bool {
+	vm.mtx.Lock()
+	exited := vm.exited
+	vm.mtx.Unlock()
+
+	if exited == nil {
+		return true
+	}
+
+	select {
+	case <-exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// WaitExit waits up to timeout for the hypervisor to exit. Returns true if it
+// has exited.
+func (vm *VirtualMachine) WaitExit(timeout time.Duration) bool {
+	return vm.waitForExit(timeout)
+}
+
+func (vm *VirtualMachine) closeMonitor() {
+	vm.monitorMtx.Lock()
+	defer vm.monitorMtx.Unlock()
+
+	if vm.monitor != nil {
+		vm.monitor.Close()
+		vm.monitor = nil
+	}
+}
+
+// Shutdown stops the virtual machine without waiting for the guest. If the
+// monitor is available the hypervisor is asked to quit so disk images are
+// flushed and closed before falling back to killing the process.
+func (vm *VirtualMachine) Shutdown() error {
+	defer vm.closeMonitor()
+
+	if vm.waitForExit(0) {
+		return nil
+	}
+
+	if monitor, err := vm.monitorWithTimeout(1 * time.Second); err == nil {
+		if err := monitor.Quit(); err != nil {
+			vm.log().Debug("failed to quit hypervisor", "err", err)
+		} else if vm.waitForExit(5 * time.Second) {
+			return nil
+		}
+	}
+
+	vm.mtx.Lock()
+	defer vm.mtx.Unlock()
+
+	if vm.cmd != nil && vm.cmd.Process != nil {
+		if vm.processGroup {
+			return common.KillProcessGroup(vm.cmd)
+		}
+
+		return vm.cmd.Process.Kill()
+	}
+	return nil
+}
+
+// ShutdownGraceful asks the guest to power off and waits up to timeout for
+// the hypervisor to exit before calling Shutdown. The request is made by the
+// shutdown function of the hypervisor script if it has one otherwise the ACPI
+// power button is pressed.
+func (vm *VirtualMachine) ShutdownGraceful(timeout time.Duration) error {
+	if vm.waitForExit(0) {
+		vm.closeMonitor()
+		return nil
+	}
+
+	var err error
+
+	if vm.factory.shutdown != nil {
+		_, err = starlark.Call(
+			&starlark.Thread{Name: "VirtualMachine"},
+			vm.factory.shutdown,
+			starlark.Tuple{vm},
+			[]starlark.Tuple{},
+		)
+	} else {
+		err = vm.Powerdown()
+	}
+
+	if err != nil {
+		vm.log().Warn("failed to request graceful shutdown", "err", err)
+	} else if vm.waitForExit(timeout) {
+		vm.closeMonitor()
+		return nil
+	} else {
+		vm.log().Warn("guest did not shutdown in time", "timeout", timeout)
+	}
+
+	return vm.Shutdown()
+}
+
+// Status returns the run state of the virtual machine.
+func (vm *VirtualMachine) Status() (*Status, error) {
+	monitor, err := vm.Monitor()
+	if err != nil {
+		return nil, err
+	}
+
+	return monitor.Status()
+}
+
+// Pause stops all guest CPUs.
+func (vm *VirtualMachine) Pause() error {
+	monitor, err := vm.Monitor()
+	if err != nil {
+		return err
+	}
+
+	return monitor.Pause()
+}
+
+// Resume starts guest CPUs after Pause.
+func (vm *VirtualMachine) Resume() error {
+	monitor, err := vm.Monitor()
+	if err != nil {
+		return err
+	}
+
+	return monitor.Resume()
+}
+
+// Powerdown presses the ACPI power button without waiting for the guest.
+func (vm *VirtualMachine) Powerdown() error {
+	monitor, err := vm.Monitor()
+	if err != nil {
+		return err
+	}
+
+	return monitor.SystemPowerdown()
+}
+
+// The monitor operations available to the hypervisor script as methods on
+// the VirtualMachine. They can only be used once the hypervisor is running
+// for example in the shutdown function.
+func (vm *VirtualMachine) lifecycleBuiltins() map[string]*starlark.Builtin {
+	noArgs := func(name string, f func() error) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+				return starlark.None, err
+			}
+
+			if err := f(); err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.None, nil
+		})
+	}
+
+	return map[string]*starlark.Builtin{
+		"pause":     noArgs("pause", vm.Pause),
+		"resume":    noArgs("resume", vm.Resume),
+		"powerdown": noArgs("powerdown", vm.Powerdown),
+		"status": starlark.NewBuiltin("status", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+				return starlark.None, err
+			}
+
+			status, err := vm.Status()
+			if err != nil {
+				return starlark.None, err
+			}
+
+			return starlark.String(status.Status), nil
+		}),
+		// qmp(command, **arguments) executes a raw QMP command and returns
+		// the decoded result.
+		"qmp": starlark.NewBuiltin("qmp", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				command string
+			)
+
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, nil, 1,
+				&command,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			var arguments any
+
+			if len(kwargs) > 0 {
+				dict := starlark.NewDict(len(kwargs))
+
+				for _, kv := range kwargs {
+					dict.SetKey(kv[0], kv[1])
+				}
+
+				encoded, err := common.StarlarkJsonEncode(thread, starlark.Tuple{dict}, []starlark.Tuple{})
+				if err != nil {
+					return starlark.None, err
+				}
+
+				arguments = json.RawMessage(encoded.(starlark.String))
+			}
+
+			monitor, err := vm.Monitor()
+			if err != nil {
+				return starlark.None, err
+			}
+
+			var ret json.RawMessage
+
+			if err := monitor.Execute(command, arguments, &ret); err != nil {
+				return starlark.None, err
+			}
+
+			if ret == nil {
+				return starlark.None, nil
+			}
+
+			val, err := common.StarlarkJsonDecode(thread, starlark.Tuple{starlark.String(ret)}, []starlark.Tuple{})
+			if err != nil {
+				return starlark.None, fmt.Errorf("failed to decode result of %s: %w", command, err)
+			}
+
+			return val, nil
+		}),
+	}
+}
@@ -0,0 +1,254 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type qmpError struct {
+	Class       string `json:"class"`
+	Description string `json:"desc"`
+}
+
+// Error implements error.
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", e.Class, e.Description)
+}
+
+type qmpCommand struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	Greeting json.RawMessage `json:"QMP,omitempty"`
+	Return   json.RawMessage `json:"return,omitempty"`
+	Error    *qmpError       `json:"error,omitempty"`
+	Event    string          `json:"event,omitempty"`
+}
+
+// Monitor is a connection to the QEMU Machine Protocol (QMP) server of a
+// running hypervisor. Commands are executed one at a time.
+type Monitor struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+	mtx  sync.Mutex
+	// Set after a I/O error. The connection can't be used again since the
+	// next response might belong to the failed command.
+	failed bool
+}
+
+// Return true if the connection failed and a new one has to be made.
+func (m *Monitor) broken() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.failed
+}
+
+func (m *Monitor) readResponse() (*qmpResponse, error) {
+	for {
+		var resp qmpResponse
+
+		if err := m.dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("qmp: failed to read response: %w", err)
+		}
+
+		// Asynchronous events can arrive at any point. Skip them.
+		if resp.Event != "" {
+			continue
+		}
+
+		return &resp, nil
+	}
+}
+
+// Execute runs a QMP command. If ret is not nil the return value of the
+// command is decoded into it.
+func (m *Monitor) Execute(command string, args any, ret any) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if err := m.enc.Encode(&qmpCommand{Execute: command, Arguments: args}); err != nil {
+		m.failed = true
+		return fmt.Errorf("qmp: failed to send command: %w", err)
+	}
+
+	resp, err := m.readResponse()
+	if err != nil {
+		m.failed = true
+		return err
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	if ret != nil && resp.Return != nil {
+		if err := json.Unmarshal(resp.Return, ret); err != nil {
+			return fmt.Errorf("qmp: failed to decode return value of %s: %w", command, err)
+		}
+	}
+
+	return nil
+}
+
+// HumanMonitorCommand runs a command using the human monitor (HMP) and
+// returns its output. Used for commands like savevm that have no stable QMP
+// equivalent across QEMU versions.
+func (m *Monitor) HumanMonitorCommand(commandLine string) (string, error) {
+	var output string
+
+	if err := m.Execute("human-monitor-command", map[string]string{
+		"command-line": commandLine,
+	}, &output); err != nil {
+		return "", err
+	}
+
+	return output, nil
+}
+
+func (m *Monitor) Close() error {
+	return m.conn.Close()
+}
+
+// Connect to a QMP server listening on the unix socket at address. Since the
+// hypervisor might still be starting the connection is retried until ctx is
+// done.
+func DialMonitor(ctx context.Context, address string) (*Monitor, error) {
+	var dialer net.Dialer
+
+	for {
+		conn, err := dialer.DialContext(ctx, "unix", address)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("failed to connect to monitor: %w", err)
+			case <-time.After(50 * time.Millisecond):
+				continue
+			}
+		}
+
+		m := &Monitor{
+			conn: conn,
+			dec:  json.NewDecoder(conn),
+			enc:  json.NewEncoder(conn),
+		}
+
+		// The server starts by sending a greeting. Capabilities negotiation
+		// has to happen before any other commands are accepted.
+		greeting, err := m.readResponse()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if greeting.Greeting == nil {
+			conn.Close()
+			return nil, fmt.Errorf("qmp: expected greeting")
+		}
+
+		if err := m.Execute("qmp_capabilities", nil, nil); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return m, nil
+	}
+}
+
+// The run state of the virtual machine as reported by query-status.
+type Status struct {
+	// True if the guest CPUs are running.
+	Running bool `json:"running"`
+	// The QEMU run state (for example running, paused, shutdown or
+	// inmigrate).
+	Status string `json:"status"`
+}
+
+// Status returns the current run state of the virtual machine.
+func (m *Monitor) Status() (*Status, error) {
+	var status Status
+
+	if err := m.Execute("query-status", nil, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Pause stops all guest CPUs. The guest clock doesn't advance while paused.
+func (m *Monitor) Pause() error {
+	return m.Execute("stop", nil, nil)
+}
+
+// Resume starts guest CPUs after Pause or after a snapshot was loaded.
+func (m *Monitor) Resume() error {
+	return m.Execute("cont", nil, nil)
+}
+
+// SystemPowerdown presses the ACPI power button. The guest decides how to
+// respond so this returns before the guest has shutdown.
+func (m *Monitor) SystemPowerdown() error {
+	return m.Execute("system_powerdown", nil, nil)
+}
+
+// Quit makes the hypervisor flush and close all disk images and then exit.
+// Data the guest has not written to disk yet is lost.
+func (m *Monitor) Quit() error {
+	// The hypervisor might close the connection before replying.
+	if err := m.Execute("quit", nil, nil); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// DeviceAdd hot-plugs a device using a QEMU device driver (for example
+// virtio-blk-pci or virtio-net-pci) with the given id and properties.
+func (m *Monitor) DeviceAdd(driver string, id string, properties map[string]any) error {
+	args := map[string]any{
+		"driver": driver,
+		"id":     id,
+	}
+
+	for k, v := range properties {
+		args[k] = v
+	}
+
+	return m.Execute("device_add", args, nil)
+}
+
+// DeviceDel requests a hot-plugged device be removed. Removal completes
+// asynchronously once the guest releases the device.
+func (m *Monitor) DeviceDel(id string) error {
+	return m.Execute("device_del", map[string]any{"id": id}, nil)
+}
+
+// AddDisk hot-plugs a disk image as a virtio-blk device named id.
+func (m *Monitor) AddDisk(id string, filename string, format string, readOnly bool) error {
+	if err := m.Execute("blockdev-add", map[string]any{
+		"node-name": id,
+		"driver":    format,
+		"read-only": readOnly,
+		"file": map[string]any{
+			"driver":   "file",
+			"filename": filename,
+		},
+	}, nil); err != nil {
+		return fmt.Errorf("failed to add block device: %w", err)
+	}
+
+	if err := m.DeviceAdd("virtio-blk-pci", id, map[string]any{"drive": id}); err != nil {
+		return fmt.Errorf("failed to add disk device: %w", err)
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
@@ -39,6 +41,19 @@ var (
 	_ starlark.Value = &vmmFactoryExecutable{}
 )
 
+// Where the guest can find its cloud-init NoCloud seed.
+type cloudInitSource struct {
+	seedImage string
+	url       string
+}
+
+// A extra disk attached after the root device.
+type disk struct {
+	filename string
+	format   string
+	readOnly bool
+}
+
 type VirtualMachine struct {
 	factory      *VirtualMachineFactory
 	cpuCores     int
@@ -47,43 +62,231 @@ type VirtualMachine struct {
 	kernel       string
 	initrd       string
 	diskImage    string
-	interaction  string
-	nic          *netstack.NetworkInterface
-	cmd          *exec.Cmd
+	diskFormat   string
+	// If true writes to the disk image are discarded when the VM exits.
+	diskEphemeral bool
+	interaction   string
+	cloudInit     cloudInitSource
+	disks         []disk
+	nic           *netstack.NetworkInterface
+	console       io.ReadWriter
+	cmd           *exec.Cmd
+	// If true the hypervisor was started in its own process group.
+	processGroup bool
+	exited       chan struct{}
 	mtx          sync.Mutex
+
+	// The unix socket of the QMP server or "" if the monitor is disabled.
+	monitorAddress string
+	// The private directory holding monitorAddress if it was picked by
+	// enableMonitor. Removed once the hypervisor exits.
+	monitorDir string
+	monitor    *Monitor
+	monitorMtx sync.Mutex
+
+	// The name of a saved state to load on startup.
+	loadSnapshot string
+
+	logger  *slog.Logger
+	verbose bool
 }
 
 func (vm *VirtualMachine) runExecutable(exe *vmmFactoryExecutable, bindOutput bool) error {
 	vm.mtx.Lock()
 
-	slog.Debug("running hypervisor", "command", exe.command, "args", exe.args)
+	vm.log().Debug("running hypervisor", "command", exe.command, "args", exe.args)
 
 	vm.cmd = exec.Command(exe.command, exe.args...)
 
+	// Don't leave the hypervisor running if tinyrange is killed.
+	common.KillWithParent(vm.cmd)
+
 	if bindOutput {
 		vm.cmd.Stdout = os.Stdout
 		vm.cmd.Stderr = os.Stderr
 		vm.cmd.Stdin = os.Stdin
+	} else if vm.console != nil {
+		vm.cmd.Stdout = vm.console
+		vm.cmd.Stderr = vm.console
+		vm.cmd.Stdin = vm.console
+
+		// Reads from the console block until the next input so don't wait
+		// for them once the hypervisor has exited.
+		vm.cmd.WaitDelay = 1 * time.Second
+	}
+
+	// The hypervisor only needs to be in the foreground process group if it's
+	// reading from the terminal.
+	if !bindOutput {
+		common.StartProcessGroup(vm.cmd)
+		vm.processGroup = true
 	}
 
+	vm.exited = make(chan struct{})
+
 	vm.mtx.Unlock()
 
+	defer close(vm.exited)
+
 	return vm.cmd.Run()
 }
 
-func (vm *VirtualMachine) Shutdown() error {
-	vm.mtx.Lock()
-	defer vm.mtx.Unlock()
+// Set the format of the disk image (options: [raw, qcow2], default: raw).
+func (vm *VirtualMachine) SetDiskFormat(format string) {
+	vm.diskFormat = format
+}
+
+// Set if writes to the disk image should be discarded when the VM exits
+// (default: true). Disk images shared with the host like cloud images are
+// ephemeral while snapshot overlays are written to directly.
+func (vm *VirtualMachine) SetDiskEphemeral(ephemeral bool) {
+	vm.diskEphemeral = ephemeral
+}
+
+// Set the unix socket the QMP monitor listens on. By default a socket in a
+// private directory is created when the virtual machine is started.
+func (vm *VirtualMachine) SetMonitorAddress(address string) {
+	vm.monitorAddress = address
+}
+
+func (vm *VirtualMachine) enableMonitor() error {
+	// The monitor gives full control over the guest so only the current user
+	// can connect to it.
+	dir, err := os.MkdirTemp("", "tinyrange-vm-")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	vm.monitorDir = dir
+	vm.monitorAddress = filepath.Join(dir, "qmp.sock")
+
+	return nil
+}
+
+// MonitorAddress returns the unix socket of the QMP monitor creating one if
+// it hasn't been set.
+func (vm *VirtualMachine) MonitorAddress() (string, error) {
+	if vm.monitorAddress == "" {
+		if err := vm.enableMonitor(); err != nil {
+			return "", fmt.Errorf("failed to enable monitor: %w", err)
+		}
+	}
+
+	return vm.monitorAddress, nil
+}
+
+// Monitor returns the connection to the hypervisor monitor. The connection is
+// made the first time it's requested and is kept open until Shutdown.
+func (vm *VirtualMachine) Monitor() (*Monitor, error) {
+	return vm.monitorWithTimeout(10 * time.Second)
+}
+
+func (vm *VirtualMachine) monitorWithTimeout(timeout time.Duration) (*Monitor, error) {
+	vm.monitorMtx.Lock()
+	defer vm.monitorMtx.Unlock()
+
+	if vm.monitor != nil {
+		// Reconnect if the connection was broken by a earlier command.
+		if !vm.monitor.broken() {
+			return vm.monitor, nil
+		}
+
+		vm.monitor.Close()
+		vm.monitor = nil
+	}
+
+	if vm.monitorAddress == "" {
+		return nil, fmt.Errorf("monitor is not enabled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	monitor, err := DialMonitor(ctx, vm.monitorAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.monitor = monitor
+
+	return monitor, nil
+}
 
-	if vm.cmd != nil {
-		return vm.cmd.Process.Kill()
+// Save the complete state of the running virtual machine (memory, devices and
+// disks) inside the disk image under tag. The disk image must support
+// snapshots (qcow2).
+func (vm *VirtualMachine) SaveSnapshot(tag string) error {
+	monitor, err := vm.Monitor()
+	if err != nil {
+		return err
+	}
+
+	output, err := monitor.HumanMonitorCommand("savevm " + tag)
+	if err != nil {
+		return err
 	}
+
+	// savevm only prints output on failure.
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("failed to save snapshot: %s", output)
+	}
+
 	return nil
 }
 
+// Load the state saved under tag when the virtual machine is started.
+func (vm *VirtualMachine) SetLoadSnapshot(tag string) {
+	vm.loadSnapshot = tag
+}
+
+// Log messages about the hypervisor to logger instead of slog.Default().
+func (vm *VirtualMachine) SetLogger(logger *slog.Logger) {
+	vm.logger = logger
+}
+
+func (vm *VirtualMachine) log() *slog.Logger {
+	if vm.logger == nil {
+		return slog.Default()
+	}
+
+	return vm.logger
+}
+
+// Ask the hypervisor script to print more details about the guest.
+func (vm *VirtualMachine) SetVerbose(verbose bool) {
+	vm.verbose = verbose
+}
+
+// Connect the hypervisor console to rw instead of discarding it when the
+// output isn't bound to the terminal.
+func (vm *VirtualMachine) SetConsole(rw io.ReadWriter) {
+	vm.console = rw
+}
+
+// Attach an additional virtio-blk disk. Disks appear in the guest in the
+// order they are added starting at /dev/vdb.
+func (vm *VirtualMachine) AddDisk(filename string, format string, readOnly bool) {
+	vm.disks = append(vm.disks, disk{filename: filename, format: format, readOnly: readOnly})
+}
+
+// Pass a cloud-init NoCloud seed to the guest either as a disk image labeled
+// cidata or as a URL the seed can be downloaded from.
+func (vm *VirtualMachine) SetCloudInit(seedImage string, url string) {
+	vm.cloudInit = cloudInitSource{seedImage: seedImage, url: url}
+}
+
 func (vm *VirtualMachine) Run(nic *netstack.NetworkInterface, bindOutput bool) error {
 	vm.nic = nic
 
+	if _, err := vm.MonitorAddress(); err != nil {
+		return err
+	}
+
 	ret, err := starlark.Call(
 		&starlark.Thread{Name: "VirtualMachine"},
 		vm.factory.callable,
@@ -95,6 +298,10 @@ func (vm *VirtualMachine) Run(nic *netstack.NetworkInterface, bindOutput bool) e
 	}
 
 	if exec, ok := ret.(*vmmFactoryExecutable); ok {
+		if vm.monitorDir != "" {
+			defer os.RemoveAll(vm.monitorDir)
+		}
+
 		return vm.runExecutable(exec, bindOutput)
 	} else {
 		return fmt.Errorf("expected Executable got %s", ret.Type())
@@ -115,6 +322,28 @@ func (vm *VirtualMachine) Attr(name string) (starlark.Value, error) {
 		return starlark.String(vm.initrd), nil
 	} else if name == "disk_image" {
 		return starlark.String(vm.diskImage), nil
+	} else if name == "disk_format" {
+		return starlark.String(vm.diskFormat), nil
+	} else if name == "disk_ephemeral" {
+		return starlark.Bool(vm.diskEphemeral), nil
+	} else if name == "disks" {
+		var disks []starlark.Value
+
+		for _, disk := range vm.disks {
+			dict := starlark.NewDict(3)
+
+			dict.SetKey(starlark.String("filename"), starlark.String(disk.filename))
+			dict.SetKey(starlark.String("format"), starlark.String(disk.format))
+			dict.SetKey(starlark.String("read_only"), starlark.Bool(disk.readOnly))
+
+			disks = append(disks, dict)
+		}
+
+		return starlark.NewList(disks), nil
+	} else if name == "cloud_init_seed" {
+		return starlark.String(vm.cloudInit.seedImage), nil
+	} else if name == "cloud_init_url" {
+		return starlark.String(vm.cloudInit.url), nil
 	} else if name == "net_send" {
 		return starlark.String(vm.nic.NetSend), nil
 	} else if name == "net_recv" {
@@ -128,7 +357,7 @@ func (vm *VirtualMachine) Attr(name string) (starlark.Value, error) {
 			return starlark.False, nil
 		}
 	} else if name == "verbose" {
-		if common.IsVerbose() {
+		if vm.verbose {
 			return starlark.True, nil
 		} else {
 			return starlark.False, nil
@@ -139,6 +368,12 @@ func (vm *VirtualMachine) Attr(name string) (starlark.Value, error) {
 		return starlark.String(runtime.GOOS), nil
 	} else if name == "interaction" {
 		return starlark.String(vm.interaction), nil
+	} else if name == "monitor" {
+		return starlark.String(vm.monitorAddress), nil
+	} else if name == "load_snapshot" {
+		return starlark.String(vm.loadSnapshot), nil
+	} else if builtin, ok := vm.lifecycleBuiltins()[name]; ok {
+		return builtin, nil
 	} else {
 		return nil, nil
 	}
@@ -153,12 +388,24 @@ func (vm *VirtualMachine) AttrNames() []string {
 		"kernel",
 		"initrd",
 		"disk_image",
+		"disk_format",
+		"disk_ephemeral",
+		"disks",
+		"cloud_init_seed",
+		"cloud_init_url",
 		"net_send",
 		"net_recv",
 		"mac_address",
 		"accelerate",
 		"verbose",
 		"os",
+		"monitor",
+		"load_snapshot",
+		"status",
+		"pause",
+		"resume",
+		"powerdown",
+		"qmp",
 	}
 }
 
@@ -178,6 +425,8 @@ var (
 type VirtualMachineFactory struct {
 	buildDir string
 	callable starlark.Callable
+	// An optional function called to request the guest shutdown gracefully.
+	shutdown starlark.Callable
 }
 
 func (factory *VirtualMachineFactory) load(filename string) error {
@@ -376,6 +625,15 @@ func (factory *VirtualMachineFactory) load(filename string) error {
 
 	factory.callable = callable
 
+	if shutdownFunc, ok := declared["shutdown"]; ok {
+		shutdown, ok := shutdownFunc.(starlark.Callable)
+		if !ok {
+			return fmt.Errorf("expected Callable got %s", shutdownFunc.Type())
+		}
+
+		factory.shutdown = shutdown
+	}
+
 	return nil
 }
 
@@ -389,14 +647,16 @@ func (factory *VirtualMachineFactory) Create(
 	interaction string,
 ) (*VirtualMachine, error) {
 	return &VirtualMachine{
-		factory:      factory,
-		cpuCores:     cpuCores,
-		memoryMb:     memoryMb,
-		architecture: architecture,
-		kernel:       kernel,
-		initrd:       initrd,
-		diskImage:    diskImage,
-		interaction:  interaction,
+		factory:       factory,
+		cpuCores:      cpuCores,
+		memoryMb:      memoryMb,
+		architecture:  architecture,
+		kernel:        kernel,
+		initrd:        initrd,
+		diskImage:     diskImage,
+		diskFormat:    "raw",
+		diskEphemeral: true,
+		interaction:   interaction,
 	}, nil
 }
 
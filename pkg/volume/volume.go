@@ -0,0 +1,235 @@
+// Package volume manages persistent disks that can be attached to virtual
+// machines and survive between runs.
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
+	"github.com/tinyrange/vm"
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type Volume struct {
+	// The name of the volume.
+	Name string `json:"name"`
+	// The absolute path of the raw ext4 disk image.
+	Filename string `json:"filename"`
+	// The size of the disk image in megabytes.
+	SizeMB int `json:"size_mb"`
+	// True if the image lives at a host path outside the build directory.
+	// Removing the volume leaves the image in place.
+	External bool `json:"external"`
+	// When the volume was created.
+	Created time.Time `json:"created"`
+}
+
+func volumeDir(buildDir string) string {
+	return filepath.Join(buildDir, "volumes")
+}
+
+func metadataFilename(buildDir string, name string) string {
+	return filepath.Join(volumeDir(buildDir), name+".json")
+}
+
+func format(filename string, sizeMB int) error {
+	size := int64(sizeMB) * 1024 * 1024
+
+	vmem := vm.NewVirtualMemory(size, 4096)
+
+	fs, err := ext4.CreateExt4Filesystem(vmem, 0, size)
+	if err != nil {
+		return fmt.Errorf("failed to create ext4 filesystem: %w", err)
+	}
+
+	// Volumes outlive the virtual machine so they need to survive a unclean
+	// shutdown. Volumes under 8MB are too small for a journal.
+	if ext4.DefaultJournalBlocks(size/4096) > 0 {
+		if err := fs.AddJournal(ext4.JournalOptions{}); err != nil {
+			return fmt.Errorf("failed to create journal: %w", err)
+		}
+	}
+
+	out, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := common.WriteSparse(out, vmem, size); err != nil {
+		os.Remove(filename)
+		return fmt.Errorf("failed to write volume: %w", err)
+	}
+
+	return nil
+}
+
+// Create a new volume formatted as ext4. If hostFilename is empty the image
+// is stored in the build directory. If hostFilename already exists it's
+// registered as is without being formatted.
+func Create(buildDir string, name string, sizeMB int, hostFilename string) (*Volume, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name: %q", name)
+	}
+
+	if err := common.Ensure(volumeDir(buildDir), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if ok, _ := common.Exists(metadataFilename(buildDir, name)); ok {
+		return nil, fmt.Errorf("volume %s already exists", name)
+	}
+
+	vol := &Volume{
+		Name:    name,
+		SizeMB:  sizeMB,
+		Created: time.Now(),
+	}
+
+	if hostFilename != "" {
+		filename, err := filepath.Abs(hostFilename)
+		if err != nil {
+			return nil, err
+		}
+
+		vol.Filename = filename
+		vol.External = true
+	} else {
+		vol.Filename = filepath.Join(volumeDir(buildDir), name+".img")
+	}
+
+	if info, err := os.Stat(vol.Filename); err == nil && vol.External {
+		vol.SizeMB = int(info.Size() / 1024 / 1024)
+	} else if err == nil {
+		return nil, fmt.Errorf("volume image %s already exists", vol.Filename)
+	} else {
+		if sizeMB <= 0 {
+			return nil, fmt.Errorf("invalid volume size: %d", sizeMB)
+		}
+
+		if err := format(vol.Filename, sizeMB); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata, err := json.MarshalIndent(vol, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(metadataFilename(buildDir, name), metadata, 0644); err != nil {
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+// Get looks up a volume by name.
+func Get(buildDir string, name string) (*Volume, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name: %q", name)
+	}
+
+	metadata, err := os.ReadFile(metadataFilename(buildDir, name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("volume %s does not exist", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var vol Volume
+
+	if err := json.Unmarshal(metadata, &vol); err != nil {
+		return nil, fmt.Errorf("failed to read volume %s: %w", name, err)
+	}
+
+	return &vol, nil
+}
+
+// List returns all volumes in the build directory sorted by name.
+func List(buildDir string) ([]*Volume, error) {
+	ents, err := os.ReadDir(volumeDir(buildDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ret []*Volume
+
+	for _, ent := range ents {
+		name, ok := strings.CutSuffix(ent.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		vol, err := Get(buildDir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, vol)
+	}
+
+	return ret, nil
+}
+
+// Lock the image at filename while a virtual machine uses it. Writable
+// images are locked exclusively so they can't be attached to two virtual
+// machines at once while read-only images can be shared. The lock is held
+// on a file next to the image until the returned file is closed.
+func Lock(filename string, readOnly bool) (io.Closer, error) {
+	f, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock volume: %w", err)
+	}
+
+	if err := lockFile(f, !readOnly); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("volume %s is in use by another virtual machine", filename)
+	}
+
+	return f, nil
+}
+
+// Remove deletes a volume. External images are left on the host. Volumes in
+// use by a virtual machine can't be removed.
+func Remove(buildDir string, name string) error {
+	vol, err := Get(buildDir, name)
+	if err != nil {
+		return err
+	}
+
+	lock, err := Lock(vol.Filename, false)
+	if err != nil {
+		return err
+	}
+
+	if !vol.External {
+		if err := os.Remove(vol.Filename); err != nil && !os.IsNotExist(err) {
+			lock.Close()
+			return err
+		}
+	}
+
+	if err := os.Remove(metadataFilename(buildDir, name)); err != nil {
+		lock.Close()
+		return err
+	}
+
+	// Windows can't remove files that are open.
+	if err := lock.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(vol.Filename + ".lock")
+}
@@ -0,0 +1,250 @@
+package volume
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/internal/fscktest"
+)
+
+// Check filename contains a ext4 filesystem of sizeMB megabytes.
+func checkImage(t *testing.T, filename string, sizeMB int) {
+	t.Helper()
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != int64(sizeMB)*1024*1024 {
+		t.Fatalf("expected a %dMB image, got %d bytes", sizeMB, info.Size())
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sb := make([]byte, 1024)
+	if _, err := f.ReadAt(sb, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if magic := binary.LittleEndian.Uint16(sb[56:]); magic != 0xEF53 {
+		t.Fatalf("expected a ext4 superblock, got magic %x", magic)
+	}
+
+	fscktest.Check(t, filename)
+}
+
+func TestCreate(t *testing.T) {
+	buildDir := t.TempDir()
+
+	// Volumes under 8MB don't have a journal.
+	for _, tc := range []struct {
+		name   string
+		sizeMB int
+	}{
+		{"small", 4},
+		{"home", 64},
+	} {
+		vol, err := Create(buildDir, tc.name, tc.sizeMB, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vol.External || vol.SizeMB != tc.sizeMB || vol.Filename != filepath.Join(buildDir, "volumes", tc.name+".img") {
+			t.Fatalf("unexpected volume: %+v", vol)
+		}
+
+		checkImage(t, vol.Filename, tc.sizeMB)
+
+		got, err := Get(buildDir, tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Name != vol.Name || got.Filename != vol.Filename || got.SizeMB != vol.SizeMB || !got.Created.Equal(vol.Created) {
+			t.Fatalf("expected %+v, got %+v", vol, got)
+		}
+	}
+
+	if _, err := Create(buildDir, "home", 64, ""); err == nil {
+		t.Fatal("expected creating a existing volume to fail")
+	}
+
+	vols, err := List(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vols) != 2 || vols[0].Name != "home" || vols[1].Name != "small" {
+		t.Fatalf("unexpected volumes: %+v", vols)
+	}
+
+	if err := Remove(buildDir, "home"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(buildDir, "volumes", "home.img")); !os.IsNotExist(err) {
+		t.Fatalf("expected the image to be removed: %v", err)
+	}
+
+	if _, err := Get(buildDir, "home"); err == nil {
+		t.Fatal("expected the volume to be removed")
+	}
+}
+
+func TestCreateExternal(t *testing.T) {
+	buildDir := t.TempDir()
+	hostDir := t.TempDir()
+
+	// A new host image is formatted with the requested size.
+	vol, err := Create(buildDir, "new", 16, filepath.Join(hostDir, "new.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vol.External || vol.SizeMB != 16 {
+		t.Fatalf("unexpected volume: %+v", vol)
+	}
+
+	checkImage(t, vol.Filename, 16)
+
+	// A existing image is registered as is and the size is taken from the
+	// image rather than the arguments.
+	existing := filepath.Join(hostDir, "existing.img")
+	if err := os.WriteFile(existing, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(existing, 48*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	vol, err = Create(buildDir, "existing", 8, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !vol.External || vol.SizeMB != 48 || vol.Filename != existing {
+		t.Fatalf("unexpected volume: %+v", vol)
+	}
+
+	contents, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents[:8]) != "contents" {
+		t.Fatal("expected the existing image not to be formatted")
+	}
+
+	// Removing a external volume leaves the image on the host.
+	if err := Remove(buildDir, "existing"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(existing); err != nil {
+		t.Fatalf("expected the image to be kept: %v", err)
+	}
+}
+
+func TestCreateInvalid(t *testing.T) {
+	buildDir := t.TempDir()
+
+	for _, tc := range []struct {
+		name   string
+		sizeMB int
+	}{
+		{"", 16},
+		{"../escape", 16},
+		{".hidden", 16},
+		{"zero", 0},
+		{"negative", -1},
+	} {
+		if _, err := Create(buildDir, tc.name, tc.sizeMB, ""); err == nil {
+			t.Fatalf("expected creating %q with size %d to fail", tc.name, tc.sizeMB)
+		}
+	}
+
+	vols, err := List(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vols) != 0 {
+		t.Fatalf("expected no volumes, got %+v", vols)
+	}
+
+	ents, err := os.ReadDir(filepath.Join(buildDir, "volumes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ents) != 0 {
+		t.Fatalf("expected no files to be left behind, got %d", len(ents))
+	}
+}
+
+func TestLock(t *testing.T) {
+	buildDir := t.TempDir()
+
+	vol, err := Create(buildDir, "data", 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := Lock(vol.Filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A writable volume can only be used by one virtual machine.
+	for _, readOnly := range []bool{false, true} {
+		if _, err := Lock(vol.Filename, readOnly); err == nil {
+			t.Fatalf("expected locking a volume in use to fail (read-only %v)", readOnly)
+		}
+	}
+
+	if err := Remove(buildDir, "data"); err == nil {
+		t.Fatal("expected removing a volume in use to fail")
+	}
+
+	if err := lock.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only volumes can be shared.
+	first, err := Lock(vol.Filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := Lock(vol.Filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Lock(vol.Filename, false); err == nil {
+		t.Fatal("expected locking a shared volume for writing to fail")
+	}
+
+	first.Close()
+	second.Close()
+
+	if err := Remove(buildDir, "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	ents, err := os.ReadDir(filepath.Join(buildDir, "volumes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ents) != 0 {
+		t.Fatalf("expected no files to be left behind, got %d", len(ents))
+	}
+}